@@ -0,0 +1,82 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Keyfactor/ejbca-spire-upstreamauthority-plugin/pkg/ejbca"
+	"github.com/hashicorp/go-hclog"
+)
+
+// diagnose runs the diagnose subcommand with args, printing a report of each check to stdout, and returns the exit
+// code of the process.
+func diagnose(args []string) int {
+	flags := flag.NewFlagSet("diagnose", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path to a file containing the plugin_data of the EJBCA UpstreamAuthority plugin")
+	trustDomain := flags.String("trust-domain", "", "trust domain of the sample CA certificate to mint; the sample mint is skipped if unset")
+	timeout := flags.Duration("timeout", time.Minute, "time allowed for all checks")
+	logLevel := flags.String("log-level", "warn", "level of the plugin's log output, written to stderr")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *configPath == "" {
+		fmt.Fprintln(os.Stderr, "-config is required")
+		flags.Usage()
+		return 2
+	}
+
+	hclConfiguration, err := os.ReadFile(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read configuration: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	plugin := ejbca.New()
+	plugin.SetLogger(hclog.New(&hclog.LoggerOptions{
+		Name:   "ejbca",
+		Level:  hclog.LevelFromString(*logLevel),
+		Output: os.Stderr,
+	}))
+	results := plugin.Diagnose(ctx, string(hclConfiguration), *trustDomain)
+
+	printDiagnosticReport(os.Stdout, results)
+	for _, result := range results {
+		if result.Status == ejbca.DiagnosticFail {
+			return 1
+		}
+	}
+	return 0
+}
+
+// printDiagnosticReport writes one line per result to w, with its status, check, and message in aligned columns.
+func printDiagnosticReport(w io.Writer, results []ejbca.DiagnosticResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, result := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", result.Status, result.Check, result.Message)
+	}
+	tw.Flush()
+}
@@ -17,6 +17,8 @@ limitations under the License.
 package main
 
 import (
+	"os"
+
 	"github.com/Keyfactor/ejbca-spire-upstreamauthority-plugin/pkg/ejbca"
 	"github.com/spiffe/spire-plugin-sdk/pluginmain"
 	upstreamauthorityv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/upstreamauthority/v1"
@@ -24,6 +26,10 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "diagnose" {
+		os.Exit(diagnose(os.Args[2:]))
+	}
+
 	plugin := ejbca.New()
 	// Serve the plugin. This function call will not return. If there is a
 	// failure to serve, the process will exit with a non-zero exit code.
@@ -0,0 +1,151 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	autoAccountBindingDerive = "derive"
+	autoAccountBindingCreate = "create"
+
+	// accountBindingPath is the path of the EJBCA REST endpoint that account bindings are created with
+	accountBindingPath = "/ejbca/ejbca-rest-api/v1/account-binding"
+)
+
+// deriveAccountBindingId returns the account binding ID used for trustDomain by auto_account_binding. The ID only
+// depends on the trust domain name, so it's stable across restarts and SPIRE servers.
+func deriveAccountBindingId(trustDomain spiffeid.TrustDomain) string {
+	sum := sha256.Sum256([]byte(trustDomain.Name()))
+	return "spire-" + hex.EncodeToString(sum[:8])
+}
+
+// loggableAccountBindingId returns accountBindingId as it may appear in logs and errors. With
+// redact_account_binding_id, it's replaced by a prefix of its SHA-256 hash, which still correlates log entries.
+func loggableAccountBindingId(config *Config, accountBindingId string) string {
+	if !config.RedactAccountBindingID || accountBindingId == "" {
+		return accountBindingId
+	}
+	sum := sha256.Sum256([]byte(accountBindingId))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// accountBinder creates account bindings with EJBCA. Each account binding ID is created at most once, after which
+// it's cached for the lifetime of the accountBinder.
+type accountBinder struct {
+	httpClient *http.Client
+	url        string
+
+	mu      sync.Mutex
+	created map[string]bool
+}
+
+// newAccountBinder returns an accountBinder for the EJBCA instance at config.Hostname. Requests are sent with
+// httpClient.
+func newAccountBinder(config *Config, httpClient *http.Client) (*accountBinder, error) {
+	baseURL, err := ejbcaBaseURL(config.Hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	return &accountBinder{
+		httpClient: httpClient,
+		url:        baseURL.JoinPath(accountBindingPath).String(),
+		created:    make(map[string]bool),
+	}, nil
+}
+
+// ensure creates the account binding identified by accountBindingId for trustDomain, unless it was already created
+// by this accountBinder. A binding that EJBCA reports as already existing is treated as created.
+func (b *accountBinder) ensure(ctx context.Context, accountBindingId string, trustDomain spiffeid.TrustDomain) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.created[accountBindingId] {
+		return nil
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"account_binding_id": accountBindingId,
+		"trust_domain":       trustDomain.Name(),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusConflict:
+	default:
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("EJBCA responded with %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	b.created[accountBindingId] = true
+	return nil
+}
+
+// getAccountBindingId returns the account binding ID to enroll csr with. With auto_account_binding, the ID is
+// derived from the trust domain of csr and, in create mode, the binding is created with EJBCA on first use.
+// Otherwise, account_binding_id is returned.
+func (p *Plugin) getAccountBindingId(ctx context.Context, config *Config, csr *x509.CertificateRequest) (string, error) {
+	if config.AutoAccountBinding == "" {
+		return config.AccountBindingID, nil
+	}
+
+	trustDomain, err := getTrustDomain(csr)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "unable to derive account binding ID: %v", err)
+	}
+	accountBindingId := deriveAccountBindingId(trustDomain)
+
+	if config.AutoAccountBinding == autoAccountBindingCreate {
+		binder := p.getAccountBinder()
+		if binder == nil {
+			return "", status.Error(codes.FailedPrecondition, "account binding creation is not configured")
+		}
+		if err := binder.ensure(ctx, accountBindingId, trustDomain); err != nil {
+			return "", status.Errorf(codes.Unavailable, "failed to create account binding %s: %v", loggableAccountBindingId(config, accountBindingId), err)
+		}
+	}
+	return accountBindingId, nil
+}
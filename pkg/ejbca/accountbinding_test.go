@@ -0,0 +1,198 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/spire/test/plugintest"
+	"github.com/spiffe/spire/test/spiretest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestDeriveAccountBindingId(t *testing.T) {
+	trustDomain := spiffeid.RequireTrustDomainFromString("example.org")
+
+	accountBindingId := deriveAccountBindingId(trustDomain)
+	require.Equal(t, "spire-bfabc37432958b06", accountBindingId)
+	require.Equal(t, accountBindingId, deriveAccountBindingId(spiffeid.RequireTrustDomainFromString("example.org")))
+	require.NotEqual(t, accountBindingId, deriveAccountBindingId(spiffeid.RequireTrustDomainFromString("other.example.org")))
+}
+
+func TestAutoAccountBinding(t *testing.T) {
+	expectedAccountBindingId := deriveAccountBindingId(spiffeid.RequireTrustDomainFromString("example.org"))
+
+	for _, tt := range []struct {
+		name string
+
+		autoAccountBinding string
+		createStatus       int
+
+		expectedCreateCalls   int
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:                "create",
+			autoAccountBinding:  "create",
+			createStatus:        http.StatusCreated,
+			expectedCreateCalls: 1,
+			expectedgRPCCode:    codes.OK,
+		},
+		{
+			name:                "create_already_exists",
+			autoAccountBinding:  "create",
+			createStatus:        http.StatusConflict,
+			expectedCreateCalls: 1,
+			expectedgRPCCode:    codes.OK,
+		},
+		{
+			name:                  "create_failed",
+			autoAccountBinding:    "create",
+			createStatus:          http.StatusForbidden,
+			expectedCreateCalls:   2,
+			expectedgRPCCode:      codes.Unavailable,
+			expectedMessagePrefix: "upstreamauthority(ejbca): failed to create account binding " + expectedAccountBindingId + ": EJBCA responded with 403 Forbidden",
+		},
+		{
+			name:               "derive",
+			autoAccountBinding: "derive",
+			expectedgRPCCode:   codes.OK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var createCalls int
+			var createRequest map[string]string
+			var accountBindingIds []string
+
+			enrollHandler := newFakeEnrollHandler(t, func(req *ejbcaclient.EnrollCertificateRestRequest) {
+				mu.Lock()
+				defer mu.Unlock()
+				accountBindingIds = append(accountBindingIds, req.GetAccountBindingId())
+			})
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != accountBindingPath {
+					enrollHandler.ServeHTTP(w, r)
+					return
+				}
+
+				mu.Lock()
+				createCalls++
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&createRequest))
+				mu.Unlock()
+				w.WriteHeader(tt.createStatus)
+			}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				AutoAccountBinding: tt.autoAccountBinding,
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			for i := 0; i < 2; i++ {
+				_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+				spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			require.Equal(t, tt.expectedCreateCalls, createCalls)
+			if tt.expectedCreateCalls > 0 {
+				require.Equal(t, map[string]string{"account_binding_id": expectedAccountBindingId, "trust_domain": "example.org"}, createRequest)
+			}
+			if tt.expectedgRPCCode == codes.OK {
+				require.Equal(t, []string{expectedAccountBindingId, expectedAccountBindingId}, accountBindingIds)
+			} else {
+				require.Empty(t, accountBindingIds)
+			}
+		})
+	}
+}
+
+func TestRedactAccountBindingId(t *testing.T) {
+	const accountBindingId = "tenant-4711-binding"
+
+	for _, tt := range []struct {
+		name string
+
+		redactAccountBindingID bool
+
+		expectedLoggedId string
+	}{
+		{
+			name:                   "enabled",
+			redactAccountBindingID: true,
+			expectedLoggedId:       "sha256:dd9b0339211f5b3f",
+		},
+		{
+			name:                   "disabled",
+			redactAccountBindingID: false,
+			expectedLoggedId:       accountBindingId,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var sentAccountBindingId string
+			testServer := newFakeEnrollServer(t, func(req *ejbcaclient.EnrollCertificateRestRequest) {
+				sentAccountBindingId = req.GetAccountBindingId()
+			})
+			defer testServer.Close()
+
+			log, logHook := test.NewNullLogger()
+			log.SetLevel(logrus.DebugLevel)
+			_, ua := loadTestPluginWithOptions(t, testServer, &Config{
+				AccountBindingID:       accountBindingId,
+				RedactAccountBindingID: tt.redactAccountBindingID,
+			}, []plugintest.Option{plugintest.Log(log)})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			require.NoError(t, err)
+
+			// EJBCA always receives the real account binding ID
+			require.Equal(t, accountBindingId, sentAccountBindingId)
+
+			var logged []string
+			for _, entry := range logHook.AllEntries() {
+				line, err := entry.String()
+				require.NoError(t, err)
+				logged = append(logged, line)
+			}
+			allLogs := strings.Join(logged, "\n")
+			require.Contains(t, allLogs, tt.expectedLoggedId)
+			if tt.redactAccountBindingID {
+				require.NotContains(t, allLogs, accountBindingId)
+			}
+		})
+	}
+}
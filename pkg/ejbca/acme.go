@@ -0,0 +1,189 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"golang.org/x/crypto/acme"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	enrollmentProtocolRest = "rest"
+	enrollmentProtocolAcme = "acme"
+)
+
+type AcmeConfig struct {
+	DirectoryURL string `hcl:"directory_url" json:"directory_url"`
+	// Base64url-encoded HMAC key of the external account binding identified by account_binding_id
+	EabHmacKey string `hcl:"eab_hmac_key" json:"eab_hmac_key"`
+
+	eabHmacKey []byte
+}
+
+// acmeEnroller enrolls CSRs through an ACME directory. The ACME account is registered with the first enrollment
+// and reused afterwards.
+type acmeEnroller struct {
+	client *acme.Client
+	eab    *acme.ExternalAccountBinding
+
+	mu         sync.Mutex
+	registered bool
+}
+
+// newAcmeEnroller returns an acmeEnroller for the ACME directory in config, with a new account key. Requests are
+// sent with httpClient.
+func newAcmeEnroller(config *Config, httpClient *http.Client) (*acmeEnroller, error) {
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate ACME account key: %w", err)
+	}
+
+	enroller := &acmeEnroller{
+		client: &acme.Client{
+			Key:          accountKey,
+			DirectoryURL: config.Acme.DirectoryURL,
+			HTTPClient:   httpClient,
+		},
+	}
+	if config.AccountBindingID != "" {
+		enroller.eab = &acme.ExternalAccountBinding{
+			KID: config.AccountBindingID,
+			Key: config.Acme.eabHmacKey,
+		}
+	}
+	return enroller, nil
+}
+
+// register registers the ACME account, binding it to the external account if one is configured.
+func (e *acmeEnroller) register(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.registered {
+		return nil
+	}
+
+	_, err := e.client.Register(ctx, &acme.Account{ExternalAccountBinding: e.eab}, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return err
+	}
+	e.registered = true
+	return nil
+}
+
+// enrollAcme enrolls csr by running an ACME order against the configured directory. The plugin can't complete ACME
+// challenges, so EJBCA must consider the order's authorizations valid, such as for a pre-authorized ACME alias. The
+// issued chain is returned as a DER certificate response so that it's handled like a REST enrollment.
+func (p *Plugin) enrollAcme(ctx context.Context, config *Config, csr *x509.CertificateRequest) (*ejbcaclient.CertificateRestResponse, error) {
+	logger := p.logger.Named("enrollAcme")
+
+	enroller := p.getAcmeEnroller()
+	if enroller == nil {
+		return nil, status.Error(codes.FailedPrecondition, "ACME enrollment is not configured")
+	}
+
+	logger.Trace("Registering ACME account", "directoryUrl", config.Acme.DirectoryURL)
+	if err := enroller.register(ctx); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to register ACME account: %v", err)
+	}
+
+	identifiers, err := getAcmeIdentifiers(csr)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "unable to build ACME order: %v", err)
+	}
+
+	logger.Debug("Creating ACME order", "identifiers", identifiers)
+	order, err := enroller.client.AuthorizeOrder(ctx, identifiers)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to create ACME order: %v", err)
+	}
+
+	for _, authzURL := range order.AuthzURLs {
+		authz, err := enroller.client.GetAuthorization(ctx, authzURL)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to get ACME authorization: %v", err)
+		}
+		if authz.Status != acme.StatusValid {
+			return nil, status.Errorf(codes.FailedPrecondition, "ACME authorization for %s is %s; the plugin can't complete ACME challenges, so EJBCA must pre-authorize the order", authz.Identifier.Value, authz.Status)
+		}
+	}
+
+	order, err = enroller.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "ACME order is not ready: %v", err)
+	}
+
+	logger.Debug("Finalizing ACME order", "order", order.URI)
+	der, _, err := enroller.client.CreateOrderCert(ctx, order.FinalizeURL, csr.Raw, true)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to finalize ACME order: %v", err)
+	}
+	if len(der) == 0 {
+		return nil, status.Error(codes.Internal, "ACME order returned no certificate")
+	}
+
+	enrollResponse := ejbcaclient.NewCertificateRestResponse()
+	enrollResponse.SetResponseFormat("DER")
+	enrollResponse.SetCertificate(base64.StdEncoding.EncodeToString(der[0]))
+	chain := []string{}
+	for _, cert := range der[1:] {
+		chain = append(chain, base64.StdEncoding.EncodeToString(cert))
+	}
+	enrollResponse.SetCertificateChain(chain)
+	return enrollResponse, nil
+}
+
+// getAcmeIdentifiers returns the ACME identifiers for the DNS and IP SANs of csr. ACME has no identifier type for
+// URIs, so the trust domain of the SPIFFE ID is used as a DNS identifier if the CSR has neither.
+func getAcmeIdentifiers(csr *x509.CertificateRequest) ([]acme.AuthzID, error) {
+	var identifiers []acme.AuthzID
+	for _, dnsName := range csr.DNSNames {
+		identifiers = append(identifiers, acme.AuthzID{Type: "dns", Value: dnsName})
+	}
+	for _, ip := range csr.IPAddresses {
+		identifiers = append(identifiers, acme.AuthzID{Type: "ip", Value: ip.String()})
+	}
+	if len(identifiers) > 0 {
+		return identifiers, nil
+	}
+
+	for _, uri := range csr.URIs {
+		if id, err := spiffeid.FromURI(uri); err == nil {
+			return []acme.AuthzID{{Type: "dns", Value: id.TrustDomain().Name()}}, nil
+		}
+	}
+	return nil, errors.New("the CSR has no DNS, IP, or SPIFFE ID SANs")
+}
+
+// parseEabHmacKey decodes a base64url-encoded external account binding HMAC key, with or without padding.
+func parseEabHmacKey(key string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(key, "="))
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spiffe/spire/test/spiretest"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/acme"
+	"google.golang.org/grpc/codes"
+)
+
+func TestAcmeEnrollment(t *testing.T) {
+	rootCA, intermediateCA, svidIssuingCA, _ := issueTestCertificates(t)
+
+	for _, tt := range []struct {
+		name string
+
+		authzStatus string
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:             "success",
+			authzStatus:      acme.StatusValid,
+			expectedgRPCCode: codes.OK,
+		},
+		{
+			name:                  "authorization_pending",
+			authzStatus:           acme.StatusPending,
+			expectedgRPCCode:      codes.FailedPrecondition,
+			expectedMessagePrefix: "upstreamauthority(ejbca): ACME authorization for example.org is pending; the plugin can't complete ACME challenges",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeAcme := &fakeAcmeServer{
+				t:           t,
+				authzStatus: tt.authzStatus,
+				chain:       []*x509.Certificate{svidIssuingCA, intermediateCA, rootCA},
+			}
+			testServer := httptest.NewTLSServer(fakeAcme)
+			defer testServer.Close()
+			fakeAcme.url = testServer.URL
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				AccountBindingID:   "fake-eab-kid",
+				EnrollmentProtocol: "acme",
+				Acme: &AcmeConfig{
+					DirectoryURL: testServer.URL + "/acme/directory",
+					EabHmacKey:   base64.RawURLEncoding.EncodeToString([]byte("fake-eab-hmac-key")),
+				},
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			x509CA, upstreamX509Roots, _, err := ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+
+			fakeAcme.mu.Lock()
+			defer fakeAcme.mu.Unlock()
+			require.Equal(t, "fake-eab-kid", fakeAcme.eabKid)
+			require.Equal(t, []acme.AuthzID{{Type: "dns", Value: "example.org"}}, fakeAcme.identifiers)
+			if tt.expectedgRPCCode != codes.OK {
+				require.Nil(t, fakeAcme.finalizedCsr)
+				return
+			}
+			require.Equal(t, csr.Raw, fakeAcme.finalizedCsr)
+			require.Equal(t, []*x509.Certificate{svidIssuingCA, intermediateCA}, x509CA)
+			require.Equal(t, []*x509.Certificate{rootCA}, upstreamX509Roots)
+		})
+	}
+}
+
+// fakeAcmeServer is a minimal RFC 8555 ACME server that issues chain for every order. JWS signatures aren't
+// verified.
+type fakeAcmeServer struct {
+	t           *testing.T
+	url         string
+	authzStatus string
+	chain       []*x509.Certificate
+
+	mu           sync.Mutex
+	eabKid       string
+	identifiers  []acme.AuthzID
+	finalizedCsr []byte
+}
+
+func (f *fakeAcmeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", "fake-nonce")
+
+	var payload []byte
+	if r.Method == http.MethodPost {
+		var jws struct {
+			Payload string `json:"payload"`
+		}
+		require.NoError(f.t, json.NewDecoder(r.Body).Decode(&jws))
+		var err error
+		payload, err = base64.RawURLEncoding.DecodeString(jws.Payload)
+		require.NoError(f.t, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	order := map[string]any{
+		"status":         acme.StatusReady,
+		"identifiers":    f.identifiers,
+		"authorizations": []string{f.url + "/acme/authz/1"},
+		"finalize":       f.url + "/acme/order/1/finalize",
+	}
+
+	switch r.URL.Path {
+	case "/acme/directory":
+		f.writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   f.url + "/acme/new-nonce",
+			"newAccount": f.url + "/acme/new-account",
+			"newOrder":   f.url + "/acme/new-order",
+		})
+	case "/acme/new-nonce":
+		w.WriteHeader(http.StatusOK)
+	case "/acme/new-account":
+		var account struct {
+			ExternalAccountBinding struct {
+				Protected string `json:"protected"`
+			} `json:"externalAccountBinding"`
+		}
+		require.NoError(f.t, json.Unmarshal(payload, &account))
+		protected, err := base64.RawURLEncoding.DecodeString(account.ExternalAccountBinding.Protected)
+		require.NoError(f.t, err)
+		var header struct {
+			Kid string `json:"kid"`
+		}
+		require.NoError(f.t, json.Unmarshal(protected, &header))
+		f.eabKid = header.Kid
+
+		w.Header().Set("Location", f.url+"/acme/account/1")
+		f.writeJSON(w, http.StatusCreated, map[string]string{"status": acme.StatusValid})
+	case "/acme/new-order":
+		var newOrder struct {
+			Identifiers []acme.AuthzID `json:"identifiers"`
+		}
+		require.NoError(f.t, json.Unmarshal(payload, &newOrder))
+		f.identifiers = newOrder.Identifiers
+		order["identifiers"] = f.identifiers
+		order["status"] = acme.StatusPending
+
+		w.Header().Set("Location", f.url+"/acme/order/1")
+		f.writeJSON(w, http.StatusCreated, order)
+	case "/acme/authz/1":
+		f.writeJSON(w, http.StatusOK, map[string]any{
+			"status":     f.authzStatus,
+			"identifier": f.identifiers[0],
+		})
+	case "/acme/order/1":
+		w.Header().Set("Location", f.url+"/acme/order/1")
+		f.writeJSON(w, http.StatusOK, order)
+	case "/acme/order/1/finalize":
+		var finalize struct {
+			Csr string `json:"csr"`
+		}
+		require.NoError(f.t, json.Unmarshal(payload, &finalize))
+		csr, err := base64.RawURLEncoding.DecodeString(finalize.Csr)
+		require.NoError(f.t, err)
+		f.finalizedCsr = csr
+		order["status"] = acme.StatusValid
+		order["certificate"] = f.url + "/acme/cert/1"
+
+		w.Header().Set("Location", f.url+"/acme/order/1")
+		f.writeJSON(w, http.StatusOK, order)
+	case "/acme/cert/1":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		for _, cert := range f.chain {
+			require.NoError(f.t, pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeAcmeServer) writeJSON(w http.ResponseWriter, statusCode int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	require.NoError(f.t, json.NewEncoder(w).Encode(body))
+}
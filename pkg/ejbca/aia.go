@@ -0,0 +1,139 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	// maxAiaChainDepth is the number of issuers follow_aia fetches before giving up on reaching a root
+	maxAiaChainDepth = 5
+	// aiaFetchTimeout bounds the time follow_aia spends fetching the whole chain
+	aiaFetchTimeout = 10 * time.Second
+	// maxAiaResponseBytes bounds the size of a certificate fetched from an AIA CA Issuers URL
+	maxAiaResponseBytes = 64 << 10
+	// maxAiaRedirects is the number of redirects followed when fetching a certificate from an AIA CA Issuers URL
+	maxAiaRedirects = 3
+)
+
+// newAiaClient returns the HTTP client that follow_aia fetches issuers with. It uses the configured proxy and
+// transport settings, requires TLS 1.2 or later for https URLs, and only follows a few redirects to http or https URLs.
+func newAiaClient(config *Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if config.Transport != nil {
+		config.Transport.apply(transport)
+	}
+	if config.proxyURL != nil {
+		transport.Proxy = http.ProxyURL(config.proxyURL)
+	}
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxAiaRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxAiaRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("refusing to follow redirect to %s URL", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// fetchAiaChain builds the CA chain of cert by following the Authority Information Access CA Issuers URLs of cert,
+// then of each fetched issuer, until a self-signed root is reached. Each fetched certificate must have signed the
+// certificate whose URL it was fetched from. The chain is returned ordered from the issuing CA to the root.
+func (p *Plugin) fetchAiaChain(ctx context.Context, client *http.Client, cert *x509.Certificate) ([]*x509.Certificate, error) {
+	logger := p.logger.Named("fetchAiaChain")
+
+	ctx, cancel := context.WithTimeout(ctx, aiaFetchTimeout)
+	defer cancel()
+
+	var chain []*x509.Certificate
+	for subject := cert; !isSelfSigned(subject); subject = chain[len(chain)-1] {
+		if len(chain) == maxAiaChainDepth {
+			return nil, fmt.Errorf("no root CA found within %d AIA CA Issuers hops", maxAiaChainDepth)
+		}
+		if len(subject.IssuingCertificateURL) == 0 {
+			return nil, fmt.Errorf("certificate %q has no AIA CA Issuers URL", subject.Subject.String())
+		}
+
+		var issuer *x509.Certificate
+		var errs []error
+		for _, issuerURL := range subject.IssuingCertificateURL {
+			logger.Debug("Fetching issuer from AIA CA Issuers URL", "subject", subject.Subject.String(), "url", issuerURL)
+			candidate, err := fetchAiaCertificate(ctx, client, issuerURL)
+			if err == nil {
+				err = subject.CheckSignatureFrom(candidate)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", issuerURL, err))
+				continue
+			}
+			issuer = candidate
+			break
+		}
+		if issuer == nil {
+			return nil, fmt.Errorf("failed to fetch issuer of %q: %w", subject.Subject.String(), errors.Join(errs...))
+		}
+		chain = append(chain, issuer)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("certificate is self-signed")
+	}
+	return chain, nil
+}
+
+// fetchAiaCertificate fetches a single DER- or PEM-encoded certificate from an AIA CA Issuers URL with client.
+func fetchAiaCertificate(ctx context.Context, client *http.Client, issuerURL string) (*x509.Certificate, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuerURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxAiaResponseBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxAiaResponseBytes {
+		return nil, fmt.Errorf("response exceeds %d bytes", maxAiaResponseBytes)
+	}
+
+	if block, _ := pem.Decode(body); block != nil && block.Type == "CERTIFICATE" {
+		body = block.Bytes
+	}
+	return x509.ParseCertificate(body)
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/spiffe/spire/test/spiretest"
+	"github.com/spiffe/spire/test/util"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestFollowAia(t *testing.T) {
+	// The AIA server serves the root as DER and the intermediate as PEM
+	issuers := map[string][]byte{}
+	var aiaHits atomic.Int32
+	aiaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		aiaHits.Add(1)
+		issuer, ok := issuers[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write(issuer)
+	}))
+	defer aiaServer.Close()
+
+	now := time.Now()
+	rootCA, rootCAKey, err := util.SelfSign(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Fake-Root-CA"},
+		SerialNumber:          big.NewInt(1),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		NotBefore:             now,
+		NotAfter:              now.Add(24 * time.Hour),
+	})
+	require.NoError(t, err)
+	intermediateCA, intermediateKey, err := util.Sign(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Fake-Sub-CA"},
+		SerialNumber:          big.NewInt(2),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		NotBefore:             now,
+		NotAfter:              now.Add(24 * time.Hour),
+		// The first URL fails, so the next one is tried
+		IssuingCertificateURL: []string{aiaServer.URL + "/missing.cer", aiaServer.URL + "/root.cer"},
+	}, rootCA, rootCAKey)
+	require.NoError(t, err)
+	svidIssuingCA, _, err := util.Sign(&x509.Certificate{
+		SerialNumber:          big.NewInt(3),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		NotBefore:             now,
+		NotAfter:              now.Add(24 * time.Hour),
+		URIs:                  []*url.URL{trustDomain.ID().URL()},
+		IssuingCertificateURL: []string{aiaServer.URL + "/intermediate.pem"},
+	}, intermediateCA, intermediateKey)
+	require.NoError(t, err)
+
+	issuers["/root.cer"] = rootCA.Raw
+	issuers["/intermediate.pem"] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediateCA.Raw})
+
+	for _, tt := range []struct {
+		name string
+
+		followAIA bool
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:             "follow_aia",
+			followAIA:        true,
+			expectedgRPCCode: codes.OK,
+		},
+		{
+			name:                  "disabled",
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): EJBCA did not return a CA chain",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			aiaHits.Store(0)
+
+			// EJBCA returns the issued CA without its chain
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				err := json.NewEncoder(w).Encode(certificateRestResponseFromExpectedCerts(t, []*x509.Certificate{svidIssuingCA}, nil, "PEM"))
+				require.NoError(t, err)
+			}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				FollowAIA: tt.followAIA,
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			x509CA, upstreamX509Roots, _, err := ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+			if tt.expectedgRPCCode != codes.OK {
+				require.Equal(t, int32(0), aiaHits.Load())
+				return
+			}
+
+			require.Equal(t, []*x509.Certificate{svidIssuingCA, intermediateCA}, x509CA)
+			require.Equal(t, []*x509.Certificate{rootCA}, upstreamX509Roots)
+			require.Equal(t, int32(3), aiaHits.Load())
+
+			// The chain built from AIA is cached for later mints
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			require.NoError(t, err)
+			require.Equal(t, int32(3), aiaHits.Load())
+		})
+	}
+}
+
+func TestFetchAiaChainDepth(t *testing.T) {
+	issuers := map[string][]byte{}
+	aiaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(issuers[r.URL.Path])
+	}))
+	defer aiaServer.Close()
+
+	// A chain of CAs whose root is one hop further than follow_aia goes
+	now := time.Now()
+	cert, key, err := util.SelfSign(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "CA-0"},
+		SerialNumber:          big.NewInt(1),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		NotBefore:             now,
+		NotAfter:              now.Add(24 * time.Hour),
+	})
+	require.NoError(t, err)
+	for i := 1; i <= maxAiaChainDepth+1; i++ {
+		path := fmt.Sprintf("/ca-%d.cer", i-1)
+		issuers[path] = cert.Raw
+		cert, key, err = util.Sign(&x509.Certificate{
+			Subject:               pkix.Name{CommonName: fmt.Sprintf("CA-%d", i)},
+			SerialNumber:          big.NewInt(int64(i + 1)),
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			NotBefore:             now,
+			NotAfter:              now.Add(24 * time.Hour),
+			IssuingCertificateURL: []string{aiaServer.URL + path},
+		}, cert, key)
+		require.NoError(t, err)
+	}
+
+	p := New()
+	p.SetLogger(hclog.Default())
+
+	_, err = p.fetchAiaChain(context.Background(), newAiaClient(&Config{}), cert)
+	require.EqualError(t, err, fmt.Sprintf("no root CA found within %d AIA CA Issuers hops", maxAiaChainDepth))
+}
+
+func TestAiaClient(t *testing.T) {
+	rootCA, _, _, _ := issueTestCertificates(t)
+
+	// The proxy answers requests for any host itself, and redirects some paths
+	var proxiedHosts []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedHosts = append(proxiedHosts, r.URL.Host)
+		switch r.URL.Path {
+		case "/root.cer":
+			_, _ = w.Write(rootCA.Raw)
+		case "/redirect.cer":
+			http.Redirect(w, r, "/root.cer", http.StatusFound)
+		case "/loop.cer":
+			http.Redirect(w, r, "/loop.cer", http.StatusFound)
+		case "/ftp.cer":
+			http.Redirect(w, r, "ftp://aia.example.com/root.cer", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+
+	client := newAiaClient(&Config{proxyURL: proxyURL})
+
+	for _, tt := range []struct {
+		name string
+
+		path string
+
+		expectedError string
+	}{
+		{
+			name: "proxied",
+			path: "/root.cer",
+		},
+		{
+			name: "redirect",
+			path: "/redirect.cer",
+		},
+		{
+			name:          "redirect_loop",
+			path:          "/loop.cer",
+			expectedError: fmt.Sprintf("stopped after %d redirects", maxAiaRedirects),
+		},
+		{
+			name:          "redirect_to_other_scheme",
+			path:          "/ftp.cer",
+			expectedError: "refusing to follow redirect to ftp URL",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			proxiedHosts = nil
+
+			cert, err := fetchAiaCertificate(context.Background(), client, "http://aia.example.com"+tt.path)
+			if tt.expectedError != "" {
+				require.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, rootCA, cert)
+			require.NotEmpty(t, proxiedHosts)
+			for _, host := range proxiedHosts {
+				require.Equal(t, "aia.example.com", host)
+			}
+		})
+	}
+}
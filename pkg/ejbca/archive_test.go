@@ -0,0 +1,87 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRootsArchiveDir(t *testing.T) {
+	// Each fake enroll handler issues from a root of its own
+	var handler atomic.Pointer[http.Handler]
+	first := newFakeEnrollHandler(t, nil)
+	handler.Store(&first)
+	testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		(*handler.Load()).ServeHTTP(w, r)
+	}))
+	defer testServer.Close()
+
+	dir := filepath.Join(t.TempDir(), "roots")
+	_, ua := loadTestPlugin(t, testServer, &Config{
+		RootsArchiveDir: dir,
+	})
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	mint := func() string {
+		_, roots, _, err := ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+		require.NoError(t, err)
+		require.Len(t, roots, 1)
+
+		fingerprint := sha256.Sum256(roots[0].Raw)
+		path := filepath.Join(dir, hex.EncodeToString(fingerprint[:])+".pem")
+		archived, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: roots[0].Raw}), archived)
+		return path
+	}
+
+	firstPath := mint()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// A repeated root isn't rewritten
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(firstPath, past, past))
+	require.Equal(t, firstPath, mint())
+	info, err := os.Stat(firstPath)
+	require.NoError(t, err)
+	require.True(t, info.ModTime().Equal(past))
+
+	// A new root is archived alongside the first
+	second := newFakeEnrollHandler(t, nil)
+	handler.Store(&second)
+	secondPath := mint()
+	require.NotEqual(t, firstPath, secondPath)
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
+	"github.com/hashicorp/go-hclog"
+	"github.com/segmentio/kafka-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const enrollmentProtocolAsyncBroker = "async_broker"
+
+// asyncBrokerReadRetryInterval is how long the Kafka broker waits before reading responses again after a failed read.
+const asyncBrokerReadRetryInterval = time.Second
+
+type AsyncBrokerConfig struct {
+	Brokers []string `hcl:"brokers" json:"brokers"`
+	// Topic that enrollment requests are published to, keyed by correlation ID
+	RequestTopic string `hcl:"request_topic" json:"request_topic"`
+	// Topic that enrollment responses are consumed from, keyed by the correlation ID of their request
+	ResponseTopic string `hcl:"response_topic" json:"response_topic"`
+	// Kafka consumer group that responses are consumed with. It must be unique to each SPIRE server, and defaults to
+	// a random group.
+	ConsumerGroup string `hcl:"consumer_group" json:"consumer_group"`
+}
+
+// asyncBroker brokers enrollment requests to EJBCA through a message queue. Requests and responses are JSON encoded
+// EJBCA REST API bodies, matched by correlation ID.
+type asyncBroker interface {
+	// Publish publishes request under correlationId. Consume must be called with the same correlationId afterwards.
+	Publish(ctx context.Context, correlationId string, request []byte) error
+	// Consume waits for the response to the request published under correlationId until ctx is done.
+	Consume(ctx context.Context, correlationId string) ([]byte, error)
+	Close() error
+}
+
+type newAsyncBrokerFunc func(hclog.Logger, *AsyncBrokerConfig) asyncBroker
+
+// kafkaAsyncBroker is an asyncBroker backed by Kafka. Responses are read from every partition of the response topic
+// by a background goroutine, as the only member of its consumer group, and dispatched to the Consume call waiting for
+// their correlation ID; responses for other correlation IDs, such as those of other SPIRE servers, are ignored.
+type kafkaAsyncBroker struct {
+	logger hclog.Logger
+	writer *kafka.Writer
+	reader *kafka.Reader
+
+	mu      sync.Mutex
+	waiters map[string]chan []byte
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newKafkaAsyncBroker(logger hclog.Logger, config *AsyncBrokerConfig) asyncBroker {
+	consumerGroup := config.ConsumerGroup
+	if consumerGroup == "" {
+		consumerGroup = newAsyncBrokerConsumerGroup()
+	}
+	logger.Debug("Consuming enrollment responses", "topic", config.ResponseTopic, "consumerGroup", consumerGroup)
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers: config.Brokers,
+		Topic:   config.ResponseTopic,
+		GroupID: consumerGroup,
+		// Responses published before the plugin was configured can't belong to one of its requests
+		StartOffset: kafka.LastOffset,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &kafkaAsyncBroker{
+		logger: logger,
+		writer: &kafka.Writer{
+			Addr:     kafka.TCP(config.Brokers...),
+			Topic:    config.RequestTopic,
+			Balancer: &kafka.Hash{},
+		},
+		reader:  reader,
+		waiters: make(map[string]chan []byte),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go b.run(ctx)
+	return b
+}
+
+func (b *kafkaAsyncBroker) run(ctx context.Context) {
+	defer close(b.done)
+	for {
+		msg, err := b.reader.ReadMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			b.logger.Warn("Failed to read enrollment response from Kafka", "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(asyncBrokerReadRetryInterval):
+			}
+			continue
+		}
+
+		b.mu.Lock()
+		waiter, ok := b.waiters[string(msg.Key)]
+		delete(b.waiters, string(msg.Key))
+		b.mu.Unlock()
+		if ok {
+			waiter <- msg.Value
+		}
+	}
+}
+
+// Publish registers correlationId before publishing, so that a response arriving before Consume is called isn't
+// missed.
+func (b *kafkaAsyncBroker) Publish(ctx context.Context, correlationId string, request []byte) error {
+	b.mu.Lock()
+	b.waiters[correlationId] = make(chan []byte, 1)
+	b.mu.Unlock()
+
+	if err := b.writer.WriteMessages(ctx, kafka.Message{Key: []byte(correlationId), Value: request}); err != nil {
+		b.mu.Lock()
+		delete(b.waiters, correlationId)
+		b.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (b *kafkaAsyncBroker) Consume(ctx context.Context, correlationId string) ([]byte, error) {
+	b.mu.Lock()
+	waiter, ok := b.waiters[correlationId]
+	b.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no request was published with correlation ID %s", correlationId)
+	}
+
+	select {
+	case response := <-waiter:
+		return response, nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		delete(b.waiters, correlationId)
+		b.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops reading responses and closes the Kafka reader and writer.
+func (b *kafkaAsyncBroker) Close() error {
+	b.cancel()
+	<-b.done
+	return errors.Join(b.reader.Close(), b.writer.Close())
+}
+
+// enrollAsyncBroker publishes enrollConfig through the async broker and waits for EJBCA's response until ctx is
+// done, such as at max_enrollment_duration. streamCtx is the context of the mint stream, which ctx is derived from.
+func (p *Plugin) enrollAsyncBroker(ctx context.Context, streamCtx context.Context, config *Config, enrollConfig ejbcaclient.EnrollCertificateRestRequest) (*ejbcaclient.CertificateRestResponse, error) {
+	logger := p.logger.Named("enrollAsyncBroker")
+
+	broker := p.getAsyncBroker()
+	if broker == nil {
+		return nil, status.Error(codes.FailedPrecondition, "async broker enrollment is not configured")
+	}
+
+	request, err := json.Marshal(enrollConfig)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to encode enrollment request: %v", err)
+	}
+	correlationId, err := newCorrelationId()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate correlation ID: %v", err)
+	}
+
+	logger.Debug("Publishing enrollment request", "correlationId", correlationId)
+	if err := broker.Publish(ctx, correlationId, request); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "failed to publish enrollment request: %v", err)
+	}
+
+	response, err := broker.Consume(ctx, correlationId)
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && streamCtx.Err() == nil {
+			return nil, status.Errorf(codes.DeadlineExceeded, "enrollment exceeded max_enrollment_duration of %s", config.maxEnrollmentDuration)
+		}
+		return nil, status.Errorf(codes.Unavailable, "failed to consume enrollment response with correlation ID %s: %v", correlationId, err)
+	}
+	logger.Debug("Consumed enrollment response", "correlationId", correlationId)
+
+	// The responder relays the EJBCA error body of a failed enrollment, which is reported like an error returned by
+	// EJBCA directly
+	var errorResponse ejbcaErrorResponse
+	if err := json.Unmarshal(response, &errorResponse); err == nil && errorResponse.ErrorMessage != "" {
+		return nil, p.parseEjbcaError(config, "failed to enroll CSR", &ejbcaResponseError{status: "error relayed by the async broker", body: response})
+	}
+
+	enrollResponse := ejbcaclient.NewCertificateRestResponse()
+	if err := json.Unmarshal(response, enrollResponse); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decode enrollment response: %v", err)
+	}
+	return enrollResponse, nil
+}
+
+// newAsyncBrokerConsumerGroup returns a random consumer group, so that every SPIRE server reads all responses.
+func newAsyncBrokerConsumerGroup() string {
+	id, err := newCorrelationId()
+	if err != nil {
+		id = strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return "spire-ejbca-" + id
+}
+
+// newCorrelationId returns a random correlation ID for an enrollment request.
+func newCorrelationId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,247 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
+	"github.com/hashicorp/go-hclog"
+	"github.com/segmentio/kafka-go"
+	upstreamauthorityv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/upstreamauthority/v1"
+	"github.com/spiffe/spire/test/spiretest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAsyncBrokerEnrollment(t *testing.T) {
+	rootCA, intermediateCA, svidIssuingCA, _ := issueTestCertificates(t)
+
+	for _, tt := range []struct {
+		name string
+
+		maxEnrollmentDuration string
+		// respond returns the response to a request, or nil to never respond
+		respond func(t *testing.T, request ejbcaclient.EnrollCertificateRestRequest) []byte
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name: "success",
+			respond: func(t *testing.T, request ejbcaclient.EnrollCertificateRestRequest) []byte {
+				require.Contains(t, request.GetCertificateRequest(), "BEGIN CERTIFICATE REQUEST")
+				require.Equal(t, "Fake-Sub-CA", request.GetCertificateAuthorityName())
+				response, err := json.Marshal(certificateRestResponseFromExpectedCerts(t, []*x509.Certificate{svidIssuingCA, intermediateCA}, []*x509.Certificate{rootCA}, "PEM"))
+				require.NoError(t, err)
+				return response
+			},
+			expectedgRPCCode: codes.OK,
+		},
+		{
+			name: "error response",
+			respond: func(*testing.T, ejbcaclient.EnrollCertificateRestRequest) []byte {
+				return []byte(`{"error_code":400,"error_message":"Wrong CA"}`)
+			},
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): EJBCA returned an error: failed to enroll CSR - error relayed by the async broker - EJBCA API returned error: Wrong CA (error_code=400)",
+		},
+		{
+			name:                  "no response before deadline",
+			maxEnrollmentDuration: "100ms",
+			expectedgRPCCode:      codes.DeadlineExceeded,
+			expectedMessagePrefix: "upstreamauthority(ejbca): enrollment exceeded max_enrollment_duration of 100ms",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// Enrollment requests must go through the broker, never to EJBCA directly
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+				t.Error("unexpected request to EJBCA")
+			}))
+			defer testServer.Close()
+
+			broker := newFakeAsyncBroker(t, tt.respond)
+			p, ua := loadTestPlugin(t, testServer, &Config{
+				EnrollmentProtocol:    "async_broker",
+				MaxEnrollmentDuration: tt.maxEnrollmentDuration,
+				AsyncBroker: &AsyncBrokerConfig{
+					Brokers:       []string{"kafka-0.example.com:9092"},
+					RequestTopic:  "ejbca-enroll-requests",
+					ResponseTopic: "ejbca-enroll-responses",
+				},
+			}, func(p *Plugin) {
+				p.hooks.newAsyncBroker = broker.newAsyncBroker
+			})
+			require.Equal(t, "ejbca-enroll-requests", broker.config.RequestTopic)
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			x509CA, upstreamX509Roots, _, err := ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+
+			broker.mu.Lock()
+			require.Len(t, broker.published, 1)
+			require.Len(t, broker.consumed, 1)
+			require.Equal(t, broker.published[0], broker.consumed[0])
+			broker.mu.Unlock()
+
+			if tt.expectedgRPCCode == codes.OK {
+				require.Equal(t, []*x509.Certificate{svidIssuingCA, intermediateCA}, x509CA)
+				require.Equal(t, []*x509.Certificate{rootCA}, upstreamX509Roots)
+			}
+
+			p.setAsyncBroker(nil)
+			require.True(t, broker.closed)
+		})
+	}
+}
+
+func TestAsyncBrokerRelayedErrorInfo(t *testing.T) {
+	testServer := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		t.Error("unexpected request to EJBCA")
+	}))
+	defer testServer.Close()
+
+	broker := newFakeAsyncBroker(t, func(*testing.T, ejbcaclient.EnrollCertificateRestRequest) []byte {
+		return []byte(`{"error_code":409,"error_message":"End entity spire already exists"}`)
+	})
+	_, ua := loadTestPlugin(t, testServer, &Config{
+		EnrollmentProtocol: "async_broker",
+		AsyncBroker: &AsyncBrokerConfig{
+			Brokers:       []string{"kafka-0.example.com:9092"},
+			RequestTopic:  "ejbca-enroll-requests",
+			ResponseTopic: "ejbca-enroll-responses",
+		},
+	}, func(p *Plugin) {
+		p.hooks.newAsyncBroker = broker.newAsyncBroker
+	})
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	// The raw client is used since the status details are dropped by the SPIRE plugin facade
+	stream, err := ua.UpstreamAuthorityPluginClient.MintX509CAAndSubscribe(context.Background(), &upstreamauthorityv1.MintX509CARequest{Csr: csr.Raw})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	spiretest.RequireGRPCStatusContains(t, err, codes.Internal, "End entity spire already exists (error_code=409)")
+
+	st := status.Convert(err)
+	require.Len(t, st.Details(), 1)
+	errorInfo, ok := st.Details()[0].(*errdetails.ErrorInfo)
+	require.True(t, ok, "expected ErrorInfo detail, got %T", st.Details()[0])
+	require.Equal(t, reasonDuplicateEndEntity, errorInfo.GetReason())
+	require.Equal(t, errorDomain, errorInfo.GetDomain())
+	require.Equal(t, "409", errorInfo.GetMetadata()["ejbca_error_code"])
+	require.Equal(t, "Fake-Sub-CA", errorInfo.GetMetadata()["ca_name"])
+}
+
+func TestKafkaAsyncBrokerConsumerGroup(t *testing.T) {
+	config := &AsyncBrokerConfig{
+		Brokers:       []string{"127.0.0.1:1"},
+		RequestTopic:  "ejbca-enroll-requests",
+		ResponseTopic: "ejbca-enroll-responses",
+	}
+
+	// Each broker reads every partition of the response topic in a consumer group of its own
+	first := newKafkaAsyncBroker(hclog.NewNullLogger(), config).(*kafkaAsyncBroker)
+	defer first.Close()
+	second := newKafkaAsyncBroker(hclog.NewNullLogger(), config).(*kafkaAsyncBroker)
+	defer second.Close()
+	require.True(t, strings.HasPrefix(first.reader.Config().GroupID, "spire-ejbca-"))
+	require.NotEqual(t, first.reader.Config().GroupID, second.reader.Config().GroupID)
+	require.Equal(t, kafka.LastOffset, first.reader.Config().StartOffset)
+
+	config.ConsumerGroup = "spire-server-a"
+	configured := newKafkaAsyncBroker(hclog.NewNullLogger(), config).(*kafkaAsyncBroker)
+	defer configured.Close()
+	require.Equal(t, "spire-server-a", configured.reader.Config().GroupID)
+}
+
+// fakeAsyncBroker is an asyncBroker that answers each published request with respond. Requests that respond returns
+// nil for are never answered.
+type fakeAsyncBroker struct {
+	t       *testing.T
+	respond func(*testing.T, ejbcaclient.EnrollCertificateRestRequest) []byte
+	config  *AsyncBrokerConfig
+
+	mu        sync.Mutex
+	responses map[string]chan []byte
+	published []string
+	consumed  []string
+	closed    bool
+}
+
+func newFakeAsyncBroker(t *testing.T, respond func(*testing.T, ejbcaclient.EnrollCertificateRestRequest) []byte) *fakeAsyncBroker {
+	return &fakeAsyncBroker{
+		t:         t,
+		respond:   respond,
+		responses: make(map[string]chan []byte),
+	}
+}
+
+func (b *fakeAsyncBroker) newAsyncBroker(_ hclog.Logger, config *AsyncBrokerConfig) asyncBroker {
+	b.config = config
+	return b
+}
+
+func (b *fakeAsyncBroker) Publish(_ context.Context, correlationId string, request []byte) error {
+	var enrollRequest ejbcaclient.EnrollCertificateRestRequest
+	require.NoError(b.t, json.Unmarshal(request, &enrollRequest))
+
+	response := make(chan []byte, 1)
+	if b.respond != nil {
+		response <- b.respond(b.t, enrollRequest)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.responses[correlationId] = response
+	b.published = append(b.published, correlationId)
+	return nil
+}
+
+func (b *fakeAsyncBroker) Consume(ctx context.Context, correlationId string) ([]byte, error) {
+	b.mu.Lock()
+	response := b.responses[correlationId]
+	b.consumed = append(b.consumed, correlationId)
+	b.mu.Unlock()
+
+	select {
+	case value := <-response:
+		return value, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (b *fakeAsyncBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return nil
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	auditLogSigningHmacSha256 = "hmac-sha256"
+	auditLogSigningEd25519    = "ed25519"
+)
+
+type AuditLogSigningConfig struct {
+	// One of hmac-sha256 or ed25519
+	Algorithm string `hcl:"algorithm" json:"algorithm"`
+	// The HMAC secret, or a PEM-encoded PKCS #8 Ed25519 private key
+	Key     string `hcl:"key" json:"key"`
+	KeyPath string `hcl:"key_path" json:"key_path"`
+
+	sign func([]byte) []byte
+}
+
+// auditEntry describes the outcome of a single MintX509CA call.
+type auditEntry struct {
+	// Timestamp is when the entry was recorded, and Sequence is its position in the entries recorded since the
+	// plugin was loaded. Both are signed, so that a replayed or reordered entry can be detected.
+	Timestamp     time.Time
+	Sequence      uint64
+	EndEntityName string
+	CAName        string
+	StatusCode    codes.Code
+	StatusMessage string
+	// Signature is the hex-encoded signature of the entry's fields, if audit_log_signing is configured
+	Signature string
+}
+
+type auditLogFunc func(auditEntry)
+
+// auditMint records an audit entry for a MintX509CA call that returned err.
+func (p *Plugin) auditMint(config *Config, endEntityName string, err error) {
+	st := status.Convert(err)
+	entry := auditEntry{
+		Timestamp:     p.hooks.now(),
+		Sequence:      p.auditSequence.Add(1),
+		EndEntityName: endEntityName,
+		CAName:        config.CAName,
+		StatusCode:    st.Code(),
+		StatusMessage: st.Message(),
+	}
+	if config.AuditLogSigning != nil {
+		signature, signErr := entry.sign(config.AuditLogSigning)
+		if signErr != nil {
+			p.logger.Error("Failed to sign audit log entry", "error", signErr)
+		}
+		entry.Signature = signature
+	}
+	p.hooks.auditLog(entry)
+}
+
+// fields returns the entry as ordered key/value pairs. The fields mirror those of SPIRE's own audit log entries, so
+// entries can be filtered by type=audit alongside the server's API audit log.
+func (e auditEntry) fields() []interface{} {
+	result := "success"
+	if e.StatusCode != codes.OK {
+		result = "error"
+	}
+
+	return []interface{}{
+		"type", "audit",
+		"action", "MintX509CA",
+		"audit_timestamp", e.Timestamp.UTC().Format(time.RFC3339Nano),
+		"audit_sequence", e.Sequence,
+		"end_entity_name", e.EndEntityName,
+		"ca_name", e.CAName,
+		"status", result,
+		"status_code", e.StatusCode.String(),
+		"status_message", e.StatusMessage,
+	}
+}
+
+// sign returns the hex-encoded signature of the entry's fields, encoded as a compact JSON object with sorted keys.
+func (e auditEntry) sign(signing *AuditLogSigningConfig) (string, error) {
+	payload, err := auditSigningPayload(e.fields())
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(signing.sign(payload)), nil
+}
+
+// auditSigningPayload encodes key/value pairs as a compact JSON object with sorted keys, which is the payload that
+// audit log signatures are computed over.
+func auditSigningPayload(fields []interface{}) ([]byte, error) {
+	object := make(map[string]interface{}, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		object[fmt.Sprint(fields[i])] = fields[i+1]
+	}
+	return json.Marshal(object)
+}
+
+// writeAuditLog writes entry, followed by its signature if it's signed, to the logger provided by SPIRE.
+func (p *Plugin) writeAuditLog(entry auditEntry) {
+	fields := entry.fields()
+	if entry.Signature != "" {
+		fields = append(fields, "signature", entry.Signature)
+	}
+	p.logger.Info("Plugin action audited", fields...)
+}
+
+// configureAuditLogSigning validates signing and prepares its signing function, reading the key from key_path if
+// it's set.
+func (p *Plugin) configureAuditLogSigning(signing *AuditLogSigningConfig) error {
+	if signing.Key != "" && signing.KeyPath != "" {
+		return errors.New("key and key_path are mutually exclusive")
+	}
+	key := []byte(signing.Key)
+	if signing.KeyPath != "" {
+		var err error
+		key, err = p.hooks.readFile(signing.KeyPath)
+		if err != nil {
+			return fmt.Errorf("failed to read key: %w", err)
+		}
+	}
+	if len(key) == 0 {
+		return errors.New("key or key_path is required")
+	}
+
+	switch signing.Algorithm {
+	case auditLogSigningHmacSha256:
+		signing.sign = func(payload []byte) []byte {
+			mac := hmac.New(sha256.New, key)
+			mac.Write(payload)
+			return mac.Sum(nil)
+		}
+	case auditLogSigningEd25519:
+		block, _ := pem.Decode(key)
+		if block == nil {
+			return errors.New("key is not PEM-encoded")
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("failed to parse key: %w", err)
+		}
+		privateKey, ok := parsed.(ed25519.PrivateKey)
+		if !ok {
+			return fmt.Errorf("key is a %T, not an Ed25519 private key", parsed)
+		}
+		signing.sign = func(payload []byte) []byte {
+			return ed25519.Sign(privateKey, payload)
+		}
+	default:
+		return fmt.Errorf("algorithm must be one of hmac-sha256 or ed25519, got %q", signing.Algorithm)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMintAuditLog(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		handler http.Handler
+
+		expectedStatusCode          codes.Code
+		expectedStatusMessagePrefix string
+	}{
+		{
+			name:               "success",
+			handler:            newFakeEnrollHandler(t, nil),
+			expectedStatusCode: codes.OK,
+		},
+		{
+			name: "failure",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				_, err := w.Write([]byte(`{"error_code":400,"error_message":"Wrong certificate profile"}`))
+				require.NoError(t, err)
+			}),
+			expectedStatusCode:          codes.Internal,
+			expectedStatusMessagePrefix: "EJBCA returned an error: failed to enroll CSR",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := httptest.NewTLSServer(tt.handler)
+			defer testServer.Close()
+
+			// The entry is recorded after the response is sent, so it may arrive after MintX509CA returns
+			entries := make(chan auditEntry, 2)
+			_, ua := loadTestPlugin(t, testServer, &Config{}, func(p *Plugin) {
+				p.hooks.auditLog = func(entry auditEntry) {
+					entries <- entry
+				}
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, _ = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+
+			var entry auditEntry
+			select {
+			case entry = <-entries:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the audit entry")
+			}
+			require.Empty(t, entries)
+			require.Equal(t, uint64(1), entry.Sequence)
+			require.False(t, entry.Timestamp.IsZero())
+			require.Equal(t, "spiffe://example.org", entry.EndEntityName)
+			require.Equal(t, "Fake-Sub-CA", entry.CAName)
+			require.Equal(t, tt.expectedStatusCode, entry.StatusCode)
+			require.True(t, strings.HasPrefix(entry.StatusMessage, tt.expectedStatusMessagePrefix), "unexpected status message %q", entry.StatusMessage)
+		})
+	}
+}
+
+func TestAuditLogSigning(t *testing.T) {
+	hmacKey := []byte("audit-secret")
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	privateKeyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.NoError(t, err)
+	privateKeyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateKeyBytes})
+
+	for _, tt := range []struct {
+		name string
+
+		algorithm string
+		key       string
+		verify    func(payload, signature []byte) bool
+	}{
+		{
+			name:      "hmac-sha256",
+			algorithm: "hmac-sha256",
+			key:       string(hmacKey),
+			verify: func(payload, signature []byte) bool {
+				mac := hmac.New(sha256.New, hmacKey)
+				mac.Write(payload)
+				return hmac.Equal(mac.Sum(nil), signature)
+			},
+		},
+		{
+			name:      "ed25519",
+			algorithm: "ed25519",
+			key:       string(privateKeyPem),
+			verify: func(payload, signature []byte) bool {
+				return ed25519.Verify(publicKey, payload, signature)
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			p := New()
+			p.SetLogger(hclog.New(&hclog.LoggerOptions{Output: &logs, JSONFormat: true}))
+
+			config := &Config{
+				CAName: "Fake-Sub-CA",
+				AuditLogSigning: &AuditLogSigningConfig{
+					Algorithm: tt.algorithm,
+					Key:       tt.key,
+				},
+			}
+			require.NoError(t, p.configureAuditLogSigning(config.AuditLogSigning))
+
+			p.auditMint(config, "spiffe://example.org", nil)
+			p.auditMint(config, "spiffe://example.org", status.Error(codes.Internal, "EJBCA did not return a CA chain"))
+
+			lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+			require.Len(t, lines, 2)
+			require.NoError(t, verifyAuditLines(lines, tt.verify))
+
+			// A replayed or reordered line breaks the sequence, and changing its sequence breaks its signature
+			require.ErrorContains(t, verifyAuditLines([]string{lines[0], lines[1], lines[1]}, tt.verify), "line 3 has audit_sequence 2, expected 3")
+			require.ErrorContains(t, verifyAuditLines([]string{lines[1], lines[0]}, tt.verify), "line 2 has audit_sequence 1, expected 3")
+			replayed := strings.Replace(lines[1], `"audit_sequence":2`, `"audit_sequence":3`, 1)
+			require.ErrorContains(t, verifyAuditLines([]string{lines[0], lines[1], replayed}, tt.verify), "line 3 has an invalid signature")
+
+			var logged map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(lines[1]), &logged))
+			logged["status_message"] = "tampered"
+			tampered, err := json.Marshal(logged)
+			require.NoError(t, err)
+			require.ErrorContains(t, verifyAuditLines([]string{lines[0], string(tampered)}, tt.verify), "line 2 has an invalid signature")
+		})
+	}
+}
+
+// verifyAuditLines verifies the signature of each JSON-formatted audit line with verify, and that the lines' audit
+// sequence numbers increase by one from line to line.
+func verifyAuditLines(lines []string, verify func(payload, signature []byte) bool) error {
+	var previous float64
+	for i, line := range lines {
+		var logged map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &logged); err != nil {
+			return err
+		}
+
+		signature, err := hex.DecodeString(logged["signature"].(string))
+		if err != nil {
+			return err
+		}
+
+		// The signature covers the audit fields, not the timestamp, level, or message added by the logger
+		var fields []interface{}
+		for _, key := range []string{"type", "action", "audit_timestamp", "audit_sequence", "end_entity_name", "ca_name", "status", "status_code", "status_message"} {
+			fields = append(fields, key, logged[key])
+		}
+		payload, err := auditSigningPayload(fields)
+		if err != nil {
+			return err
+		}
+		if !verify(payload, signature) {
+			return fmt.Errorf("line %d has an invalid signature", i+1)
+		}
+
+		sequence := logged["audit_sequence"].(float64)
+		if i > 0 && sequence != previous+1 {
+			return fmt.Errorf("line %d has audit_sequence %v, expected %v", i+1, sequence, previous+1)
+		}
+		previous = sequence
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	upstreamauthorityv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/upstreamauthority/v1"
+	"github.com/spiffe/spire/pkg/common/coretypes/x509certificate"
+	"github.com/spiffe/spire/pkg/common/pemutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// defaultBundlePollConcurrency is how many CAs are fetched at once when bundle_poll_concurrency isn't set
+const defaultBundlePollConcurrency = 4
+
+// fetchCAChain retrieves the active certificate chain of the configured CA from EJBCA.
+func (p *Plugin) fetchCAChain(ctx context.Context, client ejbcaClient, config *Config) ([]*x509.Certificate, error) {
+	return p.fetchNamedCAChain(ctx, client, config, config.CAName)
+}
+
+// fetchNamedCAChain retrieves the active certificate chain of the CA named caName from EJBCA. EJBCA's download
+// endpoint is keyed by subject DN, so the CA is first looked up by name.
+func (p *Plugin) fetchNamedCAChain(ctx context.Context, client ejbcaClient, config *Config, caName string) ([]*x509.Certificate, error) {
+	logger := p.logger.Named("fetchCAChain")
+
+	logger.Trace("Listing CAs in EJBCA", "caName", caName)
+	cas, httpResponse, err := client.ListCas(ctx).Execute()
+	if err != nil {
+		return nil, p.parseEjbcaError(config, "failed to list CAs", err)
+	}
+	if httpResponse != nil && httpResponse.Body != nil {
+		httpResponse.Body.Close()
+	}
+
+	subjectDn := ""
+	for _, ca := range cas.GetCertificateAuthorities() {
+		if ca.GetName() == caName {
+			subjectDn = ca.GetSubjectDn()
+			break
+		}
+	}
+	if subjectDn == "" {
+		return nil, status.Errorf(codes.NotFound, "CA %q was not found in EJBCA", caName)
+	}
+
+	logger.Trace("Downloading CA certificate chain", "subjectDn", subjectDn)
+	httpResponse, err = client.GetCertificateAsPem(ctx, subjectDn).Execute()
+	if err != nil {
+		return nil, p.parseEjbcaError(config, "failed to download CA certificate chain", err)
+	}
+	defer httpResponse.Body.Close()
+
+	chainPem, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read CA certificate chain: %v", err)
+	}
+
+	chain, err := pemutil.ParseCertificates(chainPem)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to parse CA certificate chain: %v", err)
+	}
+
+	logger.Debug("Fetched CA certificate chain from EJBCA", "caName", caName, "length", len(chain))
+	return chain, nil
+}
+
+// caChainResult is the outcome of fetching the CA chain of one CA while polling upstream roots.
+type caChainResult struct {
+	caName string
+	chain  []*x509.Certificate
+	err    error
+}
+
+// fetchCAChains fetches the CA chains of caNames concurrently, at most concurrency at a time. Each result is sent on
+// the returned channel as soon as its fetch completes, and the channel is closed once every fetch has completed.
+func (p *Plugin) fetchCAChains(ctx context.Context, client ejbcaClient, config *Config, caNames []string, concurrency int) <-chan caChainResult {
+	// The channel holds every result, so fetches never block on a receiver that has stopped reading
+	results := make(chan caChainResult, len(caNames))
+	workers := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for _, caName := range caNames {
+		wg.Add(1)
+		go func(caName string) {
+			defer wg.Done()
+			select {
+			case workers <- struct{}{}:
+			case <-ctx.Done():
+				results <- caChainResult{caName: caName, err: ctx.Err()}
+				return
+			}
+			defer func() { <-workers }()
+
+			chain, err := p.fetchNamedCAChain(ctx, client, config, caName)
+			results <- caChainResult{caName: caName, chain: chain, err: err}
+		}(caName)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
+
+// pollUpstreamRoots fetches the CA chains of ca_name and bundle_poll_ca_names from EJBCA every bundle_poll_interval,
+// bundle_poll_concurrency at a time, and sends the upstream X.509 roots on stream whenever a root that wasn't sent
+// before appears, until the stream is closed. Updates are sent as each fetch completes, so a slow CA doesn't hold
+// back the roots of the others. roots are the roots sent with the minted X.509 CA. Roots that were already sent are
+// kept in each update, since X.509 CAs minted under them remain in use until they're rotated. Each poll uses the
+// configuration current at that time, so a reconfigure takes effect on streams that are already open.
+func (p *Plugin) pollUpstreamRoots(stream upstreamauthorityv1.UpstreamAuthority_MintX509CAAndSubscribeServer, state *configState, roots []*x509.Certificate) error {
+	logger := p.logger.Named("pollUpstreamRoots")
+
+	interval := state.config.bundlePollInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Debug("Stream closed - no longer polling upstream roots", "caName", state.config.CAName)
+			return nil
+		case <-ticker.C:
+		}
+
+		state = p.state.Load()
+		if state.config.bundlePollInterval <= 0 {
+			logger.Debug("bundle_poll_interval was disabled by a reconfigure - skipping poll")
+			continue
+		}
+		if state.config.bundlePollInterval != interval {
+			interval = state.config.bundlePollInterval
+			ticker.Reset(interval)
+		}
+
+		caNames := append([]string{state.config.CAName}, state.config.BundlePollCANames...)
+		for result := range p.fetchCAChains(ctx, state.client, state.config, caNames, state.config.BundlePollConcurrency) {
+			if result.err != nil {
+				logger.Warn("Failed to poll upstream roots", "caName", result.caName, "error", result.err)
+				continue
+			}
+
+			var added []*x509.Certificate
+			for _, cert := range result.chain {
+				if isSelfSigned(cert) && !slices.ContainsFunc(roots, cert.Equal) && !slices.ContainsFunc(added, cert.Equal) {
+					added = append(added, cert)
+				}
+			}
+			if len(added) == 0 {
+				continue
+			}
+			roots = append(roots, added...)
+
+			logger.Info("Upstream roots changed - publishing updated roots", "caName", result.caName, "rootCa", added[0].Subject.String(), "roots", len(roots))
+			upstreamX509Roots, err := x509certificate.ToPluginProtos(roots)
+			if err != nil {
+				return status.Errorf(codes.Internal, "failed to serialize upstream X.509 roots: %v", err)
+			}
+			if err := stream.Send(&upstreamauthorityv1.MintX509CAResponse{UpstreamX509Roots: upstreamX509Roots}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// validateConnection lists the CAs in EJBCA to verify that EJBCA is reachable and accepts the configured credentials.
+func (p *Plugin) validateConnection(ctx context.Context, client ejbcaClient) error {
+	logger := p.logger.Named("validateConnection")
+
+	logger.Debug("Validating EJBCA connection")
+	_, httpResponse, err := client.ListCas(ctx).Execute()
+	if httpResponse != nil && httpResponse.Body != nil {
+		httpResponse.Body.Close()
+	}
+	if err != nil {
+		if httpResponse != nil {
+			return fmt.Errorf("EJBCA responded to the CA listing with %s", httpResponse.Status)
+		}
+		return err
+	}
+
+	logger.Info("Validated EJBCA connection")
+	return nil
+}
+
+// warmup prepares the plugin for its first mint by fetching the CA chain from EJBCA. For OAuth, this also acquires
+// the access token, which is cached by the client for subsequent requests.
+func (p *Plugin) warmup(ctx context.Context, client ejbcaClient, config *Config) error {
+	logger := p.logger.Named("warmup")
+
+	logger.Info("Warming up EJBCA connection", "caName", config.CAName)
+	start := p.hooks.now()
+	chain, err := p.fetchCAChain(ctx, client, config)
+	if err != nil {
+		logger.Warn("Failed to fetch CA certificate chain during warmup", "caName", config.CAName, "duration", p.hooks.now().Sub(start), "error", err)
+		return err
+	}
+	// CAs that share a subject DN can't be told apart by the download endpoint, so the chain may belong to another CA
+	if len(config.pinnedCAFingerprint) > 0 && len(chain) > 0 && !hasFingerprint(chain[0], config.pinnedCAFingerprint) {
+		logger.Warn("CA certificate chain fetched from EJBCA doesn't match pinned_ca_fingerprint - not caching it", "caName", config.CAName, "issuingCa", chain[0].Subject.String())
+	} else {
+		p.cacheIssuerChain(chain)
+	}
+
+	logger.Info("EJBCA connection is warmed up", "caName", config.CAName, "duration", p.hooks.now().Sub(start), "chainLength", len(chain))
+	return nil
+}
+
+// cacheIssuerChain stores chain as the cached CA chain. If the fingerprint of its issuing CA differs from the cached
+// one, EJBCA's CA has rolled over, so the stale chain is replaced and the rollover is logged.
+func (p *Plugin) cacheIssuerChain(chain []*x509.Certificate) {
+	if len(chain) == 0 {
+		return
+	}
+	fingerprint := sha256.Sum256(chain[0].Raw)
+
+	p.issuerChainCache.Lock()
+	defer p.issuerChainCache.Unlock()
+	if p.issuerChainCache.chain != nil && p.issuerChainCache.fingerprint != fingerprint {
+		p.logger.Info("Detected CA rollover in EJBCA - invalidating cached CA chain", "previousFingerprint", hex.EncodeToString(p.issuerChainCache.fingerprint[:]), "fingerprint", hex.EncodeToString(fingerprint[:]), "issuingCa", chain[0].Subject.String())
+	}
+	p.issuerChainCache.fingerprint = fingerprint
+	p.issuerChainCache.chain = chain
+}
+
+// getCachedIssuerChain returns the cached CA chain if its issuing CA signed cert. Otherwise, the cached chain is stale
+// and is invalidated so that an old root is never served, and nil is returned.
+func (p *Plugin) getCachedIssuerChain(cert *x509.Certificate) []*x509.Certificate {
+	p.issuerChainCache.Lock()
+	defer p.issuerChainCache.Unlock()
+	if p.issuerChainCache.chain == nil {
+		return nil
+	}
+	if err := cert.CheckSignatureFrom(p.issuerChainCache.chain[0]); err != nil {
+		p.logger.Info("Detected CA rollover in EJBCA - invalidating cached CA chain", "previousFingerprint", hex.EncodeToString(p.issuerChainCache.fingerprint[:]), "issuer", cert.Issuer.String(), "reason", err)
+		p.issuerChainCache.fingerprint = [sha256.Size]byte{}
+		p.issuerChainCache.chain = nil
+		return nil
+	}
+	return p.issuerChainCache.chain
+}
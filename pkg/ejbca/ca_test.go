@@ -0,0 +1,608 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	upstreamauthorityv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/upstreamauthority/v1"
+	"github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/types"
+	configv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/service/common/config/v1"
+	"github.com/spiffe/spire/pkg/server/plugin/upstreamauthority"
+	"github.com/spiffe/spire/test/plugintest"
+	"github.com/spiffe/spire/test/spiretest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestWarmup(t *testing.T) {
+	rootCA, intermediateCA, _, _ := issueTestCertificates(t)
+
+	for _, tt := range []struct {
+		name string
+
+		warmup            bool
+		warmupFailOnError bool
+		caName            string
+
+		expectedgRPCCode    codes.Code
+		expectedTokenHits   int32
+		expectedCAChainHits int32
+	}{
+		{
+			name:                "warmup",
+			warmup:              true,
+			caName:              "Fake-Sub-CA",
+			expectedgRPCCode:    codes.OK,
+			expectedTokenHits:   1,
+			expectedCAChainHits: 1,
+		},
+		{
+			name:             "no_warmup",
+			warmup:           false,
+			caName:           "Fake-Sub-CA",
+			expectedgRPCCode: codes.OK,
+		},
+		{
+			name:              "warmup_error_not_fatal",
+			warmup:            true,
+			caName:            "Unknown-CA",
+			expectedgRPCCode:  codes.OK,
+			expectedTokenHits: 1,
+		},
+		{
+			name:              "warmup_error_fatal",
+			warmup:            true,
+			warmupFailOnError: true,
+			caName:            "Unknown-CA",
+			expectedgRPCCode:  codes.Unavailable,
+			expectedTokenHits: 1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var tokenHits, caChainHits atomic.Int32
+
+			tokenServer := newFakeTokenServer(t, &tokenHits)
+			defer tokenServer.Close()
+
+			ejbcaServer := httptest.NewTLSServer(newFakeEjbcaCAHandler(t, "Fake-Sub-CA", []*x509.Certificate{intermediateCA, rootCA}, &caChainHits))
+			defer ejbcaServer.Close()
+
+			var err error
+			p := New()
+			p.SetLogger(hclog.Default())
+
+			plugintest.Load(t, builtin(p), new(upstreamauthority.V1),
+				plugintest.CaptureConfigureError(&err),
+				plugintest.Configure(fmt.Sprintf(`
+            hostname = "%s"
+            ca_cert = <<EOF
+%s
+EOF
+            oauth {
+                token_url = "%s"
+                client_id = "fi3ElQUVoBBHyRNt4mpUxG9WY65AOCcJ"
+                client_secret = "1EXHdD7Ikmmv0OkBoJZZtzOG5iAzvwdqBVuvquf-QEvL6fLrEG_heJHphtEXVj9H"
+            }
+            ca_name = "%s"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            warmup = %t
+            warmup_fail_on_error = %t
+            `, ejbcaServer.URL, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ejbcaServer.Certificate().Raw}),
+					tokenServer.URL, tt.caName, tt.warmup, tt.warmupFailOnError)),
+			)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, "")
+
+			require.Equal(t, tt.expectedTokenHits, tokenHits.Load())
+			require.Equal(t, tt.expectedCAChainHits, caChainHits.Load())
+		})
+	}
+}
+
+func TestWarmupLogging(t *testing.T) {
+	rootCA, intermediateCA, _, _ := issueTestCertificates(t)
+
+	for _, tt := range []struct {
+		name string
+
+		caName string
+
+		expectedLevel   string
+		expectedMessage string
+		expectedFields  map[string]interface{}
+	}{
+		{
+			name:            "success",
+			caName:          "Fake-Sub-CA",
+			expectedLevel:   "info",
+			expectedMessage: "EJBCA connection is warmed up",
+			expectedFields:  map[string]interface{}{"chainLength": float64(2)},
+		},
+		{
+			name:            "failure",
+			caName:          "Unknown-CA",
+			expectedLevel:   "warn",
+			expectedMessage: "Failed to fetch CA certificate chain during warmup",
+			expectedFields:  map[string]interface{}{"error": "rpc error: code = NotFound desc = CA \"Unknown-CA\" was not found in EJBCA"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := httptest.NewTLSServer(newFakeEjbcaCAHandler(t, "Fake-Sub-CA", []*x509.Certificate{intermediateCA, rootCA}, new(atomic.Int32)))
+			defer testServer.Close()
+
+			p, _ := loadTestPlugin(t, testServer, &Config{CAName: tt.caName})
+			state := p.state.Load()
+
+			var logs bytes.Buffer
+			p.SetLogger(hclog.New(&hclog.LoggerOptions{Output: &logs, JSONFormat: true}))
+			// The warmup starts at the first call and ends 250ms later
+			start := time.Now()
+			p.hooks.now = func() time.Time {
+				now := start
+				start = start.Add(250 * time.Millisecond)
+				return now
+			}
+
+			_ = p.warmup(context.Background(), state.client, state.config)
+
+			var logged map[string]interface{}
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				var entry map[string]interface{}
+				require.NoError(t, json.Unmarshal([]byte(line), &entry))
+				if entry["@message"] == tt.expectedMessage {
+					logged = entry
+				}
+			}
+			require.NotNil(t, logged, "no %q log line in %s", tt.expectedMessage, logs.String())
+			require.Equal(t, tt.expectedLevel, logged["@level"])
+			require.Equal(t, tt.caName, logged["caName"])
+			require.Equal(t, float64(250*time.Millisecond), logged["duration"])
+			for key, value := range tt.expectedFields {
+				require.Equal(t, value, logged[key], key)
+			}
+		})
+	}
+}
+
+func TestIssuerChainCacheRollover(t *testing.T) {
+	rootA, intermediateA, svidIssuingCAA, _ := issueTestCertificates(t)
+	rootB, intermediateB, svidIssuingCAB, _ := issueTestCertificates(t)
+
+	type fakeCA struct {
+		issuingCA    *x509.Certificate
+		intermediate *x509.Certificate
+		root         *x509.Certificate
+		includeChain bool
+	}
+	var current atomic.Pointer[fakeCA]
+
+	testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		ca := current.Load()
+		var roots []*x509.Certificate
+		chain := []*x509.Certificate{ca.issuingCA}
+		if ca.includeChain {
+			chain = append(chain, ca.intermediate)
+			roots = append(roots, ca.root)
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(certificateRestResponseFromExpectedCerts(t, chain, roots, "PEM"))
+		require.NoError(t, err)
+	}))
+	defer testServer.Close()
+
+	p, ua := loadTestPlugin(t, testServer, &Config{})
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	for _, step := range []struct {
+		name string
+
+		ca fakeCA
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+		expectedRoot          *x509.Certificate
+		expectedCachedCA      *x509.Certificate
+	}{
+		{
+			name:             "chain_populates_cache",
+			ca:               fakeCA{issuingCA: svidIssuingCAA, intermediate: intermediateA, root: rootA, includeChain: true},
+			expectedgRPCCode: codes.OK,
+			expectedRoot:     rootA,
+			expectedCachedCA: intermediateA,
+		},
+		{
+			name:             "cached_chain_served",
+			ca:               fakeCA{issuingCA: svidIssuingCAA, intermediate: intermediateA, root: rootA},
+			expectedgRPCCode: codes.OK,
+			expectedRoot:     rootA,
+			expectedCachedCA: intermediateA,
+		},
+		{
+			name:                  "stale_cache_invalidated",
+			ca:                    fakeCA{issuingCA: svidIssuingCAB, intermediate: intermediateB, root: rootB},
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): EJBCA did not return a CA chain",
+		},
+		{
+			name:             "cached_chain_replaced_after_rollover",
+			ca:               fakeCA{issuingCA: svidIssuingCAA, intermediate: intermediateA, root: rootA, includeChain: true},
+			expectedgRPCCode: codes.OK,
+			expectedRoot:     rootA,
+			expectedCachedCA: intermediateA,
+		},
+		{
+			name:             "new_chain_replaces_cache",
+			ca:               fakeCA{issuingCA: svidIssuingCAB, intermediate: intermediateB, root: rootB, includeChain: true},
+			expectedgRPCCode: codes.OK,
+			expectedRoot:     rootB,
+			expectedCachedCA: intermediateB,
+		},
+		{
+			name:             "new_cached_chain_served",
+			ca:               fakeCA{issuingCA: svidIssuingCAB, intermediate: intermediateB, root: rootB},
+			expectedgRPCCode: codes.OK,
+			expectedRoot:     rootB,
+			expectedCachedCA: intermediateB,
+		},
+	} {
+		ca := step.ca
+		current.Store(&ca)
+
+		_, upstreamX509Roots, _, err := ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+		spiretest.RequireGRPCStatusHasPrefix(t, err, step.expectedgRPCCode, step.expectedMessagePrefix)
+		if step.expectedgRPCCode == codes.OK {
+			require.Equal(t, []*x509.Certificate{step.expectedRoot}, upstreamX509Roots, step.name)
+		}
+
+		p.issuerChainCache.Lock()
+		if step.expectedCachedCA == nil {
+			require.Nil(t, p.issuerChainCache.chain, step.name)
+		} else {
+			require.Equal(t, sha256.Sum256(step.expectedCachedCA.Raw), p.issuerChainCache.fingerprint, step.name)
+			require.Equal(t, step.expectedCachedCA, p.issuerChainCache.chain[0], step.name)
+		}
+		p.issuerChainCache.Unlock()
+	}
+}
+
+func TestPollUpstreamRoots(t *testing.T) {
+	rootA, intermediateA, _, _ := issueTestCertificates(t)
+	rootB, intermediateB, _, _ := issueTestCertificates(t)
+
+	var chain atomic.Pointer[[]*x509.Certificate]
+	chain.Store(&[]*x509.Certificate{intermediateA, rootA})
+
+	mux := http.NewServeMux()
+	mux.Handle("/", newFakeEnrollHandler(t, nil))
+	mux.HandleFunc("/ejbca/ejbca-rest-api/v1/ca", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(map[string]any{
+			"certificate_authorities": []map[string]any{
+				{"name": "Fake-Sub-CA", "subject_dn": "CN=Fake-Sub-CA"},
+			},
+		})
+		require.NoError(t, err)
+	})
+	mux.HandleFunc("/ejbca/ejbca-rest-api/v1/ca/CN=Fake-Sub-CA/certificate/download", func(w http.ResponseWriter, _ *http.Request) {
+		for _, cert := range *chain.Load() {
+			_, err := w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+			require.NoError(t, err)
+		}
+	})
+	testServer := httptest.NewTLSServer(mux)
+	defer testServer.Close()
+
+	_, ua := loadTestPlugin(t, testServer, &Config{BundlePollInterval: "10ms"})
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := ua.UpstreamAuthorityPluginClient.MintX509CAAndSubscribe(ctx, &upstreamauthorityv1.MintX509CARequest{Csr: csr.Raw, PreferredTtl: 30})
+	require.NoError(t, err)
+
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	require.NotEmpty(t, resp.X509CaChain)
+	require.Len(t, resp.UpstreamX509Roots, 1)
+	mintedRoot := resp.UpstreamX509Roots[0].Asn1
+
+	// The minted root is kept when the root of ca_name differs from it
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	require.Empty(t, resp.X509CaChain)
+	require.Len(t, resp.UpstreamX509Roots, 2)
+	require.Equal(t, mintedRoot, resp.UpstreamX509Roots[0].Asn1)
+	require.Equal(t, rootA.Raw, resp.UpstreamX509Roots[1].Asn1)
+
+	chain.Store(&[]*x509.Certificate{intermediateB, rootB})
+
+	resp, err = stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, resp.UpstreamX509Roots, 3)
+	require.Equal(t, rootA.Raw, resp.UpstreamX509Roots[1].Asn1)
+	require.Equal(t, rootB.Raw, resp.UpstreamX509Roots[2].Asn1)
+}
+
+func TestPollUpstreamRootsMultipleCAs(t *testing.T) {
+	rootA, intermediateA, _, _ := issueTestCertificates(t)
+	rootB, intermediateB, _, _ := issueTestCertificates(t)
+	rootC, intermediateC, _, _ := issueTestCertificates(t)
+
+	chains := map[string][]*x509.Certificate{
+		"CN=Fake-Sub-CA": {intermediateA, rootA},
+		"CN=Fast-CA":     {intermediateB, rootB},
+		"CN=Slow-CA":     {intermediateC, rootC},
+	}
+	// Slow-CA doesn't answer until released, which mustn't hold back the roots of the other CAs
+	release := make(chan struct{})
+
+	mux := http.NewServeMux()
+	mux.Handle("/", newFakeEnrollHandler(t, nil))
+	mux.HandleFunc("/ejbca/ejbca-rest-api/v1/ca", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(map[string]any{
+			"certificate_authorities": []map[string]any{
+				{"name": "Fake-Sub-CA", "subject_dn": "CN=Fake-Sub-CA"},
+				{"name": "Fast-CA", "subject_dn": "CN=Fast-CA"},
+				{"name": "Slow-CA", "subject_dn": "CN=Slow-CA"},
+			},
+		})
+		require.NoError(t, err)
+	})
+	for subjectDn, chain := range chains {
+		mux.HandleFunc(fmt.Sprintf("/ejbca/ejbca-rest-api/v1/ca/%s/certificate/download", subjectDn), func(w http.ResponseWriter, r *http.Request) {
+			if subjectDn == "CN=Slow-CA" {
+				select {
+				case <-release:
+				case <-r.Context().Done():
+					return
+				}
+			}
+			for _, cert := range chain {
+				_, err := w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+				require.NoError(t, err)
+			}
+		})
+	}
+	testServer := httptest.NewTLSServer(mux)
+	defer testServer.Close()
+
+	_, ua := loadTestPlugin(t, testServer, &Config{
+		BundlePollInterval:    "10ms",
+		BundlePollCANames:     []string{"Fast-CA", "Slow-CA"},
+		BundlePollConcurrency: 2,
+	})
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := ua.UpstreamAuthorityPluginClient.MintX509CAAndSubscribe(ctx, &upstreamauthorityv1.MintX509CARequest{Csr: csr.Raw, PreferredTtl: 30})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	hasRoot := func(roots []*types.X509Certificate, root *x509.Certificate) bool {
+		return slices.ContainsFunc(roots, func(r *types.X509Certificate) bool {
+			return bytes.Equal(r.Asn1, root.Raw)
+		})
+	}
+
+	// The roots of ca_name and Fast-CA arrive while Slow-CA is still being fetched
+	for {
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		require.False(t, hasRoot(resp.UpstreamX509Roots, rootC))
+		if hasRoot(resp.UpstreamX509Roots, rootA) && hasRoot(resp.UpstreamX509Roots, rootB) {
+			break
+		}
+	}
+
+	close(release)
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	require.True(t, hasRoot(resp.UpstreamX509Roots, rootA))
+	require.True(t, hasRoot(resp.UpstreamX509Roots, rootB))
+	require.True(t, hasRoot(resp.UpstreamX509Roots, rootC))
+}
+
+func TestPollUpstreamRootsReconfigure(t *testing.T) {
+	rootA, intermediateA, _, _ := issueTestCertificates(t)
+	rootB, intermediateB, _, _ := issueTestCertificates(t)
+
+	newServer := func(chain []*x509.Certificate, chainHits *atomic.Int32) *httptest.Server {
+		caHandler := newFakeEjbcaCAHandler(t, "Fake-Sub-CA", chain, chainHits)
+		mux := http.NewServeMux()
+		mux.Handle("/", newFakeEnrollHandler(t, nil))
+		mux.Handle("/ejbca/ejbca-rest-api/v1/ca", caHandler)
+		mux.Handle("/ejbca/ejbca-rest-api/v1/ca/", caHandler)
+		return httptest.NewTLSServer(mux)
+	}
+	var hitsA, hitsB atomic.Int32
+	serverA := newServer([]*x509.Certificate{intermediateA, rootA}, &hitsA)
+	defer serverA.Close()
+	serverB := newServer([]*x509.Certificate{intermediateB, rootB}, &hitsB)
+	defer serverB.Close()
+
+	config := &Config{BundlePollInterval: "10ms"}
+	p, ua := loadTestPlugin(t, serverA, config)
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := ua.UpstreamAuthorityPluginClient.MintX509CAAndSubscribe(ctx, &upstreamauthorityv1.MintX509CARequest{Csr: csr.Raw, PreferredTtl: 30})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	// Point the plugin at serverB while the stream is open
+	clientConfig := fakeClientConfig{testServer: serverB}
+	p.hooks.newAuthenticator = clientConfig.newFakeAuthenticator
+	config.Hostname = serverB.URL
+	hclConfiguration, err := json.Marshal(config)
+	require.NoError(t, err)
+	_, err = p.Configure(context.Background(), &configv1.ConfigureRequest{HclConfiguration: string(hclConfiguration)})
+	require.NoError(t, err)
+
+	for {
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		if slices.ContainsFunc(resp.UpstreamX509Roots, func(root *types.X509Certificate) bool {
+			return bytes.Equal(root.Asn1, rootB.Raw)
+		}) {
+			break
+		}
+	}
+	require.Positive(t, hitsB.Load())
+}
+
+func TestValidateConnectionOnConfigure(t *testing.T) {
+	rootCA, intermediateCA, _, _ := issueTestCertificates(t)
+
+	for _, tt := range []struct {
+		name string
+
+		validateConnectionOnConfigure bool
+		handler                       http.Handler
+		closeServer                   bool
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:                          "reachable",
+			validateConnectionOnConfigure: true,
+			handler:                       newFakeEjbcaCAHandler(t, "Fake-Sub-CA", []*x509.Certificate{intermediateCA, rootCA}, new(atomic.Int32)),
+			expectedgRPCCode:              codes.OK,
+		},
+		{
+			name:                          "credentials_rejected",
+			validateConnectionOnConfigure: true,
+			handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusUnauthorized)
+			}),
+			expectedgRPCCode:      codes.Unavailable,
+			expectedMessagePrefix: "failed to validate EJBCA connection: EJBCA responded to the CA listing with 401 Unauthorized",
+		},
+		{
+			name:                          "unreachable",
+			validateConnectionOnConfigure: true,
+			handler:                       http.NotFoundHandler(),
+			closeServer:                   true,
+			expectedgRPCCode:              codes.Unavailable,
+			expectedMessagePrefix:         "failed to validate EJBCA connection: ",
+		},
+		{
+			name:             "disabled",
+			handler:          http.NotFoundHandler(),
+			closeServer:      true,
+			expectedgRPCCode: codes.OK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := httptest.NewTLSServer(tt.handler)
+			defer testServer.Close()
+			if tt.closeServer {
+				testServer.Close()
+			}
+
+			p := New()
+			p.SetLogger(hclog.Default())
+			clientConfig := fakeClientConfig{testServer: testServer}
+			p.hooks.newAuthenticator = clientConfig.newFakeAuthenticator
+
+			var err error
+			plugintest.Load(t, builtin(p), new(upstreamauthority.V1),
+				plugintest.CaptureConfigureError(&err),
+				plugintest.ConfigureJSON(&Config{
+					Hostname:                      testServer.URL,
+					CertAuth:                      &CertAuthConfig{ClientCert: "BEGIN CERTIFICATE ... END CERTIFICATE", ClientKey: "BEGIN RSA PRIVATE KEY ... END RSA PRIVATE KEY"},
+					CAName:                        "Fake-Sub-CA",
+					EndEntityProfileName:          "fakeSpireIntermediateCAEEP",
+					CertificateProfileName:        "fakeSubCACP",
+					ValidateConnectionOnConfigure: tt.validateConnectionOnConfigure,
+				}),
+			)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+		})
+	}
+}
+
+// newFakeTokenServer returns an OAuth 2.0 token endpoint that issues a bearer token and counts requests in hits.
+func newFakeTokenServer(t *testing.T, hits *atomic.Int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "fake-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+		require.NoError(t, err)
+	}))
+}
+
+// newFakeEjbcaCAHandler returns a handler serving EJBCA's CA listing and CA certificate download endpoints for a
+// single CA. Downloads of the CA chain are counted in chainHits.
+func newFakeEjbcaCAHandler(t *testing.T, caName string, chain []*x509.Certificate, chainHits *atomic.Int32) http.Handler {
+	subjectDn := "CN=" + caName
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ejbca/ejbca-rest-api/v1/ca", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(map[string]any{
+			"certificate_authorities": []map[string]any{
+				{"name": caName, "subject_dn": subjectDn},
+			},
+		})
+		require.NoError(t, err)
+	})
+	mux.HandleFunc(fmt.Sprintf("/ejbca/ejbca-rest-api/v1/ca/%s/certificate/download", subjectDn), func(w http.ResponseWriter, _ *http.Request) {
+		chainHits.Add(1)
+		for _, cert := range chain {
+			_, err := w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+			require.NoError(t, err)
+		}
+	})
+	return mux
+}
@@ -0,0 +1,340 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidExtensionExtKeyUsage    = asn1.ObjectIdentifier{2, 5, 29, 37}
+	oidChallengePassword       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 7}
+)
+
+// knownCSRExtensions are the CSR extensions the plugin understands when reject_unknown_critical_extensions is set
+var knownCSRExtensions = []asn1.ObjectIdentifier{
+	{2, 5, 29, 14}, // Subject Key Identifier
+	{2, 5, 29, 15}, // Key Usage
+	oidExtensionSubjectAltName,
+	{2, 5, 29, 19}, // Basic Constraints
+	{2, 5, 29, 30}, // Name Constraints
+	oidExtensionExtKeyUsage,
+}
+
+// extKeyUsageOids maps the RFC 5280 names of EKUs accepted by allowed_csr_ekus to their dotted OIDs.
+var extKeyUsageOids = map[string]string{
+	"serverAuth":      "1.3.6.1.5.5.7.3.1",
+	"clientAuth":      "1.3.6.1.5.5.7.3.2",
+	"codeSigning":     "1.3.6.1.5.5.7.3.3",
+	"emailProtection": "1.3.6.1.5.5.7.3.4",
+	"timeStamping":    "1.3.6.1.5.5.7.3.8",
+	"OCSPSigning":     "1.3.6.1.5.5.7.3.9",
+}
+
+const (
+	// sanTagURI is the context-specific tag of a uniformResourceIdentifier GeneralName
+	sanTagURI = 6
+)
+
+const (
+	requestFormatPkcs10 = "pkcs10"
+	requestFormatCrmf   = "crmf"
+)
+
+// crmfCertRequest is the CertRequest of an RFC 4211 CertReqMsg. Its certTemplate holds only the fields carried
+// over from the PKCS#10 CSR.
+type crmfCertRequest struct {
+	CertReqId    int
+	CertTemplate struct {
+		Subject    asn1.RawValue
+		PublicKey  asn1.RawValue
+		Extensions asn1.RawValue `asn1:"optional"`
+	}
+}
+
+// crmfCertReqMsg is an RFC 4211 CertReqMsg.
+type crmfCertReqMsg struct {
+	CertReq crmfCertRequest
+	Popo    asn1.RawValue
+}
+
+// getCrmfRequest wraps the subject, public key, and extensions of csr in a DER-encoded RFC 4211 CertReqMessages.
+// The plugin never holds the private key, so proof of possession is asserted as raVerified, relying on the
+// signature of the CSR that SPIRE sent.
+func getCrmfRequest(csr *x509.CertificateRequest) ([]byte, error) {
+	var msg crmfCertReqMsg
+
+	// subject [5] Name is explicitly tagged since Name is a CHOICE
+	msg.CertReq.CertTemplate.Subject = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 5, IsCompound: true, Bytes: csr.RawSubject}
+
+	var publicKey asn1.RawValue
+	if _, err := asn1.Unmarshal(csr.RawSubjectPublicKeyInfo, &publicKey); err != nil {
+		return nil, fmt.Errorf("failed to parse CSR public key: %w", err)
+	}
+	msg.CertReq.CertTemplate.PublicKey = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 6, IsCompound: true, Bytes: publicKey.Bytes}
+
+	if len(csr.Extensions) > 0 {
+		extensions, err := asn1.Marshal(csr.Extensions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode CSR extensions: %w", err)
+		}
+		var raw asn1.RawValue
+		if _, err := asn1.Unmarshal(extensions, &raw); err != nil {
+			return nil, fmt.Errorf("failed to encode CSR extensions: %w", err)
+		}
+		msg.CertReq.CertTemplate.Extensions = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 9, IsCompound: true, Bytes: raw.Bytes}
+	}
+
+	// raVerified [0] NULL
+	msg.Popo = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0}
+
+	return asn1.Marshal([]crmfCertReqMsg{msg})
+}
+
+// validateCSR checks the CSR against the CSR policy configured for the plugin. Malformed CSRs are rejected with
+// codes.InvalidArgument, and CSRs for trust domains the plugin may not mint for with codes.PermissionDenied.
+func (p *Plugin) validateCSR(config *Config, csr *x509.CertificateRequest) error {
+	if config.SPIFFEOnlySANs {
+		if err := validateSpiffeOnlySans(csr); err != nil {
+			return status.Errorf(codes.InvalidArgument, "CSR violates spiffe_only_sans: %v", err)
+		}
+	}
+
+	if config.RejectUnknownCriticalExtensions {
+		for _, ext := range csr.Extensions {
+			if ext.Critical && !slices.ContainsFunc(knownCSRExtensions, ext.Id.Equal) {
+				return status.Errorf(codes.InvalidArgument, "CSR has unrecognized critical extension %s", ext.Id)
+			}
+		}
+	}
+
+	if len(config.AllowedCSRAlgorithms) > 0 && !isAllowedCsrAlgorithm(config.AllowedCSRAlgorithms, csr) {
+		return status.Errorf(codes.InvalidArgument, "CSR signature algorithm %s with public key algorithm %s is not in allowed_csr_algorithms", csr.SignatureAlgorithm, csr.PublicKeyAlgorithm)
+	}
+
+	if !config.trustDomain.IsZero() && !hasSpiffeIdInTrustDomain(csr, config.trustDomain) {
+		return status.Errorf(codes.InvalidArgument, "CSR has no SPIFFE ID URI SAN in trust domain %q", config.trustDomain.Name())
+	}
+
+	if len(config.AllowedTrustDomains) > 0 {
+		trustDomain, err := getTrustDomain(csr)
+		if err != nil {
+			return status.Errorf(codes.PermissionDenied, "unable to determine trust domain of CSR: %v", err)
+		}
+		if !slices.Contains(config.AllowedTrustDomains, trustDomain.Name()) {
+			return status.Errorf(codes.PermissionDenied, "trust domain %q is not in allowed_trust_domains", trustDomain.Name())
+		}
+	}
+
+	return nil
+}
+
+// isAllowedCsrAlgorithm returns true if the signature algorithm or the public key algorithm of csr, as returned by
+// their String methods, matches one of the allowed names, ignoring case.
+func isAllowedCsrAlgorithm(allowed []string, csr *x509.CertificateRequest) bool {
+	return slices.ContainsFunc(allowed, func(name string) bool {
+		return strings.EqualFold(name, csr.SignatureAlgorithm.String()) || strings.EqualFold(name, csr.PublicKeyAlgorithm.String())
+	})
+}
+
+// parsePublicKeyAlgorithm returns the x509.PublicKeyAlgorithm whose name (as returned by its String method)
+// matches name, ignoring case.
+func parsePublicKeyAlgorithm(name string) (x509.PublicKeyAlgorithm, bool) {
+	for algorithm := x509.RSA; algorithm <= x509.Ed25519; algorithm++ {
+		if strings.EqualFold(algorithm.String(), name) {
+			return algorithm, true
+		}
+	}
+	return x509.UnknownPublicKeyAlgorithm, false
+}
+
+// getTrustDomain returns the trust domain of the first SPIFFE ID in the CSR's URI SANs.
+func getTrustDomain(csr *x509.CertificateRequest) (spiffeid.TrustDomain, error) {
+	for _, uri := range csr.URIs {
+		if uri.Scheme != "spiffe" {
+			continue
+		}
+		id, err := spiffeid.FromURI(uri)
+		if err != nil {
+			return spiffeid.TrustDomain{}, err
+		}
+		return id.TrustDomain(), nil
+	}
+	return spiffeid.TrustDomain{}, fmt.Errorf("CSR does not contain a SPIFFE ID URI SAN")
+}
+
+// hasSpiffeIdInTrustDomain returns true if one of the URI SANs of csr is a valid SPIFFE ID in trustDomain.
+func hasSpiffeIdInTrustDomain(csr *x509.CertificateRequest, trustDomain spiffeid.TrustDomain) bool {
+	for _, uri := range csr.URIs {
+		id, err := spiffeid.FromURI(uri)
+		if err == nil && id.MemberOf(trustDomain) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSpiffeOnlySans verifies that the CSR's only SAN is a single spiffe:// URI. The raw SAN extension is
+// inspected, since Go discards GeneralName types it doesn't model (such as otherName).
+func validateSpiffeOnlySans(csr *x509.CertificateRequest) error {
+	var generalNames []asn1.RawValue
+	for _, ext := range csr.Extensions {
+		if !ext.Id.Equal(oidExtensionSubjectAltName) {
+			continue
+		}
+
+		var names asn1.RawValue
+		if rest, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			return fmt.Errorf("failed to parse SAN extension: %w", err)
+		} else if len(rest) != 0 {
+			return fmt.Errorf("trailing data after SAN extension")
+		}
+
+		rest := names.Bytes
+		for len(rest) > 0 {
+			var name asn1.RawValue
+			var err error
+			rest, err = asn1.Unmarshal(rest, &name)
+			if err != nil {
+				return fmt.Errorf("failed to parse SAN extension: %w", err)
+			}
+			generalNames = append(generalNames, name)
+		}
+	}
+
+	if len(generalNames) != 1 {
+		return fmt.Errorf("expected exactly one SAN, found %d", len(generalNames))
+	}
+	if generalNames[0].Tag != sanTagURI || !strings.HasPrefix(string(generalNames[0].Bytes), "spiffe://") {
+		return fmt.Errorf("the SAN must be a spiffe:// URI")
+	}
+
+	return nil
+}
+
+// parseExtKeyUsage returns the dotted OID of an EKU given by its RFC 5280 name or as a dotted OID.
+func parseExtKeyUsage(name string) (string, bool) {
+	if oid, ok := extKeyUsageOids[name]; ok {
+		return oid, true
+	}
+
+	arcs := strings.Split(name, ".")
+	if len(arcs) < 2 {
+		return "", false
+	}
+	for _, arc := range arcs {
+		if _, err := strconv.ParseUint(arc, 10, 32); err != nil {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// getForwardedEkus returns the dotted OIDs of the EKUs requested by the CSR that are in allowed_csr_ekus, and those
+// that aren't and must be dropped.
+func getForwardedEkus(config *Config, csr *x509.CertificateRequest) ([]string, []string, error) {
+	ekus, err := getExtKeyUsages(csr.Extensions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var forwarded, dropped []string
+	for _, eku := range ekus {
+		if slices.Contains(config.allowedCSREKUs, eku) {
+			forwarded = append(forwarded, eku)
+		} else {
+			dropped = append(dropped, eku)
+		}
+	}
+	return forwarded, dropped, nil
+}
+
+// getExtKeyUsages returns the dotted OIDs in the EKU extension of extensions. The raw extension is parsed, since Go
+// only models the EKUs it recognizes.
+func getExtKeyUsages(extensions []pkix.Extension) ([]string, error) {
+	var oids []string
+	for _, ext := range extensions {
+		if !ext.Id.Equal(oidExtensionExtKeyUsage) {
+			continue
+		}
+
+		var ekus []asn1.ObjectIdentifier
+		if rest, err := asn1.Unmarshal(ext.Value, &ekus); err != nil {
+			return nil, fmt.Errorf("failed to parse EKU extension: %w", err)
+		} else if len(rest) != 0 {
+			return nil, fmt.Errorf("trailing data after EKU extension")
+		}
+		for _, eku := range ekus {
+			oids = append(oids, eku.String())
+		}
+	}
+	return oids, nil
+}
+
+// certificationRequestInfo is the PKCS#10 CertificationRequestInfo, parsed far enough to reach its attributes.
+type certificationRequestInfo struct {
+	Version       int
+	Subject       asn1.RawValue
+	PublicKey     asn1.RawValue
+	RawAttributes []asn1.RawValue `asn1:"tag:0"`
+}
+
+// csrAttribute is a PKCS#10 Attribute.
+type csrAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// getChallengePassword returns the challengePassword attribute of csr, which x509.CertificateRequest doesn't
+// expose. The returned bool is false if the CSR has no challenge password.
+func getChallengePassword(csr *x509.CertificateRequest) (string, bool, error) {
+	var info certificationRequestInfo
+	if _, err := asn1.Unmarshal(csr.RawTBSCertificateRequest, &info); err != nil {
+		return "", false, fmt.Errorf("failed to parse CSR attributes: %w", err)
+	}
+
+	for _, rawAttribute := range info.RawAttributes {
+		var attribute csrAttribute
+		if _, err := asn1.Unmarshal(rawAttribute.FullBytes, &attribute); err != nil {
+			return "", false, fmt.Errorf("failed to parse CSR attribute: %w", err)
+		}
+		if !attribute.Type.Equal(oidChallengePassword) {
+			continue
+		}
+		if len(attribute.Values) != 1 {
+			return "", false, fmt.Errorf("challengePassword attribute has %d values, expected 1", len(attribute.Values))
+		}
+
+		var password string
+		if _, err := asn1.Unmarshal(attribute.Values[0].FullBytes, &password); err != nil {
+			return "", false, fmt.Errorf("failed to parse challengePassword attribute: %w", err)
+		}
+		return password, password != "", nil
+	}
+	return "", false, nil
+}
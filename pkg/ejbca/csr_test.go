@@ -0,0 +1,641 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"net/url"
+	"testing"
+	"time"
+
+	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
+	"github.com/spiffe/spire/test/spiretest"
+	"github.com/spiffe/spire/test/testkey"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestSpiffeOnlySans(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		spiffeOnlySANs bool
+		dnsNames       []string
+		uris           []string
+		ips            []string
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:             "spiffe_only",
+			spiffeOnlySANs:   true,
+			uris:             []string{"spiffe://example.org"},
+			expectedgRPCCode: codes.OK,
+		},
+		{
+			name:                  "extra_dns_san",
+			spiffeOnlySANs:        true,
+			dnsNames:              []string{"reddog.example.com"},
+			uris:                  []string{"spiffe://example.org"},
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "upstreamauthority(ejbca): CSR violates spiffe_only_sans: expected exactly one SAN, found 2",
+		},
+		{
+			name:                  "extra_ip_san",
+			spiffeOnlySANs:        true,
+			uris:                  []string{"spiffe://example.org"},
+			ips:                   []string{"192.168.1.1"},
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "upstreamauthority(ejbca): CSR violates spiffe_only_sans: expected exactly one SAN, found 2",
+		},
+		{
+			name:                  "non_spiffe_uri",
+			spiffeOnlySANs:        true,
+			uris:                  []string{"https://blueelephant.example.com"},
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "upstreamauthority(ejbca): CSR violates spiffe_only_sans: the SAN must be a spiffe:// URI",
+		},
+		{
+			name:             "disabled",
+			spiffeOnlySANs:   false,
+			dnsNames:         []string{"reddog.example.com"},
+			uris:             []string{"spiffe://example.org"},
+			ips:              []string{"192.168.1.1"},
+			expectedgRPCCode: codes.OK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := newFakeEnrollServer(t, nil)
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				SPIFFEOnlySANs: tt.spiffeOnlySANs,
+			})
+
+			csr, err := generateCSR("", tt.dnsNames, tt.uris, tt.ips)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+		})
+	}
+}
+
+func TestAllowedTrustDomains(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		allowedTrustDomains []string
+		uris                []string
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:                "allowed",
+			allowedTrustDomains: []string{"example.org", "example.com"},
+			uris:                []string{"spiffe://example.com"},
+			expectedgRPCCode:    codes.OK,
+		},
+		{
+			name:                  "disallowed",
+			allowedTrustDomains:   []string{"example.org"},
+			uris:                  []string{"spiffe://evil.example.net"},
+			expectedgRPCCode:      codes.PermissionDenied,
+			expectedMessagePrefix: "upstreamauthority(ejbca): trust domain \"evil.example.net\" is not in allowed_trust_domains",
+		},
+		{
+			name:                  "no_spiffe_id",
+			allowedTrustDomains:   []string{"example.org"},
+			uris:                  []string{"https://example.org"},
+			expectedgRPCCode:      codes.PermissionDenied,
+			expectedMessagePrefix: "upstreamauthority(ejbca): unable to determine trust domain of CSR: CSR does not contain a SPIFFE ID URI SAN",
+		},
+		{
+			name:             "unrestricted",
+			uris:             []string{"spiffe://evil.example.net"},
+			expectedgRPCCode: codes.OK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := newFakeEnrollServer(t, nil)
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				AllowedTrustDomains: tt.allowedTrustDomains,
+			})
+
+			csr, err := generateCSR("", nil, tt.uris, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+		})
+	}
+}
+
+func TestTrustDomain(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		trustDomain string
+		uris        []string
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:             "matching",
+			trustDomain:      "example.org",
+			uris:             []string{"https://example.com", "spiffe://example.org"},
+			expectedgRPCCode: codes.OK,
+		},
+		{
+			name:                  "mismatched",
+			trustDomain:           "example.org",
+			uris:                  []string{"spiffe://evil.example.net"},
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "upstreamauthority(ejbca): CSR has no SPIFFE ID URI SAN in trust domain \"example.org\"",
+		},
+		{
+			name:                  "no_spiffe_id",
+			trustDomain:           "example.org",
+			uris:                  []string{"https://example.org"},
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "upstreamauthority(ejbca): CSR has no SPIFFE ID URI SAN in trust domain \"example.org\"",
+		},
+		{
+			name:             "unset",
+			uris:             []string{"spiffe://evil.example.net"},
+			expectedgRPCCode: codes.OK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := newFakeEnrollServer(t, nil)
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				TrustDomain: tt.trustDomain,
+			})
+
+			csr, err := generateCSR("", nil, tt.uris, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+		})
+	}
+}
+
+func TestMaxCsrBytes(t *testing.T) {
+	var enrollCount int
+	testServer := newFakeEnrollServer(t, func(*ejbcaclient.EnrollCertificateRestRequest) {
+		enrollCount++
+	})
+	defer testServer.Close()
+
+	_, ua := loadTestPlugin(t, testServer, &Config{
+		MaxCSRBytes: 4096,
+	})
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+	require.LessOrEqual(t, len(csr.Raw), 4096)
+
+	_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+	require.NoError(t, err)
+	require.Equal(t, 1, enrollCount)
+
+	// The oversized CSR isn't valid DER, so only the size check can reject it with this message
+	_, _, _, err = ua.MintX509CA(context.Background(), make([]byte, 1<<20), 30*time.Second)
+	spiretest.RequireGRPCStatus(t, err, codes.InvalidArgument, "upstreamauthority(ejbca): CSR is 1048576 bytes, which exceeds max_csr_bytes of 4096")
+	require.Equal(t, 1, enrollCount)
+}
+
+func TestForwardCsrEku(t *testing.T) {
+	serverAuth := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1}
+	clientAuth := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 2}
+
+	for _, tt := range []struct {
+		name string
+
+		forwardCSREKU  bool
+		allowedCSREKUs []string
+		ekus           []asn1.ObjectIdentifier
+
+		expectedEkus any
+	}{
+		{
+			name:           "allowed",
+			forwardCSREKU:  true,
+			allowedCSREKUs: []string{"serverAuth", "1.3.6.1.5.5.7.3.2"},
+			ekus:           []asn1.ObjectIdentifier{serverAuth, clientAuth},
+			expectedEkus:   []any{"1.3.6.1.5.5.7.3.1", "1.3.6.1.5.5.7.3.2"},
+		},
+		{
+			name:           "not_allowed_dropped",
+			forwardCSREKU:  true,
+			allowedCSREKUs: []string{"clientAuth"},
+			ekus:           []asn1.ObjectIdentifier{serverAuth, clientAuth},
+			expectedEkus:   []any{"1.3.6.1.5.5.7.3.2"},
+		},
+		{
+			name:           "none_allowed",
+			forwardCSREKU:  true,
+			allowedCSREKUs: []string{"codeSigning"},
+			ekus:           []asn1.ObjectIdentifier{serverAuth},
+		},
+		{
+			name:          "disabled",
+			forwardCSREKU: false,
+			ekus:          []asn1.ObjectIdentifier{serverAuth},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var ekus any
+			testServer := newFakeEnrollServer(t, func(req *ejbcaclient.EnrollCertificateRestRequest) {
+				ekus = req.AdditionalProperties["extended_key_usages"]
+			})
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				ForwardCSREKU:  tt.forwardCSREKU,
+				AllowedCSREKUs: tt.allowedCSREKUs,
+			})
+
+			ekuExtension, err := asn1.Marshal(tt.ekus)
+			require.NoError(t, err)
+			csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+				Subject: pkix.Name{CommonName: "Fake-SPIRE-CA"},
+				URIs:    []*url.URL{{Scheme: "spiffe", Host: "example.org"}},
+				ExtraExtensions: []pkix.Extension{
+					{Id: oidExtensionExtKeyUsage, Value: ekuExtension},
+				},
+			}, testkey.NewEC256(t))
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr, 30*time.Second)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedEkus, ekus)
+		})
+	}
+}
+
+func TestForwardCsrSans(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		forwardCSRSANs bool
+		sanEncoding    map[string]string
+		dnsNames       []string
+
+		expectedSubjectAltName any
+	}{
+		{
+			name:                   "uri_encoded_as_uri",
+			forwardCSRSANs:         true,
+			expectedSubjectAltName: "uniformResourceIdentifier=spiffe://example.org",
+		},
+		{
+			name:                   "dns_and_uri",
+			forwardCSRSANs:         true,
+			dnsNames:               []string{"spire.example.org"},
+			expectedSubjectAltName: "dNSName=spire.example.org, uniformResourceIdentifier=spiffe://example.org",
+		},
+		{
+			name:                   "san_encoding_override",
+			forwardCSRSANs:         true,
+			sanEncoding:            map[string]string{"uri": "uri"},
+			expectedSubjectAltName: "uri=spiffe://example.org",
+		},
+		{
+			name:           "disabled",
+			forwardCSRSANs: false,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var subjectAltName any
+			testServer := newFakeEnrollServer(t, func(req *ejbcaclient.EnrollCertificateRestRequest) {
+				subjectAltName = req.AdditionalProperties["subject_alt_name"]
+			})
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				ForwardCSRSANs: tt.forwardCSRSANs,
+				SANEncoding:    tt.sanEncoding,
+			})
+
+			csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+				Subject:  pkix.Name{CommonName: "Fake-SPIRE-CA"},
+				DNSNames: tt.dnsNames,
+				URIs:     []*url.URL{{Scheme: "spiffe", Host: "example.org"}},
+			}, testkey.NewEC256(t))
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr, 30*time.Second)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedSubjectAltName, subjectAltName)
+		})
+	}
+}
+
+func TestRejectUnknownCriticalExtensions(t *testing.T) {
+	unknownExtension := pkix.Extension{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}, Value: []byte{0x05, 0x00}}
+
+	for _, tt := range []struct {
+		name string
+
+		rejectUnknownCriticalExtensions bool
+		critical                        bool
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:                            "unknown_critical",
+			rejectUnknownCriticalExtensions: true,
+			critical:                        true,
+			expectedgRPCCode:                codes.InvalidArgument,
+			expectedMessagePrefix:           "upstreamauthority(ejbca): CSR has unrecognized critical extension 1.3.6.1.4.1.99999.1",
+		},
+		{
+			name:                            "unknown_non_critical",
+			rejectUnknownCriticalExtensions: true,
+			expectedgRPCCode:                codes.OK,
+		},
+		{
+			name:             "disabled",
+			critical:         true,
+			expectedgRPCCode: codes.OK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := newFakeEnrollServer(t, nil)
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				RejectUnknownCriticalExtensions: tt.rejectUnknownCriticalExtensions,
+			})
+
+			extension := unknownExtension
+			extension.Critical = tt.critical
+			csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+				Subject:         pkix.Name{CommonName: "Fake-SPIRE-CA"},
+				URIs:            []*url.URL{{Scheme: "spiffe", Host: "example.org"}},
+				ExtraExtensions: []pkix.Extension{extension},
+			}, testkey.NewEC256(t))
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+		})
+	}
+}
+
+func TestAllowedCsrAlgorithms(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		allowedCSRAlgorithms []string
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:                 "rsa_pss_allowed_by_signature_algorithm",
+			allowedCSRAlgorithms: []string{"SHA256-RSAPSS"},
+			expectedgRPCCode:     codes.OK,
+		},
+		{
+			name:                 "rsa_pss_allowed_by_public_key_algorithm",
+			allowedCSRAlgorithms: []string{"rsa"},
+			expectedgRPCCode:     codes.OK,
+		},
+		{
+			name:                  "rsa_pss_disallowed",
+			allowedCSRAlgorithms:  []string{"SHA256-RSA", "ECDSA"},
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "upstreamauthority(ejbca): CSR signature algorithm SHA256-RSAPSS with public key algorithm RSA is not in allowed_csr_algorithms",
+		},
+		{
+			name:             "unrestricted",
+			expectedgRPCCode: codes.OK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := newFakeEnrollServer(t, nil)
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				AllowedCSRAlgorithms: tt.allowedCSRAlgorithms,
+			})
+
+			csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+				Subject:            pkix.Name{CommonName: "Fake-SPIRE-CA"},
+				URIs:               []*url.URL{{Scheme: "spiffe", Host: "example.org"}},
+				SignatureAlgorithm: x509.SHA256WithRSAPSS,
+			}, testkey.NewRSA2048(t))
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+		})
+	}
+}
+
+func TestRequestFormat(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		requestFormat string
+
+		expectedFormatField any
+		expectCrmf          bool
+	}{
+		{
+			name: "default",
+		},
+		{
+			name:                "pkcs10",
+			requestFormat:       "pkcs10",
+			expectedFormatField: "PKCS10",
+		},
+		{
+			name:                "crmf",
+			requestFormat:       "crmf",
+			expectedFormatField: "CRMF",
+			expectCrmf:          true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var formatField any
+			var certificateRequest string
+			testServer := newFakeEnrollServer(t, func(req *ejbcaclient.EnrollCertificateRestRequest) {
+				formatField = req.AdditionalProperties["certificate_request_format"]
+				certificateRequest = req.GetCertificateRequest()
+			})
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				RequestFormat: tt.requestFormat,
+			})
+
+			csrDer, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+				Subject: pkix.Name{CommonName: "Fake-SPIRE-CA"},
+				URIs:    []*url.URL{{Scheme: "spiffe", Host: "example.org"}},
+			}, testkey.NewEC256(t))
+			require.NoError(t, err)
+			csr, err := x509.ParseCertificateRequest(csrDer)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csrDer, 30*time.Second)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedFormatField, formatField)
+
+			if !tt.expectCrmf {
+				require.Equal(t, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDer})), certificateRequest)
+				return
+			}
+
+			der, err := base64.StdEncoding.DecodeString(certificateRequest)
+			require.NoError(t, err)
+			var msgs []crmfCertReqMsg
+			rest, err := asn1.Unmarshal(der, &msgs)
+			require.NoError(t, err)
+			require.Empty(t, rest)
+			require.Len(t, msgs, 1)
+
+			template := msgs[0].CertReq.CertTemplate
+			require.Equal(t, 5, template.Subject.Tag)
+			require.Equal(t, csr.RawSubject, template.Subject.Bytes)
+			require.Equal(t, 6, template.PublicKey.Tag)
+			publicKey, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: template.PublicKey.Bytes})
+			require.NoError(t, err)
+			require.Equal(t, csr.RawSubjectPublicKeyInfo, publicKey)
+			require.Equal(t, 9, template.Extensions.Tag)
+			require.Equal(t, 0, msgs[0].Popo.Tag)
+			require.Empty(t, msgs[0].Popo.Bytes)
+		})
+	}
+}
+
+func TestUseCsrChallengePassword(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		useCSRChallengePassword bool
+		challengePassword       string
+
+		expectChallengePassword bool
+	}{
+		{
+			name:                    "used",
+			useCSRChallengePassword: true,
+			challengePassword:       "profile-secret",
+			expectChallengePassword: true,
+		},
+		{
+			name:                    "absent",
+			useCSRChallengePassword: true,
+		},
+		{
+			name:              "disabled",
+			challengePassword: "profile-secret",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var password string
+			testServer := newFakeEnrollServer(t, func(req *ejbcaclient.EnrollCertificateRestRequest) {
+				password = req.GetPassword()
+			})
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				UseCSRChallengePassword: tt.useCSRChallengePassword,
+			})
+
+			csr := createCSRWithChallengePassword(t, tt.challengePassword)
+
+			_, _, _, err := ua.MintX509CA(context.Background(), csr, 30*time.Second)
+			require.NoError(t, err)
+			if tt.expectChallengePassword {
+				require.Equal(t, tt.challengePassword, password)
+			} else {
+				require.NotEmpty(t, password)
+				require.NotEqual(t, tt.challengePassword, password)
+			}
+		})
+	}
+}
+
+// createCSRWithChallengePassword returns a DER-encoded CSR for spiffe://example.org carrying challengePassword as
+// its challengePassword attribute, or no such attribute if challengePassword is empty. x509.CreateCertificateRequest
+// can't encode the attribute, so it's added to the TBS of a generated CSR, which is then signed again.
+func createCSRWithChallengePassword(t *testing.T, challengePassword string) []byte {
+	key := testkey.NewEC256(t)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "Fake-SPIRE-CA"},
+		URIs:    []*url.URL{{Scheme: "spiffe", Host: "example.org"}},
+	}, key)
+	require.NoError(t, err)
+	if challengePassword == "" {
+		return der
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	require.NoError(t, err)
+	var info certificationRequestInfo
+	_, err = asn1.Unmarshal(csr.RawTBSCertificateRequest, &info)
+	require.NoError(t, err)
+
+	value, err := asn1.MarshalWithParams(challengePassword, "utf8")
+	require.NoError(t, err)
+	attribute, err := asn1.Marshal(csrAttribute{Type: oidChallengePassword, Values: []asn1.RawValue{{FullBytes: value}}})
+	require.NoError(t, err)
+	info.RawAttributes = append(info.RawAttributes, asn1.RawValue{FullBytes: attribute})
+
+	tbs, err := asn1.Marshal(info)
+	require.NoError(t, err)
+	digest := sha256.Sum256(tbs)
+	signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	require.NoError(t, err)
+
+	der, err = asn1.Marshal(struct {
+		TBS                asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		Signature          asn1.BitString
+	}{
+		TBS:                asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+		Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	})
+	require.NoError(t, err)
+
+	csr, err = x509.ParseCertificateRequest(der)
+	require.NoError(t, err)
+	require.NoError(t, csr.CheckSignature())
+	return der
+}
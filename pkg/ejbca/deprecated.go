@@ -0,0 +1,80 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/hashicorp/hcl/hcl/token"
+)
+
+// deprecatedFieldNames maps legacy top-level configuration field names to the names that replaced them. Legacy
+// names are still accepted, but a warning is logged when they're used.
+var deprecatedFieldNames = map[string]string{
+	"default_end_entity_name": "end_entity_name",
+}
+
+// renameDeprecatedFields rewrites deprecated field names in the parsed configuration to their replacements, logging
+// a warning for each. Setting both a deprecated field and its replacement is an error.
+func renameDeprecatedFields(logger hclog.Logger, file *ast.File) error {
+	list, ok := file.Node.(*ast.ObjectList)
+	if !ok {
+		return nil
+	}
+
+	present := make(map[string]bool)
+	for _, item := range list.Items {
+		if name, ok := itemName(item); ok {
+			present[name] = true
+		}
+	}
+
+	for _, item := range list.Items {
+		name, ok := itemName(item)
+		if !ok {
+			continue
+		}
+		replacement, ok := deprecatedFieldNames[name]
+		if !ok {
+			continue
+		}
+		if present[replacement] {
+			return fmt.Errorf("%s is deprecated and can't be set together with %s", name, replacement)
+		}
+
+		logger.Warn(fmt.Sprintf("%s is deprecated; use %s instead", name, replacement), "field", name, "replacement", replacement)
+		item.Keys[0].Token = token.Token{
+			Type: token.STRING,
+			Pos:  item.Keys[0].Token.Pos,
+			Text: strconv.Quote(replacement),
+			JSON: item.Keys[0].Token.JSON,
+		}
+	}
+	return nil
+}
+
+// itemName returns the name of a configuration field.
+func itemName(item *ast.ObjectItem) (string, bool) {
+	if len(item.Keys) == 0 {
+		return "", false
+	}
+	name, ok := item.Keys[0].Token.Value().(string)
+	return name, ok
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spiffe/spire/pkg/server/plugin/upstreamauthority"
+	"github.com/spiffe/spire/test/plugintest"
+	"github.com/spiffe/spire/test/spiretest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestDeprecatedFieldNames(t *testing.T) {
+	_, _, svidIssuingCA, svidIssuingCAKey := issueTestCertificates(t)
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: svidIssuingCA.Raw})
+	keyByte, err := x509.MarshalECPrivateKey(svidIssuingCAKey)
+	require.NoError(t, err)
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyByte})
+
+	for _, tt := range []struct {
+		name   string
+		fields string
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+		expectedEndEntityName string
+		expectedWarning       string
+	}{
+		{
+			name:                  "current_name",
+			fields:                `end_entity_name = "cn"`,
+			expectedEndEntityName: "cn",
+		},
+		{
+			name:                  "deprecated_name",
+			fields:                `default_end_entity_name = "cn"`,
+			expectedEndEntityName: "cn",
+			expectedWarning:       "default_end_entity_name is deprecated; use end_entity_name instead",
+		},
+		{
+			name: "both_names",
+			fields: `default_end_entity_name = "cn"
+            end_entity_name = "dns"`,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "invalid configuration: default_end_entity_name is deprecated and can't be set together with end_entity_name",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			log, logHook := test.NewNullLogger()
+			p := New()
+
+			var err error
+			plugintest.Load(t, builtin(p), new(upstreamauthority.V1),
+				plugintest.Log(log),
+				plugintest.CaptureConfigureError(&err),
+				plugintest.Configure(fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            %s
+            `, certPem, keyPem, tt.fields)),
+			)
+			if tt.expectedgRPCCode != codes.OK {
+				spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+				return
+			}
+			require.NoError(t, err)
+
+			config, err := p.getConfig()
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedEndEntityName, config.DefaultEndEntityName)
+
+			var warnings []string
+			for _, entry := range logHook.AllEntries() {
+				if entry.Level == logrus.WarnLevel {
+					warnings = append(warnings, entry.Message)
+				}
+			}
+			if tt.expectedWarning != "" {
+				require.Equal(t, []string{tt.expectedWarning}, warnings)
+			} else {
+				require.Empty(t, warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	upstreamauthorityv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/upstreamauthority/v1"
+	configv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/service/common/config/v1"
+	"google.golang.org/grpc"
+)
+
+const (
+	// Statuses of a DiagnosticResult
+	DiagnosticPass = "PASS"
+	DiagnosticFail = "FAIL"
+	DiagnosticSkip = "SKIP"
+
+	// certificateProfilePath and endEntityProfilePath are the paths of the EJBCA REST endpoints that describe a
+	// certificate profile and an end entity profile by name
+	certificateProfilePath = "/ejbca/ejbca-rest-api/v2/certificate/profile/"
+	endEntityProfilePath   = "/ejbca/ejbca-rest-api/v2/endentity/profile/"
+)
+
+// DiagnosticResult is the outcome of a single check run by Diagnose.
+type DiagnosticResult struct {
+	// Check names the check, such as hostname or tls
+	Check string
+	// Status is one of DiagnosticPass, DiagnosticFail, or DiagnosticSkip
+	Status  string
+	Message string
+}
+
+// diagnosticChecks are the checks run by Diagnose, in order.
+var diagnosticChecks = []string{"config", "hostname", "tls", "auth", "ca", "end_entity_profile", "certificate_profile", "mint"}
+
+// diagnosticReport accumulates the results of Diagnose, one for each of diagnosticChecks in order.
+type diagnosticReport struct {
+	results []DiagnosticResult
+	failed  string
+}
+
+func (r *diagnosticReport) pass(check string, format string, args ...interface{}) {
+	r.results = append(r.results, DiagnosticResult{Check: check, Status: DiagnosticPass, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *diagnosticReport) fail(check string, format string, args ...interface{}) {
+	r.results = append(r.results, DiagnosticResult{Check: check, Status: DiagnosticFail, Message: fmt.Sprintf(format, args...)})
+	if r.failed == "" {
+		r.failed = check
+	}
+}
+
+// skipRemaining skips the checks that don't have a result yet, since they depend on the check that failed.
+func (r *diagnosticReport) skipRemaining() []DiagnosticResult {
+	for _, check := range diagnosticChecks[len(r.results):] {
+		r.results = append(r.results, DiagnosticResult{Check: check, Status: DiagnosticSkip, Message: fmt.Sprintf("skipped because %s failed", r.failed)})
+	}
+	return r.results
+}
+
+// Diagnose validates hclConfiguration, the plugin_data of the EJBCA UpstreamAuthority plugin, against the EJBCA
+// instance it names, and returns a result for each of the following checks, in order:
+//   - config: the configuration is valid and its credentials can be loaded
+//   - hostname: the EJBCA hostname resolves and accepts connections
+//   - tls: EJBCA's server certificate is trusted
+//   - auth: EJBCA accepts the configured credentials
+//   - ca: the CA named by ca_name exists
+//   - end_entity_profile and certificate_profile: the configured profiles exist
+//   - mint: EJBCA issues a CA certificate for a CSR with the SPIFFE ID of trustDomain, which is skipped if
+//     trustDomain is empty. Kafka and Kubernetes outputs aren't written to, and Prometheus metrics aren't served.
+//
+// Checks that depend on a failed check are skipped. Diagnose configures the plugin, so it's meant to be called on a
+// Plugin that isn't otherwise in use.
+func (p *Plugin) Diagnose(ctx context.Context, hclConfiguration string, trustDomain string) []DiagnosticResult {
+	p.diagnosing = true
+	report := &diagnosticReport{}
+	configureRequest := &configv1.ConfigureRequest{
+		HclConfiguration:  hclConfiguration,
+		CoreConfiguration: &configv1.CoreConfiguration{TrustDomain: trustDomain},
+	}
+
+	config, err := p.parseConfig(configureRequest)
+	if err != nil {
+		report.fail("config", "%v", err)
+		return report.skipRemaining()
+	}
+	authenticator, err := p.hooks.newAuthenticator(config)
+	if err != nil {
+		report.fail("config", "failed to load credentials: %v", err)
+		return report.skipRemaining()
+	}
+	httpClient, err := authenticator.GetHTTPClient()
+	if err != nil {
+		report.fail("config", "failed to get HTTP client: %v", err)
+		return report.skipRemaining()
+	}
+	client, err := p.newEjbcaClient(config, authenticator)
+	if err != nil {
+		report.fail("config", "failed to create EJBCA client: %v", err)
+		return report.skipRemaining()
+	}
+	report.pass("config", "configuration is valid")
+
+	baseURL, err := ejbcaBaseURL(config.Hostname)
+	if err != nil {
+		report.fail("hostname", "%v", err)
+		return report.skipRemaining()
+	}
+	address := baseURL.Host
+	if baseURL.Port() == "" {
+		address = net.JoinHostPort(baseURL.Hostname(), "443")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		report.fail("hostname", "failed to connect to %s: %v", address, err)
+		return report.skipRemaining()
+	}
+	conn.Close()
+	report.pass("hostname", "connected to %s", address)
+
+	cas, httpResponse, err := client.ListCas(ctx).Execute()
+	if httpResponse != nil && httpResponse.Body != nil {
+		httpResponse.Body.Close()
+	}
+	switch {
+	case err != nil && isCertificateVerificationError(err):
+		report.fail("tls", "EJBCA's server certificate is not trusted: %v", err)
+		return report.skipRemaining()
+	case err != nil:
+		report.pass("tls", "EJBCA's server certificate is trusted")
+		if httpResponse != nil {
+			report.fail("auth", "EJBCA responded to the CA listing with %s", httpResponse.Status)
+		} else {
+			report.fail("auth", "%v", err)
+		}
+		return report.skipRemaining()
+	}
+	report.pass("tls", "EJBCA's server certificate is trusted")
+	report.pass("auth", "EJBCA accepted the configured credentials")
+
+	caNames := make([]string, 0, len(cas.GetCertificateAuthorities()))
+	for _, ca := range cas.GetCertificateAuthorities() {
+		caNames = append(caNames, ca.GetName())
+	}
+	if slices.Contains(caNames, config.CAName) {
+		report.pass("ca", "CA %q exists", config.CAName)
+	} else {
+		report.fail("ca", "CA %q was not found in EJBCA (found: %s)", config.CAName, strings.Join(caNames, ", "))
+	}
+
+	for _, profile := range []struct {
+		check string
+		path  string
+		name  string
+	}{
+		{check: "end_entity_profile", path: endEntityProfilePath, name: config.EndEntityProfileName},
+		{check: "certificate_profile", path: certificateProfilePath, name: config.CertificateProfileName},
+	} {
+		profileURL := baseURL.JoinPath(profile.path, profile.name).String()
+		if err := checkEjbcaResource(ctx, httpClient, profileURL); err != nil {
+			report.fail(profile.check, "profile %q: %v", profile.name, err)
+		} else {
+			report.pass(profile.check, "profile %q exists", profile.name)
+		}
+	}
+
+	switch {
+	case report.failed != "":
+		return report.skipRemaining()
+	case trustDomain == "":
+		report.results = append(report.results, DiagnosticResult{Check: "mint", Status: DiagnosticSkip, Message: "skipped because no trust domain was given"})
+	default:
+		if n, err := p.diagnoseMint(ctx, configureRequest, trustDomain); err != nil {
+			report.fail("mint", "%v", err)
+		} else {
+			report.pass("mint", "EJBCA issued a CA certificate chain of %d certificates", n)
+		}
+	}
+	return report.results
+}
+
+// diagnoseMint configures the plugin with req and mints a CA certificate for a throwaway key with the SPIFFE ID of
+// trustDomain. It returns the length of the minted CA chain.
+func (p *Plugin) diagnoseMint(ctx context.Context, req *configv1.ConfigureRequest, trustDomain string) (int, error) {
+	if _, err := p.Configure(ctx, req); err != nil {
+		return 0, err
+	}
+	// The sample mint shouldn't be published anywhere
+	p.setKafkaPublisher(nil)
+	p.setKubernetesOutput(nil)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate key: %w", err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "spire-ejbca-diagnose"},
+		URIs:    []*url.URL{{Scheme: "spiffe", Host: trustDomain}},
+	}, key)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create CSR: %w", err)
+	}
+
+	stream := &diagnosticMintStream{ctx: ctx}
+	// The sample mint is sent once, so the upstream roots aren't polled
+	if _, err := p.mintX509CA(&upstreamauthorityv1.MintX509CARequest{Csr: csr}, stream, p.state.Load()); err != nil {
+		return 0, err
+	}
+	if stream.response == nil {
+		return 0, errors.New("no CA certificate chain was minted")
+	}
+	return len(stream.response.X509CaChain), nil
+}
+
+// diagnosticMintStream is the stream that Diagnose mints a sample CA certificate on. It records the minted chain.
+type diagnosticMintStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	response *upstreamauthorityv1.MintX509CAResponse
+}
+
+func (s *diagnosticMintStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *diagnosticMintStream) Send(response *upstreamauthorityv1.MintX509CAResponse) error {
+	s.response = response
+	return nil
+}
+
+// checkEjbcaResource requests resourceURL from EJBCA and returns an error unless EJBCA responds with 200 OK.
+func checkEjbcaResource(ctx context.Context, httpClient *http.Client, resourceURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, resourceURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errors.New("not found in EJBCA")
+	default:
+		return fmt.Errorf("EJBCA responded with %s", resp.Status)
+	}
+}
+
+// isCertificateVerificationError returns true if err was caused by a failure to verify the server's certificate.
+func isCertificateVerificationError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	return errors.As(err, &verificationErr) || errors.As(err, &unknownAuthorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnose(t *testing.T) {
+	closedListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	unreachableHostname := closedListener.Addr().String()
+	require.NoError(t, closedListener.Close())
+
+	for _, tt := range []struct {
+		name string
+
+		hostname    string
+		listedCA    string
+		trustDomain string
+
+		expectedStatuses []string
+	}{
+		{
+			name:             "all_pass",
+			listedCA:         "Fake-Sub-CA",
+			trustDomain:      "example.org",
+			expectedStatuses: []string{"PASS", "PASS", "PASS", "PASS", "PASS", "PASS", "PASS", "PASS"},
+		},
+		{
+			name:             "no_trust_domain_skips_mint",
+			listedCA:         "Fake-Sub-CA",
+			expectedStatuses: []string{"PASS", "PASS", "PASS", "PASS", "PASS", "PASS", "PASS", "SKIP"},
+		},
+		{
+			name:             "ca_not_found",
+			listedCA:         "Other-CA",
+			trustDomain:      "example.org",
+			expectedStatuses: []string{"PASS", "PASS", "PASS", "PASS", "FAIL", "PASS", "PASS", "SKIP"},
+		},
+		{
+			name:             "hostname_unreachable",
+			hostname:         unreachableHostname,
+			listedCA:         "Fake-Sub-CA",
+			trustDomain:      "example.org",
+			expectedStatuses: []string{"PASS", "FAIL", "SKIP", "SKIP", "SKIP", "SKIP", "SKIP", "SKIP"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/ejbca/ejbca-rest-api/v1/ca", func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				err := json.NewEncoder(w).Encode(map[string]any{
+					"certificate_authorities": []map[string]any{
+						{"name": tt.listedCA, "subject_dn": "CN=" + tt.listedCA},
+					},
+				})
+				require.NoError(t, err)
+			})
+			mux.HandleFunc("/ejbca/ejbca-rest-api/v2/endentity/profile/fakeSpireIntermediateCAEEP", func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_, err := w.Write([]byte(`{"profile_name":"fakeSpireIntermediateCAEEP"}`))
+				require.NoError(t, err)
+			})
+			mux.HandleFunc("/ejbca/ejbca-rest-api/v2/certificate/profile/fakeSubCACP", func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_, err := w.Write([]byte(`{"certificate_profile_name":"fakeSubCACP"}`))
+				require.NoError(t, err)
+			})
+			mux.Handle("/ejbca/ejbca-rest-api/v1/certificate/pkcs10enroll", newFakeEnrollHandler(t, nil))
+			testServer := httptest.NewTLSServer(mux)
+			defer testServer.Close()
+
+			hostname := tt.hostname
+			if hostname == "" {
+				hostname = testServer.URL
+			}
+
+			p := New()
+			p.SetLogger(hclog.Default())
+			clientConfig := fakeClientConfig{testServer: testServer}
+			p.hooks.newAuthenticator = clientConfig.newFakeAuthenticator
+
+			results := p.Diagnose(context.Background(), fmt.Sprintf(`
+            hostname = "%s"
+            cert_auth {
+                client_cert = "BEGIN CERTIFICATE ... END CERTIFICATE"
+                client_key = "BEGIN RSA PRIVATE KEY ... END RSA PRIVATE KEY"
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            `, hostname), tt.trustDomain)
+
+			var checks, statuses []string
+			for _, result := range results {
+				checks = append(checks, result.Check)
+				statuses = append(statuses, result.Status)
+				require.NotEmpty(t, result.Message, "check %s has no message", result.Check)
+			}
+			require.Equal(t, []string{"config", "hostname", "tls", "auth", "ca", "end_entity_profile", "certificate_profile", "mint"}, checks)
+			require.Equal(t, tt.expectedStatuses, statuses, "unexpected statuses: %+v", results)
+		})
+	}
+}
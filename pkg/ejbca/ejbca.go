@@ -19,22 +19,42 @@ package ejbca
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"math/big"
+	"net/http"
+	"net/url"
 	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
 	"github.com/hashicorp/go-hclog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"github.com/spiffe/spire-plugin-sdk/pluginsdk"
+	metricsv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/hostservice/common/metrics/v1"
 	upstreamauthorityv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/upstreamauthority/v1"
 	configv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/service/common/config/v1"
 	"github.com/spiffe/spire/pkg/common/catalog"
 	"github.com/spiffe/spire/pkg/common/coretypes/x509certificate"
+	"github.com/spiffe/spire/pkg/common/pemutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -43,6 +63,8 @@ var (
 	// This compile-time assertion ensures the plugin conforms properly to the
 	// pluginsdk.NeedsLogger interface.
 	_ pluginsdk.NeedsLogger = (*Plugin)(nil)
+	// pluginsdk.NeedsHostServices interface.
+	_ pluginsdk.NeedsHostServices = (*Plugin)(nil)
 )
 
 const (
@@ -52,6 +74,11 @@ const (
 type newEjbcaAuthenticatorFunc func(*Config) (ejbcaclient.Authenticator, error)
 type getEnvFunc func(string) string
 type readFileFunc func(string) ([]byte, error)
+type systemCertPoolFunc func() (*x509.CertPool, error)
+type parseCertificatesFunc func([]byte) ([]*x509.Certificate, error)
+type nowFunc func() time.Time
+type afterFunc func(time.Duration) <-chan time.Time
+type geteuidFunc func() int
 
 // Plugin implements the UpstreamAuthority plugin
 type Plugin struct {
@@ -61,18 +88,85 @@ type Plugin struct {
 	// UnimplementedConfigServer is embedded to satisfy gRPC
 	configv1.UnimplementedConfigServer
 
-	config    *Config
+	// state holds the configuration and the EJBCA client built from it. They're swapped together by Configure, and
+	// mints snapshot them once at entry so that a concurrent reconfigure can't mix old and new values within a mint.
+	// The client, along with its connections and any cached OAuth token, is reused by every mint until the next
+	// Configure.
+	state     atomic.Pointer[configState]
 	configMtx sync.RWMutex
 
 	// The logger received from the framework via the SetLogger method
 	logger hclog.Logger
 
-	client ejbcaClient
+	kafka  *kafkaPublisher
+	notify *notifySocket
+	acme   *acmeEnroller
+	binder *accountBinder
+	k8s    *kubernetesOutput
+	async  asyncBroker
+
+	// metrics is the client to SPIRE's metrics host service, brokered via BrokerHostServices
+	metrics metricsv1.MetricsServiceClient
+
+	// prometheus holds the Prometheus collectors, served by promServer if prometheus_listen_address is set
+	prometheus *prometheusMetrics
+	promServer *prometheusServer
+
+	// diagnosing is set by Diagnose so that configuring for its sample mint doesn't serve Prometheus metrics
+	diagnosing bool
+
+	// caChainCache holds the CA chain most recently parsed from ca_cert or ca_cert_path, keyed by the SHA-256
+	// hash of its PEM content, so that reconfiguring with unchanged content doesn't parse it again.
+	caChainCache struct {
+		sync.Mutex
+		hash  [sha256.Size]byte
+		chain []*x509.Certificate
+	}
+
+	// issuerChainCache holds the CA chain most recently fetched from or returned by EJBCA, along with the SHA-256
+	// fingerprint of its issuing CA certificate. It's served when an enrollment response doesn't include a chain.
+	issuerChainCache struct {
+		sync.Mutex
+		fingerprint [sha256.Size]byte
+		chain       []*x509.Certificate
+	}
+
+	// recentSerials holds the serial numbers of the most recently minted CA certificates, oldest first, so that
+	// detect_duplicate_serials can recognize a serial that EJBCA returns twice.
+	recentSerials struct {
+		sync.Mutex
+		seen  map[string]bool
+		order []string
+	}
+
+	// jwtKeys holds the JWT signing keys published through PublishJWTKeyAndSubscribe
+	jwtKeys jwtKeySet
+
+	// auditSequence is the sequence number of the most recent audit log entry
+	auditSequence atomic.Uint64
+
+	// lockedKeyType holds the public key algorithm of the first CA certificate minted since the plugin was
+	// configured, which lock_key_type requires every later mint to use.
+	lockedKeyType struct {
+		sync.Mutex
+		keyType x509.PublicKeyAlgorithm
+	}
 
 	hooks struct {
-		newAuthenticator newEjbcaAuthenticatorFunc
-		getEnv           getEnvFunc
-		readFile         readFileFunc
+		newAuthenticator  newEjbcaAuthenticatorFunc
+		getEnv            getEnvFunc
+		readFile          readFileFunc
+		systemCertPool    systemCertPoolFunc
+		newKafkaProducer  newKafkaProducerFunc
+		newAsyncBroker    newAsyncBrokerFunc
+		parseCertificates parseCertificatesFunc
+		now               nowFunc
+		after             afterFunc
+		auditLog          auditLogFunc
+		geteuid           geteuidFunc
+		// prometheusRegisterer, if set, is a registry that the Prometheus collectors are registered with
+		prometheusRegisterer prometheus.Registerer
+		tracerProvider       tracerProviderFunc
 	}
 }
 
@@ -87,6 +181,12 @@ func builtin(p *Plugin) catalog.BuiltIn {
 	)
 }
 
+// configState is a configuration of the plugin along with the EJBCA client built from it.
+type configState struct {
+	config *Config
+	client ejbcaClient
+}
+
 // Config defines the configuration for the plugin.
 type Config struct {
 	Hostname               string          `hcl:"hostname" json:"hostname"`
@@ -99,6 +199,155 @@ type Config struct {
 	CertificateProfileName string          `hcl:"certificate_profile_name" json:"certificate_profile_name"`
 	DefaultEndEntityName   string          `hcl:"end_entity_name" json:"end_entity_name"`
 	AccountBindingID       string          `hcl:"account_binding_id" json:"account_binding_id"`
+	// One of lower, upper, or preserve (default)
+	EndEntityNameCase       string `hcl:"end_entity_name_case" json:"end_entity_name_case"`
+	AllowPartialCACertChain bool   `hcl:"allow_partial_ca_cert_chain" json:"allow_partial_ca_cert_chain"`
+	Warmup                  bool   `hcl:"warmup" json:"warmup"`
+	WarmupFailOnError       bool   `hcl:"warmup_fail_on_error" json:"warmup_fail_on_error"`
+	// Fails Configure with Unavailable unless EJBCA can be reached and accepts the configured credentials
+	ValidateConnectionOnConfigure bool `hcl:"validate_connection_on_configure" json:"validate_connection_on_configure"`
+	// One of dns or uri
+	PromoteSANToCN string `hcl:"promote_san_to_cn" json:"promote_san_to_cn"`
+	SPIFFEOnlySANs bool   `hcl:"spiffe_only_sans" json:"spiffe_only_sans"`
+	// Requires cert_auth with client_cert_path and client_key_path
+	ReloadClientCertOnError bool         `hcl:"reload_client_cert_on_error" json:"reload_client_cert_on_error"`
+	Kafka                   *KafkaConfig `hcl:"kafka" json:"kafka,omitempty"`
+	// Name of a Go x509.SignatureAlgorithm, such as SHA256-RSA or ECDSA-SHA384
+	ExpectedSignatureAlgorithm string                `hcl:"expected_signature_algorithm" json:"expected_signature_algorithm"`
+	AllowedTrustDomains        []string              `hcl:"allowed_trust_domains" json:"allowed_trust_domains,omitempty"`
+	RequestSigning             *RequestSigningConfig `hcl:"request_signing" json:"request_signing,omitempty"`
+	// Go duration string, such as 30s or 2m
+	MaxEnrollmentDuration string `hcl:"max_enrollment_duration" json:"max_enrollment_duration"`
+	// Ordered end_entity_name selectors tried when end_entity_name yields no value
+	EndEntityNameFallbacks []string `hcl:"end_entity_name_fallbacks" json:"end_entity_name_fallbacks,omitempty"`
+	// Key usages, such as keyCertSign or cRLSign, that the issued CA may carry
+	AllowedKeyUsages []string `hcl:"allowed_key_usages" json:"allowed_key_usages,omitempty"`
+	// Fetches the certificate with a separate finalize call when the enrollment only returns a request ID
+	TwoPhaseEnrollment bool `hcl:"two_phase_enrollment" json:"two_phase_enrollment"`
+	// Fails the mint with FailedPrecondition instead of waiting when EJBCA holds the enrollment for approval
+	FailOnApprovalRequired bool `hcl:"fail_on_approval_required" json:"fail_on_approval_required"`
+	// Go duration string, such as 720h, after which the end entity may be purged
+	EndEntityTTLTag string `hcl:"end_entity_ttl_tag" json:"end_entity_ttl_tag"`
+	ForwardCSREKU   bool   `hcl:"forward_csr_eku" json:"forward_csr_eku"`
+	// EKU names, such as serverAuth, or dotted OIDs that forward_csr_eku may forward
+	AllowedCSREKUs []string `hcl:"allowed_csr_ekus" json:"allowed_csr_ekus,omitempty"`
+	// EKU names, such as serverAuth, or dotted OIDs that the EJBCA server certificate must carry
+	RequireServerEKU                []string `hcl:"require_server_eku" json:"require_server_eku,omitempty"`
+	RejectUnknownCriticalExtensions bool     `hcl:"reject_unknown_critical_extensions" json:"reject_unknown_critical_extensions"`
+	ResetEndEntityStatus            bool     `hcl:"reset_end_entity_status" json:"reset_end_entity_status"`
+	// One of hclog or kv
+	EventLogFormat string       `hcl:"event_log_format" json:"event_log_format"`
+	Retry          *RetryConfig `hcl:"retry" json:"retry,omitempty"`
+	// One of full (default), trust-domain-only, or path-only
+	SpiffeNameScope string `hcl:"spiffe_name_scope" json:"spiffe_name_scope"`
+	// Removes the spiffe:// scheme from end entity names taken from a SPIFFE ID
+	StripSpiffeScheme bool `hcl:"strip_spiffe_scheme" json:"strip_spiffe_scheme"`
+	// Response formats, such as PEM or DER, that are accepted from EJBCA. Defaults to PEM and DER.
+	AcceptedResponseFormats []string `hcl:"accepted_response_formats" json:"accepted_response_formats,omitempty"`
+	// Hex-encoded SHA-256 fingerprint that the certificate of the CA named by ca_name must have. It pins the CA,
+	// but enrollment still selects the CA by ca_name.
+	PinnedCAFingerprint string `hcl:"pinned_ca_fingerprint" json:"pinned_ca_fingerprint"`
+	ForwardCSRSANs      bool   `hcl:"forward_csr_sans" json:"forward_csr_sans"`
+	// EJBCA names, such as uniformResourceIdentifier, keyed by dns, uri, ip, or email
+	SANEncoding map[string]string `hcl:"san_encoding" json:"san_encoding,omitempty"`
+	// Strips control characters and invalid UTF-8 from the end entity name
+	SanitizeEndEntityName bool `hcl:"sanitize_end_entity_name" json:"sanitize_end_entity_name"`
+	// pathLenConstraint that the issued CA certificate must carry
+	RequirePathLen *int `hcl:"require_path_len" json:"require_path_len,omitempty"`
+	// One of rest (default), acme, or async_broker
+	EnrollmentProtocol string             `hcl:"enrollment_protocol" json:"enrollment_protocol"`
+	Acme               *AcmeConfig        `hcl:"acme" json:"acme,omitempty"`
+	AsyncBroker        *AsyncBrokerConfig `hcl:"async_broker" json:"async_broker,omitempty"`
+	// Version of the EJBCA REST API that rest enrollments use, v1 (default) or v2. v2 requires EJBCA 8.x.
+	APIVersion string `hcl:"api_version" json:"api_version"`
+	// Gzips request bodies larger than 1 KiB
+	CompressRequests bool `hcl:"compress_requests" json:"compress_requests"`
+	// One of pkcs10 (default) or crmf
+	RequestFormat string `hcl:"request_format" json:"request_format"`
+	// One of derive or create. Derives account_binding_id from the trust domain, creating the binding with create.
+	AutoAccountBinding string `hcl:"auto_account_binding" json:"auto_account_binding"`
+	// One of warn or error
+	DetectDuplicateSerials string `hcl:"detect_duplicate_serials" json:"detect_duplicate_serials"`
+	// Logs a dns, connect, tls, token, and enroll timing breakdown of each enrollment at debug level
+	TraceTiming      bool                    `hcl:"trace_timing" json:"trace_timing"`
+	KubernetesOutput *KubernetesOutputConfig `hcl:"kubernetes_output" json:"kubernetes_output,omitempty"`
+	// Uses the challengePassword attribute of the CSR, if present, as the enrollment password
+	UseCSRChallengePassword bool `hcl:"use_csr_challenge_password" json:"use_csr_challenge_password"`
+	// Hex-encoded SHA-256 fingerprints that every intermediate CA in the returned chain must match one of
+	ExpectedIntermediateFingerprints []string `hcl:"expected_intermediate_fingerprints" json:"expected_intermediate_fingerprints,omitempty"`
+	// Signature algorithms, such as SHA256-RSAPSS, or public key algorithms, such as ECDSA, that the CSR may use
+	AllowedCSRAlgorithms []string `hcl:"allowed_csr_algorithms" json:"allowed_csr_algorithms,omitempty"`
+	// Strips a single trailing dot from end entity names taken from a DNS SAN
+	NormalizeDNSNames bool `hcl:"normalize_dns_names" json:"normalize_dns_names"`
+	// Fails the mint if its metrics can't be recorded
+	StrictTelemetry bool `hcl:"strict_telemetry" json:"strict_telemetry"`
+	// Fails Configure if the plugin runs with an effective UID of 0. Has no effect on Windows.
+	RefuseRoot bool `hcl:"refuse_root" json:"refuse_root"`
+	// If "increment", enrollments rejected because the end entity name exists are retried with a numeric suffix
+	EndEntityNameCollision string `hcl:"end_entity_name_collision" json:"end_entity_name_collision"`
+	// Replaces the account binding ID with a hash of it in logs and errors
+	RedactAccountBindingID bool `hcl:"redact_account_binding_id" json:"redact_account_binding_id"`
+	// Delays requests until X-RateLimit-Reset once X-RateLimit-Remaining drops below this value. 0 disables throttling.
+	RateLimitThreshold int `hcl:"rate_limit_threshold" json:"rate_limit_threshold"`
+	// Dot-separated path, such as data, to the EJBCA fields within responses that a gateway wraps in an envelope
+	ResponseEnvelopePath string                 `hcl:"response_envelope_path" json:"response_envelope_path"`
+	AuditLogSigning      *AuditLogSigningConfig `hcl:"audit_log_signing" json:"audit_log_signing,omitempty"`
+	// Name of the extension_data entry that receives the trust domain of the CSR's SPIFFE ID
+	TrustDomainExtensionData string `hcl:"trust_domain_extension_data" json:"trust_domain_extension_data"`
+	// How an rdn: or serialnumber end entity name selector handles a DN with several values of the attribute: first,
+	// join, or error. Defaults to first.
+	RDNMultipleValues string `hcl:"rdn_multiple_values" json:"rdn_multiple_values"`
+	// Logs which selector and CSR field produced each end entity name at trace level
+	LogEndEntityNameDecisions bool `hcl:"log_end_entity_name_decisions" json:"log_end_entity_name_decisions"`
+	// Rejects mints whose key type differs from that of the first CA certificate minted since Configure
+	LockKeyType bool `hcl:"lock_key_type" json:"lock_key_type"`
+	// http, https, socks5, or socks5h URL of a proxy through which EJBCA is reached
+	ProxyURL string `hcl:"proxy_url" json:"proxy_url"`
+	// Builds the CA chain from the AIA CA Issuers URLs of the issued CA when EJBCA returns none and none is cached
+	FollowAIA bool `hcl:"follow_aia" json:"follow_aia"`
+	// Connection pool and handshake settings of the HTTP transport to EJBCA. Defaults apply when unset.
+	Transport *TransportConfig `hcl:"transport" json:"transport,omitempty"`
+	// Go duration strings. After http2_read_idle_timeout without frames on an HTTP/2 connection to EJBCA, a ping is
+	// sent, and the connection is closed if the ping isn't answered within http2_ping_timeout.
+	HTTP2ReadIdleTimeout string `hcl:"http2_read_idle_timeout" json:"http2_read_idle_timeout"`
+	HTTP2PingTimeout     string `hcl:"http2_ping_timeout" json:"http2_ping_timeout"`
+	// Path to a JSON schema that REST enrollment requests must validate against before they're sent
+	RequestSchemaFile string `hcl:"request_schema_file" json:"request_schema_file"`
+	// Largest CSR, in DER bytes, accepted by MintX509CA. Larger CSRs are rejected before parsing. 0 disables the limit.
+	MaxCSRBytes int `hcl:"max_csr_bytes" json:"max_csr_bytes"`
+	// Directory to which each upstream root not seen before is written, named by its SHA-256 fingerprint
+	RootsArchiveDir string `hcl:"roots_archive_dir" json:"roots_archive_dir"`
+	// Path of a Unix socket on which each mint's chain and upstream roots are written as a JSON line to connected clients
+	NotifySocket string `hcl:"notify_socket" json:"notify_socket"`
+	// host:port, such as :9090, on which Prometheus metrics are served at /metrics
+	PrometheusListenAddress string `hcl:"prometheus_listen_address" json:"prometheus_listen_address"`
+	// Go duration string, such as 10m, at which the roots of ca_name are polled for updates. 0 disables polling.
+	BundlePollInterval string `hcl:"bundle_poll_interval" json:"bundle_poll_interval"`
+	// Other CAs whose roots are polled along with those of ca_name, and how many CAs are fetched at once
+	BundlePollCANames     []string `hcl:"bundle_poll_ca_names" json:"bundle_poll_ca_names,omitempty"`
+	BundlePollConcurrency int      `hcl:"bundle_poll_concurrency" json:"bundle_poll_concurrency"`
+	// Requests an end time of now plus the preferred TTL sent by SPIRE. The certificate profile must allow validity override.
+	UsePreferredTTL bool `hcl:"use_preferred_ttl" json:"use_preferred_ttl"`
+	// CA names that each end entity profile permits, keyed by end entity profile name
+	EndEntityProfileAllowedCAs map[string][]string `hcl:"end_entity_profile_allowed_cas" json:"end_entity_profile_allowed_cas,omitempty"`
+	// Trust domain that the SPIFFE ID URI SAN of every CSR must belong to
+	TrustDomain string `hcl:"trust_domain" json:"trust_domain"`
+
+	maxEnrollmentDuration            time.Duration
+	allowedKeyUsages                 x509.KeyUsage
+	endEntityTtl                     time.Duration
+	allowedCSREKUs                   []string
+	requiredServerEkus               []string
+	pinnedCAFingerprint              []byte
+	expectedIntermediateFingerprints [][]byte
+	responseEnvelopePath             []string
+	proxyURL                         *url.URL
+	bundlePollInterval               time.Duration
+	trustDomain                      spiffeid.TrustDomain
+	http2ReadIdleTimeout             time.Duration
+	http2PingTimeout                 time.Duration
+	requestSchema                    *jsonschema.Schema
+	aiaClient                        *http.Client
 }
 
 type CertAuthConfig struct {
@@ -106,6 +355,18 @@ type CertAuthConfig struct {
 	ClientCertPath string `hcl:"client_cert_path" json:"client_cert_path"`
 	ClientKey      string `hcl:"client_key" json:"client_key"`
 	ClientKeyPath  string `hcl:"client_key_path" json:"client_key_path"`
+	// PKCS#12 keystore holding the client certificate, its chain, and key, instead of client_cert and client_key
+	ClientP12Path     string `hcl:"client_p12_path" json:"client_p12_path"`
+	ClientP12Password string `hcl:"client_p12_password" json:"client_p12_password"`
+	// Additional client certificates. The one matching the CAs requested by EJBCA during the TLS handshake is presented.
+	ClientCertificates []ClientCertificateConfig `hcl:"client_certificates" json:"client_certificates,omitempty"`
+}
+
+type ClientCertificateConfig struct {
+	ClientCert     string `hcl:"client_cert" json:"client_cert"`
+	ClientCertPath string `hcl:"client_cert_path" json:"client_cert_path"`
+	ClientKey      string `hcl:"client_key" json:"client_key"`
+	ClientKeyPath  string `hcl:"client_key_path" json:"client_key_path"`
 }
 
 type OAuthConfig struct {
@@ -115,6 +376,15 @@ type OAuthConfig struct {
 	// Comma separated list of scopes
 	Scopes   string `hcl:"scopes" json:"scopes"`
 	Audience string `hcl:"audience" json:"audience"`
+	// Maximum size of a token endpoint response, in bytes
+	MaxTokenResponseBytes int64 `hcl:"max_token_response_bytes" json:"max_token_response_bytes"`
+	// Minimum TLS version for connections to the token endpoint, either "1.2" or "1.3"
+	TokenTLSMinVersion string `hcl:"token_tls_min_version" json:"token_tls_min_version"`
+	// Go duration string, such as 5s, bounding each request to the token endpoint
+	TokenRequestTimeout string `hcl:"token_request_timeout" json:"token_request_timeout"`
+
+	tokenTLSMinVersion  uint16
+	tokenRequestTimeout time.Duration
 }
 
 // New returns an instantiated EJBCA UpstreamAuthority plugin
@@ -123,17 +393,35 @@ func New() *Plugin {
 	p.hooks.newAuthenticator = p.getAuthenticator
 	p.hooks.getEnv = os.Getenv
 	p.hooks.readFile = os.ReadFile
+	p.hooks.systemCertPool = x509.SystemCertPool
+	p.hooks.newKafkaProducer = newKafkaWriter
+	p.hooks.newAsyncBroker = newKafkaAsyncBroker
+	p.hooks.parseCertificates = pemutil.ParseCertificates
+	p.hooks.now = time.Now
+	p.hooks.after = time.After
+	p.hooks.auditLog = p.writeAuditLog
+	p.hooks.geteuid = os.Geteuid
+	p.hooks.tracerProvider = otel.GetTracerProvider
+	p.prometheus = newPrometheusMetrics()
 	return p
 }
 
 // Configure configures the EJBCA UpstreamAuthority plugin. This is invoked by SPIRE when the plugin is
 // first loaded. After the first invocation, it may be used to reconfigure the plugin.
-func (p *Plugin) Configure(_ context.Context, req *configv1.ConfigureRequest) (*configv1.ConfigureResponse, error) {
+func (p *Plugin) Configure(ctx context.Context, req *configv1.ConfigureRequest) (_ *configv1.ConfigureResponse, err error) {
 	config, err := p.parseConfig(req)
 	if err != nil {
 		return nil, err
 	}
 
+	if config.RefuseRoot {
+		if runtime.GOOS == "windows" {
+			p.logger.Warn("refuse_root has no effect on Windows, which has no root user")
+		} else if p.hooks.geteuid() == 0 {
+			return nil, status.Error(codes.FailedPrecondition, "refusing to run as root (effective UID 0) because refuse_root is set")
+		}
+	}
+
 	authenticator, err := p.hooks.newAuthenticator(config)
 	if err != nil {
 		return nil, err
@@ -144,8 +432,110 @@ func (p *Plugin) Configure(_ context.Context, req *configv1.ConfigureRequest) (*
 		return nil, status.Errorf(codes.InvalidArgument, "failed to create EJBCA client: %v", err)
 	}
 
-	p.setConfig(config)
-	p.setClient(client)
+	if config.ValidateConnectionOnConfigure {
+		if err := p.validateConnection(ctx, client); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to validate EJBCA connection: %v", err)
+		}
+	}
+
+	if config.Warmup {
+		if err := p.warmup(ctx, client, config); err != nil {
+			if config.WarmupFailOnError {
+				return nil, status.Errorf(codes.Unavailable, "failed to warm up EJBCA connection: %v", err)
+			}
+			p.logger.Warn("Failed to warm up EJBCA connection; the first mint may be slow", "error", err)
+		}
+	}
+
+	var (
+		asyncBroker      asyncBroker
+		kafkaPublisher   *kafkaPublisher
+		kubernetesOutput *kubernetesOutput
+		notifySocket     *notifySocket
+		prometheusServer *prometheusServer
+	)
+	// The components below are only handed to the plugin once Configure succeeds, so the ones created before a
+	// failure are closed here. Listeners kept from the previous configuration stay open.
+	defer func() {
+		if err == nil {
+			return
+		}
+		if asyncBroker != nil {
+			_ = asyncBroker.Close()
+		}
+		if kafkaPublisher != nil {
+			_ = kafkaPublisher.Close()
+		}
+		if kubernetesOutput != nil {
+			_ = kubernetesOutput.Close()
+		}
+		if notifySocket != nil && notifySocket != p.getNotifySocket() {
+			_ = notifySocket.Close()
+		}
+		if prometheusServer != nil && prometheusServer != p.getPrometheusServer() {
+			_ = prometheusServer.Close()
+		}
+	}()
+
+	var acmeEnroller *acmeEnroller
+	if config.EnrollmentProtocol == enrollmentProtocolAcme {
+		httpClient, err := authenticator.GetHTTPClient()
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "failed to get HTTP client for ACME: %v", err)
+		}
+		acmeEnroller, err = newAcmeEnroller(config, httpClient)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create ACME client: %v", err)
+		}
+	}
+
+	if config.EnrollmentProtocol == enrollmentProtocolAsyncBroker {
+		asyncBroker = p.hooks.newAsyncBroker(p.logger.Named("asyncBroker"), config.AsyncBroker)
+	}
+
+	var accountBinder *accountBinder
+	if config.AutoAccountBinding == autoAccountBindingCreate {
+		httpClient, err := authenticator.GetHTTPClient()
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "failed to get HTTP client for account bindings: %v", err)
+		}
+		accountBinder, err = newAccountBinder(config, httpClient)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "failed to create account binding client: %v", err)
+		}
+	}
+
+	if config.KubernetesOutput != nil {
+		kubernetesClient, err := newKubernetesClient(config.KubernetesOutput, p.hooks.getEnv, p.hooks.readFile)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "failed to create Kubernetes client: %v", err)
+		}
+		kubernetesOutput = newKubernetesOutput(p.logger.Named("kubernetesOutput"), config.KubernetesOutput, kubernetesClient)
+	}
+
+	if config.Kafka != nil {
+		kafkaPublisher = newKafkaPublisher(p.logger.Named("kafka"), config.Kafka, p.hooks.newKafkaProducer(config.Kafka))
+	}
+
+	notifySocket, err = p.configureNotifySocket(config)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to listen on notify_socket: %v", err)
+	}
+
+	prometheusServer, err = p.configurePrometheus(config)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to serve Prometheus metrics: %v", err)
+	}
+
+	p.setConfig(config, client)
+	p.resetLockedKeyType()
+	p.setPrometheusServer(prometheusServer)
+	p.setKafkaPublisher(kafkaPublisher)
+	p.setNotifySocket(notifySocket)
+	p.setAcmeEnroller(acmeEnroller)
+	p.setAsyncBroker(asyncBroker)
+	p.setAccountBinder(accountBinder)
+	p.setKubernetesOutput(kubernetesOutput)
 	return &configv1.ConfigureResponse{}, nil
 }
 
@@ -156,41 +546,122 @@ func (p *Plugin) SetLogger(logger hclog.Logger) {
 }
 
 // MintX509CAAndSubscribe implements the UpstreamAuthority MintX509CAAndSubscribe RPC. Mints an X.509 CA and responds
-// with the signed X.509 CA certificate chain and upstream X.509 roots. The stream is kept open but new roots will
-// not be published unless the CA is rotated and a new X.509 CA is minted.
+// with the signed X.509 CA certificate chain and upstream X.509 roots. The stream is then kept open, and the roots of
+// ca_name are polled every bundle_poll_interval so that new upstream roots are published until the stream is closed.
 //
 // Implementation note:
 //   - It's important that the EJBCA Certificate Profile and End Entity Profile are properly configured before
 //     using this plugin. The plugin does not attempt to configure these profiles.
 func (p *Plugin) MintX509CAAndSubscribe(req *upstreamauthorityv1.MintX509CARequest, stream upstreamauthorityv1.UpstreamAuthority_MintX509CAAndSubscribeServer) error {
-	var err error
-	if p.client == nil {
+	state := p.state.Load()
+	if state == nil {
 		return status.Error(codes.FailedPrecondition, "ejbca upstreamauthority is not configured")
 	}
 
-	logger := p.logger.Named("MintX509CAAndSubscribe")
-	config, err := p.getConfig()
+	roots, err := p.mintX509CA(req, stream, state)
 	if err != nil {
 		return err
 	}
+	if state.config.bundlePollInterval <= 0 {
+		return nil
+	}
+	return p.pollUpstreamRoots(stream, state, roots)
+}
+
+// mintX509CA mints an X.509 CA with the configuration and client of state and sends it on stream. It returns the
+// upstream X.509 roots that were sent.
+func (p *Plugin) mintX509CA(req *upstreamauthorityv1.MintX509CARequest, stream upstreamauthorityv1.UpstreamAuthority_MintX509CAAndSubscribeServer, state *configState) (_ []*x509.Certificate, err error) {
+	config, client := state.config, state.client
+
+	logger := p.logger.Named("MintX509CAAndSubscribe")
+
+	start := p.hooks.now()
+	var endEntityName, serial string
+	var crl crlInfo
+	defer func() {
+		p.prometheus.observeMint(err)
+		p.auditMint(config, endEntityName, err)
+		p.logMintEvent(config, mintEvent{
+			EndEntityName: endEntityName,
+			CAName:        config.CAName,
+			Serial:        serial,
+			Duration:      p.hooks.now().Sub(start),
+			Crl:           crl,
+			Err:           err,
+		})
+	}()
+
+	ctx, span := p.startSpan(stream.Context(), spanMintX509CA, trace.WithAttributes(
+		attribute.String(spanAttributeCAName, config.CAName),
+		attribute.String(spanAttributeEndEntityProfileName, config.EndEntityProfileName),
+	))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	if config.maxEnrollmentDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, config.maxEnrollmentDuration)
+		defer cancel()
+	}
+
+	// With strict_telemetry, a mint that can't be counted must fail before anything is issued
+	if config.StrictTelemetry && !p.metrics.IsInitialized() {
+		return nil, status.Error(codes.Unavailable, "failed to record mint metric: SPIRE metrics host service is not available")
+	}
+
+	if config.MaxCSRBytes > 0 && len(req.Csr) > config.MaxCSRBytes {
+		return nil, status.Errorf(codes.InvalidArgument, "CSR is %d bytes, which exceeds max_csr_bytes of %d", len(req.Csr), config.MaxCSRBytes)
+	}
 
 	logger.Trace("Parsing CSR from request")
+	_, parseSpan := p.startSpan(ctx, spanParseCSR)
 	parsedCsr, err := x509.ParseCertificateRequest(req.Csr)
+	endSpan(parseSpan, err)
 	if err != nil {
-		return status.Errorf(codes.InvalidArgument, "unable to parse CSR: %s", err.Error())
+		return nil, status.Errorf(codes.InvalidArgument, "unable to parse CSR: %s", err.Error())
 	}
 	csrPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: req.Csr})
 
+	if err := p.validateCSR(config, parsedCsr); err != nil {
+		return nil, err
+	}
+	if err := validateEndEntityProfileCA(config); err != nil {
+		return nil, err
+	}
+	if config.LockKeyType {
+		if err := p.checkLockedKeyType("CSR", parsedCsr.PublicKeyAlgorithm); err != nil {
+			return nil, err
+		}
+	}
+
 	logger.Trace("Determining end entity name")
-	endEntityName, err := p.getEndEntityName(config, parsedCsr)
+	_, endEntityNameSpan := p.startSpan(ctx, spanResolveEndEntityName)
+	endEntityName, err = p.getEndEntityName(config, parsedCsr)
+	endSpan(endEntityNameSpan, err)
 	if err != nil {
-		return status.Errorf(codes.Internal, "unable to determine end entity name: %s", err.Error())
+		return nil, status.Errorf(codes.Internal, "unable to determine end entity name: %s", err.Error())
+	}
+
+	accountBindingId, err := p.getAccountBindingId(ctx, config, parsedCsr)
+	if err != nil {
+		return nil, err
 	}
 
 	logger.Trace("Preparing EJBCA enrollment request")
 	password, err := generateRandomString(16)
 	if err != nil {
-		return status.Errorf(codes.Internal, "failed to generate random password: %s", err.Error())
+		return nil, status.Errorf(codes.Internal, "failed to generate random password: %s", err.Error())
+	}
+	if config.UseCSRChallengePassword {
+		challengePassword, ok, err := getChallengePassword(parsedCsr)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "unable to read CSR challenge password: %v", err)
+		}
+		if ok {
+			logger.Debug("Using the CSR challenge password as the enrollment password")
+			password = challengePassword
+		}
 	}
 	enrollConfig := ejbcaclient.EnrollCertificateRestRequest{}
 	enrollConfig.SetUsername(endEntityName)
@@ -202,209 +673,700 @@ func (p *Plugin) MintX509CAAndSubscribe(req *upstreamauthorityv1.MintX509CAReque
 	enrollConfig.SetCertificateProfileName(config.CertificateProfileName)
 	enrollConfig.SetEndEntityProfileName(config.EndEntityProfileName)
 	enrollConfig.SetIncludeChain(true)
-	enrollConfig.SetAccountBindingId(config.AccountBindingID)
-
-	logger.Debug("Prepared EJBCA enrollment request", "subject", parsedCsr.Subject.String(), "uriSANs", parsedCsr.URIs, "endEntityName", endEntityName, "caName", config.CAName, "certificateProfileName", config.CertificateProfileName, "endEntityProfileName", config.EndEntityProfileName, "accountBindingId", config.AccountBindingID)
+	enrollConfig.SetAccountBindingId(accountBindingId)
 
-	logger.Info("Enrolling certificate with EJBCA")
-	enrollResponse, httpResponse, err := p.client.EnrollPkcs10Certificate(stream.Context()).
-		EnrollCertificateRestRequest(enrollConfig).
-		Execute()
-	if err != nil {
-		return p.parseEjbcaError("failed to enroll CSR", err)
+	if config.RequestFormat == requestFormatCrmf {
+		crmf, err := getCrmfRequest(parsedCsr)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "failed to wrap CSR for CRMF submission: %v", err)
+		}
+		enrollConfig.SetCertificateRequest(base64.StdEncoding.EncodeToString(crmf))
 	}
-	if httpResponse != nil && httpResponse.Body != nil {
-		httpResponse.Body.Close()
+	if config.RequestFormat != "" {
+		setAdditionalProperty(&enrollConfig, "certificate_request_format", strings.ToUpper(config.RequestFormat))
 	}
 
-	var certBytes []byte
-	var caBytes []byte
-	switch {
-	case enrollResponse.GetResponseFormat() == "PEM":
-		logger.Trace("EJBCA returned certificate in PEM format - serializing")
+	if subjectDn := getPromotedSubjectDn(config, parsedCsr); subjectDn != "" {
+		logger.Debug("Promoting SAN to subject Common Name", "subjectDn", subjectDn)
+		setAdditionalProperty(&enrollConfig, "subject_dn", subjectDn)
+	}
 
-		block, _ := pem.Decode([]byte(enrollResponse.GetCertificate()))
-		if block == nil {
-			return status.Error(codes.Internal, "failed to parse certificate PEM")
+	if config.ForwardCSRSANs {
+		if subjectAltName := getSubjectAltName(config, parsedCsr); subjectAltName != "" {
+			logger.Debug("Forwarding CSR SANs to EJBCA", "subjectAltName", subjectAltName)
+			setAdditionalProperty(&enrollConfig, "subject_alt_name", subjectAltName)
 		}
-		certBytes = block.Bytes
+	}
 
-		for _, ca := range enrollResponse.CertificateChain {
-			block, _ := pem.Decode([]byte(ca))
-			if block == nil {
-				return status.Error(codes.Internal, "failed to parse CA certificate PEM")
-			}
-			caBytes = append(caBytes, block.Bytes...)
+	if config.ForwardCSREKU {
+		forwarded, dropped, err := getForwardedEkus(config, parsedCsr)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "unable to forward CSR EKUs: %v", err)
+		}
+		if len(dropped) > 0 {
+			logger.Warn("Dropping CSR EKUs that are not in allowed_csr_ekus", "ekus", dropped)
 		}
-	case enrollResponse.GetResponseFormat() == "DER":
-		logger.Trace("EJBCA returned certificate in DER format - serializing")
+		if len(forwarded) > 0 {
+			logger.Debug("Forwarding CSR EKUs to EJBCA", "ekus", forwarded)
+			setAdditionalProperty(&enrollConfig, "extended_key_usages", forwarded)
+		}
+	}
 
-		bytes := []byte(enrollResponse.GetCertificate())
-		bytes, err := base64.StdEncoding.DecodeString(string(bytes))
+	if config.endEntityTtl > 0 {
+		expiresAt := p.hooks.now().Add(config.endEntityTtl).UTC().Format(time.RFC3339)
+		logger.Debug("Tagging end entity with expiration", "expiresAt", expiresAt)
+		setExtensionData(&enrollConfig, endEntityTtlTagName, expiresAt)
+	}
+
+	if config.UsePreferredTTL && req.PreferredTtl > 0 {
+		endTime := p.hooks.now().Add(time.Duration(req.PreferredTtl) * time.Second).UTC().Format(time.RFC3339)
+		logger.Debug("Requesting certificate end time from the preferred TTL", "preferredTtl", req.PreferredTtl, "endTime", endTime)
+		setAdditionalProperty(&enrollConfig, "end_time", endTime)
+	}
+
+	if config.TrustDomainExtensionData != "" {
+		trustDomain, err := getTrustDomain(parsedCsr)
 		if err != nil {
-			return status.Errorf(codes.Internal, "failed to base64 decode DER certificate: %v", err)
+			return nil, status.Errorf(codes.InvalidArgument, "unable to determine trust domain of CSR for trust_domain_extension_data: %v", err)
 		}
-		certBytes = append(certBytes, bytes...)
+		logger.Debug("Tagging end entity with trust domain", "name", config.TrustDomainExtensionData, "trustDomain", trustDomain.Name())
+		setExtensionData(&enrollConfig, config.TrustDomainExtensionData, trustDomain.Name())
+	}
 
-		for _, ca := range enrollResponse.CertificateChain {
-			bytes := []byte(ca)
-			bytes, err := base64.StdEncoding.DecodeString(string(bytes))
-			if err != nil {
-				return status.Errorf(codes.Internal, "failed to base64 decode DER CA certificate: %v", err)
-			}
-			caBytes = append(caBytes, bytes...)
+	logger.Debug("Prepared EJBCA enrollment request", "subject", parsedCsr.Subject.String(), "uriSANs", parsedCsr.URIs, "endEntityName", endEntityName, "caName", config.CAName, "certificateProfileName", config.CertificateProfileName, "endEntityProfileName", config.EndEntityProfileName, "accountBindingId", loggableAccountBindingId(config, accountBindingId))
+
+	if config.requestSchema != nil && config.EnrollmentProtocol != enrollmentProtocolAcme {
+		if err := validateRequestSchema(config.requestSchema, enrollConfig); err != nil {
+			return nil, status.Errorf(codes.Internal, "enrollment request violates request_schema_file: %v", err)
 		}
+	}
+
+	enrollCtx := ctx
+	var timing *requestTiming
+	if config.TraceTiming {
+		timing = newRequestTiming()
+		enrollCtx = timing.withTrace(ctx)
+	}
+
+	enrollCtx, enrollSpan := p.startSpan(enrollCtx, spanEnroll)
+	enrollStart := p.hooks.now()
+	var enrollResponse *ejbcaclient.CertificateRestResponse
+	switch config.EnrollmentProtocol {
+	case enrollmentProtocolAcme:
+		logger.Info("Enrolling certificate with EJBCA's ACME endpoint")
+		enrollResponse, err = p.enrollAcme(enrollCtx, config, parsedCsr)
+	case enrollmentProtocolAsyncBroker:
+		logger.Info("Enrolling certificate with EJBCA through the async broker")
+		enrollResponse, err = p.enrollAsyncBroker(enrollCtx, stream.Context(), config, enrollConfig)
 	default:
-		return status.Error(codes.Internal, "ejbca returned unsupported certificate format: "+enrollResponse.GetResponseFormat())
+		logger.Info("Enrolling certificate with EJBCA")
+		enrollResponse, endEntityName, err = p.enrollRest(enrollCtx, stream.Context(), config, client, enrollConfig, endEntityName, password)
+	}
+	p.prometheus.observeEnroll(p.hooks.now().Sub(enrollStart))
+	endSpan(enrollSpan, err)
+	if timing != nil {
+		logger.Debug("EJBCA request timing", timing.fields()...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	format := enrollResponse.GetResponseFormat()
+	if !slices.Contains(config.AcceptedResponseFormats, format) {
+		return nil, status.Errorf(codes.Internal, "ejbca returned unsupported certificate format: %s (accepted formats: %s)", format, strings.Join(config.AcceptedResponseFormats, ", "))
+	}
+
+	// Entries are decoded individually since some EJBCA versions mix PEM and base64 DER within a response
+	logger.Trace("EJBCA returned certificate in " + format + " format - serializing")
+	certBytes, err := decodeCertificateEntry(getIssuedCertificate(enrollResponse))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to parse certificate %s: %v", format, err)
+	}
+
+	var caBytes []byte
+	for _, ca := range enrollResponse.CertificateChain {
+		bytes, err := decodeCertificateEntry(ca)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to parse CA certificate %s: %v", format, err)
+		}
+		caBytes = append(caBytes, bytes...)
 	}
 
 	cert, err := x509.ParseCertificate(certBytes)
 	if err != nil {
-		return status.Errorf(codes.Internal, "failed to serialize certificate issued by EJBCA: %v", err)
+		return nil, status.Errorf(codes.Internal, "failed to serialize certificate issued by EJBCA: %v", err)
+	}
+	serial = cert.SerialNumber.Text(16)
+
+	if config.DetectDuplicateSerials != "" && p.recordSerial(serial) {
+		if config.DetectDuplicateSerials == detectDuplicateSerialsError {
+			return nil, status.Errorf(codes.Internal, "EJBCA returned serial %s, which was already returned by a previous mint", serial)
+		}
+		logger.Warn("EJBCA returned a serial that was already returned by a previous mint", "serial", serial)
+	}
+
+	crl = getCrlInfo(enrollResponse)
+	if len(crl.DistributionPoints) > 0 {
+		logger.Debug("EJBCA returned CRL distribution points", "crlDistributionPoints", crl.DistributionPoints)
+	}
+	if crl.LatestPartitionIndex != nil {
+		logger.Debug("EJBCA returned the latest CRL partition index", "latestCrlPartitionIndex", *crl.LatestPartitionIndex)
 	}
 
 	caChain, err := x509.ParseCertificates(caBytes)
 	if err != nil {
-		return status.Errorf(codes.Internal, "failed to serialize CA chain returned by EJBCA: %v", err)
+		return nil, status.Errorf(codes.Internal, "failed to serialize CA chain returned by EJBCA: %v", err)
+	}
+
+	rootCertificates, err := getRootCertificates(enrollResponse)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to parse root_certificates returned by EJBCA: %v", err)
+	}
+
+	if ordered, reordered := orderIssuerChain(cert, caChain); reordered {
+		logger.Debug("EJBCA returned the CA chain out of order - reordering it leaf to root", "issuingCa", ordered[0].Subject.String())
+		caChain = ordered
+	}
+
+	switch {
+	case len(caChain) > 0:
+		p.cacheIssuerChain(caChain)
+	case isSelfSigned(cert):
+		if !cert.BasicConstraintsValid || !cert.IsCA {
+			return nil, status.Error(codes.Internal, "EJBCA returned a single self-signed certificate that is not a CA")
+		}
+
+		// In a root-only deployment, the root is both the issuing CA and the upstream root
+		logger.Debug("EJBCA returned only a self-signed root CA", "rootCa", cert.Subject.String())
+		caChain = []*x509.Certificate{cert}
+	default:
+		caChain = p.getCachedIssuerChain(cert)
+		if len(caChain) > 0 {
+			logger.Debug("EJBCA did not return a CA chain - using the cached CA chain", "issuingCa", caChain[0].Subject.String())
+			break
+		}
+		if !config.FollowAIA {
+			return nil, status.Error(codes.Internal, "EJBCA did not return a CA chain")
+		}
+
+		logger.Debug("EJBCA did not return a CA chain - following the AIA CA Issuers URLs of the issued CA")
+		caChain, err = p.fetchAiaChain(ctx, config.aiaClient, cert)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "EJBCA did not return a CA chain, and it couldn't be built from AIA: %v", err)
+		}
+		p.cacheIssuerChain(caChain)
 	}
 
-	if len(caChain) == 0 {
-		return status.Error(codes.Internal, "EJBCA did not return a CA chain")
+	if err := p.validateIssuedCA(config, cert, caChain); err != nil {
+		return nil, err
+	}
+
+	if config.LockKeyType {
+		if err := p.lockKeyType(cert.PublicKeyAlgorithm); err != nil {
+			return nil, err
+		}
 	}
 
-	rootCa := caChain[len(caChain)-1]
-	logger.Trace("Retrieved root CA from CA chain", "rootCa", rootCa.Subject.String(), "intermediates", len(caChain)-1)
+	intermediates := caChain[:len(caChain)-1]
+	roots := []*x509.Certificate{caChain[len(caChain)-1]}
+	if len(rootCertificates) > 0 {
+		logger.Debug("Merging root_certificates returned by EJBCA with the CA chain", "rootCertificates", len(rootCertificates))
+		intermediates, roots = mergeRootCertificates(caChain, rootCertificates)
+	}
+	logger.Trace("Retrieved root CAs from CA chain", "rootCa", roots[0].Subject.String(), "roots", len(roots), "intermediates", len(intermediates))
 
 	// x509CertificateChain contains the leaf CA certificate, then any intermediates up to but not including the root CA.
-	x509CertificateAuthorityChain, err := x509certificate.ToPluginProtos(append([]*x509.Certificate{cert}, caChain[:len(caChain)-1]...))
+	x509CertificateAuthorityChain, err := x509certificate.ToPluginProtos(append([]*x509.Certificate{cert}, intermediates...))
 	if err != nil {
-		return status.Errorf(codes.Internal, "failed to serialize certificate chain: %v", err)
+		return nil, status.Errorf(codes.Internal, "failed to serialize certificate chain: %v", err)
 	}
 
-	rootCACertificate, err := x509certificate.ToPluginProtos([]*x509.Certificate{rootCa})
+	rootCACertificate, err := x509certificate.ToPluginProtos(roots)
 	if err != nil {
-		return status.Errorf(codes.Internal, "failed to serialize upstream X.509 roots: %v", err)
+		return nil, status.Errorf(codes.Internal, "failed to serialize upstream X.509 roots: %v", err)
+	}
+
+	// The metric is recorded before the minted bundle is published anywhere, so that a mint failed by
+	// strict_telemetry leaves no trace in the outputs
+	if err := p.incrCounter(ctx, []string{"mint_x509_ca"}); err != nil && config.StrictTelemetry {
+		return nil, status.Errorf(codes.Unavailable, "failed to record mint metric: %v", err)
+	}
+
+	if kafkaPublisher := p.getKafkaPublisher(); kafkaPublisher != nil {
+		logger.Trace("Publishing minted bundle to Kafka")
+		if err := kafkaPublisher.Publish(p.hooks.now(), append([]*x509.Certificate{cert}, intermediates...), roots); err != nil {
+			return nil, status.Errorf(codes.Unavailable, "failed to publish minted bundle to Kafka: %v", err)
+		}
+	}
+
+	if notifySocket := p.getNotifySocket(); notifySocket != nil {
+		logger.Trace("Notifying notify socket clients of minted bundle")
+		if err := notifySocket.Notify(p.hooks.now(), append([]*x509.Certificate{cert}, intermediates...), roots); err != nil {
+			logger.Warn("Failed to notify notify socket clients", "path", notifySocket.path, "error", err)
+		}
+	}
+
+	if config.RootsArchiveDir != "" {
+		logger.Trace("Archiving upstream roots")
+		archived, err := archiveRoots(config.RootsArchiveDir, roots)
+		for _, path := range archived {
+			logger.Info("Archived new upstream root", "path", path)
+		}
+		if err != nil {
+			logger.Warn("Failed to archive upstream roots", "dir", config.RootsArchiveDir, "error", err)
+		}
 	}
 
-	return stream.Send(&upstreamauthorityv1.MintX509CAResponse{
+	if kubernetesOutput := p.getKubernetesOutput(); kubernetesOutput != nil {
+		logger.Trace("Queueing upstream roots for the Kubernetes Secret")
+		kubernetesOutput.Write(roots)
+	}
+
+	if err := stream.Send(&upstreamauthorityv1.MintX509CAResponse{
 		X509CaChain:       x509CertificateAuthorityChain,
 		UpstreamX509Roots: rootCACertificate,
-	})
+	}); err != nil {
+		return nil, err
+	}
+	return roots, nil
 }
 
 // PublishJWTKeyAndSubscribe implements the UpstreamAuthority PublishJWTKeyAndSubscribe RPC. Publishes a JWT signing key
-// upstream and responds with the upstream JWT keys. If supported by the implementation, subsequent responses on the
-// stream contain upstream JWT key updates, otherwise the stream is closed after the initial response.
+// upstream and responds with the upstream JWT keys. Subsequent responses on the stream contain upstream JWT key
+// updates until the stream is closed.
 //
-// The EJBCA UpstreamAuthority plugin does not support publishing JWT keys.
-func (p *Plugin) PublishJWTKeyAndSubscribe(_ *upstreamauthorityv1.PublishJWTKeyRequest, _ upstreamauthorityv1.UpstreamAuthority_PublishJWTKeyAndSubscribeServer) error {
-	return status.Error(codes.Unimplemented, "publishing JWT keys is not supported by the EJBCA UpstreamAuthority plugin")
+// EJBCA doesn't manage JWT keys, so the EJBCA UpstreamAuthority plugin keeps published keys in memory, keyed by key
+// ID, and responds with every unexpired key published to it.
+func (p *Plugin) PublishJWTKeyAndSubscribe(req *upstreamauthorityv1.PublishJWTKeyRequest, stream upstreamauthorityv1.UpstreamAuthority_PublishJWTKeyAndSubscribeServer) error {
+	if _, err := p.getConfig(); err != nil {
+		return status.Error(codes.FailedPrecondition, "ejbca upstreamauthority is not configured")
+	}
+
+	jwtKey := req.GetJwtKey()
+	switch {
+	case jwtKey == nil:
+		return status.Error(codes.InvalidArgument, "missing JWT key")
+	case jwtKey.KeyId == "":
+		return status.Error(codes.InvalidArgument, "missing JWT key ID")
+	case len(jwtKey.PublicKey) == 0:
+		return status.Error(codes.InvalidArgument, "missing JWT public key")
+	}
+
+	notify := p.jwtKeys.subscribe()
+	defer p.jwtKeys.unsubscribe(notify)
+
+	p.logger.Debug("Publishing JWT key", "keyId", jwtKey.KeyId)
+	p.jwtKeys.publish(jwtKey)
+
+	for {
+		select {
+		case <-notify:
+			if err := stream.Send(&upstreamauthorityv1.PublishJWTKeyResponse{
+				UpstreamJwtKeys: p.jwtKeys.list(p.hooks.now()),
+			}); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
 }
 
-// setConfig replaces the configuration atomically under a write lock.
-func (p *Plugin) setConfig(config *Config) {
+// setConfig atomically replaces the configuration and the client built from it.
+func (p *Plugin) setConfig(config *Config, client ejbcaClient) {
+	p.state.Store(&configState{config: config, client: client})
+}
+
+// getConfig gets the current configuration.
+func (p *Plugin) getConfig() (*Config, error) {
+	state := p.state.Load()
+	if state == nil {
+		return nil, status.Error(codes.FailedPrecondition, "not configured")
+	}
+	return state.config, nil
+}
+
+// getClient gets the current EJBCA client. It returns nil if the plugin isn't configured.
+func (p *Plugin) getClient() ejbcaClient {
+	state := p.state.Load()
+	if state == nil {
+		return nil
+	}
+	return state.client
+}
+
+// setClient atomically replaces the client built from config. It does nothing if the plugin has since been
+// reconfigured, so that a client built from a stale configuration never replaces a newer one.
+func (p *Plugin) setClient(config *Config, client ejbcaClient) {
+	for {
+		state := p.state.Load()
+		if state == nil || state.config != config {
+			return
+		}
+		if p.state.CompareAndSwap(state, &configState{config: config, client: client}) {
+			return
+		}
+	}
+}
+
+// setKafkaPublisher replaces the Kafka publisher atomically under a write lock. The previous publisher, if any, is
+// closed after its queued messages are published.
+func (p *Plugin) setKafkaPublisher(kafkaPublisher *kafkaPublisher) {
 	p.configMtx.Lock()
-	p.config = config
+	previous := p.kafka
+	p.kafka = kafkaPublisher
 	p.configMtx.Unlock()
+
+	if previous != nil {
+		if err := previous.Close(); err != nil {
+			p.logger.Warn("Failed to close Kafka producer", "error", err)
+		}
+	}
 }
 
-// getConfig gets the configuration under a read lock.
-func (p *Plugin) getConfig() (*Config, error) {
+// getKafkaPublisher gets the Kafka publisher under a read lock. It returns nil if Kafka output isn't configured.
+func (p *Plugin) getKafkaPublisher() *kafkaPublisher {
 	p.configMtx.RLock()
 	defer p.configMtx.RUnlock()
-	if p.config == nil {
-		return nil, status.Error(codes.FailedPrecondition, "not configured")
+	return p.kafka
+}
+
+// setAsyncBroker replaces the async broker atomically under a write lock. The previous broker, if any, is closed;
+// enrollments still waiting on it fail.
+func (p *Plugin) setAsyncBroker(asyncBroker asyncBroker) {
+	p.configMtx.Lock()
+	previous := p.async
+	p.async = asyncBroker
+	p.configMtx.Unlock()
+
+	if previous != nil {
+		if err := previous.Close(); err != nil {
+			p.logger.Warn("Failed to close async broker", "error", err)
+		}
+	}
+}
+
+// getAsyncBroker gets the async broker under a read lock. It returns nil if async broker enrollment isn't configured.
+func (p *Plugin) getAsyncBroker() asyncBroker {
+	p.configMtx.RLock()
+	defer p.configMtx.RUnlock()
+	return p.async
+}
+
+// setKubernetesOutput replaces the Kubernetes output atomically under a write lock. The previous output, if any, is
+// closed after its queued writes complete.
+func (p *Plugin) setKubernetesOutput(kubernetesOutput *kubernetesOutput) {
+	p.configMtx.Lock()
+	previous := p.k8s
+	p.k8s = kubernetesOutput
+	p.configMtx.Unlock()
+
+	if previous != nil {
+		_ = previous.Close()
 	}
-	return p.config, nil
 }
 
-// setClient replaces the client atomically under a write lock.
-func (p *Plugin) setClient(client ejbcaClient) {
+// getKubernetesOutput gets the Kubernetes output under a read lock. It returns nil if Kubernetes output isn't
+// configured.
+func (p *Plugin) getKubernetesOutput() *kubernetesOutput {
+	p.configMtx.RLock()
+	defer p.configMtx.RUnlock()
+	return p.k8s
+}
+
+// setAcmeEnroller replaces the ACME enroller atomically under a write lock.
+func (p *Plugin) setAcmeEnroller(acmeEnroller *acmeEnroller) {
 	p.configMtx.Lock()
-	p.client = client
+	p.acme = acmeEnroller
 	p.configMtx.Unlock()
 }
 
-// getEndEntityName calculates the End Entity Name based on the default_end_entity_name from the EJBCA UpstreamAuthority
-// configuration. The possible values are:
+// getAcmeEnroller gets the ACME enroller under a read lock. It returns nil if ACME enrollment isn't configured.
+func (p *Plugin) getAcmeEnroller() *acmeEnroller {
+	p.configMtx.RLock()
+	defer p.configMtx.RUnlock()
+	return p.acme
+}
+
+// setAccountBinder replaces the account binder atomically under a write lock.
+func (p *Plugin) setAccountBinder(accountBinder *accountBinder) {
+	p.configMtx.Lock()
+	p.binder = accountBinder
+	p.configMtx.Unlock()
+}
+
+// getAccountBinder gets the account binder under a read lock. It returns nil if account bindings aren't created
+// by the plugin.
+func (p *Plugin) getAccountBinder() *accountBinder {
+	p.configMtx.RLock()
+	defer p.configMtx.RUnlock()
+	return p.binder
+}
+
+// getEndEntityName determines the End Entity Name for the CSR and applies any configured normalization to it.
+func (p *Plugin) getEndEntityName(config *Config, csr *x509.CertificateRequest) (string, error) {
+	logger := p.logger.Named("getEndEntityName")
+
+	selector := config.DefaultEndEntityName
+	eeName, source, err := p.resolveEndEntityName(config, selector, csr)
+	var rejected []string
+	for _, fallback := range config.EndEntityNameFallbacks {
+		if err == nil {
+			break
+		}
+		logger.Debug("End entity name selector yielded no value - trying fallback", "error", err, "fallback", fallback)
+		rejected = append(rejected, fmt.Sprintf("%s: %v", endEntityNameSelectorName(selector), err))
+		selector = fallback
+		eeName, source, err = p.resolveEndEntityName(config, selector, csr)
+	}
+	if err != nil {
+		if config.LogEndEntityNameDecisions {
+			rejected = append(rejected, fmt.Sprintf("%s: %v", endEntityNameSelectorName(selector), err))
+			logger.Trace("No end entity name selector yielded a value", "rejectedSelectors", rejected)
+		}
+		return "", err
+	}
+	resolved := eeName
+
+	switch config.EndEntityNameCase {
+	case "lower":
+		eeName = strings.ToLower(eeName)
+	case "upper":
+		eeName = strings.ToUpper(eeName)
+	}
+
+	if config.SanitizeEndEntityName {
+		sanitized := sanitizeEndEntityName(eeName)
+		if sanitized == "" {
+			return "", fmt.Errorf("end entity name %q is empty after sanitization", eeName)
+		}
+		if sanitized != eeName {
+			logger.Debug("Sanitized end entity name", "endEntityName", sanitized, "original", eeName)
+		}
+		eeName = sanitized
+	}
+
+	if config.LogEndEntityNameDecisions {
+		logger.Trace("Resolved end entity name", "endEntityName", eeName, "selector", endEntityNameSelectorName(selector), "source", source, "resolvedValue", resolved, "rejectedSelectors", rejected, "endEntityNameCase", config.EndEntityNameCase, "sanitized", config.SanitizeEndEntityName)
+	}
+	return eeName, nil
+}
+
+// endEntityNameSelectorName returns the name of an end entity name selector for logs. The unset selector, which
+// tries each CSR field in turn, is named default.
+func endEntityNameSelectorName(selector string) string {
+	if selector == "" {
+		return "default"
+	}
+	return selector
+}
+
+// sanitizeEndEntityName removes invalid UTF-8 and characters that aren't printable, such as control characters,
+// from name, and trims surrounding whitespace.
+func sanitizeEndEntityName(name string) string {
+	var sanitized strings.Builder
+	for i, r := range name {
+		if r == utf8.RuneError {
+			if _, size := utf8.DecodeRuneInString(name[i:]); size <= 1 {
+				continue
+			}
+		}
+		if unicode.IsPrint(r) {
+			sanitized.WriteRune(r)
+		}
+	}
+	return strings.TrimSpace(sanitized.String())
+}
+
+// resolveEndEntityName calculates the End Entity Name based on an end entity name selector, such as end_entity_name
+// or one of end_entity_name_fallbacks from the EJBCA UpstreamAuthority configuration. The possible values are:
 // - cn: Uses the Common Name from the CSR's Distinguished Name.
 // - dns: Uses the first DNS Name from the CSR's Subject Alternative Names (SANs).
-// - uri: Uses the first URI from the CSR's Subject Alternative Names (SANs).
+// - uri: Uses the first URI from the CSR's Subject Alternative Names (SANs). For SPIFFE IDs, spiffe_name_scope
+// selects the portion of the URI that is used.
 // - ip: Uses the first IP Address from the CSR's Subject Alternative Names (SANs).
+// - rdn:<attribute>: Uses the named RDN attribute (such as UID or 2.5.4.5) from the CSR's Distinguished Name.
+// - serialnumber: Uses the serialNumber attribute from the CSR's Distinguished Name, like rdn:SERIALNUMBER.
+// - othername:<oid>: Uses the value of the otherName SAN of the given type from the CSR.
+// - A value containing {{ is executed as a Go template with endEntityNameTemplateData.
 // - Custom Value: Any other string will be directly used as the End Entity Name.
-// If the default_end_entity_name is not set, the plugin will determine the End Entity Name in the same order as above.
-func (p *Plugin) getEndEntityName(config *Config, csr *x509.CertificateRequest) (string, error) {
+// If the selector is not set, the plugin will determine the End Entity Name in the same order as above. The CSR field
+// that the name was taken from, such as "DNS SAN", is returned along with the name.
+func (p *Plugin) resolveEndEntityName(config *Config, selector string, csr *x509.CertificateRequest) (string, string, error) {
 	logger := p.logger.Named("getEndEntityName")
 
 	eeName := ""
 	// 1. If the endEntityName option is set, determine the end entity name based on the option
 	// 2. If the endEntityName option is not set, determine the end entity name based on the CSR
 
+	// {{ ... }}: Execute the selector as a Go template with values from the CertificateRequest
+	if isEndEntityNameTemplate(selector) {
+		eeName, err := executeEndEntityNameTemplate(selector, csr)
+		if err != nil {
+			return "", "", err
+		}
+		logger.Debug("Using the end_entity_name template as the EJBCA end entity name", "endEntityName", eeName)
+		return eeName, "template", nil
+	}
+
+	// serialnumber: Use the serialNumber attribute from the CertificateRequest's DN
+	rdnSelector := selector
+	if strings.EqualFold(selector, serialNumberSelector) {
+		rdnSelector = rdnSelectorPrefix + "SERIALNUMBER"
+	}
+
+	// rdn:<attribute>: Use the named RDN attribute from the CertificateRequest's DN
+	if attribute, ok := strings.CutPrefix(rdnSelector, rdnSelectorPrefix); ok {
+		attributeType, err := parseRdnAttributeType(attribute)
+		if err != nil {
+			return "", "", err
+		}
+		values := getRdnValues(csr.Subject, attributeType)
+		if len(values) == 0 {
+			return "", "", fmt.Errorf("the CertificateRequest's DN has no %s attribute", attribute)
+		}
+		eeName = values[0]
+		if len(values) > 1 {
+			switch config.RDNMultipleValues {
+			case rdnMultipleValuesJoin:
+				eeName = strings.Join(values, rdnValueSeparator)
+			case rdnMultipleValuesError:
+				return "", "", fmt.Errorf("the CertificateRequest's DN has %d %s attributes", len(values), attribute)
+			}
+		}
+		logger.Debug("Using an RDN attribute from the CSR's DN as the EJBCA end entity name", "attribute", attribute, "endEntityName", eeName)
+		return eeName, "subject " + attribute, nil
+	}
+
+	// othername:<oid>: Use the otherName SAN of the given type from the CertificateRequest
+	if typeID, ok := strings.CutPrefix(selector, otherNameSelectorPrefix); ok {
+		otherNameType, err := parseOtherNameType(typeID)
+		if err != nil {
+			return "", "", err
+		}
+		eeName, err = getOtherNameValue(csr.Extensions, otherNameType)
+		if err != nil {
+			return "", "", err
+		}
+		if eeName == "" {
+			return "", "", fmt.Errorf("the CertificateRequest has no otherName SAN of type %s", typeID)
+		}
+		logger.Debug("Using an otherName SAN from the CSR as the EJBCA end entity name", "type", typeID, "endEntityName", eeName)
+		return eeName, "otherName SAN " + typeID, nil
+	}
+
 	// cn: Use the CommonName from the CertificateRequest's DN
-	if config.DefaultEndEntityName == "cn" || config.DefaultEndEntityName == "" {
+	if selector == "cn" || selector == "" {
 		if csr.Subject.CommonName != "" {
 			eeName = csr.Subject.CommonName
 			logger.Debug("Using CommonName from the CSR's DN as the EJBCA end entity name", "endEntityName", eeName)
-			return eeName, nil
+			return eeName, "subject CN", nil
 		}
 	}
 
 	// dns: Use the first DNSName from the CertificateRequest's DNSNames SANs
-	if config.DefaultEndEntityName == "dns" || config.DefaultEndEntityName == "" {
+	if selector == "dns" || selector == "" {
 		if len(csr.DNSNames) > 0 && csr.DNSNames[0] != "" {
 			eeName = csr.DNSNames[0]
+			if config.NormalizeDNSNames {
+				// A fully qualified name such as host.example.com. isn't a valid EJBCA end entity name
+				eeName = strings.TrimSuffix(eeName, ".")
+			}
 			logger.Debug("Using the first DNSName from the CSR's DNSNames SANs as the EJBCA end entity name", "endEntityName", eeName)
-			return eeName, nil
+			return eeName, "DNS SAN", nil
 		}
 	}
 
 	// uri: Use the first URI from the CertificateRequest's URI Sans
-	if config.DefaultEndEntityName == "uri" || config.DefaultEndEntityName == "" {
+	if selector == "uri" || selector == "" {
 		if len(csr.URIs) > 0 {
-			eeName = csr.URIs[0].String()
-			logger.Debug("Using the first URI from the CSR's URI Sans as the EJBCA end entity name", "endEntityName", eeName)
-			return eeName, nil
+			eeName = scopeSpiffeName(config.SpiffeNameScope, csr.URIs[0])
+			if config.StripSpiffeScheme {
+				// Some EJBCA deployments reject usernames that contain a URI scheme
+				eeName = strings.TrimPrefix(eeName, "spiffe://")
+			}
+			if eeName != "" {
+				logger.Debug("Using the first URI from the CSR's URI Sans as the EJBCA end entity name", "endEntityName", eeName, "spiffeNameScope", config.SpiffeNameScope)
+				return eeName, "URI SAN", nil
+			}
 		}
 	}
 
 	// ip: Use the first IPAddress from the CertificateRequest's IPAddresses SANs
-	if config.DefaultEndEntityName == "ip" || config.DefaultEndEntityName == "" {
+	if selector == "ip" || selector == "" {
 		if len(csr.IPAddresses) > 0 {
 			eeName = csr.IPAddresses[0].String()
 			logger.Debug("Using the first IPAddress from the CSR's IPAddresses SANs as the EJBCA end entity name", "endEntityName", eeName)
-			return eeName, nil
+			return eeName, "IP SAN", nil
 		}
 	}
 
-	// End of defaults; if the endEntityName option is set to anything but cn, dns, or uri, use the option as the end entity name
-	if config.DefaultEndEntityName != "" && config.DefaultEndEntityName != "cn" && config.DefaultEndEntityName != "dns" && config.DefaultEndEntityName != "uri" {
-		eeName = config.DefaultEndEntityName
+	// End of defaults; if the endEntityName option is set to anything but cn, dns, uri, or ip, use the option as the end entity name
+	if selector != "" && selector != "cn" && selector != "dns" && selector != "uri" && selector != "ip" {
+		eeName = selector
 		logger.Debug("Using the default_end_entity_name config value as the EJBCA end entity name", "endEntityName", eeName)
-		return eeName, nil
+		return eeName, "configured value", nil
 	}
 
 	// If we get here, we were unable to determine the end entity name
-	logger.Error(fmt.Sprintf("the endEntityName option is set to %q, but no valid end entity name could be determined from the CertificateRequest", config.DefaultEndEntityName))
+	logger.Error(fmt.Sprintf("the endEntityName option is set to %q, but no valid end entity name could be determined from the CertificateRequest", selector))
+
+	return "", "", fmt.Errorf("no valid end entity name could be determined from the CertificateRequest")
+}
+
+const (
+	spiffeNameScopeFull            = "full"
+	spiffeNameScopeTrustDomainOnly = "trust-domain-only"
+	spiffeNameScopePathOnly        = "path-only"
+)
 
-	return "", fmt.Errorf("no valid end entity name could be determined from the CertificateRequest")
+// scopeSpiffeName returns the portion of uri selected by scope. URIs that aren't SPIFFE IDs are always used in full.
+func scopeSpiffeName(scope string, uri *url.URL) string {
+	if uri.Scheme != "spiffe" {
+		return uri.String()
+	}
+	switch scope {
+	case spiffeNameScopeTrustDomainOnly:
+		return uri.Host
+	case spiffeNameScopePathOnly:
+		return uri.Path
+	default:
+		return uri.String()
+	}
 }
 
-// parseEjbcaError parses an error returned by the EJBCA API and returns a gRPC status error.
-func (p *Plugin) parseEjbcaError(detail string, err error) error {
+// parseEjbcaError parses an error returned by the EJBCA API and returns a gRPC status error. The returned status
+// carries an ErrorInfo detail describing the failure so that callers can handle it programmatically.
+func (p *Plugin) parseEjbcaError(config *Config, detail string, err error) error {
 	if err == nil {
 		return nil
 	}
 	logger := p.logger.Named("parseEjbcaError")
 	errString := fmt.Sprintf("%s - %s", detail, err.Error())
 
-	ejbcaError := &ejbcaclient.GenericOpenAPIError{}
-	if errors.As(err, &ejbcaError) {
-		errString += fmt.Sprintf(" - EJBCA API returned error %s", ejbcaError.Body())
+	var errorResponse ejbcaErrorResponse
+	if body, ok := ejbcaErrorBody(err); ok {
+		// The body isn't included in the returned status since EJBCA may echo back the request, such as the CSR
+		logger.Debug("EJBCA API error response", "body", string(body))
+		errString += " - EJBCA API returned error"
+		if json.Unmarshal(body, &errorResponse) == nil && errorResponse.ErrorMessage != "" {
+			errString += fmt.Sprintf(": %s (error_code=%d)", redactEjbcaErrorMessage(errorResponse.ErrorMessage), errorResponse.ErrorCode)
+		}
 	}
 
 	logger.Error("EJBCA returned an error", "error", errString)
 
-	return status.Errorf(codes.Internal, "EJBCA returned an error: %s", errString)
+	metadata := map[string]string{
+		"ca_name":                  config.CAName,
+		"end_entity_profile_name":  config.EndEntityProfileName,
+		"certificate_profile_name": config.CertificateProfileName,
+	}
+	if errorResponse.ErrorCode != 0 {
+		metadata["ejbca_error_code"] = strconv.Itoa(errorResponse.ErrorCode)
+	}
+
+	st := status.Newf(codes.Internal, "EJBCA returned an error: %s", errString)
+	return withErrorInfo(st, errorResponse.reason(), metadata).Err()
 }
 
 // generateRandomString generates a random string of the specified length
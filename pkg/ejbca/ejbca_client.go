@@ -18,28 +18,60 @@ package ejbca
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
 	"strings"
+	"time"
 
 	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
 	"github.com/gogo/status"
 	"github.com/hashicorp/hcl"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	configv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/service/common/config/v1"
-	"github.com/spiffe/spire/pkg/common/pemutil"
 	"google.golang.org/grpc/codes"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 type ejbcaClient interface {
 	EnrollPkcs10Certificate(ctx context.Context) ejbcaclient.ApiEnrollPkcs10CertificateRequest
+	FinalizeEnrollment(ctx context.Context, requestId int32) ejbcaclient.ApiFinalizeEnrollmentRequest
+	ListCas(ctx context.Context) ejbcaclient.ApiListCasRequest
+	GetCertificateAsPem(ctx context.Context, subjectDn string) ejbcaclient.ApiGetCertificateAsPemRequest
+	Setstatus(ctx context.Context, endentityName string) ejbcaclient.ApiSetstatusRequest
+	EnrollPkcs10CertificateV2(ctx context.Context, req ejbcaclient.EnrollCertificateRestRequest) (*ejbcaclient.CertificateRestResponse, *http.Response, error)
+}
+
+// apiClient combines the EJBCA REST API services used by the plugin
+type apiClient struct {
+	*ejbcaclient.V1CertificateApiService
+	*ejbcaclient.V1CaApiService
+	*ejbcaclient.V1EndentityApiService
+
+	// httpClient and enrollV2URL are only set for api_version v2
+	httpClient  *http.Client
+	enrollV2URL string
 }
 
 func (p *Plugin) parseConfig(req *configv1.ConfigureRequest) (*Config, error) {
 	logger := p.logger.Named("parseConfig")
 	config := new(Config)
 	logger.Trace("Decoding EJBCA configuration")
-	if err := hcl.Decode(&config, req.HclConfiguration); err != nil {
+	file, err := hcl.Parse(req.HclConfiguration)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to decode configuration: %v", err)
+	}
+	if err := renameDeprecatedFields(logger, file); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid configuration: %v", err)
+	}
+	if err := hcl.DecodeObject(&config, file); err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "failed to decode configuration: %v", err)
 	}
 
@@ -62,6 +94,25 @@ func (p *Plugin) parseConfig(req *configv1.ConfigureRequest) (*Config, error) {
 			config.OAuth.Audience = p.hooks.getEnv("EJBCA_OAUTH_AUDIENCE")
 		}
 
+		if config.OAuth.MaxTokenResponseBytes < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "oauth.max_token_response_bytes must not be negative, got %d", config.OAuth.MaxTokenResponseBytes)
+		}
+		switch config.OAuth.TokenTLSMinVersion {
+		case "":
+		case "1.2":
+			config.OAuth.tokenTLSMinVersion = tls.VersionTLS12
+		case "1.3":
+			config.OAuth.tokenTLSMinVersion = tls.VersionTLS13
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "oauth.token_tls_min_version must be \"1.2\" or \"1.3\", got %q", config.OAuth.TokenTLSMinVersion)
+		}
+		if config.OAuth.TokenRequestTimeout != "" {
+			timeout, err := time.ParseDuration(config.OAuth.TokenRequestTimeout)
+			if err != nil || timeout <= 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "oauth.token_request_timeout must be a positive duration, got %q", config.OAuth.TokenRequestTimeout)
+			}
+			config.OAuth.tokenRequestTimeout = timeout
+		}
 		if config.OAuth.TokenURL == "" {
 			logger.Error("Token URL is required for OAuth authentication")
 			return nil, status.Error(codes.InvalidArgument, "token_url or EJBCA_OAUTH_TOKEN_URL is required for OAuth authentication")
@@ -75,20 +126,44 @@ func (p *Plugin) parseConfig(req *configv1.ConfigureRequest) (*Config, error) {
 			return nil, status.Error(codes.InvalidArgument, "client_secret or EJBCA_OAUTH_CLIENT_SECRET is required for OAuth authentication")
 		}
 	case config.CertAuth != nil:
-		if config.CertAuth.ClientCertPath == "" {
+		if config.CertAuth.ClientP12Path != "" {
+			if config.CertAuth.ClientCert != "" || config.CertAuth.ClientCertPath != "" || config.CertAuth.ClientKey != "" || config.CertAuth.ClientKeyPath != "" {
+				return nil, status.Error(codes.InvalidArgument, "client_p12_path can't be combined with client_cert or client_key")
+			}
+			if config.CertAuth.ClientP12Password == "" {
+				config.CertAuth.ClientP12Password = p.hooks.getEnv("EJBCA_CLIENT_P12_PASSWORD")
+			}
+			logger.Debug("Reading client certificate and key from PKCS#12 keystore", "path", config.CertAuth.ClientP12Path)
+			if err := p.loadClientP12(config.CertAuth); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid client_p12_path: %v", err)
+			}
+		}
+		if config.CertAuth.ClientCertPath == "" && config.CertAuth.ClientP12Path == "" {
 			config.CertAuth.ClientCertPath = p.hooks.getEnv("EJBCA_CLIENT_CERT_PATH")
 		}
-		if config.CertAuth.ClientKeyPath == "" {
+		if config.CertAuth.ClientKeyPath == "" && config.CertAuth.ClientP12Path == "" {
 			config.CertAuth.ClientKeyPath = p.hooks.getEnv("EJBCA_CLIENT_CERT_KEY_PATH")
 		}
 
-		if config.CertAuth.ClientCertPath == "" && config.CertAuth.ClientCert == "" {
-			logger.Error("Client certificate is required for mTLS authentication")
-			return nil, status.Error(codes.InvalidArgument, "client_cert or EJBCA_CLIENT_CERT_PATH is required for mTLS authentication")
+		hasClientCert := config.CertAuth.ClientCertPath != "" || config.CertAuth.ClientCert != ""
+		hasClientKey := config.CertAuth.ClientKeyPath != "" || config.CertAuth.ClientKey != ""
+		if len(config.CertAuth.ClientCertificates) == 0 || hasClientCert || hasClientKey {
+			if !hasClientCert {
+				logger.Error("Client certificate is required for mTLS authentication")
+				return nil, status.Error(codes.InvalidArgument, "client_cert or EJBCA_CLIENT_CERT_PATH is required for mTLS authentication")
+			}
+			if !hasClientKey {
+				logger.Error("Client key is required for mTLS authentication")
+				return nil, status.Error(codes.InvalidArgument, "client_key or EJBCA_CLIENT_KEY_PATH is required for mTLS authentication")
+			}
 		}
-		if config.CertAuth.ClientKeyPath == "" && config.CertAuth.ClientKey == "" {
-			logger.Error("Client key is required for mTLS authentication")
-			return nil, status.Error(codes.InvalidArgument, "client_key or EJBCA_CLIENT_KEY_PATH is required for mTLS authentication")
+		for i, clientCertificate := range config.CertAuth.ClientCertificates {
+			if clientCertificate.ClientCertPath == "" && clientCertificate.ClientCert == "" {
+				return nil, status.Errorf(codes.InvalidArgument, "client_certificates[%d]: client_cert or client_cert_path is required", i)
+			}
+			if clientCertificate.ClientKeyPath == "" && clientCertificate.ClientKey == "" {
+				return nil, status.Errorf(codes.InvalidArgument, "client_certificates[%d]: client_key or client_key_path is required", i)
+			}
 		}
 	default:
 		logger.Error("No authentication method specified")
@@ -99,6 +174,17 @@ func (p *Plugin) parseConfig(req *configv1.ConfigureRequest) (*Config, error) {
 		config.CaCertPath = p.hooks.getEnv("EJBCA_CA_CERT_PATH")
 	}
 
+	if config.ProxyURL == "" {
+		config.ProxyURL = p.hooks.getEnv("EJBCA_PROXY_URL")
+	}
+	if config.ProxyURL != "" {
+		proxyURL, err := parseProxyURL(config.ProxyURL)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid proxy_url: %v", err)
+		}
+		config.proxyURL = proxyURL
+	}
+
 	if config.Hostname == "" {
 		return nil, status.Error(codes.InvalidArgument, "hostname is required")
 	}
@@ -112,6 +198,412 @@ func (p *Plugin) parseConfig(req *configv1.ConfigureRequest) (*Config, error) {
 		return nil, status.Error(codes.InvalidArgument, "certificate_profile_name is required")
 	}
 
+	if isEndEntityNameTemplate(config.DefaultEndEntityName) {
+		if _, err := parseEndEntityNameTemplate(config.DefaultEndEntityName); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid end_entity_name: %v", err)
+		}
+	}
+	if attribute, ok := strings.CutPrefix(config.DefaultEndEntityName, rdnSelectorPrefix); ok {
+		if _, err := parseRdnAttributeType(attribute); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid end_entity_name: %v", err)
+		}
+	}
+	if typeID, ok := strings.CutPrefix(config.DefaultEndEntityName, otherNameSelectorPrefix); ok {
+		if _, err := parseOtherNameType(typeID); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid end_entity_name: %v", err)
+		}
+	}
+	for _, fallback := range config.EndEntityNameFallbacks {
+		if isEndEntityNameTemplate(fallback) {
+			if _, err := parseEndEntityNameTemplate(fallback); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid end_entity_name_fallbacks: %v", err)
+			}
+		}
+		if attribute, ok := strings.CutPrefix(fallback, rdnSelectorPrefix); ok {
+			if _, err := parseRdnAttributeType(attribute); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid end_entity_name_fallbacks: %v", err)
+			}
+		}
+		if typeID, ok := strings.CutPrefix(fallback, otherNameSelectorPrefix); ok {
+			if _, err := parseOtherNameType(typeID); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid end_entity_name_fallbacks: %v", err)
+			}
+		}
+	}
+
+	if config.TrustDomain != "" {
+		trustDomain, err := spiffeid.TrustDomainFromString(config.TrustDomain)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid trust_domain: %v", err)
+		}
+		config.trustDomain = trustDomain
+	}
+
+	switch config.RDNMultipleValues {
+	case "", rdnMultipleValuesFirst, rdnMultipleValuesJoin, rdnMultipleValuesError:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "rdn_multiple_values must be one of first, join, or error, got %q", config.RDNMultipleValues)
+	}
+
+	switch config.EndEntityNameCase {
+	case "", "preserve", "lower", "upper":
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "end_entity_name_case must be one of lower, upper, or preserve, got %q", config.EndEntityNameCase)
+	}
+
+	if len(config.AcceptedResponseFormats) == 0 {
+		config.AcceptedResponseFormats = supportedResponseFormats
+	}
+	for _, format := range config.AcceptedResponseFormats {
+		if !slices.Contains(supportedResponseFormats, format) {
+			return nil, status.Errorf(codes.InvalidArgument, "accepted_response_formats contains unsupported format %q, supported formats are %s", format, strings.Join(supportedResponseFormats, ", "))
+		}
+	}
+
+	switch config.SpiffeNameScope {
+	case "", spiffeNameScopeFull, spiffeNameScopeTrustDomainOnly, spiffeNameScopePathOnly:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "spiffe_name_scope must be one of full, trust-domain-only, or path-only, got %q", config.SpiffeNameScope)
+	}
+
+	if config.RequestSigning != nil {
+		if config.RequestSigning.Secret == "" {
+			config.RequestSigning.Secret = p.hooks.getEnv("EJBCA_REQUEST_SIGNING_SECRET")
+		}
+		if config.RequestSigning.Secret == "" {
+			return nil, status.Error(codes.InvalidArgument, "secret or EJBCA_REQUEST_SIGNING_SECRET is required for request signing")
+		}
+	}
+
+	if config.AuditLogSigning != nil {
+		if err := p.configureAuditLogSigning(config.AuditLogSigning); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid audit_log_signing: %v", err)
+		}
+	}
+
+	if config.MaxEnrollmentDuration != "" {
+		maxEnrollmentDuration, err := time.ParseDuration(config.MaxEnrollmentDuration)
+		if err != nil || maxEnrollmentDuration <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "max_enrollment_duration must be a positive duration, got %q", config.MaxEnrollmentDuration)
+		}
+		config.maxEnrollmentDuration = maxEnrollmentDuration
+	}
+
+	if config.HTTP2ReadIdleTimeout != "" {
+		http2ReadIdleTimeout, err := time.ParseDuration(config.HTTP2ReadIdleTimeout)
+		if err != nil || http2ReadIdleTimeout <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "http2_read_idle_timeout must be a positive duration, got %q", config.HTTP2ReadIdleTimeout)
+		}
+		config.http2ReadIdleTimeout = http2ReadIdleTimeout
+	}
+	if config.HTTP2PingTimeout != "" {
+		if config.http2ReadIdleTimeout == 0 {
+			return nil, status.Error(codes.InvalidArgument, "http2_ping_timeout requires http2_read_idle_timeout")
+		}
+		http2PingTimeout, err := time.ParseDuration(config.HTTP2PingTimeout)
+		if err != nil || http2PingTimeout <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "http2_ping_timeout must be a positive duration, got %q", config.HTTP2PingTimeout)
+		}
+		config.http2PingTimeout = http2PingTimeout
+	}
+
+	if config.RequestSchemaFile != "" {
+		schema, err := p.hooks.readFile(config.RequestSchemaFile)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "failed to read request_schema_file: %v", err)
+		}
+		config.requestSchema, err = compileRequestSchema(schema)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid request_schema_file: %v", err)
+		}
+	}
+
+	if config.BundlePollInterval != "" {
+		bundlePollInterval, err := time.ParseDuration(config.BundlePollInterval)
+		if err != nil || bundlePollInterval < 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "bundle_poll_interval must be a non-negative duration, got %q", config.BundlePollInterval)
+		}
+		config.bundlePollInterval = bundlePollInterval
+	}
+	if config.BundlePollConcurrency == 0 {
+		config.BundlePollConcurrency = defaultBundlePollConcurrency
+	}
+	if config.BundlePollConcurrency < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "bundle_poll_concurrency must not be negative, got %d", config.BundlePollConcurrency)
+	}
+
+	if config.EndEntityTTLTag != "" {
+		endEntityTtl, err := time.ParseDuration(config.EndEntityTTLTag)
+		if err != nil || endEntityTtl <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "end_entity_ttl_tag must be a positive duration, got %q", config.EndEntityTTLTag)
+		}
+		config.endEntityTtl = endEntityTtl
+	}
+
+	for _, name := range config.AllowedCSREKUs {
+		oid, ok := parseExtKeyUsage(name)
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "allowed_csr_ekus contains unknown EKU %q", name)
+		}
+		config.allowedCSREKUs = append(config.allowedCSREKUs, oid)
+	}
+	if config.ForwardCSREKU && len(config.allowedCSREKUs) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "allowed_csr_ekus is required when forward_csr_eku is enabled")
+	}
+	for _, name := range config.RequireServerEKU {
+		oid, ok := parseExtKeyUsage(name)
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "require_server_eku contains unknown EKU %q", name)
+		}
+		config.requiredServerEkus = append(config.requiredServerEkus, oid)
+	}
+
+	if config.RequirePathLen != nil && *config.RequirePathLen < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "require_path_len must not be negative, got %d", *config.RequirePathLen)
+	}
+
+	if config.PinnedCAFingerprint != "" {
+		fingerprint, err := parseFingerprint(config.PinnedCAFingerprint)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid pinned_ca_fingerprint: %v", err)
+		}
+		config.pinnedCAFingerprint = fingerprint
+	}
+
+	for _, expected := range config.ExpectedIntermediateFingerprints {
+		fingerprint, err := parseFingerprint(expected)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid expected_intermediate_fingerprints entry %q: %v", expected, err)
+		}
+		config.expectedIntermediateFingerprints = append(config.expectedIntermediateFingerprints, fingerprint)
+	}
+
+	if config.ExpectedSignatureAlgorithm != "" {
+		if _, ok := parseSignatureAlgorithm(config.ExpectedSignatureAlgorithm); !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "expected_signature_algorithm %q is not a known signature algorithm", config.ExpectedSignatureAlgorithm)
+		}
+	}
+
+	for _, name := range config.AllowedCSRAlgorithms {
+		_, isSignatureAlgorithm := parseSignatureAlgorithm(name)
+		_, isPublicKeyAlgorithm := parsePublicKeyAlgorithm(name)
+		if !isSignatureAlgorithm && !isPublicKeyAlgorithm {
+			return nil, status.Errorf(codes.InvalidArgument, "allowed_csr_algorithms contains %q, which is not a known signature or public key algorithm", name)
+		}
+	}
+
+	for _, name := range config.AllowedKeyUsages {
+		usage, ok := keyUsages[name]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "allowed_key_usages contains unknown key usage %q", name)
+		}
+		config.allowedKeyUsages |= usage
+	}
+
+	if config.Kafka != nil {
+		if len(config.Kafka.Brokers) == 0 {
+			return nil, status.Error(codes.InvalidArgument, "kafka.brokers is required when kafka output is configured")
+		}
+		if config.Kafka.Topic == "" {
+			return nil, status.Error(codes.InvalidArgument, "kafka.topic is required when kafka output is configured")
+		}
+		switch config.Kafka.FailureMode {
+		case "", kafkaFailureModeDrop, kafkaFailureModeFail:
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "kafka.failure_mode must be one of drop or fail, got %q", config.Kafka.FailureMode)
+		}
+	}
+
+	if config.KubernetesOutput != nil {
+		if config.KubernetesOutput.Namespace == "" {
+			return nil, status.Error(codes.InvalidArgument, "kubernetes_output.namespace is required when kubernetes output is configured")
+		}
+		if config.KubernetesOutput.Name == "" {
+			return nil, status.Error(codes.InvalidArgument, "kubernetes_output.name is required when kubernetes output is configured")
+		}
+	}
+
+	if config.Transport == nil {
+		config.Transport = &TransportConfig{}
+	}
+	if config.Transport.MaxIdleConns == 0 {
+		config.Transport.MaxIdleConns = defaultTransportMaxIdleConns
+	}
+	if config.Transport.MaxIdleConns < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "transport.max_idle_conns must not be negative, got %d", config.Transport.MaxIdleConns)
+	}
+	if config.Transport.MaxIdleConnsPerHost == 0 {
+		config.Transport.MaxIdleConnsPerHost = defaultTransportMaxIdleConnsPerHost
+	}
+	if config.Transport.MaxIdleConnsPerHost < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "transport.max_idle_conns_per_host must not be negative, got %d", config.Transport.MaxIdleConnsPerHost)
+	}
+	config.Transport.idleConnTimeout = defaultTransportIdleConnTimeout
+	if config.Transport.IdleConnTimeout != "" {
+		idleConnTimeout, err := time.ParseDuration(config.Transport.IdleConnTimeout)
+		if err != nil || idleConnTimeout <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "transport.idle_conn_timeout must be a positive duration, got %q", config.Transport.IdleConnTimeout)
+		}
+		config.Transport.idleConnTimeout = idleConnTimeout
+	}
+	config.Transport.tlsHandshakeTimeout = defaultTransportTLSHandshakeTimeout
+	if config.Transport.TLSHandshakeTimeout != "" {
+		tlsHandshakeTimeout, err := time.ParseDuration(config.Transport.TLSHandshakeTimeout)
+		if err != nil || tlsHandshakeTimeout <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "transport.tls_handshake_timeout must be a positive duration, got %q", config.Transport.TLSHandshakeTimeout)
+		}
+		config.Transport.tlsHandshakeTimeout = tlsHandshakeTimeout
+	}
+
+	if config.FollowAIA {
+		config.aiaClient = newAiaClient(config)
+	}
+
+	if config.Retry != nil {
+		if config.Retry.MaxAttempts == 0 {
+			config.Retry.MaxAttempts = defaultRetryMaxAttempts
+		}
+		if config.Retry.MaxAttempts < 1 {
+			return nil, status.Errorf(codes.InvalidArgument, "retry.max_attempts must be at least 1, got %d", config.Retry.MaxAttempts)
+		}
+
+		config.Retry.initialBackoff = defaultRetryInitialBackoff
+		if config.Retry.InitialBackoff != "" {
+			initialBackoff, err := time.ParseDuration(config.Retry.InitialBackoff)
+			if err != nil || initialBackoff <= 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "retry.initial_backoff must be a positive duration, got %q", config.Retry.InitialBackoff)
+			}
+			config.Retry.initialBackoff = initialBackoff
+		}
+
+		config.Retry.maxBackoff = defaultRetryMaxBackoff
+		if config.Retry.MaxBackoff != "" {
+			maxBackoff, err := time.ParseDuration(config.Retry.MaxBackoff)
+			if err != nil || maxBackoff <= 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "retry.max_backoff must be a positive duration, got %q", config.Retry.MaxBackoff)
+			}
+			config.Retry.maxBackoff = maxBackoff
+		}
+		config.Retry.maxBackoff = max(config.Retry.maxBackoff, config.Retry.initialBackoff)
+
+		if len(config.Retry.RetryableStatusCodes) == 0 {
+			config.Retry.RetryableStatusCodes = defaultRetryableStatusCodes
+		}
+	}
+
+	switch config.DetectDuplicateSerials {
+	case "", detectDuplicateSerialsWarn, detectDuplicateSerialsError:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "detect_duplicate_serials must be one of warn or error, got %q", config.DetectDuplicateSerials)
+	}
+
+	switch config.EventLogFormat {
+	case "", eventLogFormatHclog, eventLogFormatKeyValue:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "event_log_format must be one of hclog or kv, got %q", config.EventLogFormat)
+	}
+
+	for sanType, name := range config.SANEncoding {
+		if _, ok := defaultSanEncoding[sanType]; !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "san_encoding contains unknown SAN type %q, expected one of dns, uri, ip, or email", sanType)
+		}
+		if name == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "san_encoding for %s must not be empty", sanType)
+		}
+	}
+
+	switch config.EnrollmentProtocol {
+	case "", enrollmentProtocolRest:
+	case enrollmentProtocolAcme:
+		if config.Acme == nil || config.Acme.DirectoryURL == "" {
+			return nil, status.Error(codes.InvalidArgument, "acme.directory_url is required when enrollment_protocol is acme")
+		}
+		if config.AccountBindingID != "" && config.Acme.EabHmacKey == "" {
+			return nil, status.Error(codes.InvalidArgument, "acme.eab_hmac_key is required for the external account binding identified by account_binding_id")
+		}
+		if config.Acme.EabHmacKey != "" {
+			if config.AccountBindingID == "" {
+				return nil, status.Error(codes.InvalidArgument, "account_binding_id is required when acme.eab_hmac_key is set")
+			}
+			key, err := parseEabHmacKey(config.Acme.EabHmacKey)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "acme.eab_hmac_key is not valid base64url: %v", err)
+			}
+			config.Acme.eabHmacKey = key
+		}
+	case enrollmentProtocolAsyncBroker:
+		if config.AsyncBroker == nil || len(config.AsyncBroker.Brokers) == 0 {
+			return nil, status.Error(codes.InvalidArgument, "async_broker.brokers is required when enrollment_protocol is async_broker")
+		}
+		if config.AsyncBroker.RequestTopic == "" || config.AsyncBroker.ResponseTopic == "" {
+			return nil, status.Error(codes.InvalidArgument, "async_broker.request_topic and async_broker.response_topic are required when enrollment_protocol is async_broker")
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "enrollment_protocol must be one of rest, acme, or async_broker, got %q", config.EnrollmentProtocol)
+	}
+
+	switch config.APIVersion {
+	case "":
+		config.APIVersion = apiVersionV1
+	case apiVersionV1, apiVersionV2:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "api_version must be one of v1 or v2, got %q", config.APIVersion)
+	}
+
+	switch config.AutoAccountBinding {
+	case "":
+	case autoAccountBindingDerive, autoAccountBindingCreate:
+		if config.AccountBindingID != "" {
+			return nil, status.Error(codes.InvalidArgument, "account_binding_id and auto_account_binding are mutually exclusive")
+		}
+		if config.EnrollmentProtocol == enrollmentProtocolAcme {
+			return nil, status.Error(codes.InvalidArgument, "auto_account_binding is not supported when enrollment_protocol is acme")
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "auto_account_binding must be one of derive or create, got %q", config.AutoAccountBinding)
+	}
+
+	if config.MaxCSRBytes < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "max_csr_bytes must not be negative, got %d", config.MaxCSRBytes)
+	}
+
+	if config.RateLimitThreshold < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "rate_limit_threshold must not be negative, got %d", config.RateLimitThreshold)
+	}
+
+	if config.ResponseEnvelopePath != "" {
+		config.responseEnvelopePath = strings.Split(config.ResponseEnvelopePath, ".")
+		if slices.Contains(config.responseEnvelopePath, "") {
+			return nil, status.Errorf(codes.InvalidArgument, "response_envelope_path must be a dot-separated path of field names, got %q", config.ResponseEnvelopePath)
+		}
+	}
+
+	switch config.EndEntityNameCollision {
+	case "":
+	case endEntityNameCollisionIncrement:
+		if config.ResetEndEntityStatus {
+			return nil, status.Error(codes.InvalidArgument, "end_entity_name_collision and reset_end_entity_status are mutually exclusive")
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "end_entity_name_collision must be \"increment\", got %q", config.EndEntityNameCollision)
+	}
+
+	if config.FailOnApprovalRequired && config.TwoPhaseEnrollment {
+		return nil, status.Error(codes.InvalidArgument, "fail_on_approval_required and two_phase_enrollment are mutually exclusive")
+	}
+
+	switch config.RequestFormat {
+	case "", requestFormatPkcs10, requestFormatCrmf:
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "request_format must be one of pkcs10 or crmf, got %q", config.RequestFormat)
+	}
+
+	switch config.PromoteSANToCN {
+	case "", "dns", "uri":
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "promote_san_to_cn must be one of dns or uri, got %q", config.PromoteSANToCN)
+	}
+
 	return config, nil
 }
 
@@ -123,7 +615,7 @@ func (p *Plugin) getAuthenticator(config *Config) (ejbcaclient.Authenticator, er
 	if config.CaCert != "" {
 		logger.Trace("Parsing CA chain from configuration")
 
-		chain, err := pemutil.ParseCertificates([]byte(config.CaCert))
+		chain, err := p.parseCaChain([]byte(config.CaCert))
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse CA chain: %w", err)
 		}
@@ -138,7 +630,7 @@ func (p *Plugin) getAuthenticator(config *Config) (ejbcaclient.Authenticator, er
 			return nil, fmt.Errorf("failed to read CA chain from file: %w", err)
 		}
 
-		chain, err := pemutil.ParseCertificates(caChainBytes)
+		chain, err := p.parseCaChain(caChainBytes)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse CA chain: %w", err)
 		}
@@ -166,11 +658,19 @@ func (p *Plugin) getAuthenticator(config *Config) (ejbcaclient.Authenticator, er
 			return nil, fmt.Errorf("failed to build OAuth authenticator: %w", err)
 		}
 
+		if config.OAuth.MaxTokenResponseBytes > 0 || config.OAuth.tokenTLSMinVersion != 0 || config.OAuth.tokenRequestTimeout > 0 {
+			logger.Debug("Configuring OAuth token client", "maxTokenResponseBytes", config.OAuth.MaxTokenResponseBytes, "tokenTLSMinVersion", config.OAuth.TokenTLSMinVersion, "tokenRequestTimeout", config.OAuth.tokenRequestTimeout)
+			err = configureTokenSource(authenticator, config.OAuth, newTokenTransport(config.OAuth))
+			if err != nil {
+				return nil, fmt.Errorf("failed to configure OAuth token source: %w", err)
+			}
+		}
+
 		logger.Debug("Created OAuth authenticator")
 	case config.CertAuth != nil:
 		logger.Trace("Creating mTLS authenticator")
 
-		var tlsCert tls.Certificate
+		var tlsCerts []tls.Certificate
 		if config.CertAuth.ClientCertPath != "" {
 			logger.Debug("Reading client certificate from file", "path", config.CertAuth.ClientCertPath)
 			clientCertBytes, err := p.hooks.readFile(config.CertAuth.ClientCertPath)
@@ -187,29 +687,158 @@ func (p *Plugin) getAuthenticator(config *Config) (ejbcaclient.Authenticator, er
 			}
 			config.CertAuth.ClientKey = string(clientKeyBytes)
 		}
+		if config.CertAuth.ClientCert != "" {
+			tlsCert, err := tls.X509KeyPair([]byte(config.CertAuth.ClientCert), []byte(config.CertAuth.ClientKey))
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client certificate: %w", err)
+			}
+			tlsCerts = append(tlsCerts, tlsCert)
+		}
 
-		tlsCert, err := tls.X509KeyPair([]byte(config.CertAuth.ClientCert), []byte(config.CertAuth.ClientKey))
-		if err != nil {
-			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		for i, clientCertificate := range config.CertAuth.ClientCertificates {
+			tlsCert, err := p.loadClientCertificate(clientCertificate)
+			if err != nil {
+				return nil, fmt.Errorf("client_certificates[%d]: %w", i, err)
+			}
+			tlsCerts = append(tlsCerts, tlsCert)
 		}
 
 		authenticator, err = ejbcaclient.NewMTLSAuthenticatorBuilder().
-			WithClientCertificate(&tlsCert).
+			WithClientCertificate(&tlsCerts[0]).
 			WithCaCertificates(caChain).
 			Build()
 		if err != nil {
 			return nil, fmt.Errorf("failed to build MTLS authenticator: %w", err)
 		}
 
+		if len(tlsCerts) > 1 {
+			logger.Debug("Selecting the client certificate by the CAs requested by EJBCA", "clientCertificates", len(tlsCerts))
+			err = configureTransport(authenticator, func(transport *http.Transport) {
+				transport.TLSClientConfig.Certificates = nil
+				transport.TLSClientConfig.GetClientCertificate = p.newClientCertificateSelector(tlsCerts)
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to configure HTTP transport: %w", err)
+			}
+		}
+
 		logger.Debug("Created mTLS authenticator")
 	default:
 		logger.Error("No authentication method specified")
 		return nil, status.Error(codes.InvalidArgument, "no authentication method specified")
 	}
 
+	if config.AllowPartialCACertChain && len(caChain) > 0 {
+		logger.Debug("Trusting system roots in addition to the configured CA chain")
+
+		rootCAs, err := p.hooks.systemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load system cert pool: %w", err)
+		}
+		for _, cert := range caChain {
+			rootCAs.AddCert(cert)
+		}
+
+		err = configureTransport(authenticator, func(transport *http.Transport) {
+			transport.TLSClientConfig.RootCAs = rootCAs
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure HTTP transport: %w", err)
+		}
+	}
+
 	return authenticator, nil
 }
 
+// loadClientCertificate loads the client certificate and key of an entry of client_certificates, reading them from
+// their paths if set.
+func (p *Plugin) loadClientCertificate(config ClientCertificateConfig) (tls.Certificate, error) {
+	certPem, keyPem := []byte(config.ClientCert), []byte(config.ClientKey)
+	if config.ClientCertPath != "" {
+		var err error
+		if certPem, err = p.hooks.readFile(config.ClientCertPath); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to read client certificate from file: %w", err)
+		}
+	}
+	if config.ClientKeyPath != "" {
+		var err error
+		if keyPem, err = p.hooks.readFile(config.ClientKeyPath); err != nil {
+			return tls.Certificate{}, fmt.Errorf("failed to read client key from file: %w", err)
+		}
+	}
+
+	tlsCert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	return tlsCert, nil
+}
+
+// loadClientP12 decodes the PKCS#12 keystore at client_p12_path with client_p12_password and stores its certificate
+// and key on certAuth as PEM-encoded client_cert and client_key, so that the keystore is loaded like inline
+// credentials. The CA certificates of the keystore follow the client certificate.
+func (p *Plugin) loadClientP12(certAuth *CertAuthConfig) error {
+	p12, err := p.hooks.readFile(certAuth.ClientP12Path)
+	if err != nil {
+		return fmt.Errorf("failed to read keystore: %w", err)
+	}
+	key, cert, caCerts, err := pkcs12.DecodeChain(p12, certAuth.ClientP12Password)
+	if err != nil {
+		return fmt.Errorf("failed to decode keystore: %w", err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %w", err)
+	}
+
+	var certPem []byte
+	for _, chainCert := range append([]*x509.Certificate{cert}, caCerts...) {
+		certPem = append(certPem, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chainCert.Raw})...)
+	}
+	certAuth.ClientCert = string(certPem)
+	certAuth.ClientKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}))
+	return nil
+}
+
+// newClientCertificateSelector returns a tls.Config GetClientCertificate callback that presents the first of
+// tlsCerts that is issued by one of the CAs in EJBCA's certificate request. If none is, the first certificate is
+// presented, so that EJBCA reports why it rejects it.
+func (p *Plugin) newClientCertificateSelector(tlsCerts []tls.Certificate) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	logger := p.logger.Named("selectClientCertificate")
+	return func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		for i := range tlsCerts {
+			if err := cri.SupportsCertificate(&tlsCerts[i]); err == nil {
+				logger.Debug("Presenting client certificate issued by a CA requested by EJBCA", "index", i)
+				return &tlsCerts[i], nil
+			}
+		}
+		logger.Warn("No client certificate is issued by a CA requested by EJBCA - presenting the first one", "acceptableCAs", len(cri.AcceptableCAs))
+		return &tlsCerts[0], nil
+	}
+}
+
+// parseCaChain parses the PEM-encoded CA chain, reusing the result of the previous call if the content hasn't
+// changed.
+func (p *Plugin) parseCaChain(caChainPem []byte) ([]*x509.Certificate, error) {
+	hash := sha256.Sum256(caChainPem)
+
+	p.caChainCache.Lock()
+	defer p.caChainCache.Unlock()
+	if p.caChainCache.chain != nil && p.caChainCache.hash == hash {
+		p.logger.Trace("Reusing previously parsed CA chain")
+		return p.caChainCache.chain, nil
+	}
+
+	chain, err := p.hooks.parseCertificates(caChainPem)
+	if err != nil {
+		return nil, err
+	}
+
+	p.caChainCache.hash = hash
+	p.caChainCache.chain = chain
+	return chain, nil
+}
+
 // newEjbcaClient generates a new EJBCA client based on the provided configuration.
 func (p *Plugin) newEjbcaClient(config *Config, authenticator ejbcaclient.Authenticator) (ejbcaClient, error) {
 	logger := p.logger.Named("newEjbcaClient")
@@ -220,6 +849,32 @@ func (p *Plugin) newEjbcaClient(config *Config, authenticator ejbcaclient.Authen
 		return nil, status.Error(codes.InvalidArgument, "authenticator is required")
 	}
 
+	var http2Err error
+	err := configureTransport(authenticator, func(transport *http.Transport) {
+		transport.TLSClientConfig.VerifyConnection = p.newServerCertificateVerifier(config)
+		if config.Transport != nil {
+			config.Transport.apply(transport)
+		}
+		if config.proxyURL != nil {
+			transport.Proxy = http.ProxyURL(config.proxyURL)
+		}
+		if config.http2ReadIdleTimeout > 0 {
+			logger.Debug("Configuring HTTP/2 health checks", "readIdleTimeout", config.http2ReadIdleTimeout, "pingTimeout", config.http2PingTimeout)
+			http2Err = configureHTTP2(transport, config.http2ReadIdleTimeout, config.http2PingTimeout)
+		}
+	})
+	if err == nil {
+		err = http2Err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure HTTP transport: %w", err)
+	}
+
+	authenticator, err = wrapAuthenticator(authenticator, p.newTransportMiddleware(config))
+	if err != nil {
+		return nil, err
+	}
+
 	configuration := ejbcaclient.NewConfiguration()
 	configuration.Host = config.Hostname
 
@@ -230,6 +885,77 @@ func (p *Plugin) newEjbcaClient(config *Config, authenticator ejbcaclient.Authen
 		return nil, err
 	}
 
-	logger.Info("Created EJBCA REST API client for EJBCA UpstreamAuthority plugin")
-	return ejbcaClient.V1CertificateApi, nil
+	client := &apiClient{
+		V1CertificateApiService: ejbcaClient.V1CertificateApi,
+		V1CaApiService:          ejbcaClient.V1CaApi,
+		V1EndentityApiService:   ejbcaClient.V1EndentityApi,
+	}
+	if config.APIVersion == apiVersionV2 {
+		baseURL, err := ejbcaBaseURL(config.Hostname)
+		if err != nil {
+			return nil, err
+		}
+		client.httpClient, err = authenticator.GetHTTPClient()
+		if err != nil {
+			return nil, err
+		}
+		client.enrollV2URL = baseURL.JoinPath(enrollV2Path).String()
+	}
+
+	logger.Info("Created EJBCA REST API client for EJBCA UpstreamAuthority plugin", "apiVersion", config.APIVersion)
+	return client, nil
+}
+
+// ejbcaBaseURL returns the HTTPS URL of the EJBCA instance at hostname, which may or may not include a scheme.
+func ejbcaBaseURL(hostname string) (*url.URL, error) {
+	if !strings.HasPrefix(hostname, "http://") && !strings.HasPrefix(hostname, "https://") {
+		hostname = "https://" + hostname
+	}
+	u, err := url.Parse(hostname)
+	if err != nil {
+		return nil, fmt.Errorf("ejbca hostname is not a valid URL: %w", err)
+	}
+	return &url.URL{Scheme: "https", Host: u.Host}, nil
+}
+
+// reloadClient builds a new EJBCA client after re-reading the mTLS client certificate and key from
+// client_cert_path and client_key_path, and replaces the plugin's client with it.
+func (p *Plugin) reloadClient(config *Config) (ejbcaClient, error) {
+	if config.CertAuth == nil || config.CertAuth.ClientCertPath == "" || config.CertAuth.ClientKeyPath == "" {
+		return nil, errors.New("client_cert_path and client_key_path are required to reload the client certificate")
+	}
+
+	// getAuthenticator stores the credentials it reads on the config, so build from a copy to avoid racing
+	// with concurrent readers of the shared config.
+	reloadConfig := *config
+	certAuth := *config.CertAuth
+	reloadConfig.CertAuth = &certAuth
+
+	authenticator, err := p.hooks.newAuthenticator(&reloadConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := p.newEjbcaClient(&reloadConfig, authenticator)
+	if err != nil {
+		return nil, err
+	}
+
+	p.setClient(config, client)
+	return client, nil
+}
+
+// isClientCertRejected returns true if err was caused by the server rejecting the client certificate during the
+// TLS handshake, such as when the certificate has expired.
+func isClientCertRejected(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" || opErr.Err == nil {
+		return false
+	}
+
+	switch opErr.Err.Error() {
+	case "tls: bad certificate", "tls: expired certificate", "tls: revoked certificate", "tls: unknown certificate", "tls: certificate required":
+		return true
+	}
+	return false
 }
@@ -17,12 +17,15 @@ limitations under the License.
 package ejbca
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
@@ -34,13 +37,19 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
 	"github.com/hashicorp/go-hclog"
 	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	upstreamauthorityv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/upstreamauthority/v1"
+	configv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/service/common/config/v1"
+	"github.com/spiffe/spire/pkg/common/pemutil"
 	commonutil "github.com/spiffe/spire/pkg/common/util"
 	"github.com/spiffe/spire/pkg/server/plugin/upstreamauthority"
 	"github.com/spiffe/spire/test/clock"
@@ -49,7 +58,10 @@ import (
 	"github.com/spiffe/spire/test/testkey"
 	"github.com/spiffe/spire/test/util"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"software.sslmate.com/src/go-pkcs12"
 )
 
 var (
@@ -85,6 +97,15 @@ func TestConfigure(t *testing.T) {
 	require.NoError(t, err)
 	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyByte})
 
+	p12, err := pkcs12.Modern.Encode(svidIssuingCAKey, svidIssuingCA, []*x509.Certificate{rootCA}, "p12-password")
+	require.NoError(t, err)
+	readP12 := func(key string) ([]byte, error) {
+		if key == "/path/to/client.p12" {
+			return p12, nil
+		}
+		return nil, errors.New("file not found")
+	}
+
 	for i, tt := range []struct {
 		name     string
 		getEnv   getEnvFunc
@@ -628,225 +649,1855 @@ EOF
 			},
 			expectedgRPCCode: codes.OK,
 		},
-	} {
-		t.Run(tt.name, func(t *testing.T) {
-			var err error
-			p := New()
-
-			p.hooks.getEnv = tt.getEnv
-			p.hooks.readFile = tt.readFile
-
-			logOptions := hclog.DefaultOptions
-			logOptions.Level = hclog.Debug
-			p.SetLogger(hclog.Default())
-
-			options := []plugintest.Option{
-				plugintest.CaptureConfigureError(&err),
-				plugintest.Configure(tt.config),
-			}
-
-			plugintest.Load(t, builtin(p), new(upstreamauthority.V1), options...)
-			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
-			t.Logf("\ntestcase[%d] and err:%+v\n", i, err)
-		})
-	}
-}
-
-func TestMintX509CAAndSubscribe(t *testing.T) {
-	rootCA, intermediateCA, svidIssuingCA, _ := issueTestCertificates(t)
-
-	for _, tt := range []struct {
-		name string
-
-		// Config
-		certificateResponseFormat string
-		ejbcaStatusCode           int
-
-		// Request
-		caName                 string
-		endEntityProfileName   string
-		certificateProfileName string
-		endEntityName          string
-		accountBindingID       string
-
-		// Expected values
-		expectedgRPCCode      codes.Code
-		expectedMessagePrefix string
-		expectedEndEntityName string
-		expectedCaAndChain    []*x509.Certificate
-		expectedRootCAs       []*x509.Certificate
-	}{
 		{
-			name: "success_pem",
-
-			certificateResponseFormat: "PEM",
-			ejbcaStatusCode:           http.StatusOK,
-
-			caName:                 "Fake-Sub-CA",
-			endEntityProfileName:   "fakeSpireIntermediateCAEEP",
-			certificateProfileName: "fakeSubCACP",
-			endEntityName:          "",
-			accountBindingID:       "",
-
-			expectedgRPCCode:      codes.OK,
-			expectedMessagePrefix: "",
-			expectedEndEntityName: trustDomain.ID().String(),
-			expectedCaAndChain:    []*x509.Certificate{svidIssuingCA, intermediateCA},
-			expectedRootCAs:       []*x509.Certificate{rootCA},
+			name: "Client PKCS#12 keystore",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            ca_cert = <<EOF
+%s
+EOF
+            cert_auth {
+                client_p12_path = "/path/to/client.p12"
+                client_p12_password = "p12-password"
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            `, caPem),
+			getEnv:           os.Getenv,
+			readFile:         readP12,
+			expectedgRPCCode: codes.OK,
 		},
 		{
-			name: "success_der",
-
-			certificateResponseFormat: "DER",
-			ejbcaStatusCode:           http.StatusOK,
-
-			caName:                 "Fake-Sub-CA",
-			endEntityProfileName:   "fakeSpireIntermediateCAEEP",
-			certificateProfileName: "fakeSubCACP",
-			endEntityName:          "",
-			accountBindingID:       "",
-
-			expectedgRPCCode:      codes.OK,
-			expectedMessagePrefix: "",
-			expectedEndEntityName: trustDomain.ID().String(),
-			expectedCaAndChain:    []*x509.Certificate{svidIssuingCA, intermediateCA},
-			expectedRootCAs:       []*x509.Certificate{rootCA},
+			name: "Client PKCS#12 keystore password from environment",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            ca_cert = <<EOF
+%s
+EOF
+            cert_auth {
+                client_p12_path = "/path/to/client.p12"
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            `, caPem),
+			getEnv: func(key string) string {
+				if key == "EJBCA_CLIENT_P12_PASSWORD" {
+					return "p12-password"
+				}
+				return ""
+			},
+			readFile:         readP12,
+			expectedgRPCCode: codes.OK,
 		},
 		{
-			name: "fail_unknown_format",
-
-			certificateResponseFormat: "PKCS7",
-
-			caName:                 "Fake-Sub-CA",
-			endEntityProfileName:   "fakeSpireIntermediateCAEEP",
-			certificateProfileName: "fakeSubCACP",
-			endEntityName:          "",
-			accountBindingID:       "",
-
-			expectedgRPCCode:      codes.Internal,
-			expectedMessagePrefix: "upstreamauthority(ejbca): ejbca returned unsupported certificate format: PKCS7",
-			ejbcaStatusCode:       http.StatusOK,
-			expectedEndEntityName: trustDomain.ID().String(),
-			expectedCaAndChain:    []*x509.Certificate{svidIssuingCA, intermediateCA},
-			expectedRootCAs:       []*x509.Certificate{rootCA},
+			name: "Client PKCS#12 keystore with wrong password",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            ca_cert = <<EOF
+%s
+EOF
+            cert_auth {
+                client_p12_path = "/path/to/client.p12"
+                client_p12_password = "wrong-password"
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            `, caPem),
+			getEnv:                os.Getenv,
+			readFile:              readP12,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "invalid client_p12_path: failed to decode keystore",
 		},
 		{
-			name: "success_ejbca_api_error",
-
-			certificateResponseFormat: "PEM",
-			ejbcaStatusCode:           http.StatusBadRequest,
-
-			caName:                 "Fake-Sub-CA",
-			endEntityProfileName:   "fakeSpireIntermediateCAEEP",
-			certificateProfileName: "fakeSubCACP",
-			endEntityName:          "",
-			accountBindingID:       "",
-
-			expectedgRPCCode:      codes.Internal,
-			expectedMessagePrefix: "upstreamauthority(ejbca): EJBCA returned an error: failed to enroll CSR - 400 Bad Request - EJBCA API returned error",
-			expectedEndEntityName: trustDomain.ID().String(),
-			expectedCaAndChain:    []*x509.Certificate{svidIssuingCA, intermediateCA},
-			expectedRootCAs:       []*x509.Certificate{rootCA},
+			name: "Client PKCS#12 keystore with client cert",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_p12_path = "/path/to/client.p12"
+                client_p12_password = "p12-password"
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            `, certPem),
+			getEnv:                os.Getenv,
+			readFile:              readP12,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "client_p12_path can't be combined with client_cert or client_key",
 		},
-	} {
-		t.Run(tt.name, func(t *testing.T) {
-			var err error
-
-			testServer := httptest.NewTLSServer(http.HandlerFunc(
-				func(w http.ResponseWriter, r *http.Request) {
-					enrollRestRequest := ejbcaclient.EnrollCertificateRestRequest{}
-					err := json.NewDecoder(r.Body).Decode(&enrollRestRequest)
-					require.NoError(t, err)
-
-					// Perform assertions before fake enrollment
-					require.Equal(t, tt.caName, enrollRestRequest.GetCertificateAuthorityName())
-					require.Equal(t, tt.endEntityProfileName, enrollRestRequest.GetEndEntityProfileName())
-					require.Equal(t, tt.certificateProfileName, enrollRestRequest.GetCertificateProfileName())
-					require.Equal(t, tt.accountBindingID, enrollRestRequest.GetAccountBindingId())
-					require.Equal(t, tt.expectedEndEntityName, enrollRestRequest.GetUsername())
-
-					response := certificateRestResponseFromExpectedCerts(t, tt.expectedCaAndChain, tt.expectedRootCAs, tt.certificateResponseFormat)
-
-					w.Header().Add("Content-Type", "application/json")
-					w.WriteHeader(tt.ejbcaStatusCode)
-					err = json.NewEncoder(w).Encode(response)
-					require.NoError(t, err)
-				}))
-			defer testServer.Close()
-
-			p := New()
-			ua := new(upstreamauthority.V1)
-
-			logOptions := hclog.DefaultOptions
-			logOptions.Level = hclog.Debug
-			p.SetLogger(hclog.Default())
-
-			clientConfig := fakeClientConfig{
-				testServer: testServer,
-			}
-			p.hooks.newAuthenticator = clientConfig.newFakeAuthenticator
-
-			config := &Config{
-				Hostname: testServer.URL,
-
-				// We populate the client cert & client key to random values since newFakeAuthenticator doesn't have
-				// any built-in authentication.
-				CertAuth: &CertAuthConfig{
-					ClientCert: "BEGIN CERTIFICATE ... END CERTIFICATE",
-					ClientKey:  "BEGIN RSA PRIVATE KEY ... END RSA PRIVATE KEY",
-				},
-
-				CAName:                 tt.caName,
-				EndEntityProfileName:   tt.endEntityProfileName,
-				CertificateProfileName: tt.certificateProfileName,
-				DefaultEndEntityName:   tt.endEntityName,
-				AccountBindingID:       tt.accountBindingID,
-			}
-
-			options := []plugintest.Option{
-				plugintest.CaptureConfigureError(&err),
-				plugintest.ConfigureJSON(config),
-			}
-
-			plugintest.Load(t, builtin(p), ua, options...)
-			require.NoError(t, err)
-
-			priv := testkey.NewEC384(t)
-			csr, err := commonutil.MakeCSR(priv, trustDomain.ID())
-			require.NoError(t, err)
-
-			ctx := context.Background()
-			caAndChain, rootCAs, stream, err := ua.MintX509CA(ctx, csr, 30*time.Second)
-			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
-			if tt.expectedgRPCCode == codes.OK {
-				require.NotNil(t, stream)
-				require.NotNil(t, caAndChain)
-				require.NotNil(t, rootCAs)
-			}
-		})
-	}
-}
-
-func certificateRestResponseFromExpectedCerts(t *testing.T, issuingCaAndChain []*x509.Certificate, rootCAs []*x509.Certificate, format string) *ejbcaclient.CertificateRestResponse {
-	require.NotEqual(t, 0, len(issuingCaAndChain))
-	var issuingCa string
-	if format == "PEM" {
-		issuingCa = string(pem.EncodeToMemory(&pem.Block{Bytes: issuingCaAndChain[0].Raw, Type: "CERTIFICATE"}))
-	} else {
-		issuingCa = base64.StdEncoding.EncodeToString(issuingCaAndChain[0].Raw)
-	}
-
-	var caChain []string
-	if format == "PEM" {
-		for _, cert := range issuingCaAndChain[1:] {
-			caChain = append(caChain, string(pem.EncodeToMemory(&pem.Block{Bytes: cert.Raw, Type: "CERTIFICATE"})))
-		}
-		for _, cert := range rootCAs {
-			caChain = append(caChain, string(pem.EncodeToMemory(&pem.Block{Bytes: cert.Raw, Type: "CERTIFICATE"})))
-		}
-	} else {
-		for _, cert := range issuingCaAndChain[1:] {
-			caChain = append(caChain, base64.StdEncoding.EncodeToString(cert.Raw))
+		{
+			name: "Allow partial CA cert chain",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+			ca_cert = <<EOF
+%s
+EOF
+            allow_partial_ca_cert_chain = true
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            `, caPem, certPem, keyPem),
+			getEnv:           os.Getenv,
+			readFile:         os.ReadFile,
+			expectedgRPCCode: codes.OK,
+		},
+		{
+			name: "Unknown expected signature algorithm",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            expected_signature_algorithm = "SHA256-DSA-FAKE"
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "expected_signature_algorithm \"SHA256-DSA-FAKE\" is not a known signature algorithm",
+		},
+		{
+			name: "Unknown allowed key usage",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            allowed_key_usages = ["keyCertSign", "serverAuth"]
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "allowed_key_usages contains unknown key usage \"serverAuth\"",
+		},
+		{
+			name: "Invalid max enrollment duration",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            max_enrollment_duration = "soon"
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "max_enrollment_duration must be a positive duration, got \"soon\"",
+		},
+		{
+			name: "Invalid bundle poll interval",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            bundle_poll_interval = "-10m"
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "bundle_poll_interval must be a non-negative duration, got \"-10m\"",
+		},
+		{
+			name: "Invalid end entity TTL tag",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            end_entity_ttl_tag = "-1h"
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "end_entity_ttl_tag must be a positive duration, got \"-1h\"",
+		},
+		{
+			name: "Forward CSR EKU without allow-list",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            forward_csr_eku = true
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "allowed_csr_ekus is required when forward_csr_eku is enabled",
+		},
+		{
+			name: "Invalid token TLS min version",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            ca_cert = <<EOF
+%s
+EOF
+            oauth {
+                token_url = "https://dev.idp.com/oauth/token"
+                client_id = "fi3ElQUVoBBHyRNt4mpUxG9WY65AOCcJ"
+                client_secret = "1EXHdD7Ikmmv0OkBoJZZtzOG5iAzvwdqBVuvquf-QEvL6fLrEG_heJHphtEXVj9H"
+                token_tls_min_version = "1.1"
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            `, caPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "oauth.token_tls_min_version must be \"1.2\" or \"1.3\", got \"1.1\"",
+		},
+		{
+			name: "Invalid token request timeout",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            ca_cert = <<EOF
+%s
+EOF
+            oauth {
+                token_url = "https://dev.idp.com/oauth/token"
+                client_id = "fi3ElQUVoBBHyRNt4mpUxG9WY65AOCcJ"
+                client_secret = "1EXHdD7Ikmmv0OkBoJZZtzOG5iAzvwdqBVuvquf-QEvL6fLrEG_heJHphtEXVj9H"
+                token_request_timeout = "-5s"
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            `, caPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "oauth.token_request_timeout must be a positive duration, got \"-5s\"",
+		},
+		{
+			name: "Unsupported accepted response format",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            accepted_response_formats = ["PEM", "PKCS7"]
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "accepted_response_formats contains unsupported format \"PKCS7\", supported formats are PEM, DER",
+		},
+		{
+			name: "Invalid CA fingerprint",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            pinned_ca_fingerprint = "ab:cd:ef"
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "invalid pinned_ca_fingerprint: expected a 32 byte SHA-256 fingerprint, got 3 bytes",
+		},
+		{
+			name: "Unknown SAN encoding type",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            forward_csr_sans = true
+            san_encoding {
+                upn = "userPrincipalName"
+            }
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "san_encoding contains unknown SAN type \"upn\", expected one of dns, uri, ip, or email",
+		},
+		{
+			name: "Negative required path len",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            require_path_len = -1
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "require_path_len must not be negative, got -1",
+		},
+		{
+			name: "ACME without directory URL",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            enrollment_protocol = "acme"
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "acme.directory_url is required when enrollment_protocol is acme",
+		},
+		{
+			name: "Async broker without response topic",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            enrollment_protocol = "async_broker"
+            async_broker {
+                brokers = ["kafka-0.example.com:9092"]
+                request_topic = "ejbca-enroll-requests"
+            }
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "async_broker.request_topic and async_broker.response_topic are required when enrollment_protocol is async_broker",
+		},
+		{
+			name: "Unsupported request format",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            request_format = "spkac"
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "request_format must be one of pkcs10 or crmf, got \"spkac\"",
+		},
+		{
+			name: "Unknown allowed CSR algorithm",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            allowed_csr_algorithms = ["SHA256-RSAPSS", "RSA-PSS"]
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "allowed_csr_algorithms contains \"RSA-PSS\", which is not a known signature or public key algorithm",
+		},
+		{
+			name: "Account binding ID with auto account binding",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            account_binding_id = "spire"
+            auto_account_binding = "create"
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "account_binding_id and auto_account_binding are mutually exclusive",
+		},
+		{
+			name: "Unknown duplicate serial detection mode",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            detect_duplicate_serials = "fail"
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "detect_duplicate_serials must be one of warn or error, got \"fail\"",
+		},
+		{
+			name: "Unknown API version",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            api_version = "v3"
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "api_version must be one of v1 or v2, got \"v3\"",
+		},
+		{
+			name: "Invalid expected intermediate fingerprint",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            expected_intermediate_fingerprints = ["abcd"]
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "invalid expected_intermediate_fingerprints entry \"abcd\": expected a 32 byte SHA-256 fingerprint, got 2 bytes",
+		},
+		{
+			name: "Unknown end entity name collision mode",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            end_entity_name_collision = "hash"
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "end_entity_name_collision must be \"increment\", got \"hash\"",
+		},
+		{
+			name: "End entity name collision with reset end entity status",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            end_entity_name_collision = "increment"
+            reset_end_entity_status = true
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "end_entity_name_collision and reset_end_entity_status are mutually exclusive",
+		},
+		{
+			name: "Negative rate limit threshold",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            rate_limit_threshold = -1
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "rate_limit_threshold must not be negative, got -1",
+		},
+		{
+			name: "Client certificates entry without key",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_certificates = [
+                    {
+                        client_cert = <<EOF
+%s
+EOF
+                        client_key = <<EOF
+%s
+EOF
+                    },
+                    {
+                        client_cert_path = "/etc/spire/ejbca-client-two.pem"
+                    },
+                ]
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "client_certificates[1]: client_key or client_key_path is required",
+		},
+		{
+			name: "Unknown end entity name RDN attribute",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            end_entity_name = "rdn:favoriteColor"
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "invalid end_entity_name: unknown RDN attribute \"favoriteColor\"",
+		},
+		{
+			name: "Invalid end entity name template",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            end_entity_name = "spire-{{.CommonName"
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "invalid end_entity_name: failed to parse end entity name template",
+		},
+		{
+			name: "Invalid rdn_multiple_values",
+			config: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            rdn_multiple_values = "last"
+            `, certPem, keyPem),
+			getEnv:                os.Getenv,
+			readFile:              os.ReadFile,
+			expectedgRPCCode:      codes.InvalidArgument,
+			expectedMessagePrefix: "rdn_multiple_values must be one of first, join, or error, got \"last\"",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			p := New()
+
+			p.hooks.getEnv = tt.getEnv
+			p.hooks.readFile = tt.readFile
+
+			logOptions := hclog.DefaultOptions
+			logOptions.Level = hclog.Debug
+			p.SetLogger(hclog.Default())
+
+			options := []plugintest.Option{
+				plugintest.CaptureConfigureError(&err),
+				plugintest.Configure(tt.config),
+			}
+
+			plugintest.Load(t, builtin(p), new(upstreamauthority.V1), options...)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+			t.Logf("\ntestcase[%d] and err:%+v\n", i, err)
+		})
+	}
+}
+
+func TestRefuseRoot(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("refuse_root has no effect on Windows")
+	}
+
+	for _, tt := range []struct {
+		name string
+
+		refuseRoot bool
+		euid       int
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:                  "root refused",
+			refuseRoot:            true,
+			euid:                  0,
+			expectedgRPCCode:      codes.FailedPrecondition,
+			expectedMessagePrefix: "refusing to run as root (effective UID 0) because refuse_root is set",
+		},
+		{
+			name:             "non-root allowed",
+			refuseRoot:       true,
+			euid:             1000,
+			expectedgRPCCode: codes.OK,
+		},
+		{
+			name:             "root allowed without refuse_root",
+			refuseRoot:       false,
+			euid:             0,
+			expectedgRPCCode: codes.OK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := newFakeEnrollServer(t, nil)
+			defer testServer.Close()
+
+			p := New()
+			p.SetLogger(hclog.Default())
+			p.hooks.newAuthenticator = (&fakeClientConfig{testServer: testServer}).newFakeAuthenticator
+			p.hooks.geteuid = func() int { return tt.euid }
+
+			var err error
+			plugintest.Load(t, builtin(p), new(upstreamauthority.V1),
+				plugintest.CaptureConfigureError(&err),
+				plugintest.ConfigureJSON(&Config{
+					Hostname: testServer.URL,
+					CertAuth: &CertAuthConfig{
+						ClientCert: "BEGIN CERTIFICATE ... END CERTIFICATE",
+						ClientKey:  "BEGIN RSA PRIVATE KEY ... END RSA PRIVATE KEY",
+					},
+					CAName:                 "Fake-Sub-CA",
+					EndEntityProfileName:   "fakeSpireIntermediateCAEEP",
+					CertificateProfileName: "fakeSubCACP",
+					RefuseRoot:             tt.refuseRoot,
+				}),
+			)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+		})
+	}
+}
+
+func TestConfigureClosesComponentsOnError(t *testing.T) {
+	// Occupy a port so that serving Prometheus metrics on it fails
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	for _, tt := range []struct {
+		name string
+
+		notifySocket            string
+		prometheusListenAddress string
+
+		expectedMessagePrefix string
+	}{
+		{
+			name:                  "notify socket fails",
+			notifySocket:          filepath.Join(t.TempDir(), "missing", "notify.sock"),
+			expectedMessagePrefix: "failed to listen on notify_socket: ",
+		},
+		{
+			name:                    "prometheus fails",
+			prometheusListenAddress: listener.Addr().String(),
+			expectedMessagePrefix:   "failed to serve Prometheus metrics: ",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := newFakeEnrollServer(t, nil)
+			defer testServer.Close()
+
+			producer := newFakeKafkaProducer()
+			broker := newFakeAsyncBroker(t, nil)
+
+			p := New()
+			p.SetLogger(hclog.Default())
+			p.hooks.newAuthenticator = (&fakeClientConfig{testServer: testServer}).newFakeAuthenticator
+			p.hooks.newKafkaProducer = producer.newKafkaProducer
+			p.hooks.newAsyncBroker = broker.newAsyncBroker
+
+			var err error
+			plugintest.Load(t, builtin(p), new(upstreamauthority.V1),
+				plugintest.CaptureConfigureError(&err),
+				plugintest.ConfigureJSON(&Config{
+					Hostname: testServer.URL,
+					CertAuth: &CertAuthConfig{
+						ClientCert: "BEGIN CERTIFICATE ... END CERTIFICATE",
+						ClientKey:  "BEGIN RSA PRIVATE KEY ... END RSA PRIVATE KEY",
+					},
+					CAName:                 "Fake-Sub-CA",
+					EndEntityProfileName:   "fakeSpireIntermediateCAEEP",
+					CertificateProfileName: "fakeSubCACP",
+					EnrollmentProtocol:     "async_broker",
+					AsyncBroker: &AsyncBrokerConfig{
+						Brokers:       []string{"kafka-0.example.com:9092"},
+						RequestTopic:  "ejbca-enroll-requests",
+						ResponseTopic: "ejbca-enroll-responses",
+					},
+					Kafka: &KafkaConfig{
+						Brokers: []string{"kafka-0.example.com:9092"},
+						Topic:   "spire-bundles",
+					},
+					NotifySocket:            tt.notifySocket,
+					PrometheusListenAddress: tt.prometheusListenAddress,
+				}),
+			)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, codes.InvalidArgument, tt.expectedMessagePrefix)
+
+			require.NotNil(t, producer.config)
+			require.True(t, producer.closed)
+			require.NotNil(t, broker.config)
+			broker.mu.Lock()
+			require.True(t, broker.closed)
+			broker.mu.Unlock()
+			require.Nil(t, p.getNotifySocket())
+			require.Nil(t, p.getPrometheusServer())
+		})
+	}
+}
+
+func TestClientCertificateSelection(t *testing.T) {
+	now := time.Now()
+	newCA := func(cn string) (*x509.Certificate, *ecdsa.PrivateKey) {
+		ca, caKey, err := util.SelfSign(&x509.Certificate{
+			Subject:               pkix.Name{CommonName: cn},
+			SerialNumber:          big.NewInt(1),
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(time.Hour),
+		})
+		require.NoError(t, err)
+		return ca, caKey
+	}
+	newLeaf := func(cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, ekus []x509.ExtKeyUsage, ips []net.IP) (*x509.Certificate, *ecdsa.PrivateKey) {
+		cert, key, err := util.Sign(&x509.Certificate{
+			Subject:      pkix.Name{CommonName: cn},
+			SerialNumber: big.NewInt(2),
+			IPAddresses:  ips,
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  ekus,
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     now.Add(time.Hour),
+		}, parent, parentKey)
+		require.NoError(t, err)
+		return cert, key
+	}
+	encodeKey := func(key *ecdsa.PrivateKey) string {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		require.NoError(t, err)
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	}
+	encodeCert := func(cert *x509.Certificate) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	}
+
+	serverCA, serverCAKey := newCA("Fake-TLS-CA")
+	serverCert, serverKey := newLeaf("127.0.0.1", serverCA, serverCAKey, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}, []net.IP{net.ParseIP("127.0.0.1")})
+	clientCAOne, clientCAOneKey := newCA("Fake-Client-CA-One")
+	clientCATwo, clientCATwoKey := newCA("Fake-Client-CA-Two")
+	clientCertOne, clientKeyOne := newLeaf("spire-client-one", clientCAOne, clientCAOneKey, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, nil)
+	clientCertTwo, clientKeyTwo := newLeaf("spire-client-two", clientCATwo, clientCATwoKey, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, nil)
+
+	for _, tt := range []struct {
+		name string
+
+		requestedCA *x509.Certificate
+
+		expectedClientCert string
+	}{
+		{
+			name:               "first certificate requested",
+			requestedCA:        clientCAOne,
+			expectedClientCert: "spire-client-one",
+		},
+		{
+			name:               "additional certificate requested",
+			requestedCA:        clientCATwo,
+			expectedClientCert: "spire-client-two",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var presented string
+			testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				presented = r.TLS.PeerCertificates[0].Subject.CommonName
+			}))
+			clientCAs := x509.NewCertPool()
+			clientCAs.AddCert(tt.requestedCA)
+			testServer.TLS = &tls.Config{
+				Certificates: []tls.Certificate{{Certificate: [][]byte{serverCert.Raw}, PrivateKey: serverKey}},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    clientCAs,
+			}
+			testServer.StartTLS()
+			defer testServer.Close()
+
+			p := New()
+			p.SetLogger(hclog.Default())
+			authenticator, err := p.getAuthenticator(&Config{
+				CaCert: encodeCert(serverCA),
+				CertAuth: &CertAuthConfig{
+					ClientCert: encodeCert(clientCertOne),
+					ClientKey:  encodeKey(clientKeyOne),
+					ClientCertificates: []ClientCertificateConfig{
+						{
+							ClientCert: encodeCert(clientCertTwo),
+							ClientKey:  encodeKey(clientKeyTwo),
+						},
+					},
+				},
+			})
+			require.NoError(t, err)
+			client, err := authenticator.GetHTTPClient()
+			require.NoError(t, err)
+
+			resp, err := client.Get(testServer.URL)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, tt.expectedClientCert, presented)
+		})
+	}
+}
+
+func TestAllowPartialCaCertChain(t *testing.T) {
+	now := time.Now()
+	systemRoot, systemRootKey, err := util.SelfSign(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Fake-System-Root-CA"},
+		SerialNumber:          big.NewInt(1),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+	})
+	require.NoError(t, err)
+
+	intermediateTemplate := func(cn string) *x509.Certificate {
+		return &x509.Certificate{
+			Subject:               pkix.Name{CommonName: cn},
+			SerialNumber:          big.NewInt(2),
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(time.Hour),
+		}
+	}
+	tlsIssuingCA, tlsIssuingCAKey, err := util.Sign(intermediateTemplate("Fake-TLS-Issuing-CA"), systemRoot, systemRootKey)
+	require.NoError(t, err)
+	otherIssuingCA, _, err := util.Sign(intermediateTemplate("Fake-Other-Issuing-CA"), systemRoot, systemRootKey)
+	require.NoError(t, err)
+
+	serverCert := issueTLSServerCertificate(t, tlsIssuingCA, tlsIssuingCAKey)
+	serverCert.Certificate = append(serverCert.Certificate, tlsIssuingCA.Raw)
+
+	testServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	testServer.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+	testServer.StartTLS()
+	defer testServer.Close()
+
+	clientCert := issueTLSServerCertificate(t, tlsIssuingCA, tlsIssuingCAKey)
+	clientKeyBytes, err := x509.MarshalPKCS8PrivateKey(clientCert.PrivateKey)
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name string
+
+		caCert                  *x509.Certificate
+		allowPartialCACertChain bool
+
+		expectConnectionError bool
+	}{
+		{
+			name:                    "intermediate ca_cert chains to system root",
+			caCert:                  otherIssuingCA,
+			allowPartialCACertChain: true,
+		},
+		{
+			name:                  "intermediate ca_cert without system roots",
+			caCert:                otherIssuingCA,
+			expectConnectionError: true,
+		},
+		{
+			name:   "issuing ca_cert without system roots",
+			caCert: tlsIssuingCA,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := New()
+			p.SetLogger(hclog.Default())
+			p.hooks.systemCertPool = func() (*x509.CertPool, error) {
+				pool := x509.NewCertPool()
+				pool.AddCert(systemRoot)
+				return pool, nil
+			}
+
+			config := &Config{
+				Hostname:                testServer.URL,
+				CaCert:                  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tt.caCert.Raw})),
+				AllowPartialCACertChain: tt.allowPartialCACertChain,
+				CertAuth: &CertAuthConfig{
+					ClientCert: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCert.Certificate[0]})),
+					ClientKey:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: clientKeyBytes})),
+				},
+			}
+
+			authenticator, err := p.hooks.newAuthenticator(config)
+			require.NoError(t, err)
+			client, err := authenticator.GetHTTPClient()
+			require.NoError(t, err)
+
+			resp, err := client.Get(testServer.URL)
+			if tt.expectConnectionError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			resp.Body.Close()
+		})
+	}
+}
+
+func TestCaCertParseCache(t *testing.T) {
+	rootCA, intermediateCA, svidIssuingCA, svidIssuingCAKey := issueTestCertificates(t)
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: svidIssuingCA.Raw})
+	keyByte, err := x509.MarshalECPrivateKey(svidIssuingCAKey)
+	require.NoError(t, err)
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyByte})
+
+	p := New()
+	p.SetLogger(hclog.Default())
+
+	parses := 0
+	p.hooks.parseCertificates = func(b []byte) ([]*x509.Certificate, error) {
+		parses++
+		return pemutil.ParseCertificates(b)
+	}
+
+	configure := func(caCert *x509.Certificate) {
+		_, err := p.Configure(context.Background(), &configv1.ConfigureRequest{
+			HclConfiguration: fmt.Sprintf(`
+            hostname = "ejbca.example.org"
+            ca_cert = <<EOF
+%s
+EOF
+            cert_auth {
+                client_cert = <<EOF
+%s
+EOF
+                client_key = <<EOF
+%s
+EOF
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            `, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), certPem, keyPem),
+		})
+		require.NoError(t, err)
+	}
+
+	configure(rootCA)
+	require.Equal(t, 1, parses)
+
+	configure(rootCA)
+	require.Equal(t, 1, parses, "unchanged ca_cert should not be parsed again")
+
+	configure(intermediateCA)
+	require.Equal(t, 2, parses, "changed ca_cert should be parsed again")
+
+	configure(intermediateCA)
+	require.Equal(t, 2, parses)
+}
+
+func TestMintX509CAAndSubscribe(t *testing.T) {
+	rootCA, intermediateCA, svidIssuingCA, _ := issueTestCertificates(t)
+
+	for _, tt := range []struct {
+		name string
+
+		// Config
+		certificateResponseFormat string
+		acceptedResponseFormats   []string
+		ejbcaStatusCode           int
+
+		// Request
+		caName                 string
+		endEntityProfileName   string
+		certificateProfileName string
+		endEntityName          string
+		accountBindingID       string
+
+		// Expected values
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+		expectedEndEntityName string
+		expectedCaAndChain    []*x509.Certificate
+		expectedRootCAs       []*x509.Certificate
+	}{
+		{
+			name: "success_pem",
+
+			certificateResponseFormat: "PEM",
+			ejbcaStatusCode:           http.StatusOK,
+
+			caName:                 "Fake-Sub-CA",
+			endEntityProfileName:   "fakeSpireIntermediateCAEEP",
+			certificateProfileName: "fakeSubCACP",
+			endEntityName:          "",
+			accountBindingID:       "",
+
+			expectedgRPCCode:      codes.OK,
+			expectedMessagePrefix: "",
+			expectedEndEntityName: trustDomain.ID().String(),
+			expectedCaAndChain:    []*x509.Certificate{svidIssuingCA, intermediateCA},
+			expectedRootCAs:       []*x509.Certificate{rootCA},
+		},
+		{
+			name: "success_der",
+
+			certificateResponseFormat: "DER",
+			ejbcaStatusCode:           http.StatusOK,
+
+			caName:                 "Fake-Sub-CA",
+			endEntityProfileName:   "fakeSpireIntermediateCAEEP",
+			certificateProfileName: "fakeSubCACP",
+			endEntityName:          "",
+			accountBindingID:       "",
+
+			expectedgRPCCode:      codes.OK,
+			expectedMessagePrefix: "",
+			expectedEndEntityName: trustDomain.ID().String(),
+			expectedCaAndChain:    []*x509.Certificate{svidIssuingCA, intermediateCA},
+			expectedRootCAs:       []*x509.Certificate{rootCA},
+		},
+		{
+			name: "fail_unknown_format",
+
+			certificateResponseFormat: "PKCS7",
+
+			caName:                 "Fake-Sub-CA",
+			endEntityProfileName:   "fakeSpireIntermediateCAEEP",
+			certificateProfileName: "fakeSubCACP",
+			endEntityName:          "",
+			accountBindingID:       "",
+
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): ejbca returned unsupported certificate format: PKCS7 (accepted formats: PEM, DER)",
+			ejbcaStatusCode:       http.StatusOK,
+			expectedEndEntityName: trustDomain.ID().String(),
+			expectedCaAndChain:    []*x509.Certificate{svidIssuingCA, intermediateCA},
+			expectedRootCAs:       []*x509.Certificate{rootCA},
+		},
+		{
+			name: "success_accepted_format",
+
+			certificateResponseFormat: "DER",
+			acceptedResponseFormats:   []string{"DER"},
+
+			caName:                 "Fake-Sub-CA",
+			endEntityProfileName:   "fakeSpireIntermediateCAEEP",
+			certificateProfileName: "fakeSubCACP",
+			endEntityName:          "",
+			accountBindingID:       "",
+
+			expectedgRPCCode:      codes.OK,
+			expectedMessagePrefix: "",
+			ejbcaStatusCode:       http.StatusOK,
+			expectedEndEntityName: trustDomain.ID().String(),
+			expectedCaAndChain:    []*x509.Certificate{svidIssuingCA, intermediateCA},
+			expectedRootCAs:       []*x509.Certificate{rootCA},
+		},
+		{
+			name: "fail_rejected_format",
+
+			certificateResponseFormat: "DER",
+			acceptedResponseFormats:   []string{"PEM"},
+
+			caName:                 "Fake-Sub-CA",
+			endEntityProfileName:   "fakeSpireIntermediateCAEEP",
+			certificateProfileName: "fakeSubCACP",
+			endEntityName:          "",
+			accountBindingID:       "",
+
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): ejbca returned unsupported certificate format: DER (accepted formats: PEM)",
+			ejbcaStatusCode:       http.StatusOK,
+			expectedEndEntityName: trustDomain.ID().String(),
+			expectedCaAndChain:    []*x509.Certificate{svidIssuingCA, intermediateCA},
+			expectedRootCAs:       []*x509.Certificate{rootCA},
+		},
+		{
+			name: "success_ejbca_api_error",
+
+			certificateResponseFormat: "PEM",
+			ejbcaStatusCode:           http.StatusBadRequest,
+
+			caName:                 "Fake-Sub-CA",
+			endEntityProfileName:   "fakeSpireIntermediateCAEEP",
+			certificateProfileName: "fakeSubCACP",
+			endEntityName:          "",
+			accountBindingID:       "",
+
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): EJBCA returned an error: failed to enroll CSR - 400 Bad Request - EJBCA API returned error",
+			expectedEndEntityName: trustDomain.ID().String(),
+			expectedCaAndChain:    []*x509.Certificate{svidIssuingCA, intermediateCA},
+			expectedRootCAs:       []*x509.Certificate{rootCA},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+
+			testServer := httptest.NewTLSServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					enrollRestRequest := ejbcaclient.EnrollCertificateRestRequest{}
+					err := json.NewDecoder(r.Body).Decode(&enrollRestRequest)
+					require.NoError(t, err)
+
+					// Perform assertions before fake enrollment
+					require.Equal(t, tt.caName, enrollRestRequest.GetCertificateAuthorityName())
+					require.Equal(t, tt.endEntityProfileName, enrollRestRequest.GetEndEntityProfileName())
+					require.Equal(t, tt.certificateProfileName, enrollRestRequest.GetCertificateProfileName())
+					require.Equal(t, tt.accountBindingID, enrollRestRequest.GetAccountBindingId())
+					require.Equal(t, tt.expectedEndEntityName, enrollRestRequest.GetUsername())
+
+					response := certificateRestResponseFromExpectedCerts(t, tt.expectedCaAndChain, tt.expectedRootCAs, tt.certificateResponseFormat)
+
+					w.Header().Add("Content-Type", "application/json")
+					w.WriteHeader(tt.ejbcaStatusCode)
+					err = json.NewEncoder(w).Encode(response)
+					require.NoError(t, err)
+				}))
+			defer testServer.Close()
+
+			p := New()
+			ua := new(upstreamauthority.V1)
+
+			logOptions := hclog.DefaultOptions
+			logOptions.Level = hclog.Debug
+			p.SetLogger(hclog.Default())
+
+			clientConfig := fakeClientConfig{
+				testServer: testServer,
+			}
+			p.hooks.newAuthenticator = clientConfig.newFakeAuthenticator
+
+			config := &Config{
+				Hostname: testServer.URL,
+
+				// We populate the client cert & client key to random values since newFakeAuthenticator doesn't have
+				// any built-in authentication.
+				CertAuth: &CertAuthConfig{
+					ClientCert: "BEGIN CERTIFICATE ... END CERTIFICATE",
+					ClientKey:  "BEGIN RSA PRIVATE KEY ... END RSA PRIVATE KEY",
+				},
+
+				CAName:                  tt.caName,
+				EndEntityProfileName:    tt.endEntityProfileName,
+				CertificateProfileName:  tt.certificateProfileName,
+				DefaultEndEntityName:    tt.endEntityName,
+				AccountBindingID:        tt.accountBindingID,
+				AcceptedResponseFormats: tt.acceptedResponseFormats,
+			}
+
+			options := []plugintest.Option{
+				plugintest.CaptureConfigureError(&err),
+				plugintest.ConfigureJSON(config),
+			}
+
+			plugintest.Load(t, builtin(p), ua, options...)
+			require.NoError(t, err)
+
+			priv := testkey.NewEC384(t)
+			csr, err := commonutil.MakeCSR(priv, trustDomain.ID())
+			require.NoError(t, err)
+
+			ctx := context.Background()
+			caAndChain, rootCAs, stream, err := ua.MintX509CA(ctx, csr, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+			if tt.expectedgRPCCode == codes.OK {
+				require.NotNil(t, stream)
+				require.NotNil(t, caAndChain)
+				require.NotNil(t, rootCAs)
+			}
+		})
+	}
+}
+
+func TestMintX509CAErrorDetails(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		ejbcaStatusCode int
+		ejbcaErrorBody  string
+
+		expectedReason    string
+		expectedErrorCode string
+		expectedMessage   string
+	}{
+		{
+			name:            "ca_offline",
+			ejbcaStatusCode: http.StatusBadRequest,
+			ejbcaErrorBody:  `{"error_code":400,"error_message":"CA with DN 'CN=Fake-Sub-CA' is offline."}`,
+
+			expectedReason:    "EJBCA_CA_OFFLINE",
+			expectedErrorCode: "400",
+			expectedMessage:   "EJBCA returned an error: failed to enroll CSR - 400 Bad Request - EJBCA API returned error: CA with DN 'CN=Fake-Sub-CA' is offline. (error_code=400)",
+		},
+		{
+			name:            "duplicate_end_entity",
+			ejbcaStatusCode: http.StatusConflict,
+			ejbcaErrorBody:  `{"error_code":409,"error_message":"User 'spiffe://example.org' already exists."}`,
+
+			expectedReason:    "DUPLICATE_END_ENTITY",
+			expectedErrorCode: "409",
+			expectedMessage:   "EJBCA returned an error: failed to enroll CSR - 409 Conflict - EJBCA API returned error: User 'spiffe://example.org' already exists. (error_code=409)",
+		},
+		{
+			name:            "end_entity_profile_not_found",
+			ejbcaStatusCode: http.StatusBadRequest,
+			ejbcaErrorBody:  `{"error_code":400,"error_message":"End entity profile not found"}`,
+
+			expectedReason:    "EJBCA_ERROR",
+			expectedErrorCode: "400",
+			expectedMessage:   "EJBCA returned an error: failed to enroll CSR - 400 Bad Request - EJBCA API returned error: End entity profile not found (error_code=400)",
+		},
+		{
+			name:            "csr_redacted",
+			ejbcaStatusCode: http.StatusBadRequest,
+			ejbcaErrorBody:  `{"error_code":400,"error_message":"Invalid CSR -----BEGIN CERTIFICATE REQUEST-----\nMIIBfake\n-----END CERTIFICATE REQUEST----- for end entity"}`,
+
+			expectedReason:    "EJBCA_ERROR",
+			expectedErrorCode: "400",
+			expectedMessage:   "EJBCA returned an error: failed to enroll CSR - 400 Bad Request - EJBCA API returned error: Invalid CSR [redacted PEM] for end entity (error_code=400)",
+		},
+		{
+			name:            "unstructured_error",
+			ejbcaStatusCode: http.StatusInternalServerError,
+			ejbcaErrorBody:  `internal server error`,
+
+			expectedReason:  "EJBCA_ERROR",
+			expectedMessage: "EJBCA returned an error: failed to enroll CSR - 500 Internal Server Error - EJBCA API returned error",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := httptest.NewTLSServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Add("Content-Type", "application/json")
+					w.WriteHeader(tt.ejbcaStatusCode)
+					_, err := w.Write([]byte(tt.ejbcaErrorBody))
+					require.NoError(t, err)
+				}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{})
+
+			csr, err := commonutil.MakeCSR(testkey.NewEC384(t), trustDomain.ID())
+			require.NoError(t, err)
+
+			stream, err := ua.UpstreamAuthorityPluginClient.MintX509CAAndSubscribe(context.Background(), &upstreamauthorityv1.MintX509CARequest{Csr: csr})
+			require.NoError(t, err)
+			_, err = stream.Recv()
+
+			st := status.Convert(err)
+			require.Equal(t, codes.Internal, st.Code())
+			require.Equal(t, tt.expectedMessage, st.Message())
+			require.Len(t, st.Details(), 1)
+			errorInfo, ok := st.Details()[0].(*errdetails.ErrorInfo)
+			require.True(t, ok, "expected ErrorInfo detail, got %T", st.Details()[0])
+
+			require.Equal(t, tt.expectedReason, errorInfo.GetReason())
+			require.Equal(t, errorDomain, errorInfo.GetDomain())
+			require.Equal(t, "Fake-Sub-CA", errorInfo.GetMetadata()["ca_name"])
+			require.Equal(t, "fakeSpireIntermediateCAEEP", errorInfo.GetMetadata()["end_entity_profile_name"])
+			require.Equal(t, "fakeSubCACP", errorInfo.GetMetadata()["certificate_profile_name"])
+			require.Equal(t, tt.expectedErrorCode, errorInfo.GetMetadata()["ejbca_error_code"])
+		})
+	}
+}
+
+func TestPromoteSanToCn(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		promoteSANToCN string
+		subject        string
+		dnsNames       []string
+		uris           []string
+
+		expectedSubjectDn string
+	}{
+		{
+			name:           "promote_dns",
+			promoteSANToCN: "dns",
+			subject:        "O=Example",
+			dnsNames:       []string{"reddog.example.com"},
+			uris:           []string{"spiffe://example.org"},
+
+			expectedSubjectDn: "CN=reddog.example.com,O=Example",
+		},
+		{
+			name:           "promote_uri",
+			promoteSANToCN: "uri",
+			dnsNames:       []string{"reddog.example.com"},
+			uris:           []string{"spiffe://example.org"},
+
+			expectedSubjectDn: "CN=spiffe://example.org",
+		},
+		{
+			name:           "csr_has_cn",
+			promoteSANToCN: "dns",
+			subject:        "CN=purplecat.example.com",
+			dnsNames:       []string{"reddog.example.com"},
+		},
+		{
+			name:           "no_matching_san",
+			promoteSANToCN: "dns",
+			uris:           []string{"spiffe://example.org"},
+		},
+		{
+			name:     "disabled",
+			dnsNames: []string{"reddog.example.com"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var subjectDn interface{}
+			testServer := newFakeEnrollServer(t, func(req *ejbcaclient.EnrollCertificateRestRequest) {
+				subjectDn = req.AdditionalProperties["subject_dn"]
+			})
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				DefaultEndEntityName: "aNonStandardValue",
+				PromoteSANToCN:       tt.promoteSANToCN,
+			})
+
+			csr, err := generateCSR(tt.subject, tt.dnsNames, tt.uris, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			require.NoError(t, err)
+
+			if tt.expectedSubjectDn == "" {
+				require.Nil(t, subjectDn)
+				return
+			}
+			require.Equal(t, tt.expectedSubjectDn, subjectDn)
+		})
+	}
+}
+
+func TestReloadClientCertOnError(t *testing.T) {
+	now := time.Now()
+	tlsCA, tlsCAKey, err := util.SelfSign(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Fake-TLS-CA"},
+		SerialNumber:          big.NewInt(1),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		NotBefore:             now.Add(-2 * time.Hour),
+		NotAfter:              now.Add(time.Hour),
+	})
+	require.NoError(t, err)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(tlsCA)
+
+	testServer := httptest.NewUnstartedServer(newFakeEnrollHandler(t, nil))
+	testServer.TLS = &tls.Config{
+		Certificates: []tls.Certificate{issueTLSServerCertificate(t, tlsCA, tlsCAKey)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	testServer.StartTLS()
+	defer testServer.Close()
+
+	encodeKeyPair := func(cert tls.Certificate) ([]byte, []byte) {
+		keyBytes, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		require.NoError(t, err)
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}),
+			pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+	}
+
+	expiredTemplate := &x509.Certificate{
+		Subject:      pkix.Name{CommonName: "Fake-Expired-Client"},
+		SerialNumber: big.NewInt(4),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		NotBefore:    now.Add(-2 * time.Hour),
+		NotAfter:     now.Add(-time.Hour),
+	}
+	expired, expiredKey, err := util.Sign(expiredTemplate, tlsCA, tlsCAKey)
+	require.NoError(t, err)
+	expiredCert := tls.Certificate{Certificate: [][]byte{expired.Raw}, PrivateKey: expiredKey}
+
+	for _, tt := range []struct {
+		name string
+
+		reloadClientCertOnError bool
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:                    "reload_and_retry",
+			reloadClientCertOnError: true,
+			expectedgRPCCode:        codes.OK,
+		},
+		{
+			name:                    "no_reload",
+			reloadClientCertOnError: false,
+			expectedgRPCCode:        codes.Internal,
+			expectedMessagePrefix:   "upstreamauthority(ejbca): EJBCA returned an error: failed to enroll CSR",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			certPath := filepath.Join(dir, "client.crt")
+			keyPath := filepath.Join(dir, "client.key")
+
+			certPEM, keyPEM := encodeKeyPair(expiredCert)
+			require.NoError(t, os.WriteFile(certPath, certPEM, 0600))
+			require.NoError(t, os.WriteFile(keyPath, keyPEM, 0600))
+
+			p := New()
+			p.SetLogger(hclog.Default())
+			ua := new(upstreamauthority.V1)
+			plugintest.Load(t, builtin(p), ua,
+				plugintest.Configure(fmt.Sprintf(`
+            hostname = "%s"
+            ca_cert = <<EOF
+%s
+EOF
+            cert_auth {
+                client_cert_path = "%s"
+                client_key_path = "%s"
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            reload_client_cert_on_error = %t
+            `, testServer.URL, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsCA.Raw}),
+					certPath, keyPath, tt.reloadClientCertOnError)),
+			)
+
+			// Rotate the client certificate on disk after the plugin has loaded the expired one
+			certPEM, keyPEM = encodeKeyPair(issueTLSServerCertificate(t, tlsCA, tlsCAKey))
+			require.NoError(t, os.WriteFile(certPath, certPEM, 0600))
+			require.NoError(t, os.WriteFile(keyPath, keyPEM, 0600))
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+		})
+	}
+}
+
+func TestMaxEnrollmentDuration(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		maxEnrollmentDuration string
+		serverDelay           time.Duration
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:                  "within_budget",
+			maxEnrollmentDuration: "10s",
+			expectedgRPCCode:      codes.OK,
+		},
+		{
+			name:                  "budget_exceeded",
+			maxEnrollmentDuration: "100ms",
+			serverDelay:           10 * time.Second,
+			expectedgRPCCode:      codes.DeadlineExceeded,
+			expectedMessagePrefix: "upstreamauthority(ejbca): enrollment exceeded max_enrollment_duration of 100ms",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			enrollHandler := newFakeEnrollHandler(t, nil)
+			done := make(chan struct{})
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(tt.serverDelay):
+				case <-done:
+					return
+				}
+				enrollHandler.ServeHTTP(w, r)
+			}))
+			defer testServer.Close()
+			defer close(done)
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				MaxEnrollmentDuration: tt.maxEnrollmentDuration,
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			start := time.Now()
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+			require.Less(t, time.Since(start), 5*time.Second)
+		})
+	}
+}
+
+func TestConcurrentReconfigure(t *testing.T) {
+	// Each configuration pairs a CA with its own end entity profile, so a mint that mixed two configurations would
+	// enroll with a mismatched pair
+	profiles := map[string]string{
+		"Fake-Sub-CA-1": "fakeSpireIntermediateCAEEP-1",
+		"Fake-Sub-CA-2": "fakeSpireIntermediateCAEEP-2",
+	}
+	testServer := newFakeEnrollServer(t, func(req *ejbcaclient.EnrollCertificateRestRequest) {
+		require.Equal(t, profiles[req.GetCertificateAuthorityName()], req.GetEndEntityProfileName())
+	})
+	defer testServer.Close()
+
+	config := &Config{
+		CAName:               "Fake-Sub-CA-1",
+		EndEntityProfileName: "fakeSpireIntermediateCAEEP-1",
+	}
+	p, ua := loadTestPlugin(t, testServer, config)
+
+	var configurations []string
+	for caName, endEntityProfileName := range profiles {
+		reconfig := *config
+		reconfig.CAName = caName
+		reconfig.EndEntityProfileName = endEntityProfileName
+		configuration, err := json.Marshal(&reconfig)
+		require.NoError(t, err)
+		configurations = append(configurations, string(configuration))
+	}
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	reconfigured := make(chan error)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				close(reconfigured)
+				return
+			default:
+			}
+			_, err := p.Configure(context.Background(), &configv1.ConfigureRequest{
+				HclConfiguration: configurations[i%len(configurations)],
+			})
+			if err != nil {
+				reconfigured <- err
+				return
+			}
+		}
+	}()
+
+	const minters, mintsPerMinter = 4, 5
+	minted := make(chan error, minters*mintsPerMinter)
+	var wg sync.WaitGroup
+	for i := 0; i < minters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < mintsPerMinter; j++ {
+				_, _, _, err := ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+				minted <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	require.NoError(t, <-reconfigured)
+
+	close(minted)
+	for err := range minted {
+		require.NoError(t, err)
+	}
+}
+
+// newFakeEnrollServer returns a fake EJBCA server that passes each enrollment request to inspect and responds with a
+// successful PEM enrollment of the test certificates.
+func newFakeEnrollServer(t *testing.T, inspect func(*ejbcaclient.EnrollCertificateRestRequest)) *httptest.Server {
+	return httptest.NewTLSServer(newFakeEnrollHandler(t, inspect))
+}
+
+// newFakeEnrollHandler returns a handler that responds to every PKCS#10 enrollment with a PEM-encoded chain. If
+// inspect is not nil, it's called with each decoded enrollment request.
+func newFakeEnrollHandler(t *testing.T, inspect func(*ejbcaclient.EnrollCertificateRestRequest)) http.Handler {
+	rootCA, intermediateCA, svidIssuingCA, _ := issueTestCertificates(t)
+
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			enrollRestRequest := ejbcaclient.EnrollCertificateRestRequest{}
+			err := json.NewDecoder(r.Body).Decode(&enrollRestRequest)
+			require.NoError(t, err)
+
+			if inspect != nil {
+				inspect(&enrollRestRequest)
+			}
+
+			response := certificateRestResponseFromExpectedCerts(t, []*x509.Certificate{svidIssuingCA, intermediateCA}, []*x509.Certificate{rootCA}, "PEM")
+
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			err = json.NewEncoder(w).Encode(response)
+			require.NoError(t, err)
+		})
+}
+
+// loadTestPlugin loads a plugin configured to talk to testServer. Required fields that are unset in config are
+// populated with the same values used throughout these tests. Each of setHooks is called with the plugin before it's
+// configured, so tests can replace hooks beyond the fake authenticator.
+func loadTestPlugin(t *testing.T, testServer *httptest.Server, config *Config, setHooks ...func(*Plugin)) (*Plugin, *upstreamauthority.V1) {
+	return loadTestPluginWithOptions(t, testServer, config, nil, setHooks...)
+}
+
+// loadTestPluginWithOptions is like loadTestPlugin, but also passes options to plugintest.Load, such as host services.
+func loadTestPluginWithOptions(t *testing.T, testServer *httptest.Server, config *Config, options []plugintest.Option, setHooks ...func(*Plugin)) (*Plugin, *upstreamauthority.V1) {
+	var err error
+
+	p := New()
+	ua := new(upstreamauthority.V1)
+	p.SetLogger(hclog.Default())
+
+	clientConfig := fakeClientConfig{
+		testServer: testServer,
+	}
+	p.hooks.newAuthenticator = clientConfig.newFakeAuthenticator
+	for _, setHook := range setHooks {
+		setHook(p)
+	}
+
+	if config.Hostname == "" {
+		config.Hostname = testServer.URL
+	}
+	if config.CertAuth == nil && config.OAuth == nil {
+		// newFakeAuthenticator doesn't have any built-in authentication.
+		config.CertAuth = &CertAuthConfig{
+			ClientCert: "BEGIN CERTIFICATE ... END CERTIFICATE",
+			ClientKey:  "BEGIN RSA PRIVATE KEY ... END RSA PRIVATE KEY",
+		}
+	}
+	if config.CAName == "" {
+		config.CAName = "Fake-Sub-CA"
+	}
+	if config.EndEntityProfileName == "" {
+		config.EndEntityProfileName = "fakeSpireIntermediateCAEEP"
+	}
+	if config.CertificateProfileName == "" {
+		config.CertificateProfileName = "fakeSubCACP"
+	}
+
+	options = append(options,
+		plugintest.CaptureConfigureError(&err),
+		plugintest.ConfigureJSON(config),
+	)
+	plugintest.Load(t, builtin(p), ua, options...)
+	require.NoError(t, err)
+
+	return p, ua
+}
+
+func certificateRestResponseFromExpectedCerts(t *testing.T, issuingCaAndChain []*x509.Certificate, rootCAs []*x509.Certificate, format string) *ejbcaclient.CertificateRestResponse {
+	require.NotEqual(t, 0, len(issuingCaAndChain))
+	var issuingCa string
+	if format == "PEM" {
+		issuingCa = string(pem.EncodeToMemory(&pem.Block{Bytes: issuingCaAndChain[0].Raw, Type: "CERTIFICATE"}))
+	} else {
+		issuingCa = base64.StdEncoding.EncodeToString(issuingCaAndChain[0].Raw)
+	}
+
+	var caChain []string
+	if format == "PEM" {
+		for _, cert := range issuingCaAndChain[1:] {
+			caChain = append(caChain, string(pem.EncodeToMemory(&pem.Block{Bytes: cert.Raw, Type: "CERTIFICATE"})))
+		}
+		for _, cert := range rootCAs {
+			caChain = append(caChain, string(pem.EncodeToMemory(&pem.Block{Bytes: cert.Raw, Type: "CERTIFICATE"})))
+		}
+	} else {
+		for _, cert := range issuingCaAndChain[1:] {
+			caChain = append(caChain, base64.StdEncoding.EncodeToString(cert.Raw))
 		}
 		for _, cert := range rootCAs {
 			caChain = append(caChain, base64.StdEncoding.EncodeToString(cert.Raw))
@@ -864,14 +2515,23 @@ func TestGetEndEntityName(t *testing.T) {
 	for _, tt := range []struct {
 		name string
 
-		defaultEndEntityName string
-
-		subject  string
-		dnsNames []string
-		uris     []string
-		ips      []string
+		defaultEndEntityName   string
+		endEntityNameFallbacks []string
+		endEntityNameCase      string
+		spiffeNameScope        string
+		stripSpiffeScheme      bool
+		sanitizeEndEntityName  bool
+		normalizeDNSNames      bool
+		rdnMultipleValues      string
+
+		subject    string
+		dnsNames   []string
+		uris       []string
+		ips        []string
+		otherNames map[string]string
 
 		expectedEndEntityName string
+		expectedError         string
 	}{
 		{
 			name:                 "defaultEndEntityName unset use cn",
@@ -963,6 +2623,357 @@ func TestGetEndEntityName(t *testing.T) {
 
 			expectedEndEntityName: "aNonStandardValue",
 		},
+		{
+			name:                 "endEntityNameCase lower",
+			defaultEndEntityName: "cn",
+			endEntityNameCase:    "lower",
+			subject:              "CN=PurpleCat.Example.com",
+
+			expectedEndEntityName: "purplecat.example.com",
+		},
+		{
+			name:                 "endEntityNameCase upper",
+			defaultEndEntityName: "dns",
+			endEntityNameCase:    "upper",
+			dnsNames:             []string{"RedDog.example.com"},
+
+			expectedEndEntityName: "REDDOG.EXAMPLE.COM",
+		},
+		{
+			name:                 "endEntityNameCase preserve",
+			defaultEndEntityName: "cn",
+			endEntityNameCase:    "preserve",
+			subject:              "CN=PurpleCat.Example.com",
+
+			expectedEndEntityName: "PurpleCat.Example.com",
+		},
+		{
+			name:                 "endEntityNameCase unset preserves",
+			defaultEndEntityName: "uri",
+			uris:                 []string{"spiffe://Example.org"},
+
+			expectedEndEntityName: "spiffe://Example.org",
+		},
+		{
+			name:                 "defaultEndEntityName rdn by name",
+			defaultEndEntityName: "rdn:UID",
+			subject:              "CN=purplecat.example.com,UID=spire-server-01",
+			dnsNames:             []string{"reddog.example.com"},
+
+			expectedEndEntityName: "spire-server-01",
+		},
+		{
+			name:                 "defaultEndEntityName rdn by lowercase name",
+			defaultEndEntityName: "rdn:serialNumber",
+			subject:              "CN=purplecat.example.com,SERIALNUMBER=8675309",
+
+			expectedEndEntityName: "8675309",
+		},
+		{
+			name:                 "defaultEndEntityName rdn by oid",
+			defaultEndEntityName: "rdn:2.5.4.5",
+			subject:              "CN=purplecat.example.com,SERIALNUMBER=8675309",
+
+			expectedEndEntityName: "8675309",
+		},
+		{
+			name:                 "serialnumber selector",
+			defaultEndEntityName: "serialnumber",
+			subject:              "CN=purplecat.example.com,SERIALNUMBER=8675309",
+			uris:                 []string{"spiffe://example.org/device"},
+
+			expectedEndEntityName: "8675309",
+		},
+		{
+			name:                 "serialnumber selector multiple values uses first by default",
+			defaultEndEntityName: "serialnumber",
+			subject:              "SERIALNUMBER=8675309,SERIALNUMBER=5551212",
+
+			expectedEndEntityName: "8675309",
+		},
+		{
+			name:                 "serialnumber selector multiple values joined",
+			defaultEndEntityName: "serialnumber",
+			rdnMultipleValues:    "join",
+			subject:              "SERIALNUMBER=8675309,SERIALNUMBER=5551212",
+
+			expectedEndEntityName: "8675309,5551212",
+		},
+		{
+			name:                 "rdn oid multiple values error",
+			defaultEndEntityName: "rdn:2.5.4.5",
+			rdnMultipleValues:    "error",
+			subject:              "SERIALNUMBER=8675309,SERIALNUMBER=5551212",
+
+			expectedError: "the CertificateRequest's DN has 2 2.5.4.5 attributes",
+		},
+		{
+			name:                 "serialnumber selector single value with error",
+			defaultEndEntityName: "serialnumber",
+			rdnMultipleValues:    "error",
+			subject:              "SERIALNUMBER=8675309",
+
+			expectedEndEntityName: "8675309",
+		},
+		{
+			name:                 "serialnumber selector missing",
+			defaultEndEntityName: "serialnumber",
+			subject:              "CN=purplecat.example.com",
+
+			expectedError: "the CertificateRequest's DN has no SERIALNUMBER attribute",
+		},
+		{
+			name:                 "defaultEndEntityName othername",
+			defaultEndEntityName: "othername:1.3.6.1.4.1.311.20.2.3",
+			uris:                 []string{"spiffe://example.org"},
+			otherNames:           map[string]string{"1.3.6.1.4.1.311.20.2.3": "spire-server@example.org"},
+
+			expectedEndEntityName: "spire-server@example.org",
+		},
+		{
+			name:                 "defaultEndEntityName othername selects by oid",
+			defaultEndEntityName: "othername:1.3.6.1.4.1.99999.1",
+			otherNames: map[string]string{
+				"1.3.6.1.4.1.311.20.2.3": "spire-server@example.org",
+				"1.3.6.1.4.1.99999.1":    "spiffe://example.org/spire/server",
+			},
+
+			expectedEndEntityName: "spiffe://example.org/spire/server",
+		},
+		{
+			name:                   "endEntityNameFallbacks othername primary empty",
+			defaultEndEntityName:   "othername:1.3.6.1.4.1.99999.1",
+			endEntityNameFallbacks: []string{"uri"},
+			uris:                   []string{"spiffe://example.org"},
+			otherNames:             map[string]string{"1.3.6.1.4.1.311.20.2.3": "spire-server@example.org"},
+
+			expectedEndEntityName: "spiffe://example.org",
+		},
+		{
+			name:                 "defaultEndEntityName othername missing",
+			defaultEndEntityName: "othername:1.3.6.1.4.1.311.20.2.3",
+			uris:                 []string{"spiffe://example.org"},
+
+			expectedError: "the CertificateRequest has no otherName SAN of type 1.3.6.1.4.1.311.20.2.3",
+		},
+		{
+			name:                   "endEntityNameFallbacks primary empty use fallback",
+			defaultEndEntityName:   "dns",
+			endEntityNameFallbacks: []string{"uri", "cn"},
+			subject:                "CN=purplecat.example.com",
+			uris:                   []string{"spiffe://example.org"},
+
+			expectedEndEntityName: "spiffe://example.org",
+		},
+		{
+			name:                   "endEntityNameFallbacks first fallback empty use second",
+			defaultEndEntityName:   "dns",
+			endEntityNameFallbacks: []string{"uri", "cn"},
+			subject:                "CN=purplecat.example.com",
+
+			expectedEndEntityName: "purplecat.example.com",
+		},
+		{
+			name:                   "endEntityNameFallbacks rdn primary empty",
+			defaultEndEntityName:   "rdn:UID",
+			endEntityNameFallbacks: []string{"dns"},
+			subject:                "CN=purplecat.example.com",
+			dnsNames:               []string{"reddog.example.com"},
+
+			expectedEndEntityName: "reddog.example.com",
+		},
+		{
+			name:                 "spiffeNameScope unset uses full uri",
+			defaultEndEntityName: "uri",
+			uris:                 []string{"spiffe://example.org/ns/prod/sa/spire-server"},
+
+			expectedEndEntityName: "spiffe://example.org/ns/prod/sa/spire-server",
+		},
+		{
+			name:                 "spiffeNameScope full",
+			defaultEndEntityName: "uri",
+			spiffeNameScope:      "full",
+			uris:                 []string{"spiffe://example.org/ns/prod/sa/spire-server"},
+
+			expectedEndEntityName: "spiffe://example.org/ns/prod/sa/spire-server",
+		},
+		{
+			name:                 "stripSpiffeScheme strips the scheme",
+			defaultEndEntityName: "uri",
+			stripSpiffeScheme:    true,
+			uris:                 []string{"spiffe://example.org/ns/prod/sa/spire-server"},
+
+			expectedEndEntityName: "example.org/ns/prod/sa/spire-server",
+		},
+		{
+			name:                 "stripSpiffeScheme unset retains the scheme",
+			defaultEndEntityName: "uri",
+			stripSpiffeScheme:    false,
+			uris:                 []string{"spiffe://example.org/ns/prod/sa/spire-server"},
+
+			expectedEndEntityName: "spiffe://example.org/ns/prod/sa/spire-server",
+		},
+		{
+			name:                 "stripSpiffeScheme retains the scheme of non-spiffe uri",
+			defaultEndEntityName: "uri",
+			stripSpiffeScheme:    true,
+			uris:                 []string{"https://blueelephant.example.com"},
+
+			expectedEndEntityName: "https://blueelephant.example.com",
+		},
+		{
+			name:                 "spiffeNameScope trust-domain-only",
+			defaultEndEntityName: "uri",
+			spiffeNameScope:      "trust-domain-only",
+			uris:                 []string{"spiffe://example.org/ns/prod/sa/spire-server"},
+
+			expectedEndEntityName: "example.org",
+		},
+		{
+			name:                 "spiffeNameScope path-only",
+			defaultEndEntityName: "uri",
+			spiffeNameScope:      "path-only",
+			uris:                 []string{"spiffe://example.org/ns/prod/sa/spire-server"},
+
+			expectedEndEntityName: "/ns/prod/sa/spire-server",
+		},
+		{
+			name:                 "spiffeNameScope path-only without path uses next selector",
+			defaultEndEntityName: "",
+			spiffeNameScope:      "path-only",
+			uris:                 []string{"spiffe://example.org"},
+			ips:                  []string{"192.168.1.1"},
+
+			expectedEndEntityName: "192.168.1.1",
+		},
+		{
+			name:                 "spiffeNameScope ignored for non-spiffe uri",
+			defaultEndEntityName: "uri",
+			spiffeNameScope:      "trust-domain-only",
+			uris:                 []string{"https://blueelephant.example.com/path"},
+
+			expectedEndEntityName: "https://blueelephant.example.com/path",
+		},
+		{
+			name:                  "sanitizeEndEntityName strips control characters",
+			defaultEndEntityName:  "cn",
+			sanitizeEndEntityName: true,
+			subject:               "CN=purple\x00cat\x1b.example\u200b.com\n",
+
+			expectedEndEntityName: "purplecat.example.com",
+		},
+		{
+			name:                  "sanitizeEndEntityName keeps printable unicode",
+			defaultEndEntityName:  "cn",
+			sanitizeEndEntityName: true,
+			subject:               "CN=Grüne Katze",
+
+			expectedEndEntityName: "Grüne Katze",
+		},
+		{
+			name:                  "sanitizeEndEntityName only control characters",
+			defaultEndEntityName:  "cn",
+			sanitizeEndEntityName: true,
+			subject:               "CN=\x01\x02",
+
+			expectedError: "end entity name \"\\x01\\x02\" is empty after sanitization",
+		},
+		{
+			name:                 "sanitizeEndEntityName disabled keeps control characters",
+			defaultEndEntityName: "cn",
+			subject:              "CN=purple\x00cat",
+
+			expectedEndEntityName: "purple\x00cat",
+		},
+		{
+			name:                 "normalizeDNSNames strips trailing dot",
+			defaultEndEntityName: "dns",
+			normalizeDNSNames:    true,
+			dnsNames:             []string{"host.example.com."},
+
+			expectedEndEntityName: "host.example.com",
+		},
+		{
+			name:                 "normalizeDNSNames keeps name without trailing dot",
+			defaultEndEntityName: "dns",
+			normalizeDNSNames:    true,
+			dnsNames:             []string{"host.example.com"},
+
+			expectedEndEntityName: "host.example.com",
+		},
+		{
+			name:                 "normalizeDNSNames disabled keeps trailing dot",
+			defaultEndEntityName: "dns",
+			dnsNames:             []string{"host.example.com."},
+
+			expectedEndEntityName: "host.example.com.",
+		},
+		{
+			name:                   "endEntityNameFallbacks ip primary empty",
+			defaultEndEntityName:   "ip",
+			endEntityNameFallbacks: []string{"dns"},
+			subject:                "CN=purplecat.example.com",
+			dnsNames:               []string{"reddog.example.com"},
+
+			expectedEndEntityName: "reddog.example.com",
+		},
+		{
+			// Before end_entity_name_fallbacks, a selector that yielded no value was used as a literal name
+			name:                 "defaultEndEntityName ip without IP SAN",
+			defaultEndEntityName: "ip",
+			subject:              "CN=purplecat.example.com",
+			dnsNames:             []string{"reddog.example.com"},
+
+			expectedError: "no valid end entity name could be determined from the CertificateRequest",
+		},
+		{
+			name:                   "endEntityNameFallbacks unused when primary yields",
+			defaultEndEntityName:   "dns",
+			endEntityNameFallbacks: []string{"cn"},
+			subject:                "CN=purplecat.example.com",
+			dnsNames:               []string{"reddog.example.com"},
+
+			expectedEndEntityName: "reddog.example.com",
+		},
+		{
+			name:                 "template with CSR fields",
+			defaultEndEntityName: "{{.TrustDomain}}-{{.CommonName}}-{{.DNSName}}-{{.IPAddress}}",
+			subject:              "CN=purplecat",
+			dnsNames:             []string{"reddog.example.com"},
+			uris:                 []string{"spiffe://example.org/spire/server"},
+			ips:                  []string{"192.168.1.1"},
+
+			expectedEndEntityName: "example.org-purplecat-reddog.example.com-192.168.1.1",
+		},
+		{
+			name:                 "template with URI",
+			defaultEndEntityName: "spire-{{.URI}}",
+			uris:                 []string{"spiffe://example.org/spire/server"},
+
+			expectedEndEntityName: "spire-spiffe://example.org/spire/server",
+		},
+		{
+			name:                 "template with missing field",
+			defaultEndEntityName: "spire-{{.Missing}}",
+			uris:                 []string{"spiffe://example.org"},
+
+			expectedError: "failed to execute end entity name template: template: end_entity_name:1:8: executing \"end_entity_name\" at <.Missing>: can't evaluate field Missing in type ejbca.endEntityNameTemplateData",
+		},
+		{
+			name:                 "template with empty result",
+			defaultEndEntityName: "{{.CommonName}}",
+			uris:                 []string{"spiffe://example.org"},
+
+			expectedError: "end entity name template produced an empty name",
+		},
+		{
+			name:                   "template empty result uses fallback",
+			defaultEndEntityName:   "{{.DNSName}}",
+			endEntityNameFallbacks: []string{"uri"},
+			uris:                   []string{"spiffe://example.org"},
+
+			expectedEndEntityName: "spiffe://example.org",
+		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			config := &Config{
@@ -976,10 +2987,20 @@ func TestGetEndEntityName(t *testing.T) {
 				CertificateProfileName: "fakeSubCACP",
 				DefaultEndEntityName:   tt.defaultEndEntityName,
 				AccountBindingID:       "",
+				EndEntityNameCase:      tt.endEntityNameCase,
+				EndEntityNameFallbacks: tt.endEntityNameFallbacks,
+				SpiffeNameScope:        tt.spiffeNameScope,
+				StripSpiffeScheme:      tt.stripSpiffeScheme,
+				SanitizeEndEntityName:  tt.sanitizeEndEntityName,
+				NormalizeDNSNames:      tt.normalizeDNSNames,
+				RDNMultipleValues:      tt.rdnMultipleValues,
 			}
 
 			csr, err := generateCSR(tt.subject, tt.dnsNames, tt.uris, tt.ips)
 			require.NoError(t, err)
+			if len(tt.otherNames) > 0 {
+				csr = generateOtherNameCSR(t, tt.otherNames, tt.uris)
+			}
 
 			p := New()
 
@@ -988,12 +3009,124 @@ func TestGetEndEntityName(t *testing.T) {
 			p.SetLogger(hclog.Default())
 
 			endEntityName, err := p.getEndEntityName(config, csr)
+			if tt.expectedError != "" {
+				require.EqualError(t, err, tt.expectedError)
+				return
+			}
 			require.NoError(t, err)
 			require.Equal(t, tt.expectedEndEntityName, endEntityName)
 		})
 	}
 }
 
+func TestEndEntityNameDecisionLog(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		logEndEntityNameDecisions bool
+		dnsNames                  []string
+
+		expectedEntry map[string]any
+	}{
+		{
+			name:                      "fallback",
+			logEndEntityNameDecisions: true,
+			dnsNames:                  []string{"spire.example.org"},
+			expectedEntry: map[string]any{
+				"@message":          "Resolved end entity name",
+				"endEntityName":     "spire.example.org",
+				"selector":          "dns",
+				"source":            "DNS SAN",
+				"resolvedValue":     "spire.example.org",
+				"rejectedSelectors": []any{"rdn:UID: the CertificateRequest's DN has no UID attribute"},
+			},
+		},
+		{
+			name:                      "no_value",
+			logEndEntityNameDecisions: true,
+			expectedEntry: map[string]any{
+				"@message": "No end entity name selector yielded a value",
+				"rejectedSelectors": []any{
+					"rdn:UID: the CertificateRequest's DN has no UID attribute",
+					"dns: no valid end entity name could be determined from the CertificateRequest",
+				},
+			},
+		},
+		{
+			name:     "disabled",
+			dnsNames: []string{"spire.example.org"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				DefaultEndEntityName:      "rdn:UID",
+				EndEntityNameFallbacks:    []string{"dns"},
+				LogEndEntityNameDecisions: tt.logEndEntityNameDecisions,
+			}
+
+			csr, err := generateCSR("", tt.dnsNames, nil, nil)
+			require.NoError(t, err)
+
+			var logs bytes.Buffer
+			p := New()
+			p.SetLogger(hclog.New(&hclog.LoggerOptions{Output: &logs, JSONFormat: true, Level: hclog.Trace}))
+
+			_, _ = p.getEndEntityName(config, csr)
+
+			var entry map[string]any
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				var candidate map[string]any
+				require.NoError(t, json.Unmarshal([]byte(line), &candidate))
+				if candidate["@level"] == "trace" {
+					require.Nil(t, entry, "more than one trace entry was logged")
+					entry = candidate
+				}
+			}
+			if tt.expectedEntry == nil {
+				require.Nil(t, entry)
+				return
+			}
+			require.NotNil(t, entry)
+			for key, value := range tt.expectedEntry {
+				require.Equal(t, value, entry[key], key)
+			}
+		})
+	}
+}
+
+// generateOtherNameCSR returns a CSR whose SANs are an otherName with a UTF8String value for each entry of otherNames,
+// keyed by the dotted OID of its type, followed by uris.
+func generateOtherNameCSR(t *testing.T, otherNames map[string]string, uris []string) *x509.CertificateRequest {
+	var generalNames []asn1.RawValue
+	for typeID, value := range otherNames {
+		oid, err := parseOtherNameType(typeID)
+		require.NoError(t, err)
+		encodedValue, err := asn1.MarshalWithParams(value, "utf8")
+		require.NoError(t, err)
+		encoded, err := asn1.MarshalWithParams(otherName{
+			TypeID: oid,
+			Value:  asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: encodedValue},
+		}, "tag:0")
+		require.NoError(t, err)
+		generalNames = append(generalNames, asn1.RawValue{FullBytes: encoded})
+	}
+	for _, uri := range uris {
+		generalNames = append(generalNames, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 6, Bytes: []byte(uri)})
+	}
+	san, err := asn1.Marshal(generalNames)
+	require.NoError(t, err)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		ExtraExtensions: []pkix.Extension{{Id: oidExtensionSubjectAltName, Value: san}},
+	}, key)
+	require.NoError(t, err)
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	require.NoError(t, err)
+	return csr
+}
+
 func generateCSR(subject string, dnsNames []string, uris []string, ipAddresses []string) (*x509.CertificateRequest, error) {
 	keyBytes, _ := rsa.GenerateKey(rand.Reader, 2048)
 
@@ -1028,6 +3161,11 @@ func generateCSR(subject string, dnsNames []string, uris []string, ipAddresses [
 				name.OrganizationalUnit = []string{value}
 			case "CN":
 				name.CommonName = value
+			case "SERIALNUMBER":
+				// ExtraNames, unlike SerialNumber, can hold several values
+				name.ExtraNames = append(name.ExtraNames, pkix.AttributeTypeAndValue{Type: rdnAttributeTypes["SERIALNUMBER"], Value: value})
+			case "UID":
+				name.ExtraNames = append(name.ExtraNames, pkix.AttributeTypeAndValue{Type: rdnAttributeTypes["UID"], Value: value})
 			default:
 				// Ignore any unknown keys
 			}
@@ -1085,6 +3223,27 @@ func generateCSR(subject string, dnsNames []string, uris []string, ipAddresses [
 	return parsedCSR, nil
 }
 
+// issueTLSServerCertificate issues a TLS certificate for 127.0.0.1 signed by parent.
+func issueTLSServerCertificate(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) tls.Certificate {
+	now := time.Now()
+	cert, key, err := util.Sign(&x509.Certificate{
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		SerialNumber: big.NewInt(3),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+	}, parent, parentKey)
+	require.NoError(t, err)
+
+	return tls.Certificate{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}
+}
+
 func issueTestCertificates(t *testing.T) (*x509.Certificate, *x509.Certificate, *x509.Certificate, *ecdsa.PrivateKey) {
 	now := clock.NewMock(t).Now()
 	rootCaTemplate := &x509.Certificate{
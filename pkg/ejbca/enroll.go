@@ -0,0 +1,304 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// setAdditionalProperty sets a field on the enrollment request that isn't modeled by the EJBCA client SDK.
+func setAdditionalProperty(req *ejbcaclient.EnrollCertificateRestRequest, key string, value interface{}) {
+	if req.AdditionalProperties == nil {
+		req.AdditionalProperties = make(map[string]interface{})
+	}
+	req.AdditionalProperties[key] = value
+}
+
+// endEntityTtlTagName is the name of the extension data entry that holds the time after which an end entity created
+// by the plugin may be purged.
+const endEntityTtlTagName = "spire_end_entity_expires_at"
+
+// setExtensionData appends a name/value entry to the extension_data of the enrollment request, which EJBCA stores
+// with the end entity.
+func setExtensionData(req *ejbcaclient.EnrollCertificateRestRequest, name string, value string) {
+	extensionData, _ := req.AdditionalProperties["extension_data"].([]map[string]string)
+	setAdditionalProperty(req, "extension_data", append(extensionData, map[string]string{
+		"name":  name,
+		"value": value,
+	}))
+}
+
+// validateEndEntityProfileCA returns an InvalidArgument error if end_entity_profile_allowed_cas lists the CAs that the
+// configured end entity profile permits and ca_name isn't one of them. Profiles that aren't listed aren't restricted.
+func validateEndEntityProfileCA(config *Config) error {
+	allowedCas, ok := config.EndEntityProfileAllowedCAs[config.EndEntityProfileName]
+	if !ok || slices.Contains(allowedCas, config.CAName) {
+		return nil
+	}
+	return status.Errorf(codes.InvalidArgument, "CA %q is not allowed by end entity profile %q according to end_entity_profile_allowed_cas (allowed: %s)", config.CAName, config.EndEntityProfileName, strings.Join(allowedCas, ", "))
+}
+
+// getPromotedSubjectDn returns the subject DN to request from EJBCA when promote_san_to_cn is configured and the
+// CSR has no Common Name. The CN is synthesized from the first SAN of the configured type. If no promotion applies,
+// an empty string is returned.
+func getPromotedSubjectDn(config *Config, csr *x509.CertificateRequest) string {
+	if csr.Subject.CommonName != "" {
+		return ""
+	}
+
+	cn := ""
+	switch config.PromoteSANToCN {
+	case "dns":
+		if len(csr.DNSNames) > 0 {
+			cn = csr.DNSNames[0]
+		}
+	case "uri":
+		if len(csr.URIs) > 0 {
+			cn = csr.URIs[0].String()
+		}
+	}
+	if cn == "" {
+		return ""
+	}
+
+	subject := csr.Subject
+	subject.CommonName = cn
+	return subject.String()
+}
+
+// defaultSanEncoding maps the SAN types of a CSR to the names that EJBCA uses for them in a subject_alt_name string.
+// san_encoding overrides individual entries.
+var defaultSanEncoding = map[string]string{
+	"dns":   "dNSName",
+	"uri":   "uniformResourceIdentifier",
+	"ip":    "iPAddress",
+	"email": "rfc822name",
+}
+
+// getSubjectAltName returns the CSR's SANs as an EJBCA subject_alt_name string, such as
+// "uniformResourceIdentifier=spiffe://example.org", so that each SAN is encoded with the type the end entity profile
+// expects. An empty string is returned if the CSR has no SANs.
+func getSubjectAltName(config *Config, csr *x509.CertificateRequest) string {
+	encoding := func(sanType string) string {
+		if name, ok := config.SANEncoding[sanType]; ok {
+			return name
+		}
+		return defaultSanEncoding[sanType]
+	}
+
+	var names []string
+	for _, dnsName := range csr.DNSNames {
+		names = append(names, encoding("dns")+"="+escapeAltNameValue(dnsName))
+	}
+	for _, uri := range csr.URIs {
+		names = append(names, encoding("uri")+"="+escapeAltNameValue(uri.String()))
+	}
+	for _, ip := range csr.IPAddresses {
+		names = append(names, encoding("ip")+"="+ip.String())
+	}
+	for _, email := range csr.EmailAddresses {
+		names = append(names, encoding("email")+"="+escapeAltNameValue(email))
+	}
+	return strings.Join(names, ", ")
+}
+
+// escapeAltNameValue escapes the characters that separate entries in an EJBCA subject_alt_name string.
+func escapeAltNameValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`).Replace(value)
+}
+
+// finalizeEnrollment completes a two-phase enrollment. EJBCA responds to the initial enrollment with a request ID
+// instead of the certificate, which is then retrieved by finalizing the request with the enrollment password.
+func (p *Plugin) finalizeEnrollment(ctx context.Context, config *Config, client ejbcaClient, enrollResponse *ejbcaclient.CertificateRestResponse, password string) (*ejbcaclient.CertificateRestResponse, error) {
+	logger := p.logger.Named("finalizeEnrollment")
+
+	requestId, ok := getRequestId(enrollResponse)
+	if !ok {
+		return nil, status.Error(codes.Internal, "EJBCA returned neither a certificate nor a request ID to finalize")
+	}
+
+	responseFormat := enrollResponse.GetResponseFormat()
+	if responseFormat == "" {
+		responseFormat = "PEM"
+	}
+	finalizeRequest := ejbcaclient.FinalizeRestRequest{}
+	finalizeRequest.SetResponseFormat(responseFormat)
+	finalizeRequest.SetPassword(password)
+
+	logger.Info("Finalizing enrollment with EJBCA", "requestId", requestId)
+	finalizeResponse, httpResponse, err := client.FinalizeEnrollment(ctx, requestId).
+		FinalizeRestRequest(finalizeRequest).
+		Execute()
+	if err != nil {
+		return nil, p.parseEjbcaError(config, "failed to finalize enrollment", err)
+	}
+	if httpResponse != nil && httpResponse.Body != nil {
+		httpResponse.Body.Close()
+	}
+
+	// The request may still be waiting on EJBCA, for example for approval, in which case SPIRE retries the mint
+	if getIssuedCertificate(finalizeResponse) == "" {
+		return nil, status.Errorf(codes.Unavailable, "enrollment request %d is not ready to be finalized", requestId)
+	}
+
+	logger.Debug("Finalized enrollment", "requestId", requestId)
+	return finalizeResponse, nil
+}
+
+// getRequestId returns the request_id field of an enrollment response, which isn't modeled by the EJBCA client SDK.
+func getRequestId(resp *ejbcaclient.CertificateRestResponse) (int32, bool) {
+	return parseRequestId(resp.AdditionalProperties["request_id"])
+}
+
+// parseRequestId converts a request_id decoded from JSON, which EJBCA sends as a number or a string.
+func parseRequestId(requestIdValue any) (int32, bool) {
+	switch value := requestIdValue.(type) {
+	case float64:
+		return int32(value), true
+	case string:
+		requestId, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return 0, false
+		}
+		return int32(requestId), true
+	}
+	return 0, false
+}
+
+// approvalRequiredError returns the error of a mint whose enrollment EJBCA holds for approval. It carries an ErrorInfo
+// detail with the APPROVAL_REQUIRED reason and, if known, the request ID of the approval in its metadata.
+func approvalRequiredError(config *Config, endEntityName string, requestId int32, hasRequestId bool) error {
+	metadata := map[string]string{
+		"ca_name":                  config.CAName,
+		"end_entity_profile_name":  config.EndEntityProfileName,
+		"certificate_profile_name": config.CertificateProfileName,
+	}
+	if hasRequestId {
+		metadata["request_id"] = strconv.Itoa(int(requestId))
+	}
+	st := status.Newf(codes.FailedPrecondition, "enrollment of end entity %s requires approval in EJBCA", endEntityName)
+	return withErrorInfo(st, reasonApprovalRequired, metadata).Err()
+}
+
+// resetEndEntityStatus sets the status of an existing end entity back to NEW, with the password of the pending
+// enrollment, so that EJBCA accepts another enrollment for it.
+func (p *Plugin) resetEndEntityStatus(ctx context.Context, config *Config, client ejbcaClient, endEntityName string, password string) error {
+	logger := p.logger.Named("resetEndEntityStatus")
+
+	statusRequest := ejbcaclient.SetEndEntityStatusRestRequest{}
+	statusRequest.SetStatus("NEW")
+	statusRequest.SetToken("USERGENERATED")
+	statusRequest.SetPassword(password)
+
+	logger.Info("Resetting end entity status to NEW", "endEntityName", endEntityName)
+	httpResponse, err := client.Setstatus(ctx, endEntityName).
+		SetEndEntityStatusRestRequest(statusRequest).
+		Execute()
+	if err != nil {
+		return p.parseEjbcaError(config, "failed to reset end entity status", err)
+	}
+	if httpResponse != nil && httpResponse.Body != nil {
+		httpResponse.Body.Close()
+	}
+	return nil
+}
+
+const (
+	endEntityNameCollisionIncrement = "increment"
+
+	// maxEndEntityNameCollisions is the number of numbered end entity names tried by end_entity_name_collision
+	maxEndEntityNameCollisions = 10
+)
+
+// enrollRest enrolls the CSR in enrollConfig with EJBCA's REST API. Rejected client certificates, end entity
+// statuses, and end entity name collisions are recovered from as configured, and two-phase enrollments are finalized.
+// The end entity name that was last enrolled is returned, which differs from endEntityName after a collision. streamCtx
+// is the context of the mint stream, which ctx is derived from.
+func (p *Plugin) enrollRest(ctx context.Context, streamCtx context.Context, config *Config, client ejbcaClient, enrollConfig ejbcaclient.EnrollCertificateRestRequest, endEntityName string, password string) (*ejbcaclient.CertificateRestResponse, string, error) {
+	logger := p.logger.Named("enrollRest")
+
+	enrollResponse, httpResponse, err := p.enroll(ctx, config, client, enrollConfig)
+	if err != nil && config.ReloadClientCertOnError && isClientCertRejected(err) {
+		logger.Warn("EJBCA rejected the client certificate - reloading it from disk and retrying", "error", err)
+
+		reloaded, reloadErr := p.reloadClient(config)
+		if reloadErr != nil {
+			return nil, endEntityName, status.Errorf(codes.Unavailable, "failed to reload client certificate after %v: %v", err, reloadErr)
+		}
+		client = reloaded
+
+		enrollResponse, httpResponse, err = p.enroll(ctx, config, client, enrollConfig)
+	}
+	for collision := 1; err != nil && config.EndEntityNameCollision == endEntityNameCollisionIncrement && isDuplicateEndEntityError(err); collision++ {
+		if collision > maxEndEntityNameCollisions {
+			return nil, endEntityName, status.Errorf(codes.AlreadyExists, "end entity name %s and its first %d numbered alternatives already exist", endEntityName, maxEndEntityNameCollisions)
+		}
+		name := fmt.Sprintf("%s-%d", endEntityName, collision)
+		logger.Warn("End entity name already exists - retrying with a numbered name", "endEntityName", enrollConfig.GetUsername(), "retryEndEntityName", name)
+		enrollConfig.SetUsername(name)
+		enrollResponse, httpResponse, err = p.enroll(ctx, config, client, enrollConfig)
+	}
+	endEntityName = enrollConfig.GetUsername()
+
+	if err != nil && config.ResetEndEntityStatus && isEndEntityStatusError(err) {
+		logger.Warn("EJBCA rejected the enrollment because of the end entity status - resetting it to NEW and retrying", "endEntityName", endEntityName, "error", err)
+
+		if resetErr := p.resetEndEntityStatus(ctx, config, client, endEntityName, password); resetErr != nil {
+			return nil, endEntityName, resetErr
+		}
+
+		enrollResponse, httpResponse, err = p.enroll(ctx, config, client, enrollConfig)
+	}
+	if err != nil && config.FailOnApprovalRequired && isApprovalRequiredError(err) {
+		requestId, hasRequestId := getErrorRequestId(err)
+		return nil, endEntityName, approvalRequiredError(config, endEntityName, requestId, hasRequestId)
+	}
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && streamCtx.Err() == nil {
+			return nil, endEntityName, status.Errorf(codes.DeadlineExceeded, "enrollment exceeded max_enrollment_duration of %s", config.maxEnrollmentDuration)
+		}
+		return nil, endEntityName, p.parseEjbcaError(config, "failed to enroll CSR", err)
+	}
+	if httpResponse != nil && httpResponse.Body != nil {
+		httpResponse.Body.Close()
+	}
+
+	if config.FailOnApprovalRequired && getIssuedCertificate(enrollResponse) == "" {
+		if requestId, ok := getRequestId(enrollResponse); ok {
+			return nil, endEntityName, approvalRequiredError(config, endEntityName, requestId, true)
+		}
+	}
+
+	if config.TwoPhaseEnrollment && getIssuedCertificate(enrollResponse) == "" {
+		enrollResponse, err = p.finalizeEnrollment(ctx, config, client, enrollResponse, password)
+		if err != nil {
+			return nil, endEntityName, err
+		}
+	}
+
+	return enrollResponse, endEntityName, nil
+}
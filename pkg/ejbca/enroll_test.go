@@ -0,0 +1,591 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
+	upstreamauthorityv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/upstreamauthority/v1"
+	"github.com/spiffe/spire/test/spiretest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTwoPhaseEnrollment(t *testing.T) {
+	rootCA, intermediateCA, svidIssuingCA, _ := issueTestCertificates(t)
+
+	for _, tt := range []struct {
+		name string
+
+		twoPhaseEnrollment bool
+		enrollResponse     map[string]any
+		finalizeReady      bool
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+		expectedFinalizeHits  int
+	}{
+		{
+			name:                 "finalized",
+			twoPhaseEnrollment:   true,
+			enrollResponse:       map[string]any{"request_id": 42, "response_format": "PEM"},
+			finalizeReady:        true,
+			expectedgRPCCode:     codes.OK,
+			expectedFinalizeHits: 1,
+		},
+		{
+			name:                  "not_ready",
+			twoPhaseEnrollment:    true,
+			enrollResponse:        map[string]any{"request_id": 42},
+			expectedgRPCCode:      codes.Unavailable,
+			expectedMessagePrefix: "upstreamauthority(ejbca): enrollment request 42 is not ready to be finalized",
+			expectedFinalizeHits:  1,
+		},
+		{
+			name:                  "no_request_id",
+			twoPhaseEnrollment:    true,
+			enrollResponse:        map[string]any{"response_format": "PEM"},
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): EJBCA returned neither a certificate nor a request ID to finalize",
+		},
+		{
+			name:                  "disabled",
+			enrollResponse:        map[string]any{"request_id": 42, "response_format": "PEM"},
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): failed to parse certificate PEM",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var enrollPassword string
+			finalizeHits := 0
+
+			mux := http.NewServeMux()
+			mux.HandleFunc("/ejbca/ejbca-rest-api/v1/certificate/pkcs10enroll", func(w http.ResponseWriter, r *http.Request) {
+				enrollRestRequest := ejbcaclient.EnrollCertificateRestRequest{}
+				err := json.NewDecoder(r.Body).Decode(&enrollRestRequest)
+				require.NoError(t, err)
+				enrollPassword = enrollRestRequest.GetPassword()
+
+				w.Header().Add("Content-Type", "application/json")
+				err = json.NewEncoder(w).Encode(tt.enrollResponse)
+				require.NoError(t, err)
+			})
+			mux.HandleFunc("/ejbca/ejbca-rest-api/v1/certificate/42/finalize", func(w http.ResponseWriter, r *http.Request) {
+				finalizeHits++
+
+				finalizeRestRequest := ejbcaclient.FinalizeRestRequest{}
+				err := json.NewDecoder(r.Body).Decode(&finalizeRestRequest)
+				require.NoError(t, err)
+				require.Equal(t, enrollPassword, finalizeRestRequest.GetPassword())
+				require.Equal(t, "PEM", finalizeRestRequest.GetResponseFormat())
+
+				var response any = map[string]any{"request_id": 42}
+				if tt.finalizeReady {
+					response = certificateRestResponseFromExpectedCerts(t, []*x509.Certificate{svidIssuingCA, intermediateCA}, []*x509.Certificate{rootCA}, "PEM")
+				}
+				w.Header().Add("Content-Type", "application/json")
+				err = json.NewEncoder(w).Encode(response)
+				require.NoError(t, err)
+			})
+			testServer := httptest.NewTLSServer(mux)
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				TwoPhaseEnrollment: tt.twoPhaseEnrollment,
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			x509CA, upstreamX509Roots, _, err := ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+			require.Equal(t, tt.expectedFinalizeHits, finalizeHits)
+			if tt.expectedgRPCCode != codes.OK {
+				return
+			}
+
+			require.Equal(t, []*x509.Certificate{svidIssuingCA, intermediateCA}, x509CA)
+			require.Equal(t, []*x509.Certificate{rootCA}, upstreamX509Roots)
+		})
+	}
+}
+
+func TestFailOnApprovalRequired(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		failOnApprovalRequired bool
+		enrollStatusCode       int
+		enrollResponse         map[string]any
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+		expectedRequestId     string
+	}{
+		{
+			name:                   "pending_request",
+			failOnApprovalRequired: true,
+			enrollStatusCode:       http.StatusAccepted,
+			enrollResponse:         map[string]any{"request_id": 42},
+			expectedgRPCCode:       codes.FailedPrecondition,
+			expectedMessagePrefix:  "enrollment of end entity spiffe://example.org requires approval in EJBCA",
+			expectedRequestId:      "42",
+		},
+		{
+			name:                   "approval_error",
+			failOnApprovalRequired: true,
+			enrollStatusCode:       http.StatusBadRequest,
+			enrollResponse:         map[string]any{"error_code": 400, "error_message": "Request requires approval", "request_id": "7"},
+			expectedgRPCCode:       codes.FailedPrecondition,
+			expectedMessagePrefix:  "enrollment of end entity spiffe://example.org requires approval in EJBCA",
+			expectedRequestId:      "7",
+		},
+		{
+			name:                   "approval_error_without_request_id",
+			failOnApprovalRequired: true,
+			enrollStatusCode:       http.StatusBadRequest,
+			enrollResponse:         map[string]any{"error_code": 400, "error_message": "Request requires approval"},
+			expectedgRPCCode:       codes.FailedPrecondition,
+			expectedMessagePrefix:  "enrollment of end entity spiffe://example.org requires approval in EJBCA",
+		},
+		{
+			name:                  "disabled",
+			enrollStatusCode:      http.StatusBadRequest,
+			enrollResponse:        map[string]any{"error_code": 400, "error_message": "Request requires approval", "request_id": "7"},
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "EJBCA returned an error: failed to enroll CSR",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(tt.enrollStatusCode)
+				err := json.NewEncoder(w).Encode(tt.enrollResponse)
+				require.NoError(t, err)
+			}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				FailOnApprovalRequired: tt.failOnApprovalRequired,
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			// The raw client is used since the status details are dropped by the SPIRE plugin facade
+			stream, err := ua.UpstreamAuthorityPluginClient.MintX509CAAndSubscribe(context.Background(), &upstreamauthorityv1.MintX509CARequest{Csr: csr.Raw})
+			require.NoError(t, err)
+			_, err = stream.Recv()
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+			if tt.expectedgRPCCode != codes.FailedPrecondition {
+				return
+			}
+
+			st := status.Convert(err)
+			require.Len(t, st.Details(), 1)
+			errorInfo, ok := st.Details()[0].(*errdetails.ErrorInfo)
+			require.True(t, ok, "expected ErrorInfo detail, got %T", st.Details()[0])
+			require.Equal(t, reasonApprovalRequired, errorInfo.GetReason())
+			require.Equal(t, errorDomain, errorInfo.GetDomain())
+			requestId, ok := errorInfo.GetMetadata()["request_id"]
+			require.Equal(t, tt.expectedRequestId != "", ok)
+			require.Equal(t, tt.expectedRequestId, requestId)
+		})
+	}
+}
+
+func TestEndEntityProfileAllowedCas(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		endEntityProfileAllowedCAs map[string][]string
+
+		expectedgRPCCode codes.Code
+		expectedMessage  string
+		expectedEnrolled bool
+	}{
+		{
+			name: "allowed",
+			endEntityProfileAllowedCAs: map[string][]string{
+				"fakeSpireIntermediateCAEEP": {"Other-CA", "Fake-Sub-CA"},
+			},
+			expectedEnrolled: true,
+		},
+		{
+			name: "disallowed",
+			endEntityProfileAllowedCAs: map[string][]string{
+				"fakeSpireIntermediateCAEEP": {"Other-CA"},
+			},
+			expectedgRPCCode: codes.InvalidArgument,
+			expectedMessage:  "upstreamauthority(ejbca): CA \"Fake-Sub-CA\" is not allowed by end entity profile \"fakeSpireIntermediateCAEEP\" according to end_entity_profile_allowed_cas (allowed: Other-CA)",
+		},
+		{
+			name: "profile_not_listed",
+			endEntityProfileAllowedCAs: map[string][]string{
+				"otherEEP": {"Other-CA"},
+			},
+			expectedEnrolled: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			enrolled := false
+			testServer := newFakeEnrollServer(t, func(*ejbcaclient.EnrollCertificateRestRequest) {
+				enrolled = true
+			})
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				EndEntityProfileAllowedCAs: tt.endEntityProfileAllowedCAs,
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatus(t, err, tt.expectedgRPCCode, tt.expectedMessage)
+			require.Equal(t, tt.expectedEnrolled, enrolled)
+		})
+	}
+}
+
+func TestEndEntityTtlTag(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tt := range []struct {
+		name string
+
+		endEntityTTLTag string
+
+		expectedExtensionData any
+	}{
+		{
+			name:            "tagged",
+			endEntityTTLTag: "720h",
+			expectedExtensionData: []any{
+				map[string]any{"name": "spire_end_entity_expires_at", "value": "2024-07-01T12:00:00Z"},
+			},
+		},
+		{
+			name: "unset",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var extensionData any
+			testServer := newFakeEnrollServer(t, func(req *ejbcaclient.EnrollCertificateRestRequest) {
+				extensionData = req.AdditionalProperties["extension_data"]
+			})
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				EndEntityTTLTag: tt.endEntityTTLTag,
+			}, func(p *Plugin) {
+				p.hooks.now = func() time.Time { return now }
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedExtensionData, extensionData)
+		})
+	}
+}
+
+func TestUsePreferredTtl(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tt := range []struct {
+		name string
+
+		usePreferredTTL bool
+		preferredTtl    time.Duration
+
+		expectedEndTime any
+	}{
+		{
+			name:            "end_time_requested",
+			usePreferredTTL: true,
+			preferredTtl:    48 * time.Hour,
+			expectedEndTime: "2024-06-03T12:00:00Z",
+		},
+		{
+			name:            "no_preferred_ttl",
+			usePreferredTTL: true,
+		},
+		{
+			name:         "disabled",
+			preferredTtl: 48 * time.Hour,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var endTime any
+			testServer := newFakeEnrollServer(t, func(req *ejbcaclient.EnrollCertificateRestRequest) {
+				endTime = req.AdditionalProperties["end_time"]
+			})
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{UsePreferredTTL: tt.usePreferredTTL}, func(p *Plugin) {
+				p.hooks.now = func() time.Time { return now }
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, tt.preferredTtl)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedEndTime, endTime)
+		})
+	}
+}
+
+func TestTrustDomainExtensionData(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		trustDomainExtensionData string
+		uris                     []string
+
+		expectedExtensionData any
+		expectedgRPCCode      codes.Code
+		expectedMessage       string
+	}{
+		{
+			name:                     "tagged",
+			trustDomainExtensionData: "spire_trust_domain",
+			uris:                     []string{"spiffe://example.org/spire/server"},
+			expectedExtensionData: []any{
+				map[string]any{"name": "spire_trust_domain", "value": "example.org"},
+			},
+		},
+		{
+			name:                     "no_spiffe_id",
+			trustDomainExtensionData: "spire_trust_domain",
+			uris:                     []string{"https://example.org"},
+			expectedgRPCCode:         codes.InvalidArgument,
+			expectedMessage:          "upstreamauthority(ejbca): unable to determine trust domain of CSR for trust_domain_extension_data: CSR does not contain a SPIFFE ID URI SAN",
+		},
+		{
+			name: "unset",
+			uris: []string{"spiffe://example.org"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var extensionData any
+			testServer := newFakeEnrollServer(t, func(req *ejbcaclient.EnrollCertificateRestRequest) {
+				extensionData = req.AdditionalProperties["extension_data"]
+			})
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				TrustDomainExtensionData: tt.trustDomainExtensionData,
+			})
+
+			csr, err := generateCSR("", nil, tt.uris, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatus(t, err, tt.expectedgRPCCode, tt.expectedMessage)
+			require.Equal(t, tt.expectedExtensionData, extensionData)
+		})
+	}
+}
+
+func TestResetEndEntityStatus(t *testing.T) {
+	rootCA, intermediateCA, svidIssuingCA, _ := issueTestCertificates(t)
+
+	for _, tt := range []struct {
+		name string
+
+		resetEndEntityStatus bool
+		setStatusCode        int
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+		expectedEnrollHits    int
+		expectedSetStatusHits int
+	}{
+		{
+			name:                  "reset_then_success",
+			resetEndEntityStatus:  true,
+			setStatusCode:         http.StatusOK,
+			expectedgRPCCode:      codes.OK,
+			expectedEnrollHits:    2,
+			expectedSetStatusHits: 1,
+		},
+		{
+			name:                  "reset_fails",
+			resetEndEntityStatus:  true,
+			setStatusCode:         http.StatusForbidden,
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): EJBCA returned an error: failed to reset end entity status",
+			expectedEnrollHits:    1,
+			expectedSetStatusHits: 1,
+		},
+		{
+			name:                  "disabled",
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): EJBCA returned an error: failed to enroll CSR",
+			expectedEnrollHits:    1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var enrollHits, setStatusHits int
+			var enrollPassword string
+
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+
+				if strings.HasSuffix(r.URL.Path, "/setstatus") {
+					setStatusHits++
+					require.Equal(t, "/ejbca/ejbca-rest-api/v1/endentity/spiffe:%2F%2Fexample.org/setstatus", r.URL.EscapedPath())
+
+					statusRequest := ejbcaclient.SetEndEntityStatusRestRequest{}
+					err := json.NewDecoder(r.Body).Decode(&statusRequest)
+					require.NoError(t, err)
+					require.Equal(t, "NEW", statusRequest.GetStatus())
+					require.Equal(t, enrollPassword, statusRequest.GetPassword())
+
+					w.WriteHeader(tt.setStatusCode)
+					return
+				}
+
+				enrollHits++
+				enrollRestRequest := ejbcaclient.EnrollCertificateRestRequest{}
+				err := json.NewDecoder(r.Body).Decode(&enrollRestRequest)
+				require.NoError(t, err)
+				enrollPassword = enrollRestRequest.GetPassword()
+
+				if setStatusHits == 0 {
+					w.WriteHeader(http.StatusBadRequest)
+					err = json.NewEncoder(w).Encode(map[string]any{
+						"error_code":    400,
+						"error_message": "End entity spiffe://example.org has status GENERATED and can not be enrolled",
+					})
+					require.NoError(t, err)
+					return
+				}
+
+				err = json.NewEncoder(w).Encode(certificateRestResponseFromExpectedCerts(t, []*x509.Certificate{svidIssuingCA, intermediateCA}, []*x509.Certificate{rootCA}, "PEM"))
+				require.NoError(t, err)
+			}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				ResetEndEntityStatus: tt.resetEndEntityStatus,
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+			require.Equal(t, tt.expectedEnrollHits, enrollHits)
+			require.Equal(t, tt.expectedSetStatusHits, setStatusHits)
+		})
+	}
+}
+
+func TestEndEntityNameCollision(t *testing.T) {
+	rootCA, intermediateCA, svidIssuingCA, _ := issueTestCertificates(t)
+
+	for _, tt := range []struct {
+		name string
+
+		endEntityNameCollision string
+		collisions             int
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+		expectedUsernames     []string
+	}{
+		{
+			name:                   "increment_after_two_collisions",
+			endEntityNameCollision: "increment",
+			collisions:             2,
+			expectedgRPCCode:       codes.OK,
+			expectedUsernames:      []string{"spiffe://example.org", "spiffe://example.org-1", "spiffe://example.org-2"},
+		},
+		{
+			name:                   "increment_exhausted",
+			endEntityNameCollision: "increment",
+			collisions:             100,
+			expectedgRPCCode:       codes.AlreadyExists,
+			expectedMessagePrefix:  "upstreamauthority(ejbca): end entity name spiffe://example.org and its first 10 numbered alternatives already exist",
+			expectedUsernames: []string{
+				"spiffe://example.org", "spiffe://example.org-1", "spiffe://example.org-2", "spiffe://example.org-3",
+				"spiffe://example.org-4", "spiffe://example.org-5", "spiffe://example.org-6", "spiffe://example.org-7",
+				"spiffe://example.org-8", "spiffe://example.org-9", "spiffe://example.org-10",
+			},
+		},
+		{
+			name:                  "disabled",
+			collisions:            1,
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): EJBCA returned an error: failed to enroll CSR",
+			expectedUsernames:     []string{"spiffe://example.org"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var usernames []string
+
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+
+				enrollRestRequest := ejbcaclient.EnrollCertificateRestRequest{}
+				err := json.NewDecoder(r.Body).Decode(&enrollRestRequest)
+				require.NoError(t, err)
+				usernames = append(usernames, enrollRestRequest.GetUsername())
+
+				if len(usernames) <= tt.collisions {
+					w.WriteHeader(http.StatusBadRequest)
+					err = json.NewEncoder(w).Encode(map[string]any{
+						"error_code":    400,
+						"error_message": "End entity " + enrollRestRequest.GetUsername() + " already exists",
+					})
+					require.NoError(t, err)
+					return
+				}
+
+				err = json.NewEncoder(w).Encode(certificateRestResponseFromExpectedCerts(t, []*x509.Certificate{svidIssuingCA, intermediateCA}, []*x509.Certificate{rootCA}, "PEM"))
+				require.NoError(t, err)
+			}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				EndEntityNameCollision: tt.endEntityNameCollision,
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+			require.Equal(t, tt.expectedUsernames, usernames)
+		})
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
+)
+
+const (
+	apiVersionV1 = "v1"
+	apiVersionV2 = "v2"
+
+	// enrollV2Path is the path of the EJBCA 8.x REST endpoint that PKCS#10 CSRs are enrolled with by api_version v2
+	enrollV2Path = "/ejbca/ejbca-rest-api/v2/certificate/pkcs10enroll"
+)
+
+// enrollV2EndEntityFields are the fields of a v1 enrollment request that the v2 API nests under end_entity
+var enrollV2EndEntityFields = []string{"username", "password", "email", "account_binding_id", "extension_data"}
+
+// newEnrollV2Request converts a v1 enrollment request to the shape expected by the v2 API, which nests the fields
+// describing the end entity under end_entity and always includes the CA chain.
+func newEnrollV2Request(req ejbcaclient.EnrollCertificateRestRequest) (map[string]interface{}, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+
+	endEntity := make(map[string]interface{})
+	for _, field := range enrollV2EndEntityFields {
+		if value, ok := fields[field]; ok {
+			endEntity[field] = value
+			delete(fields, field)
+		}
+	}
+	fields["end_entity"] = endEntity
+	delete(fields, "include_chain")
+	return fields, nil
+}
+
+// mapEnrollV2Response maps a v2 enrollment response to the v1 response model. The v2 API returns the chain of the
+// issuing CA without its root in issuer_chain, and the root separately in root_certificate, so they're mapped to
+// certificate_chain and root_certificates.
+func mapEnrollV2Response(body []byte) (*ejbcaclient.CertificateRestResponse, error) {
+	response := &ejbcaclient.CertificateRestResponse{}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return response, nil
+	}
+	if err := json.Unmarshal(body, response); err != nil {
+		return nil, err
+	}
+
+	issuerChain, _ := response.AdditionalProperties["issuer_chain"].([]interface{})
+	for _, entry := range issuerChain {
+		encoded, ok := entry.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected %T entry in issuer_chain", entry)
+		}
+		response.CertificateChain = append(response.CertificateChain, encoded)
+	}
+	delete(response.AdditionalProperties, "issuer_chain")
+
+	if root, ok := response.AdditionalProperties["root_certificate"].(string); ok && root != "" {
+		response.AdditionalProperties["root_certificates"] = []interface{}{root}
+	}
+	delete(response.AdditionalProperties, "root_certificate")
+	return response, nil
+}
+
+// EnrollPkcs10CertificateV2 enrolls req with the v2 enrollment endpoint. Like the EJBCA client SDK, the body of the
+// returned response is restored so that it can still be read, and an error response is returned as an error that
+// carries its body.
+func (c *apiClient) EnrollPkcs10CertificateV2(ctx context.Context, req ejbcaclient.EnrollCertificateRestRequest) (*ejbcaclient.CertificateRestResponse, *http.Response, error) {
+	if c.httpClient == nil {
+		return nil, nil, errors.New("EJBCA client isn't configured for api_version v2")
+	}
+
+	v2Request, err := newEnrollV2Request(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	requestBody, err := json.Marshal(v2Request)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, c.enrollV2URL, bytes.NewReader(requestBody))
+	if err != nil {
+		return nil, nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("Accept", "application/json")
+
+	httpResponse, err := c.httpClient.Do(httpRequest)
+	if err != nil {
+		return nil, httpResponse, err
+	}
+	body, err := io.ReadAll(httpResponse.Body)
+	httpResponse.Body.Close()
+	httpResponse.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil, httpResponse, err
+	}
+
+	if httpResponse.StatusCode >= http.StatusMultipleChoices {
+		return nil, httpResponse, &ejbcaResponseError{status: httpResponse.Status, body: body}
+	}
+
+	response, err := mapEnrollV2Response(body)
+	if err != nil {
+		return nil, httpResponse, fmt.Errorf("failed to decode v2 enrollment response: %w", err)
+	}
+	return response, httpResponse, nil
+}
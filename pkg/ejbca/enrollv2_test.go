@@ -0,0 +1,146 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	upstreamauthorityv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/upstreamauthority/v1"
+	"github.com/spiffe/spire/test/spiretest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestEnrollAPIVersion(t *testing.T) {
+	rootCA, intermediateCA, svidIssuingCA, _ := issueTestCertificates(t)
+	encode := func(cert *x509.Certificate) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	}
+
+	for _, tt := range []struct {
+		name string
+
+		apiVersion string
+
+		expectedPath string
+	}{
+		{
+			name:         "default",
+			expectedPath: "/ejbca/ejbca-rest-api/v1/certificate/pkcs10enroll",
+		},
+		{
+			name:         "v1",
+			apiVersion:   "v1",
+			expectedPath: "/ejbca/ejbca-rest-api/v1/certificate/pkcs10enroll",
+		},
+		{
+			name:         "v2",
+			apiVersion:   "v2",
+			expectedPath: "/ejbca/ejbca-rest-api/v2/certificate/pkcs10enroll",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests []map[string]interface{}
+			mux := http.NewServeMux()
+			mux.Handle("/ejbca/ejbca-rest-api/v1/certificate/pkcs10enroll", newFakeEnrollHandler(t, nil))
+			mux.HandleFunc("/ejbca/ejbca-rest-api/v2/certificate/pkcs10enroll", func(w http.ResponseWriter, r *http.Request) {
+				var request map[string]interface{}
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+				requests = append(requests, request)
+
+				w.Header().Add("Content-Type", "application/json")
+				require.NoError(t, json.NewEncoder(w).Encode(map[string]interface{}{
+					"certificate":      encode(svidIssuingCA),
+					"response_format":  "PEM",
+					"issuer_chain":     []string{encode(intermediateCA)},
+					"root_certificate": encode(rootCA),
+				}))
+			})
+			var paths []string
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				paths = append(paths, r.URL.Path)
+				mux.ServeHTTP(w, r)
+			}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				APIVersion:       tt.apiVersion,
+				AccountBindingID: "spire-binding",
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			x509CA, upstreamX509Roots, _, err := ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			require.NoError(t, err)
+			require.Equal(t, []string{tt.expectedPath}, paths)
+			require.Equal(t, []*x509.Certificate{svidIssuingCA, intermediateCA}, x509CA)
+			require.Equal(t, []*x509.Certificate{rootCA}, upstreamX509Roots)
+
+			if tt.apiVersion != "v2" {
+				require.Empty(t, requests)
+				return
+			}
+			require.Len(t, requests, 1)
+			request := requests[0]
+			require.Contains(t, request["certificate_request"], "BEGIN CERTIFICATE REQUEST")
+			require.Equal(t, "Fake-Sub-CA", request["certificate_authority_name"])
+			require.NotContains(t, request, "username")
+			require.NotContains(t, request, "include_chain")
+			endEntity, ok := request["end_entity"].(map[string]interface{})
+			require.True(t, ok, "expected end_entity object, got %T", request["end_entity"])
+			require.NotEmpty(t, endEntity["username"])
+			require.Equal(t, "spire-binding", endEntity["account_binding_id"])
+		})
+	}
+}
+
+func TestEnrollAPIVersionV2Error(t *testing.T) {
+	testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error_code":400,"error_message":"CA Fake-Sub-CA is offline"}`))
+	}))
+	defer testServer.Close()
+
+	_, ua := loadTestPlugin(t, testServer, &Config{APIVersion: "v2"})
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	// The raw client is used since the status details are dropped by the SPIRE plugin facade
+	stream, err := ua.UpstreamAuthorityPluginClient.MintX509CAAndSubscribe(context.Background(), &upstreamauthorityv1.MintX509CARequest{Csr: csr.Raw})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	spiretest.RequireGRPCStatusContains(t, err, codes.Internal, "CA Fake-Sub-CA is offline (error_code=400)")
+
+	st := status.Convert(err)
+	require.Len(t, st.Details(), 1)
+	errorInfo, ok := st.Details()[0].(*errdetails.ErrorInfo)
+	require.True(t, ok, "expected ErrorInfo detail, got %T", st.Details()[0])
+	require.Equal(t, reasonCAOffline, errorInfo.GetReason())
+	require.Equal(t, "400", errorInfo.GetMetadata()["ejbca_error_code"])
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+
+	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// errorDomain is the ErrorInfo domain attached to gRPC status details returned by the plugin
+	errorDomain = "ejbca.upstreamauthority.spire.keyfactor.com"
+
+	reasonEjbcaError         = "EJBCA_ERROR"
+	reasonCAOffline          = "EJBCA_CA_OFFLINE"
+	reasonDuplicateEndEntity = "DUPLICATE_END_ENTITY"
+	reasonApprovalRequired   = "APPROVAL_REQUIRED"
+)
+
+// ejbcaErrorResponse is the JSON error body returned by the EJBCA REST API
+type ejbcaErrorResponse struct {
+	ErrorCode    int    `json:"error_code"`
+	ErrorMessage string `json:"error_message"`
+}
+
+// reason maps the EJBCA error message to a stable ErrorInfo reason.
+func (e ejbcaErrorResponse) reason() string {
+	message := strings.ToLower(e.ErrorMessage)
+	switch {
+	case strings.Contains(message, "offline"), strings.Contains(message, "not active"):
+		return reasonCAOffline
+	case strings.Contains(message, "already exists"), strings.Contains(message, "duplicate"):
+		return reasonDuplicateEndEntity
+	case strings.Contains(message, "approval"):
+		return reasonApprovalRequired
+	default:
+		return reasonEjbcaError
+	}
+}
+
+// maxEjbcaErrorMessageLength is the length beyond which EJBCA error messages are truncated in returned errors
+const maxEjbcaErrorMessageLength = 512
+
+// pemBlockPattern matches PEM blocks, such as a CSR or a certificate, that an EJBCA error message may echo back
+var pemBlockPattern = regexp.MustCompile(`(?s)-----BEGIN [A-Z0-9 ]+-----.*?(-----END [A-Z0-9 ]+-----|$)`)
+
+// redactEjbcaErrorMessage prepares an EJBCA error message to be returned to SPIRE. PEM blocks are replaced with a
+// placeholder so that a CSR or key echoed back by EJBCA isn't leaked, and long messages are truncated.
+func redactEjbcaErrorMessage(message string) string {
+	message = pemBlockPattern.ReplaceAllString(message, "[redacted PEM]")
+	if len(message) > maxEjbcaErrorMessageLength {
+		message = strings.ToValidUTF8(message[:maxEjbcaErrorMessageLength], "") + "..."
+	}
+	return message
+}
+
+// withErrorInfo attaches an ErrorInfo detail to st. If the detail can't be attached, st is returned unchanged.
+func withErrorInfo(st *status.Status, reason string, metadata map[string]string) *status.Status {
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   errorDomain,
+		Metadata: metadata,
+	})
+	if err != nil {
+		return st
+	}
+	return detailed
+}
+
+// ejbcaResponseError is returned for an error response from an EJBCA endpoint that isn't called through the EJBCA
+// client SDK. Like ejbcaclient.GenericOpenAPIError, it carries the response body so that the EJBCA error can be
+// parsed.
+type ejbcaResponseError struct {
+	status string
+	body   []byte
+}
+
+func (e *ejbcaResponseError) Error() string {
+	return e.status
+}
+
+// Body returns the body of the error response
+func (e *ejbcaResponseError) Body() []byte {
+	return e.body
+}
+
+// ejbcaErrorBody returns the response body of an EJBCA error response in err, whether it was returned by the EJBCA
+// client SDK or by an endpoint called without it.
+func ejbcaErrorBody(err error) ([]byte, bool) {
+	ejbcaError := &ejbcaclient.GenericOpenAPIError{}
+	if errors.As(err, &ejbcaError) {
+		return ejbcaError.Body(), true
+	}
+	responseError := &ejbcaResponseError{}
+	if errors.As(err, &responseError) {
+		return responseError.Body(), true
+	}
+	return nil, false
+}
+
+// isDuplicateEndEntityError returns true if EJBCA rejected an enrollment because an end entity with the same name
+// already exists.
+func isDuplicateEndEntityError(err error) bool {
+	body, ok := ejbcaErrorBody(err)
+	if !ok {
+		return false
+	}
+
+	var errorResponse ejbcaErrorResponse
+	if err := json.Unmarshal(body, &errorResponse); err != nil {
+		return false
+	}
+	return errorResponse.reason() == reasonDuplicateEndEntity
+}
+
+// isEndEntityStatusError returns true if EJBCA rejected an enrollment because the end entity already exists in a
+// status that doesn't allow enrollment, such as GENERATED.
+func isEndEntityStatusError(err error) bool {
+	body, ok := ejbcaErrorBody(err)
+	if !ok {
+		return false
+	}
+
+	var errorResponse ejbcaErrorResponse
+	if err := json.Unmarshal(body, &errorResponse); err != nil {
+		return false
+	}
+	return errorResponse.reason() == reasonDuplicateEndEntity || strings.Contains(strings.ToLower(errorResponse.ErrorMessage), "status")
+}
+
+// isApprovalRequiredError returns true if EJBCA rejected an enrollment because it requires approval.
+func isApprovalRequiredError(err error) bool {
+	body, ok := ejbcaErrorBody(err)
+	if !ok {
+		return false
+	}
+
+	var errorResponse ejbcaErrorResponse
+	if err := json.Unmarshal(body, &errorResponse); err != nil {
+		return false
+	}
+	return errorResponse.reason() == reasonApprovalRequired
+}
+
+// getErrorRequestId returns the request_id field of an EJBCA error response, if it has one.
+func getErrorRequestId(err error) (int32, bool) {
+	body, ok := ejbcaErrorBody(err)
+	if !ok {
+		return 0, false
+	}
+
+	var errorResponse map[string]any
+	if err := json.Unmarshal(body, &errorResponse); err != nil {
+		return 0, false
+	}
+	return parseRequestId(errorResponse["request_id"])
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// eventLogFormatHclog writes mint events as a message with hclog key/value pairs, rendered by SPIRE's log format
+	eventLogFormatHclog = "hclog"
+	// eventLogFormatKeyValue writes mint events as a single flat key=value message, independent of SPIRE's log format
+	eventLogFormatKeyValue = "kv"
+)
+
+// mintEvent is the result of a single MintX509CA call, logged for ingestion by log pipelines such as a SIEM.
+type mintEvent struct {
+	EndEntityName string
+	CAName        string
+	Serial        string
+	Duration      time.Duration
+	Crl           crlInfo
+	Err           error
+}
+
+// fields returns the event as ordered key/value pairs with stable key names.
+func (e mintEvent) fields() []interface{} {
+	result := "success"
+	if e.Err != nil {
+		result = "failure"
+	}
+
+	fields := []interface{}{
+		"event", "mint_x509_ca",
+		"result", result,
+		"ca_name", e.CAName,
+		"end_entity_name", e.EndEntityName,
+		"serial", e.Serial,
+		"duration_ms", e.Duration.Milliseconds(),
+	}
+	if len(e.Crl.DistributionPoints) > 0 {
+		fields = append(fields, "crl_distribution_points", strings.Join(e.Crl.DistributionPoints, ","))
+	}
+	if e.Crl.LatestPartitionIndex != nil {
+		fields = append(fields, "latest_crl_partition_index", *e.Crl.LatestPartitionIndex)
+	}
+	if e.Err != nil {
+		st := status.Convert(e.Err)
+		fields = append(fields, "status_code", st.Code().String(), "error", st.Message())
+	}
+	return fields
+}
+
+// logMintEvent logs event in the configured event_log_format.
+func (p *Plugin) logMintEvent(config *Config, event mintEvent) {
+	message := "Minted X509 CA"
+	if event.Err != nil {
+		message = "Failed to mint X509 CA"
+	}
+
+	if config.EventLogFormat == eventLogFormatKeyValue {
+		p.logger.Info(formatKeyValues(event.fields()))
+		return
+	}
+	p.logger.Info(message, event.fields()...)
+}
+
+// formatKeyValues renders key/value pairs as space-separated key=value tokens. Values that are empty or contain
+// spaces, quotes, or equals signs are quoted.
+func formatKeyValues(fields []interface{}) string {
+	tokens := make([]string, 0, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		value := fmt.Sprint(fields[i+1])
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+		tokens = append(tokens, fmt.Sprintf("%v=%s", fields[i], value))
+	}
+	return strings.Join(tokens, " ")
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestLogMintEvent(t *testing.T) {
+	partitionIndex := 3
+
+	for _, tt := range []struct {
+		name string
+
+		eventLogFormat string
+		crl            crlInfo
+		err            error
+
+		expectedLog string
+	}{
+		{
+			name:           "kv_success",
+			eventLogFormat: "kv",
+			expectedLog:    "[INFO]  event=mint_x509_ca result=success ca_name=Fake-Sub-CA end_entity_name=spiffe://example.org serial=1a duration_ms=1500\n",
+		},
+		{
+			name:           "kv_failure",
+			eventLogFormat: "kv",
+			err:            status.Error(codes.Internal, "EJBCA did not return a CA chain"),
+			expectedLog:    "[INFO]  event=mint_x509_ca result=failure ca_name=Fake-Sub-CA end_entity_name=spiffe://example.org serial=1a duration_ms=1500 status_code=Internal error=\"EJBCA did not return a CA chain\"\n",
+		},
+		{
+			name:           "kv_non_status_error",
+			eventLogFormat: "kv",
+			err:            errors.New("oops"),
+			expectedLog:    "[INFO]  event=mint_x509_ca result=failure ca_name=Fake-Sub-CA end_entity_name=spiffe://example.org serial=1a duration_ms=1500 status_code=Unknown error=oops\n",
+		},
+		{
+			name:           "kv_crl_info",
+			eventLogFormat: "kv",
+			crl: crlInfo{
+				DistributionPoints:   []string{"http://ejbca.example.org/crl/1.crl", "http://ejbca.example.org/crl/2.crl"},
+				LatestPartitionIndex: &partitionIndex,
+			},
+			expectedLog: "[INFO]  event=mint_x509_ca result=success ca_name=Fake-Sub-CA end_entity_name=spiffe://example.org serial=1a duration_ms=1500 crl_distribution_points=http://ejbca.example.org/crl/1.crl,http://ejbca.example.org/crl/2.crl latest_crl_partition_index=3\n",
+		},
+		{
+			name:        "hclog",
+			expectedLog: "[INFO]  Minted X509 CA: event=mint_x509_ca result=success ca_name=Fake-Sub-CA end_entity_name=spiffe://example.org serial=1a duration_ms=1500\n",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			p := New()
+			p.SetLogger(hclog.New(&hclog.LoggerOptions{Output: &logs, DisableTime: true}))
+
+			p.logMintEvent(&Config{EventLogFormat: tt.eventLogFormat}, mintEvent{
+				EndEntityName: "spiffe://example.org",
+				CAName:        "Fake-Sub-CA",
+				Serial:        "1a",
+				Duration:      1500 * time.Millisecond,
+				Crl:           tt.crl,
+				Err:           tt.err,
+			})
+			require.Equal(t, tt.expectedLog, logs.String())
+		})
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/types"
+)
+
+// jwtKeySet holds the JWT signing keys published through PublishJWTKeyAndSubscribe, keyed by key ID. EJBCA doesn't
+// manage JWT keys, so they're kept in memory and only shared with the subscribers of this plugin instance.
+type jwtKeySet struct {
+	mtx         sync.Mutex
+	keys        map[string]*types.JWTKey
+	subscribers map[chan struct{}]struct{}
+}
+
+// publish stores key, replacing any key with the same key ID, and notifies every subscriber.
+func (s *jwtKeySet) publish(key *types.JWTKey) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.keys == nil {
+		s.keys = make(map[string]*types.JWTKey)
+	}
+	s.keys[key.KeyId] = key
+
+	for notify := range s.subscribers {
+		// A pending notification already covers this key
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel that receives a value whenever a key is published. The subscription must be ended
+// with unsubscribe.
+func (s *jwtKeySet) subscribe() chan struct{} {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.subscribers == nil {
+		s.subscribers = make(map[chan struct{}]struct{})
+	}
+	notify := make(chan struct{}, 1)
+	s.subscribers[notify] = struct{}{}
+	return notify
+}
+
+func (s *jwtKeySet) unsubscribe(notify chan struct{}) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.subscribers, notify)
+}
+
+// list returns the keys that haven't expired at now, ordered by key ID. Expired keys are removed.
+func (s *jwtKeySet) list(now time.Time) []*types.JWTKey {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	keys := make([]*types.JWTKey, 0, len(s.keys))
+	for keyID, key := range s.keys {
+		if key.ExpiresAt != 0 && !now.Before(time.Unix(key.ExpiresAt, 0)) {
+			delete(s.keys, keyID)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b *types.JWTKey) int {
+		return strings.Compare(a.KeyId, b.KeyId)
+	})
+	return keys
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	upstreamauthorityv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/server/upstreamauthority/v1"
+	"github.com/spiffe/spire-plugin-sdk/proto/spire/plugin/types"
+	"github.com/spiffe/spire/test/spiretest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestPublishJWTKey(t *testing.T) {
+	testServer := newFakeEnrollServer(t, nil)
+	defer testServer.Close()
+
+	now := time.Now()
+	_, ua := loadTestPlugin(t, testServer, &Config{}, func(p *Plugin) {
+		p.hooks.now = func() time.Time { return now }
+	})
+
+	keyA := &types.JWTKey{KeyId: "key-a", PublicKey: []byte("public-key-a"), ExpiresAt: now.Add(time.Hour).Unix()}
+	keyB := &types.JWTKey{KeyId: "key-b", PublicKey: []byte("public-key-b"), ExpiresAt: now.Add(time.Hour).Unix()}
+	expired := &types.JWTKey{KeyId: "key-expired", PublicKey: []byte("public-key-expired"), ExpiresAt: now.Add(-time.Hour).Unix()}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	recvKeyIDs := func(stream upstreamauthorityv1.UpstreamAuthority_PublishJWTKeyAndSubscribeClient) []string {
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		var keyIDs []string
+		for _, key := range resp.UpstreamJwtKeys {
+			keyIDs = append(keyIDs, key.KeyId)
+		}
+		return keyIDs
+	}
+
+	streamA, err := ua.UpstreamAuthorityPluginClient.PublishJWTKeyAndSubscribe(ctx, &upstreamauthorityv1.PublishJWTKeyRequest{JwtKey: keyA})
+	require.NoError(t, err)
+	require.Equal(t, []string{"key-a"}, recvKeyIDs(streamA))
+
+	streamB, err := ua.UpstreamAuthorityPluginClient.PublishJWTKeyAndSubscribe(ctx, &upstreamauthorityv1.PublishJWTKeyRequest{JwtKey: keyB})
+	require.NoError(t, err)
+	require.Equal(t, []string{"key-a", "key-b"}, recvKeyIDs(streamB))
+
+	// The first stream is updated with the key published on the second one
+	require.Equal(t, []string{"key-a", "key-b"}, recvKeyIDs(streamA))
+
+	streamExpired, err := ua.UpstreamAuthorityPluginClient.PublishJWTKeyAndSubscribe(ctx, &upstreamauthorityv1.PublishJWTKeyRequest{JwtKey: expired})
+	require.NoError(t, err)
+	require.Equal(t, []string{"key-a", "key-b"}, recvKeyIDs(streamExpired))
+}
+
+func TestPublishJWTKeyInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		jwtKey *types.JWTKey
+
+		expectedMessage string
+	}{
+		{
+			name:            "missing_key",
+			expectedMessage: "missing JWT key",
+		},
+		{
+			name:            "missing_key_id",
+			jwtKey:          &types.JWTKey{PublicKey: []byte("public-key")},
+			expectedMessage: "missing JWT key ID",
+		},
+		{
+			name:            "missing_public_key",
+			jwtKey:          &types.JWTKey{KeyId: "key"},
+			expectedMessage: "missing JWT public key",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := newFakeEnrollServer(t, nil)
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{})
+
+			stream, err := ua.UpstreamAuthorityPluginClient.PublishJWTKeyAndSubscribe(context.Background(), &upstreamauthorityv1.PublishJWTKeyRequest{JwtKey: tt.jwtKey})
+			require.NoError(t, err)
+			_, err = stream.Recv()
+			spiretest.RequireGRPCStatus(t, err, codes.InvalidArgument, tt.expectedMessage)
+		})
+	}
+}
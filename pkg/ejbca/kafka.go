@@ -0,0 +1,173 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	defaultKafkaBufferSize   = 16
+	defaultKafkaWriteTimeout = 10 * time.Second
+
+	kafkaFailureModeDrop = "drop"
+	kafkaFailureModeFail = "fail"
+)
+
+var errKafkaBufferFull = errors.New("kafka output buffer is full")
+
+type KafkaConfig struct {
+	Brokers []string `hcl:"brokers" json:"brokers"`
+	Topic   string   `hcl:"topic" json:"topic"`
+	// Maximum number of messages waiting to be published
+	BufferSize int `hcl:"buffer_size" json:"buffer_size"`
+	// One of drop (default) or fail
+	FailureMode string `hcl:"failure_mode" json:"failure_mode"`
+}
+
+// kafkaProducer is the subset of *kafka.Writer used to publish minted bundles.
+type kafkaProducer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+type newKafkaProducerFunc func(*KafkaConfig) kafkaProducer
+
+func newKafkaWriter(config *KafkaConfig) kafkaProducer {
+	return &kafka.Writer{
+		Addr:     kafka.TCP(config.Brokers...),
+		Topic:    config.Topic,
+		Balancer: &kafka.LeastBytes{},
+	}
+}
+
+// mintedBundleMessage is the JSON message published to Kafka after each successful mint.
+type mintedBundleMessage struct {
+	MintedAt          time.Time `json:"minted_at"`
+	X509CaChain       []string  `json:"x509_ca_chain"`
+	UpstreamX509Roots []string  `json:"upstream_x509_roots"`
+}
+
+// kafkaPublisher publishes minted bundles to Kafka from a background goroutine so that a slow or unavailable
+// broker never blocks minting. Messages are queued in a bounded buffer; what happens when the buffer is full is
+// controlled by the configured failure mode.
+type kafkaPublisher struct {
+	logger      hclog.Logger
+	producer    kafkaProducer
+	failureMode string
+	messages    chan kafka.Message
+	done        chan struct{}
+
+	// mu guards closed, so that a mint still holding a publisher replaced by a reconfigure never sends on messages
+	// after Close has closed it
+	mu     sync.Mutex
+	closed bool
+}
+
+func newKafkaPublisher(logger hclog.Logger, config *KafkaConfig, producer kafkaProducer) *kafkaPublisher {
+	bufferSize := config.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultKafkaBufferSize
+	}
+
+	failureMode := config.FailureMode
+	if failureMode == "" {
+		failureMode = kafkaFailureModeDrop
+	}
+
+	k := &kafkaPublisher{
+		logger:      logger,
+		producer:    producer,
+		failureMode: failureMode,
+		messages:    make(chan kafka.Message, bufferSize),
+		done:        make(chan struct{}),
+	}
+	go k.run()
+	return k
+}
+
+func (k *kafkaPublisher) run() {
+	defer close(k.done)
+	for msg := range k.messages {
+		ctx, cancel := context.WithTimeout(context.Background(), defaultKafkaWriteTimeout)
+		if err := k.producer.WriteMessages(ctx, msg); err != nil {
+			k.logger.Warn("Failed to publish minted bundle to Kafka", "error", err)
+		}
+		cancel()
+	}
+}
+
+// Publish queues the chain and roots minted at mintedAt for publishing. An error is only returned if the buffer is
+// full and the failure mode is fail; otherwise the message is dropped with a warning. Messages published after the
+// publisher is closed are dropped with a warning.
+func (k *kafkaPublisher) Publish(mintedAt time.Time, chain []*x509.Certificate, roots []*x509.Certificate) error {
+	value, err := json.Marshal(mintedBundleMessage{
+		MintedAt:          mintedAt.UTC(),
+		X509CaChain:       encodeCertificatesPEM(chain),
+		UpstreamX509Roots: encodeCertificatesPEM(roots),
+	})
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.closed {
+		k.logger.Warn("Dropping minted bundle because the Kafka publisher was closed by a reconfigure")
+		return nil
+	}
+
+	select {
+	case k.messages <- kafka.Message{Value: value}:
+		return nil
+	default:
+	}
+
+	if k.failureMode == kafkaFailureModeFail {
+		return errKafkaBufferFull
+	}
+	k.logger.Warn("Dropping minted bundle because the Kafka output buffer is full")
+	return nil
+}
+
+// Close stops accepting messages, waits for queued messages to be published, and closes the producer.
+func (k *kafkaPublisher) Close() error {
+	k.mu.Lock()
+	k.closed = true
+	close(k.messages)
+	k.mu.Unlock()
+
+	<-k.done
+	return k.producer.Close()
+}
+
+func encodeCertificatesPEM(certs []*x509.Certificate) []string {
+	encoded := make([]string, 0, len(certs))
+	for _, cert := range certs {
+		encoded = append(encoded, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+	}
+	return encoded
+}
@@ -0,0 +1,199 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/segmentio/kafka-go"
+	"github.com/spiffe/spire/test/spiretest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestKafkaOutput(t *testing.T) {
+	testServer := newFakeEnrollServer(t, nil)
+	defer testServer.Close()
+
+	producer := newFakeKafkaProducer()
+	p, ua := loadTestPlugin(t, testServer, &Config{
+		Kafka: &KafkaConfig{
+			Brokers: []string{"kafka-0.example.com:9092"},
+			Topic:   "spire-bundles",
+		},
+	}, func(p *Plugin) {
+		p.hooks.newKafkaProducer = producer.newKafkaProducer
+	})
+	close(producer.release)
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	x509CA, upstreamX509Roots, _, err := ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+	require.NoError(t, err)
+
+	var msg kafka.Message
+	select {
+	case msg = <-producer.written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the minted bundle to be published")
+	}
+	require.Equal(t, "spire-bundles", producer.config.Topic)
+
+	var bundle mintedBundleMessage
+	require.NoError(t, json.Unmarshal(msg.Value, &bundle))
+	require.Len(t, bundle.UpstreamX509Roots, len(upstreamX509Roots))
+	for i, root := range upstreamX509Roots {
+		require.Equal(t, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})), bundle.UpstreamX509Roots[i])
+	}
+	require.Len(t, bundle.X509CaChain, len(x509CA))
+	for i, cert := range x509CA {
+		require.Equal(t, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})), bundle.X509CaChain[i])
+	}
+
+	p.setKafkaPublisher(nil)
+	require.True(t, producer.closed)
+}
+
+func TestKafkaOutputBufferFull(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		failureMode string
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:             "drop",
+			failureMode:      "drop",
+			expectedgRPCCode: codes.OK,
+		},
+		{
+			name:                  "fail",
+			failureMode:           "fail",
+			expectedgRPCCode:      codes.Unavailable,
+			expectedMessagePrefix: "upstreamauthority(ejbca): failed to publish minted bundle to Kafka: kafka output buffer is full",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := newFakeEnrollServer(t, nil)
+			defer testServer.Close()
+
+			producer := newFakeKafkaProducer()
+			defer close(producer.release)
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				Kafka: &KafkaConfig{
+					Brokers:     []string{"kafka-0.example.com:9092"},
+					Topic:       "spire-bundles",
+					BufferSize:  1,
+					FailureMode: tt.failureMode,
+				},
+			}, func(p *Plugin) {
+				p.hooks.newKafkaProducer = producer.newKafkaProducer
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			// The first bundle is picked up by the publisher, which blocks until released
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			require.NoError(t, err)
+			select {
+			case <-producer.started:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for the publisher to start writing")
+			}
+
+			// The second bundle fills the buffer
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+		})
+	}
+}
+
+func TestKafkaPublisherClose(t *testing.T) {
+	rootCA, intermediateCA, _, _ := issueTestCertificates(t)
+
+	producer := newFakeKafkaProducer()
+	close(producer.release)
+	publisher := newKafkaPublisher(hclog.NewNullLogger(), &KafkaConfig{FailureMode: kafkaFailureModeFail}, producer)
+
+	mintedAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, publisher.Publish(mintedAt, []*x509.Certificate{intermediateCA}, []*x509.Certificate{rootCA}))
+
+	var msg kafka.Message
+	select {
+	case msg = <-producer.written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the minted bundle to be published")
+	}
+	var bundle mintedBundleMessage
+	require.NoError(t, json.Unmarshal(msg.Value, &bundle))
+	require.Equal(t, mintedAt, bundle.MintedAt)
+
+	require.NoError(t, publisher.Close())
+	require.True(t, producer.closed)
+
+	// A mint that fetched the publisher before a reconfigure closed it drops its bundle instead of panicking
+	require.NoError(t, publisher.Publish(mintedAt, []*x509.Certificate{intermediateCA}, []*x509.Certificate{rootCA}))
+}
+
+type fakeKafkaProducer struct {
+	config  *KafkaConfig
+	started chan struct{}
+	release chan struct{}
+	written chan kafka.Message
+	closed  bool
+}
+
+func newFakeKafkaProducer() *fakeKafkaProducer {
+	return &fakeKafkaProducer{
+		started: make(chan struct{}, 16),
+		release: make(chan struct{}),
+		written: make(chan kafka.Message, 16),
+	}
+}
+
+func (f *fakeKafkaProducer) newKafkaProducer(config *KafkaConfig) kafkaProducer {
+	f.config = config
+	return f
+}
+
+func (f *fakeKafkaProducer) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	f.started <- struct{}{}
+	<-f.release
+	for _, msg := range msgs {
+		f.written <- msg
+	}
+	return nil
+}
+
+func (f *fakeKafkaProducer) Close() error {
+	f.closed = true
+	return nil
+}
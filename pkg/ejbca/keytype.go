@@ -0,0 +1,58 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"crypto/x509"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// checkLockedKeyType returns a FailedPrecondition error if lock_key_type has locked a key type other than keyType.
+// what names the source of keyType, such as CSR, in the error.
+func (p *Plugin) checkLockedKeyType(what string, keyType x509.PublicKeyAlgorithm) error {
+	p.lockedKeyType.Lock()
+	defer p.lockedKeyType.Unlock()
+	return checkKeyType(what, p.lockedKeyType.keyType, keyType)
+}
+
+// lockKeyType locks the key type of the CA certificates minted until the plugin is reconfigured to keyType, if it's
+// not locked yet. It returns a FailedPrecondition error if another key type is already locked.
+func (p *Plugin) lockKeyType(keyType x509.PublicKeyAlgorithm) error {
+	p.lockedKeyType.Lock()
+	defer p.lockedKeyType.Unlock()
+	if p.lockedKeyType.keyType == x509.UnknownPublicKeyAlgorithm {
+		p.lockedKeyType.keyType = keyType
+		return nil
+	}
+	return checkKeyType("issued CA", p.lockedKeyType.keyType, keyType)
+}
+
+// resetLockedKeyType unlocks the key type, so that the next minted CA certificate locks it again.
+func (p *Plugin) resetLockedKeyType() {
+	p.lockedKeyType.Lock()
+	defer p.lockedKeyType.Unlock()
+	p.lockedKeyType.keyType = x509.UnknownPublicKeyAlgorithm
+}
+
+func checkKeyType(what string, locked x509.PublicKeyAlgorithm, keyType x509.PublicKeyAlgorithm) error {
+	if locked == x509.UnknownPublicKeyAlgorithm || locked == keyType {
+		return nil
+	}
+	return status.Errorf(codes.FailedPrecondition, "%s key type %s differs from the %s key type locked by lock_key_type; reconfigure the plugin to change key types", what, keyType, locked)
+}
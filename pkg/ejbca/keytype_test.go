@@ -0,0 +1,82 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+
+	configv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/service/common/config/v1"
+	"github.com/spiffe/spire/test/spiretest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestLockKeyType(t *testing.T) {
+	// The fake EJBCA issues an ECDSA CA certificate whatever the key of the CSR
+	testServer := newFakeEnrollServer(t, nil)
+	defer testServer.Close()
+
+	config := &Config{LockKeyType: true}
+	p, ua := loadTestPlugin(t, testServer, config)
+
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecdsaCsr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		URIs: []*url.URL{{Scheme: "spiffe", Host: "example.org"}},
+	}, ecdsaKey)
+	require.NoError(t, err)
+	rsaCsr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	_, _, _, err = ua.MintX509CA(context.Background(), ecdsaCsr, 30*time.Second)
+	require.NoError(t, err)
+
+	_, _, _, err = ua.MintX509CA(context.Background(), rsaCsr.Raw, 30*time.Second)
+	spiretest.RequireGRPCStatus(t, err, codes.FailedPrecondition, "upstreamauthority(ejbca): CSR key type RSA differs from the ECDSA key type locked by lock_key_type; reconfigure the plugin to change key types")
+
+	_, _, _, err = ua.MintX509CA(context.Background(), ecdsaCsr, 30*time.Second)
+	require.NoError(t, err)
+
+	// Reconfiguring unlocks the key type
+	hclConfiguration, err := json.Marshal(config)
+	require.NoError(t, err)
+	_, err = p.Configure(context.Background(), &configv1.ConfigureRequest{HclConfiguration: string(hclConfiguration)})
+	require.NoError(t, err)
+
+	_, _, _, err = ua.MintX509CA(context.Background(), rsaCsr.Raw, 30*time.Second)
+	require.NoError(t, err)
+}
+
+func TestLockKeyTypeIssuedCA(t *testing.T) {
+	p := New()
+
+	require.NoError(t, p.lockKeyType(x509.RSA))
+	require.NoError(t, p.lockKeyType(x509.RSA))
+	spiretest.RequireGRPCStatus(t, p.lockKeyType(x509.ECDSA), codes.FailedPrecondition, "issued CA key type ECDSA differs from the RSA key type locked by lock_key_type; reconfigure the plugin to change key types")
+
+	p.resetLockedKeyType()
+	require.NoError(t, p.lockKeyType(x509.ECDSA))
+	require.NoError(t, p.checkLockedKeyType("CSR", x509.ECDSA))
+}
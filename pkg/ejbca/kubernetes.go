@@ -0,0 +1,385 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultKubernetesOutputKey    = "bundle.pem"
+	defaultKubernetesBufferSize   = 4
+	defaultKubernetesWriteTimeout = 10 * time.Second
+
+	serviceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	serviceAccountCAPath    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+type KubernetesOutputConfig struct {
+	Namespace string `hcl:"namespace" json:"namespace"`
+	Name      string `hcl:"name" json:"name"`
+	// Key of the roots PEM in the Secret's data. Defaults to bundle.pem.
+	Key string `hcl:"key" json:"key"`
+	// Path to a kubeconfig file. The in-cluster service account is used if unset.
+	Kubeconfig string `hcl:"kubeconfig" json:"kubeconfig"`
+}
+
+// kubernetesClient is a minimal client of the Kubernetes API, limited to writing Secrets.
+type kubernetesClient struct {
+	httpClient *http.Client
+	server     string
+
+	// token is a static bearer token. If tokenFile is set, the token is read from it for every request instead,
+	// since projected service account tokens are rotated on disk.
+	token     string
+	tokenFile string
+	readFile  readFileFunc
+}
+
+// kubeconfig is the subset of the kubeconfig file format needed to reach a cluster.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// newKubernetesClient returns a client for the cluster in the kubeconfig file at config.Kubeconfig, or for the
+// cluster the plugin runs in if it's unset.
+func newKubernetesClient(config *KubernetesOutputConfig, getEnv getEnvFunc, readFile readFileFunc) (*kubernetesClient, error) {
+	if config.Kubeconfig == "" {
+		return newInClusterKubernetesClient(getEnv, readFile)
+	}
+	return newKubeconfigKubernetesClient(config.Kubeconfig, readFile)
+}
+
+func newInClusterKubernetesClient(getEnv getEnvFunc, readFile readFileFunc) (*kubernetesClient, error) {
+	host, port := getEnv("KUBERNETES_SERVICE_HOST"), getEnv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+
+	caPem, err := readFile(serviceAccountCAPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %w", err)
+	}
+	tlsConfig, err := newKubernetesTLSConfig(caPem)
+	if err != nil {
+		return nil, err
+	}
+
+	return &kubernetesClient{
+		httpClient: newKubernetesHTTPClient(tlsConfig),
+		server:     "https://" + net.JoinHostPort(host, port),
+		tokenFile:  serviceAccountTokenPath,
+		readFile:   readFile,
+	}, nil
+}
+
+func newKubeconfigKubernetesClient(path string, readFile readFileFunc) (*kubernetesClient, error) {
+	raw, err := readFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read kubeconfig: %w", err)
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(raw, &kc); err != nil {
+		return nil, fmt.Errorf("failed to parse kubeconfig: %w", err)
+	}
+
+	var clusterName, userName string
+	for _, c := range kc.Contexts {
+		if c.Name == kc.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+		}
+	}
+	if clusterName == "" {
+		return nil, fmt.Errorf("kubeconfig has no context named %q", kc.CurrentContext)
+	}
+
+	// Relative paths in a kubeconfig are relative to the directory of the kubeconfig
+	resolve := func(file string) string {
+		if file == "" || filepath.IsAbs(file) {
+			return file
+		}
+		return filepath.Join(filepath.Dir(path), file)
+	}
+	readData := func(data string, file string) ([]byte, error) {
+		if data != "" {
+			return base64.StdEncoding.DecodeString(data)
+		}
+		if file != "" {
+			return readFile(resolve(file))
+		}
+		return nil, nil
+	}
+
+	client := &kubernetesClient{readFile: readFile}
+	var tlsConfig *tls.Config
+	for _, c := range kc.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		caPem, err := readData(c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cluster certificate authority: %w", err)
+		}
+		if tlsConfig, err = newKubernetesTLSConfig(caPem); err != nil {
+			return nil, err
+		}
+		client.server = strings.TrimSuffix(c.Cluster.Server, "/")
+	}
+	if client.server == "" {
+		return nil, fmt.Errorf("kubeconfig has no server for cluster %q", clusterName)
+	}
+
+	userFound := userName == ""
+	for _, u := range kc.Users {
+		if u.Name != userName {
+			continue
+		}
+		userFound = true
+		client.token = u.User.Token
+		client.tokenFile = resolve(u.User.TokenFile)
+
+		certPem, err := readData(u.User.ClientCertificateData, u.User.ClientCertificate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client certificate: %w", err)
+		}
+		keyPem, err := readData(u.User.ClientKeyData, u.User.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client key: %w", err)
+		}
+		if certPem != nil {
+			cert, err := tls.X509KeyPair(certPem, keyPem)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client certificate: %w", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	if !userFound {
+		return nil, fmt.Errorf("kubeconfig has no user named %q", userName)
+	}
+
+	client.httpClient = newKubernetesHTTPClient(tlsConfig)
+	return client, nil
+}
+
+// newKubernetesTLSConfig returns a TLS configuration that trusts the CA certificates in caPem, or the system trust
+// store if caPem is empty.
+func newKubernetesTLSConfig(caPem []byte) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(caPem) > 0 {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPem) {
+			return nil, errors.New("no certificates found in Kubernetes certificate authority")
+		}
+	}
+	return tlsConfig, nil
+}
+
+func newKubernetesHTTPClient(tlsConfig *tls.Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}
+}
+
+// upsertSecret sets key in the data of the Secret namespace/name to value, creating the Secret if it doesn't exist.
+// Other keys of an existing Secret are left untouched.
+func (c *kubernetesClient) upsertSecret(ctx context.Context, namespace string, name string, key string, value []byte) error {
+	data := map[string]string{key: base64.StdEncoding.EncodeToString(value)}
+	secretPath := "/api/v1/namespaces/" + url.PathEscape(namespace) + "/secrets"
+
+	patch, err := json.Marshal(map[string]any{"data": data})
+	if err != nil {
+		return err
+	}
+	statusCode, err := c.do(ctx, http.MethodPatch, secretPath+"/"+url.PathEscape(name), "application/merge-patch+json", patch)
+	if err != nil || statusCode != http.StatusNotFound {
+		return err
+	}
+
+	secret, err := json.Marshal(map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata":   map[string]string{"name": name, "namespace": namespace},
+		"type":       "Opaque",
+		"data":       data,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = c.do(ctx, http.MethodPost, secretPath, "application/json", secret)
+	return err
+}
+
+// do sends a request to the Kubernetes API. A 404 status is returned without an error so that callers can fall back
+// to creating the resource; any other unsuccessful status is an error.
+func (c *kubernetesClient) do(ctx context.Context, method string, path string, contentType string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.server+path, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "application/json")
+
+	token := c.token
+	if c.tokenFile != "" {
+		raw, err := c.readFile(c.tokenFile)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read Kubernetes token: %w", err)
+		}
+		token = strings.TrimSpace(string(raw))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode/100 == 2 {
+		return resp.StatusCode, nil
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return resp.StatusCode, fmt.Errorf("kubernetes API responded to %s %s with %s: %s", method, path, resp.Status, strings.TrimSpace(string(message)))
+}
+
+// kubernetesOutput writes the upstream roots of each minted bundle to a Kubernetes Secret from a background
+// goroutine, so that a slow or unavailable Kubernetes API never blocks minting. Writes are queued in a bounded
+// buffer, and are dropped with a warning when it's full.
+type kubernetesOutput struct {
+	logger    hclog.Logger
+	client    *kubernetesClient
+	namespace string
+	name      string
+	key       string
+	roots     chan []*x509.Certificate
+	done      chan struct{}
+
+	// mu guards closed, so that a mint still holding an output replaced by a reconfigure never sends on roots after
+	// Close has closed it
+	mu     sync.Mutex
+	closed bool
+}
+
+func newKubernetesOutput(logger hclog.Logger, config *KubernetesOutputConfig, client *kubernetesClient) *kubernetesOutput {
+	key := config.Key
+	if key == "" {
+		key = defaultKubernetesOutputKey
+	}
+	k := &kubernetesOutput{
+		logger:    logger,
+		client:    client,
+		namespace: config.Namespace,
+		name:      config.Name,
+		key:       key,
+		roots:     make(chan []*x509.Certificate, defaultKubernetesBufferSize),
+		done:      make(chan struct{}),
+	}
+	go k.run()
+	return k
+}
+
+func (k *kubernetesOutput) run() {
+	defer close(k.done)
+	for roots := range k.roots {
+		if err := k.write(roots); err != nil {
+			k.logger.Warn("Failed to write upstream roots to Kubernetes Secret", "namespace", k.namespace, "name", k.name, "error", err)
+		}
+	}
+}
+
+// write upserts the PEM-encoded roots into the Secret.
+func (k *kubernetesOutput) write(roots []*x509.Certificate) error {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultKubernetesWriteTimeout)
+	defer cancel()
+	return k.client.upsertSecret(ctx, k.namespace, k.name, k.key, []byte(strings.Join(encodeCertificatesPEM(roots), "")))
+}
+
+// Write queues roots to be written to the Secret. Roots are dropped with a warning if the buffer is full or the
+// output is closed.
+func (k *kubernetesOutput) Write(roots []*x509.Certificate) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.closed {
+		k.logger.Warn("Dropping upstream roots because the Kubernetes output was closed by a reconfigure")
+		return
+	}
+
+	select {
+	case k.roots <- roots:
+	default:
+		k.logger.Warn("Dropping upstream roots because the Kubernetes output buffer is full", "namespace", k.namespace, "name", k.name)
+	}
+}
+
+// Close stops accepting roots and waits for the queued roots to be written.
+func (k *kubernetesOutput) Close() error {
+	k.mu.Lock()
+	k.closed = true
+	close(k.roots)
+	k.mu.Unlock()
+
+	<-k.done
+	return nil
+}
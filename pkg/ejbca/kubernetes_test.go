@@ -0,0 +1,311 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKubernetesServer is a fake Kubernetes API server that stores the data of Secrets written with merge patches
+// and creates.
+type fakeKubernetesServer struct {
+	*httptest.Server
+
+	t     *testing.T
+	token string
+
+	mu      sync.Mutex
+	secrets map[string]map[string]string
+	methods []string
+}
+
+func newFakeKubernetesServer(t *testing.T, token string) *fakeKubernetesServer {
+	s := &fakeKubernetesServer{
+		t:       t,
+		token:   token,
+		secrets: make(map[string]map[string]string),
+	}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *fakeKubernetesServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods = append(s.methods, r.Method)
+
+	if r.Header.Get("Authorization") != "Bearer "+s.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		Kind     string `json:"kind"`
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Data map[string]string `json:"data"`
+	}
+	require.NoError(s.t, json.NewDecoder(r.Body).Decode(&body))
+
+	switch {
+	case r.Method == http.MethodPatch && strings.HasPrefix(r.URL.Path, "/api/v1/namespaces/spire/secrets/"):
+		require.Equal(s.t, "application/merge-patch+json", r.Header.Get("Content-Type"))
+		secret, ok := s.secrets[strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/spire/secrets/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for key, value := range body.Data {
+			secret[key] = value
+		}
+	case r.Method == http.MethodPost && r.URL.Path == "/api/v1/namespaces/spire/secrets":
+		require.Equal(s.t, "Secret", body.Kind)
+		s.secrets[body.Metadata.Name] = body.Data
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_, _ = w.Write([]byte("{}"))
+}
+
+func (s *fakeKubernetesServer) secretData(t *testing.T, name string, key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	require.Contains(t, s.secrets, name)
+	require.Contains(t, s.secrets[name], key)
+	value, err := base64.StdEncoding.DecodeString(s.secrets[name][key])
+	require.NoError(t, err)
+	return string(value)
+}
+
+func TestKubernetesOutput(t *testing.T) {
+	rootCA, intermediateCA, svidIssuingCA, _ := issueTestCertificates(t)
+
+	for _, tt := range []struct {
+		name string
+
+		inCluster bool
+		key       string
+
+		expectedKey string
+	}{
+		{
+			name:        "kubeconfig",
+			expectedKey: "bundle.pem",
+		},
+		{
+			name:        "in_cluster",
+			inCluster:   true,
+			key:         "roots.pem",
+			expectedKey: "roots.pem",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				err := json.NewEncoder(w).Encode(certificateRestResponseFromExpectedCerts(t, []*x509.Certificate{svidIssuingCA, intermediateCA}, []*x509.Certificate{rootCA}, "PEM"))
+				require.NoError(t, err)
+			}))
+			defer testServer.Close()
+
+			kubernetesServer := newFakeKubernetesServer(t, "fake-token")
+			defer kubernetesServer.Close()
+			kubernetesCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: kubernetesServer.Certificate().Raw})
+
+			output := &KubernetesOutputConfig{
+				Namespace: "spire",
+				Name:      "upstream-roots",
+				Key:       tt.key,
+			}
+			var setHooks []func(*Plugin)
+			if tt.inCluster {
+				serverURL, err := url.Parse(kubernetesServer.URL)
+				require.NoError(t, err)
+				setHooks = append(setHooks, func(p *Plugin) {
+					p.hooks.getEnv = func(key string) string {
+						return map[string]string{
+							"KUBERNETES_SERVICE_HOST": serverURL.Hostname(),
+							"KUBERNETES_SERVICE_PORT": serverURL.Port(),
+						}[key]
+					}
+					p.hooks.readFile = func(path string) ([]byte, error) {
+						switch path {
+						case serviceAccountTokenPath:
+							return []byte("fake-token\n"), nil
+						case serviceAccountCAPath:
+							return kubernetesCA, nil
+						}
+						return os.ReadFile(path)
+					}
+				})
+			} else {
+				output.Kubeconfig = filepath.Join(t.TempDir(), "kubeconfig")
+				require.NoError(t, os.WriteFile(output.Kubeconfig, []byte(fmt.Sprintf(`
+apiVersion: v1
+kind: Config
+current-context: spire
+contexts:
+- name: spire
+  context:
+    cluster: fake
+    user: spire-server
+clusters:
+- name: fake
+  cluster:
+    server: %s
+    certificate-authority-data: %s
+users:
+- name: spire-server
+  user:
+    token: fake-token
+`, kubernetesServer.URL, base64.StdEncoding.EncodeToString(kubernetesCA))), 0600))
+			}
+
+			p, ua := loadTestPlugin(t, testServer, &Config{
+				KubernetesOutput: output,
+			}, setHooks...)
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			for i := 0; i < 2; i++ {
+				_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+				require.NoError(t, err)
+			}
+			// Closing the output waits for the queued writes
+			p.setKubernetesOutput(nil)
+
+			require.Equal(t, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootCA.Raw})), kubernetesServer.secretData(t, "upstream-roots", tt.expectedKey))
+
+			// The first mint creates the Secret after the patch finds none, and the second patches it
+			kubernetesServer.mu.Lock()
+			defer kubernetesServer.mu.Unlock()
+			require.Equal(t, []string{http.MethodPatch, http.MethodPost, http.MethodPatch}, kubernetesServer.methods)
+		})
+	}
+}
+
+func TestKubernetesOutputDoesNotBlockMint(t *testing.T) {
+	rootCA, intermediateCA, svidIssuingCA, _ := issueTestCertificates(t)
+
+	testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(certificateRestResponseFromExpectedCerts(t, []*x509.Certificate{svidIssuingCA, intermediateCA}, []*x509.Certificate{rootCA}, "PEM"))
+		require.NoError(t, err)
+	}))
+	defer testServer.Close()
+
+	// The Kubernetes API doesn't respond until release is closed
+	release := make(chan struct{})
+	var requests sync.WaitGroup
+	requests.Add(1)
+	var once sync.Once
+	kubernetesServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		once.Do(requests.Done)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer kubernetesServer.Close()
+
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	require.NoError(t, os.WriteFile(kubeconfig, []byte(fmt.Sprintf(`
+current-context: spire
+contexts:
+- name: spire
+  context:
+    cluster: fake
+    user: spire-server
+clusters:
+- name: fake
+  cluster:
+    server: %s
+    certificate-authority-data: %s
+users:
+- name: spire-server
+  user:
+    token: fake-token
+`, kubernetesServer.URL, base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: kubernetesServer.Certificate().Raw})))), 0600))
+
+	p, ua := loadTestPlugin(t, testServer, &Config{
+		KubernetesOutput: &KubernetesOutputConfig{
+			Namespace:  "spire",
+			Name:       "upstream-roots",
+			Kubeconfig: kubeconfig,
+		},
+	})
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	// More mints than the buffer holds complete while the first write is stuck, and the writes that don't fit are
+	// dropped
+	for i := 0; i < defaultKubernetesBufferSize+2; i++ {
+		_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+		require.NoError(t, err)
+	}
+	requests.Wait()
+
+	close(release)
+	p.setKubernetesOutput(nil)
+
+	// Writes queued after close are dropped instead of panicking
+	output := newKubernetesOutput(hclog.NewNullLogger(), &KubernetesOutputConfig{Namespace: "spire", Name: "upstream-roots"}, &kubernetesClient{})
+	require.NoError(t, output.Close())
+	output.Write([]*x509.Certificate{rootCA})
+}
+
+func TestKubeconfigUnknownUser(t *testing.T) {
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	require.NoError(t, os.WriteFile(kubeconfig, []byte(`
+current-context: spire
+contexts:
+- name: spire
+  context:
+    cluster: fake
+    user: spire-server
+clusters:
+- name: fake
+  cluster:
+    server: https://kubernetes.example.org
+users:
+- name: someone-else
+  user:
+    token: fake-token
+`), 0600))
+
+	_, err := newKubernetesClient(&KubernetesOutputConfig{Kubeconfig: kubeconfig}, os.Getenv, os.ReadFile)
+	require.EqualError(t, err, `kubeconfig has no user named "spire-server"`)
+}
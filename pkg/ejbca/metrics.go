@@ -0,0 +1,47 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"errors"
+
+	"github.com/spiffe/spire-plugin-sdk/pluginsdk"
+	metricsv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/hostservice/common/metrics/v1"
+)
+
+// BrokerHostServices is called by the framework when the plugin is loaded and provides the plugin with clients to
+// SPIRE host services. Metrics are emitted through SPIRE's metrics host service if it's available.
+func (p *Plugin) BrokerHostServices(broker pluginsdk.ServiceBroker) error {
+	if !broker.BrokerClient(&p.metrics) {
+		p.logger.Debug("SPIRE metrics host service is not available; metrics will not be emitted")
+	}
+	return nil
+}
+
+// incrCounter increments the counter with key through SPIRE's metrics host service. Failures are logged and
+// returned; callers only act on the error with strict_telemetry, since metrics must not fail a mint by default.
+func (p *Plugin) incrCounter(ctx context.Context, key []string, labels ...*metricsv1.Label) error {
+	if !p.metrics.IsInitialized() {
+		return errors.New("SPIRE metrics host service is not available")
+	}
+	if _, err := p.metrics.IncrCounter(ctx, &metricsv1.IncrCounterRequest{Key: key, Val: 1, Labels: labels}); err != nil {
+		p.logger.Warn("Failed to emit metric", "key", key, "error", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	metricsv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/hostservice/common/metrics/v1"
+	"github.com/spiffe/spire/pkg/common/hostservice/metricsservice"
+	"github.com/spiffe/spire/pkg/common/telemetry"
+	"github.com/spiffe/spire/test/fakes/fakemetrics"
+	"github.com/spiffe/spire/test/plugintest"
+	"github.com/spiffe/spire/test/spiretest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+// failingMetricsServer is a metrics host service whose methods all fail, as if the metrics sink were unreachable.
+type failingMetricsServer struct {
+	metricsv1.UnimplementedMetricsServer
+}
+
+func TestStrictTelemetry(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		strictTelemetry bool
+		metricsServer   metricsv1.MetricsServer
+
+		expectedError   string
+		expectedWarning bool
+		// expectedEnrolled is true if the CSR reaches EJBCA, and expectedArchived if the minted roots are archived
+		expectedEnrolled bool
+		expectedArchived bool
+	}{
+		{
+			name:             "failing sink is not fatal by default",
+			strictTelemetry:  false,
+			metricsServer:    failingMetricsServer{},
+			expectedWarning:  true,
+			expectedEnrolled: true,
+			expectedArchived: true,
+		},
+		{
+			name:             "failing sink fails the mint with strict_telemetry",
+			strictTelemetry:  true,
+			metricsServer:    failingMetricsServer{},
+			expectedError:    "upstreamauthority(ejbca): failed to record mint metric:",
+			expectedWarning:  true,
+			expectedEnrolled: true,
+		},
+		{
+			name:            "missing host service fails the mint with strict_telemetry",
+			strictTelemetry: true,
+			expectedError:   "upstreamauthority(ejbca): failed to record mint metric: SPIRE metrics host service is not available",
+		},
+		{
+			name:             "missing host service is not fatal by default",
+			strictTelemetry:  false,
+			expectedEnrolled: true,
+			expectedArchived: true,
+		},
+		{
+			name:             "working sink with strict_telemetry",
+			strictTelemetry:  true,
+			metricsServer:    metricsservice.V1(fakemetrics.New()),
+			expectedEnrolled: true,
+			expectedArchived: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var enrolled atomic.Bool
+			testServer := newFakeEnrollServer(t, func(*ejbcaclient.EnrollCertificateRestRequest) {
+				enrolled.Store(true)
+			})
+			defer testServer.Close()
+
+			log, logHook := test.NewNullLogger()
+			options := []plugintest.Option{plugintest.Log(log)}
+			if tt.metricsServer != nil {
+				options = append(options, plugintest.HostServices(metricsv1.MetricsServiceServer(tt.metricsServer)))
+			}
+			archiveDir := t.TempDir()
+			_, ua := loadTestPluginWithOptions(t, testServer, &Config{
+				StrictTelemetry: tt.strictTelemetry,
+				RootsArchiveDir: archiveDir,
+			}, options)
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			if tt.expectedError != "" {
+				spiretest.RequireGRPCStatusHasPrefix(t, err, codes.Unavailable, tt.expectedError)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.expectedEnrolled, enrolled.Load())
+
+			// A mint failed by strict_telemetry isn't written to any output
+			archived, err := os.ReadDir(archiveDir)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedArchived, len(archived) > 0)
+
+			var warned bool
+			for _, entry := range logHook.AllEntries() {
+				if entry.Level == logrus.WarnLevel && entry.Message == "Failed to emit metric" {
+					warned = true
+				}
+			}
+			require.Equal(t, tt.expectedWarning, warned)
+		})
+	}
+}
+
+func TestMintMetric(t *testing.T) {
+	testServer := newFakeEnrollServer(t, nil)
+	defer testServer.Close()
+
+	metrics := fakemetrics.New()
+	_, ua := loadTestPluginWithOptions(t, testServer, &Config{}, []plugintest.Option{
+		plugintest.HostServices(metricsv1.MetricsServiceServer(metricsservice.V1(metrics))),
+	})
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+	require.NoError(t, err)
+
+	require.Equal(t, []fakemetrics.MetricItem{
+		{
+			Type:   fakemetrics.IncrCounterWithLabelsType,
+			Key:    []string{"mint_x509_ca"},
+			Val:    1,
+			Labels: []telemetry.Label{},
+		},
+	}, metrics.AllMetrics())
+}
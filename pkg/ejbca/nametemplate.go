@@ -0,0 +1,86 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// endEntityNameTemplateData is the data an end_entity_name template is executed with. Each field is empty if the CSR
+// has no such value.
+type endEntityNameTemplateData struct {
+	// CommonName is the CommonName of the CSR's DN
+	CommonName string
+	// DNSName is the first DNS SAN of the CSR
+	DNSName string
+	// URI is the first URI SAN of the CSR
+	URI string
+	// IPAddress is the first IP SAN of the CSR
+	IPAddress string
+	// TrustDomain is the trust domain of the SPIFFE ID in the CSR's URI SANs
+	TrustDomain string
+}
+
+// isEndEntityNameTemplate reports whether an end_entity_name selector is a Go template rather than a keyword or a
+// literal name.
+func isEndEntityNameTemplate(selector string) bool {
+	return strings.Contains(selector, "{{")
+}
+
+func parseEndEntityNameTemplate(selector string) (*template.Template, error) {
+	tmpl, err := template.New("end_entity_name").Option("missingkey=error").Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse end entity name template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// executeEndEntityNameTemplate executes the end_entity_name template selector with the values of csr.
+func executeEndEntityNameTemplate(selector string, csr *x509.CertificateRequest) (string, error) {
+	tmpl, err := parseEndEntityNameTemplate(selector)
+	if err != nil {
+		return "", err
+	}
+
+	data := endEntityNameTemplateData{
+		CommonName: csr.Subject.CommonName,
+	}
+	if len(csr.DNSNames) > 0 {
+		data.DNSName = csr.DNSNames[0]
+	}
+	if len(csr.URIs) > 0 {
+		data.URI = csr.URIs[0].String()
+	}
+	if len(csr.IPAddresses) > 0 {
+		data.IPAddress = csr.IPAddresses[0].String()
+	}
+	if trustDomain, err := getTrustDomain(csr); err == nil {
+		data.TrustDomain = trustDomain.String()
+	}
+
+	var name strings.Builder
+	if err := tmpl.Execute(&name, data); err != nil {
+		return "", fmt.Errorf("failed to execute end entity name template: %w", err)
+	}
+	if name.Len() == 0 {
+		return "", fmt.Errorf("end entity name template produced an empty name")
+	}
+	return name.String(), nil
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	// notifySocketWriteTimeout bounds how long a notification waits on a client that isn't reading
+	notifySocketWriteTimeout = 5 * time.Second
+	// notifyClientBufferSize is the number of notifications queued for a client before it's disconnected
+	notifyClientBufferSize = 16
+)
+
+// notifySocket accepts local clients on notify_socket and writes a line of JSON with the minted chain and upstream
+// roots to each of them after every mint. Each client is written to from its own goroutine, so a client that isn't
+// reading doesn't delay the mint or the other clients.
+type notifySocket struct {
+	logger   hclog.Logger
+	path     string
+	listener net.Listener
+
+	// mtx guards clients. A client's queue is only sent on and closed under mtx, while it's in clients.
+	mtx     sync.Mutex
+	clients map[net.Conn]chan []byte
+}
+
+// newNotifySocket listens on the Unix socket at path and starts accepting clients. A stale socket left at path by a
+// previous process is removed; any other file at path is an error.
+func newNotifySocket(logger hclog.Logger, path string) (*notifySocket, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &notifySocket{
+		logger:   logger,
+		path:     path,
+		listener: listener,
+		clients:  make(map[net.Conn]chan []byte),
+	}
+	go s.accept()
+	return s, nil
+}
+
+func (s *notifySocket) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Warn("Failed to accept notify socket client", "error", err)
+			}
+			return
+		}
+
+		lines := make(chan []byte, notifyClientBufferSize)
+		s.mtx.Lock()
+		s.clients[conn] = lines
+		s.mtx.Unlock()
+		s.logger.Debug("Notify socket client connected", "clients", s.clientCount())
+
+		go s.watch(conn)
+		go s.write(conn, lines)
+	}
+}
+
+// write writes the lines queued for the client until its queue is closed. A client that can't be written to is
+// disconnected.
+func (s *notifySocket) write(conn net.Conn, lines <-chan []byte) {
+	for line := range lines {
+		_ = conn.SetWriteDeadline(time.Now().Add(notifySocketWriteTimeout))
+		if _, err := conn.Write(line); err != nil {
+			s.logger.Warn("Disconnecting notify socket client that couldn't be written to", "error", err)
+			s.remove(conn)
+		}
+	}
+}
+
+// watch discards anything the client sends and removes it once it disconnects.
+func (s *notifySocket) watch(conn net.Conn) {
+	_, _ = io.Copy(io.Discard, conn)
+	s.remove(conn)
+	s.logger.Debug("Notify socket client disconnected", "clients", s.clientCount())
+}
+
+func (s *notifySocket) remove(conn net.Conn) {
+	s.mtx.Lock()
+	if lines, ok := s.clients[conn]; ok {
+		close(lines)
+		delete(s.clients, conn)
+	}
+	s.mtx.Unlock()
+	_ = conn.Close()
+}
+
+func (s *notifySocket) clientCount() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.clients)
+}
+
+// Notify queues the chain and roots minted at mintedAt for every connected client, without waiting for them to be
+// written. Clients whose queue is full are disconnected.
+func (s *notifySocket) Notify(mintedAt time.Time, chain []*x509.Certificate, roots []*x509.Certificate) error {
+	line, err := json.Marshal(mintedBundleMessage{
+		MintedAt:          mintedAt.UTC(),
+		X509CaChain:       encodeCertificatesPEM(chain),
+		UpstreamX509Roots: encodeCertificatesPEM(roots),
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	var full []net.Conn
+	s.mtx.Lock()
+	for conn, lines := range s.clients {
+		select {
+		case lines <- line:
+		default:
+			full = append(full, conn)
+		}
+	}
+	s.mtx.Unlock()
+
+	for _, conn := range full {
+		s.logger.Warn("Disconnecting notify socket client that isn't reading notifications")
+		s.remove(conn)
+	}
+	return nil
+}
+
+// Close stops accepting clients, disconnects the connected ones, and removes the socket.
+func (s *notifySocket) Close() error {
+	err := s.listener.Close()
+
+	s.mtx.Lock()
+	for conn, lines := range s.clients {
+		close(lines)
+		_ = conn.Close()
+		delete(s.clients, conn)
+	}
+	s.mtx.Unlock()
+	return err
+}
+
+// configureNotifySocket starts listening on notify_socket. A socket already listening on the same path is kept.
+func (p *Plugin) configureNotifySocket(config *Config) (*notifySocket, error) {
+	if config.NotifySocket == "" || p.diagnosing {
+		return nil, nil
+	}
+	if previous := p.getNotifySocket(); previous != nil && previous.path == config.NotifySocket {
+		return previous, nil
+	}
+	return newNotifySocket(p.logger.Named("notify_socket"), config.NotifySocket)
+}
+
+// setNotifySocket replaces the notify socket atomically under a write lock. The previous socket, if any and if it's
+// not being kept, is closed.
+func (p *Plugin) setNotifySocket(notifySocket *notifySocket) {
+	p.configMtx.Lock()
+	previous := p.notify
+	p.notify = notifySocket
+	p.configMtx.Unlock()
+
+	if previous != nil && previous != notifySocket {
+		if err := previous.Close(); err != nil {
+			p.logger.Warn("Failed to close notify socket", "error", err)
+		}
+	}
+}
+
+// getNotifySocket gets the notify socket under a read lock. It returns nil if notify_socket isn't configured.
+func (p *Plugin) getNotifySocket() *notifySocket {
+	p.configMtx.RLock()
+	defer p.configMtx.RUnlock()
+	return p.notify
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifySocket(t *testing.T) {
+	testServer := newFakeEnrollServer(t, nil)
+	defer testServer.Close()
+
+	// Unix socket paths are limited to about 100 bytes, which the test's temporary directory may exceed
+	dir, err := os.MkdirTemp("", "ejbca")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "notify.sock")
+
+	mintedAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	p, ua := loadTestPlugin(t, testServer, &Config{
+		NotifySocket: socketPath,
+	}, func(p *Plugin) {
+		p.hooks.now = func() time.Time { return mintedAt }
+	})
+	defer p.setNotifySocket(nil)
+
+	notifySocket := p.getNotifySocket()
+	require.NotNil(t, notifySocket)
+
+	// A client that disconnects before the mint is dropped
+	gone, err := net.Dial("unix", socketPath)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return notifySocket.clientCount() == 1 }, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, gone.Close())
+	require.Eventually(t, func() bool { return notifySocket.clientCount() == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	conn, err := net.Dial("unix", socketPath)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool { return notifySocket.clientCount() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	chain, roots, _, err := ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+
+	var message mintedBundleMessage
+	require.NoError(t, json.Unmarshal(line, &message))
+	require.Equal(t, mintedAt, message.MintedAt)
+	require.Len(t, message.X509CaChain, len(chain))
+	require.Len(t, message.UpstreamX509Roots, len(roots))
+	for i, root := range roots {
+		require.Equal(t, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw})), message.UpstreamX509Roots[i])
+	}
+
+	// Closing the socket removes it
+	p.setNotifySocket(nil)
+	_, err = os.Stat(socketPath)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestNotifySocketStalledClient(t *testing.T) {
+	dir, err := os.MkdirTemp("", "ejbca")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	notifySocket, err := newNotifySocket(hclog.NewNullLogger(), filepath.Join(dir, "notify.sock"))
+	require.NoError(t, err)
+	defer notifySocket.Close()
+
+	conn, err := net.Dial("unix", notifySocket.path)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool { return notifySocket.clientCount() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// Writes to a pipe block until they're read, so the stalled client never takes more than one notification off
+	// its queue
+	stalled, stalledPeer := net.Pipe()
+	defer stalledPeer.Close()
+	lines := make(chan []byte, notifyClientBufferSize)
+	notifySocket.mtx.Lock()
+	notifySocket.clients[stalled] = lines
+	notifySocket.mtx.Unlock()
+	go notifySocket.write(stalled, lines)
+
+	mintedAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	start := time.Now()
+	for i := 0; i < notifyClientBufferSize+2; i++ {
+		require.NoError(t, notifySocket.Notify(mintedAt, nil, nil))
+	}
+	require.Less(t, time.Since(start), notifySocketWriteTimeout)
+
+	// The stalled client is disconnected once its queue is full, while the other client is still notified
+	notifySocket.mtx.Lock()
+	require.NotContains(t, notifySocket.clients, stalled)
+	notifySocket.mtx.Unlock()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	require.NoError(t, err)
+	var message mintedBundleMessage
+	require.NoError(t, json.Unmarshal(line, &message))
+	require.Equal(t, mintedAt, message.MintedAt)
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// configureTokenSource replaces the token source of the OAuth authenticator's transport with one whose token
+// requests are sent with tokenTransport and bounded by token_request_timeout. The EJBCA client SDK otherwise requests
+// tokens with http.DefaultClient.
+func configureTokenSource(authenticator ejbcaclient.Authenticator, config *OAuthConfig, tokenTransport http.RoundTripper) error {
+	client, err := authenticator.GetHTTPClient()
+	if err != nil {
+		return err
+	}
+	transport, ok := client.Transport.(*oauth2.Transport)
+	if !ok {
+		return fmt.Errorf("unsupported OAuth HTTP transport %T", client.Transport)
+	}
+
+	credentials := &clientcredentials.Config{
+		ClientID:     config.ClientID,
+		ClientSecret: config.ClientSecret,
+		TokenURL:     config.TokenURL,
+		Scopes:       strings.Split(config.Scopes, " "),
+	}
+	if config.Audience != "" {
+		credentials.EndpointParams = map[string][]string{
+			"audience": {config.Audience},
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{
+		Transport: tokenTransport,
+		Timeout:   config.tokenRequestTimeout,
+	})
+	transport.Source = credentials.TokenSource(ctx)
+	return nil
+}
+
+// newTokenTransport returns the RoundTripper used for token requests. The token endpoint's TLS settings are
+// independent of the EJBCA connection.
+func newTokenTransport(config *OAuthConfig) http.RoundTripper {
+	var transport http.RoundTripper = http.DefaultTransport
+	if config.tokenTLSMinVersion != 0 {
+		tlsTransport := http.DefaultTransport.(*http.Transport).Clone()
+		tlsTransport.TLSClientConfig = &tls.Config{
+			MinVersion: config.tokenTLSMinVersion,
+		}
+		transport = tlsTransport
+	}
+	if config.MaxTokenResponseBytes > 0 {
+		transport = &maxResponseBytesTransport{next: transport, max: config.MaxTokenResponseBytes}
+	}
+	return transport
+}
+
+// maxResponseBytesTransport fails reads of response bodies that are larger than max bytes.
+type maxResponseBytesTransport struct {
+	next http.RoundTripper
+	max  int64
+}
+
+func (t *maxResponseBytesTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.Body == nil {
+		return resp, err
+	}
+
+	resp.Body = &maxBytesReader{
+		reader:    io.LimitReader(resp.Body, t.max+1),
+		closer:    resp.Body,
+		remaining: t.max,
+	}
+	return resp, nil
+}
+
+// maxBytesReader returns an error once more than remaining bytes have been read from reader.
+type maxBytesReader struct {
+	reader    io.Reader
+	closer    io.Closer
+	remaining int64
+}
+
+func (r *maxBytesReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return 0, fmt.Errorf("token response exceeds max_token_response_bytes")
+	}
+	return n, err
+}
+
+func (r *maxBytesReader) Close() error {
+	return r.closer.Close()
+}
@@ -0,0 +1,324 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/spiffe/spire/pkg/server/plugin/upstreamauthority"
+	"github.com/spiffe/spire/test/plugintest"
+	"github.com/spiffe/spire/test/spiretest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestMaxTokenResponseBytes(t *testing.T) {
+	rootCA, intermediateCA, _, _ := issueTestCertificates(t)
+
+	for _, tt := range []struct {
+		name string
+
+		maxTokenResponseBytes int64
+		padding               int
+
+		expectedgRPCCode      codes.Code
+		expectedMessageSubstr string
+	}{
+		{
+			name:                  "within_limit",
+			maxTokenResponseBytes: 4096,
+			expectedgRPCCode:      codes.OK,
+		},
+		{
+			name:                  "oversized",
+			maxTokenResponseBytes: 4096,
+			padding:               1 << 20,
+			expectedgRPCCode:      codes.Unavailable,
+			expectedMessageSubstr: "token response exceeds max_token_response_bytes",
+		},
+		{
+			name:             "unlimited",
+			padding:          64 << 10,
+			expectedgRPCCode: codes.OK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				err := json.NewEncoder(w).Encode(map[string]any{
+					"access_token": "fake-access-token",
+					"token_type":   "Bearer",
+					"expires_in":   3600,
+					"padding":      strings.Repeat("x", tt.padding),
+				})
+				require.NoError(t, err)
+			}))
+			defer tokenServer.Close()
+
+			var caChainHits atomic.Int32
+			ejbcaServer := httptest.NewTLSServer(newFakeEjbcaCAHandler(t, "Fake-Sub-CA", []*x509.Certificate{intermediateCA, rootCA}, &caChainHits))
+			defer ejbcaServer.Close()
+
+			var err error
+			p := New()
+			p.SetLogger(hclog.Default())
+
+			plugintest.Load(t, builtin(p), new(upstreamauthority.V1),
+				plugintest.CaptureConfigureError(&err),
+				plugintest.Configure(fmt.Sprintf(`
+            hostname = "%s"
+            ca_cert = <<EOF
+%s
+EOF
+            oauth {
+                token_url = "%s"
+                client_id = "fi3ElQUVoBBHyRNt4mpUxG9WY65AOCcJ"
+                client_secret = "1EXHdD7Ikmmv0OkBoJZZtzOG5iAzvwdqBVuvquf-QEvL6fLrEG_heJHphtEXVj9H"
+                max_token_response_bytes = %d
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            warmup = true
+            warmup_fail_on_error = true
+            `, ejbcaServer.URL, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ejbcaServer.Certificate().Raw}),
+					tokenServer.URL, tt.maxTokenResponseBytes)),
+			)
+			if tt.expectedgRPCCode == codes.OK {
+				require.NoError(t, err)
+				require.Equal(t, int32(1), caChainHits.Load())
+				return
+			}
+			spiretest.RequireGRPCStatusContains(t, err, tt.expectedgRPCCode, tt.expectedMessageSubstr)
+			require.Equal(t, int32(0), caChainHits.Load())
+		})
+	}
+}
+
+func TestTokenTlsMinVersion(t *testing.T) {
+	rootCA, intermediateCA, _, _ := issueTestCertificates(t)
+
+	for _, tt := range []struct {
+		name string
+
+		tokenTLSMinVersion string
+
+		expectedMessageSubstr string
+	}{
+		{
+			// The handshake gets as far as certificate verification, since the token server's
+			// certificate isn't trusted.
+			name:                  "unset",
+			expectedMessageSubstr: "certificate signed by unknown authority",
+		},
+		{
+			name:                  "tls_1_2",
+			tokenTLSMinVersion:    "1.2",
+			expectedMessageSubstr: "certificate signed by unknown authority",
+		},
+		{
+			name:                  "tls_1_3",
+			tokenTLSMinVersion:    "1.3",
+			expectedMessageSubstr: "protocol version not supported",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var tokenHits atomic.Int32
+			tokenServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				tokenHits.Add(1)
+			}))
+			tokenServer.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+			tokenServer.StartTLS()
+			defer tokenServer.Close()
+
+			var caChainHits atomic.Int32
+			ejbcaServer := httptest.NewTLSServer(newFakeEjbcaCAHandler(t, "Fake-Sub-CA", []*x509.Certificate{intermediateCA, rootCA}, &caChainHits))
+			defer ejbcaServer.Close()
+
+			var err error
+			p := New()
+			p.SetLogger(hclog.Default())
+
+			plugintest.Load(t, builtin(p), new(upstreamauthority.V1),
+				plugintest.CaptureConfigureError(&err),
+				plugintest.Configure(fmt.Sprintf(`
+            hostname = "%s"
+            ca_cert = <<EOF
+%s
+EOF
+            oauth {
+                token_url = "%s"
+                client_id = "fi3ElQUVoBBHyRNt4mpUxG9WY65AOCcJ"
+                client_secret = "1EXHdD7Ikmmv0OkBoJZZtzOG5iAzvwdqBVuvquf-QEvL6fLrEG_heJHphtEXVj9H"
+                token_tls_min_version = "%s"
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            warmup = true
+            warmup_fail_on_error = true
+            `, ejbcaServer.URL, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ejbcaServer.Certificate().Raw}),
+					tokenServer.URL, tt.tokenTLSMinVersion)),
+			)
+			spiretest.RequireGRPCStatusContains(t, err, codes.Unavailable, tt.expectedMessageSubstr)
+			require.Equal(t, int32(0), tokenHits.Load())
+			require.Equal(t, int32(0), caChainHits.Load())
+		})
+	}
+}
+
+func TestTokenRequestTimeout(t *testing.T) {
+	rootCA, intermediateCA, _, _ := issueTestCertificates(t)
+
+	// Token requests stall past the timeout while slow is set, and are answered immediately otherwise
+	var slow atomic.Bool
+	slow.Store(true)
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slow.Load() {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "fake-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+		require.NoError(t, err)
+	}))
+	defer tokenServer.Close()
+
+	var caChainHits atomic.Int32
+	ejbcaServer := httptest.NewTLSServer(newFakeEjbcaCAHandler(t, "Fake-Sub-CA", []*x509.Certificate{intermediateCA, rootCA}, &caChainHits))
+	defer ejbcaServer.Close()
+
+	var err error
+	p := New()
+	p.SetLogger(hclog.Default())
+
+	plugintest.Load(t, builtin(p), new(upstreamauthority.V1),
+		plugintest.CaptureConfigureError(&err),
+		plugintest.Configure(fmt.Sprintf(`
+            hostname = "%s"
+            ca_cert = <<EOF
+%s
+EOF
+            oauth {
+                token_url = "%s"
+                client_id = "fi3ElQUVoBBHyRNt4mpUxG9WY65AOCcJ"
+                client_secret = "1EXHdD7Ikmmv0OkBoJZZtzOG5iAzvwdqBVuvquf-QEvL6fLrEG_heJHphtEXVj9H"
+                token_request_timeout = "200ms"
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            `, ejbcaServer.URL, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ejbcaServer.Certificate().Raw}),
+			tokenServer.URL)),
+	)
+	require.NoError(t, err)
+
+	config, err := p.getConfig()
+	require.NoError(t, err)
+
+	start := time.Now()
+	err = p.warmup(context.Background(), p.getClient(), config)
+	require.ErrorContains(t, err, "Client.Timeout exceeded")
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Equal(t, int32(0), caChainHits.Load())
+
+	slow.Store(false)
+	require.NoError(t, p.warmup(context.Background(), p.getClient(), config))
+	require.Equal(t, int32(1), caChainHits.Load())
+}
+
+func TestOAuthTokenReuse(t *testing.T) {
+	var tokenHits atomic.Int32
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		tokenHits.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "fake-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+		require.NoError(t, err)
+	}))
+	defer tokenServer.Close()
+
+	var enrollHits atomic.Int32
+	enrollHandler := newFakeEnrollHandler(t, nil)
+	ejbcaServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enrollHits.Add(1)
+		require.Equal(t, "Bearer fake-access-token", r.Header.Get("Authorization"))
+		enrollHandler.ServeHTTP(w, r)
+	}))
+	defer ejbcaServer.Close()
+
+	var err error
+	p := New()
+	p.SetLogger(hclog.Default())
+	ua := new(upstreamauthority.V1)
+
+	plugintest.Load(t, builtin(p), ua,
+		plugintest.CaptureConfigureError(&err),
+		plugintest.Configure(fmt.Sprintf(`
+            hostname = "%s"
+            ca_cert = <<EOF
+%s
+EOF
+            oauth {
+                token_url = "%s"
+                client_id = "fi3ElQUVoBBHyRNt4mpUxG9WY65AOCcJ"
+                client_secret = "1EXHdD7Ikmmv0OkBoJZZtzOG5iAzvwdqBVuvquf-QEvL6fLrEG_heJHphtEXVj9H"
+            }
+            ca_name = "Fake-Sub-CA"
+            end_entity_profile_name = "fakeSpireIntermediateCAEEP"
+            certificate_profile_name = "fakeSubCACP"
+            `, ejbcaServer.URL, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ejbcaServer.Certificate().Raw}),
+			tokenServer.URL)),
+	)
+	require.NoError(t, err)
+
+	client := p.getClient()
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, int32(2), enrollHits.Load())
+	require.Equal(t, int32(1), tokenHits.Load())
+	require.Same(t, client, p.getClient())
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// otherNameSelectorPrefix prefixes an end_entity_name selector that reads an otherName SAN of the given type from
+	// the CSR, such as othername:1.3.6.1.4.1.311.20.2.3
+	otherNameSelectorPrefix = "othername:"
+)
+
+var oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// otherName is the otherName form of a GeneralName, defined in RFC 5280 as a type ID followed by a value that is
+// explicitly tagged [0]. Value holds the explicit tag, whose contents are the encoded value.
+type otherName struct {
+	TypeID asn1.ObjectIdentifier
+	Value  asn1.RawValue
+}
+
+// parseOtherNameType parses the dotted OID that identifies the type of an otherName.
+func parseOtherNameType(typeID string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(typeID, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid otherName type %q: expected a dotted OID", typeID)
+	}
+	oid := make(asn1.ObjectIdentifier, 0, len(parts))
+	for _, part := range parts {
+		arc, err := strconv.Atoi(part)
+		if err != nil || arc < 0 {
+			return nil, fmt.Errorf("invalid otherName type %q: expected a dotted OID", typeID)
+		}
+		oid = append(oid, arc)
+	}
+	return oid, nil
+}
+
+// getOtherNameValue returns the first non-empty string value of an otherName SAN with the given type in extensions,
+// or an empty string if there is none. Values that aren't UTF8String, IA5String, or PrintableString are skipped.
+func getOtherNameValue(extensions []pkix.Extension, typeID asn1.ObjectIdentifier) (string, error) {
+	for _, extension := range extensions {
+		if !extension.Id.Equal(oidExtensionSubjectAltName) {
+			continue
+		}
+
+		var generalNames []asn1.RawValue
+		rest, err := asn1.Unmarshal(extension.Value, &generalNames)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse subject alternative names: %w", err)
+		}
+		if len(rest) > 0 {
+			return "", errors.New("failed to parse subject alternative names: trailing data")
+		}
+
+		for _, generalName := range generalNames {
+			// otherName is the GeneralName choice with implicit tag [0]
+			if generalName.Class != asn1.ClassContextSpecific || generalName.Tag != 0 {
+				continue
+			}
+			var name otherName
+			if _, err := asn1.UnmarshalWithParams(generalName.FullBytes, &name, "tag:0"); err != nil {
+				return "", fmt.Errorf("failed to parse otherName: %w", err)
+			}
+			if !name.TypeID.Equal(typeID) || name.Value.Class != asn1.ClassContextSpecific || name.Value.Tag != 0 {
+				continue
+			}
+
+			var value asn1.RawValue
+			if _, err := asn1.Unmarshal(name.Value.Bytes, &value); err != nil {
+				return "", fmt.Errorf("failed to parse otherName value: %w", err)
+			}
+			if value.Class != asn1.ClassUniversal {
+				continue
+			}
+			switch value.Tag {
+			case asn1.TagUTF8String, asn1.TagIA5String, asn1.TagPrintableString:
+				if len(value.Bytes) > 0 {
+					return string(value.Bytes), nil
+				}
+			}
+		}
+	}
+	return "", nil
+}
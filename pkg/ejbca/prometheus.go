@@ -0,0 +1,169 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	prometheusMetricsPath = "/metrics"
+
+	mintResultSuccess = "success"
+	mintResultError   = "error"
+)
+
+// prometheusMetrics holds the Prometheus collectors of the plugin. They're created once by New so that their values
+// survive a reconfigure, and are registered with a registerer hook and/or the prometheus_listen_address registry.
+type prometheusMetrics struct {
+	mintTotal      *prometheus.CounterVec
+	enrollDuration prometheus.Histogram
+}
+
+func newPrometheusMetrics() *prometheusMetrics {
+	return &prometheusMetrics{
+		mintTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ejbca_upstreamauthority_mint_total",
+			Help: "Number of X.509 CA mints, by result.",
+		}, []string{"result"}),
+		enrollDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "ejbca_upstreamauthority_enroll_duration_seconds",
+			Help:    "Duration of enrollment calls to EJBCA, in seconds.",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+}
+
+// register registers the collectors with registerer. Collectors that are already registered, such as when the
+// plugin is reconfigured with the same registerer, are left as they are.
+func (m *prometheusMetrics) register(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{m.mintTotal, m.enrollDuration} {
+		if err := registerer.Register(collector); err != nil {
+			var alreadyRegistered prometheus.AlreadyRegisteredError
+			if errors.As(err, &alreadyRegistered) && alreadyRegistered.ExistingCollector == collector {
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// observeMint increments the mint counter with the result of a mint that returned err.
+func (m *prometheusMetrics) observeMint(err error) {
+	result := mintResultSuccess
+	if err != nil {
+		result = mintResultError
+	}
+	m.mintTotal.WithLabelValues(result).Inc()
+}
+
+// observeEnroll records the duration of an enrollment call to EJBCA.
+func (m *prometheusMetrics) observeEnroll(duration time.Duration) {
+	m.enrollDuration.Observe(duration.Seconds())
+}
+
+// prometheusServer serves the metrics of the plugin at /metrics on prometheus_listen_address.
+type prometheusServer struct {
+	address  string
+	listener net.Listener
+	server   *http.Server
+}
+
+// newPrometheusServer registers metrics with a registry owned by the server and starts serving it on address.
+func newPrometheusServer(address string, metrics *prometheusMetrics) (*prometheusServer, error) {
+	registry := prometheus.NewRegistry()
+	if err := metrics.register(registry); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(prometheusMetricsPath, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	return &prometheusServer{
+		address:  address,
+		listener: listener,
+		server:   server,
+	}, nil
+}
+
+// Close stops the server, waiting briefly for in-flight scrapes to complete.
+func (s *prometheusServer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// configurePrometheus registers the metrics with the registerer hook, if set, and starts serving them on
+// prometheus_listen_address. A server already listening on the same address is kept.
+func (p *Plugin) configurePrometheus(config *Config) (*prometheusServer, error) {
+	if p.hooks.prometheusRegisterer != nil {
+		if err := p.prometheus.register(p.hooks.prometheusRegisterer); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.PrometheusListenAddress == "" || p.diagnosing {
+		return nil, nil
+	}
+	if previous := p.getPrometheusServer(); previous != nil && previous.address == config.PrometheusListenAddress {
+		return previous, nil
+	}
+	return newPrometheusServer(config.PrometheusListenAddress, p.prometheus)
+}
+
+// setPrometheusServer replaces the Prometheus server atomically under a write lock. The previous server, if any and
+// if it's not being kept, is closed.
+func (p *Plugin) setPrometheusServer(prometheusServer *prometheusServer) {
+	p.configMtx.Lock()
+	previous := p.promServer
+	p.promServer = prometheusServer
+	p.configMtx.Unlock()
+
+	if previous != nil && previous != prometheusServer {
+		if err := previous.Close(); err != nil {
+			p.logger.Warn("Failed to close Prometheus metrics server", "error", err)
+		}
+	}
+}
+
+// getPrometheusServer gets the Prometheus server under a read lock. It returns nil if prometheus_listen_address
+// isn't configured.
+func (p *Plugin) getPrometheusServer() *prometheusServer {
+	p.configMtx.RLock()
+	defer p.configMtx.RUnlock()
+	return p.promServer
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		enrollStatus int
+
+		expectedResult string
+	}{
+		{
+			name:           "success",
+			enrollStatus:   http.StatusOK,
+			expectedResult: mintResultSuccess,
+		},
+		{
+			name:           "error",
+			enrollStatus:   http.StatusInternalServerError,
+			expectedResult: mintResultError,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			enrollHandler := newFakeEnrollHandler(t, nil)
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.enrollStatus != http.StatusOK {
+					w.WriteHeader(tt.enrollStatus)
+					return
+				}
+				enrollHandler.ServeHTTP(w, r)
+			}))
+			defer testServer.Close()
+
+			registry := prometheus.NewRegistry()
+			_, ua := loadTestPlugin(t, testServer, &Config{}, func(p *Plugin) {
+				p.hooks.prometheusRegisterer = registry
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			if tt.expectedResult == mintResultSuccess {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+
+			families, err := registry.Gather()
+			require.NoError(t, err)
+
+			mints := map[string]float64{}
+			var enrollCount uint64
+			for _, family := range families {
+				for _, metric := range family.GetMetric() {
+					switch family.GetName() {
+					case "ejbca_upstreamauthority_mint_total":
+						require.Len(t, metric.GetLabel(), 1)
+						require.Equal(t, "result", metric.GetLabel()[0].GetName())
+						mints[metric.GetLabel()[0].GetValue()] = metric.GetCounter().GetValue()
+					case "ejbca_upstreamauthority_enroll_duration_seconds":
+						enrollCount = metric.GetHistogram().GetSampleCount()
+					}
+				}
+			}
+			require.Equal(t, map[string]float64{tt.expectedResult: 1}, mints)
+			require.Equal(t, uint64(1), enrollCount)
+		})
+	}
+}
+
+func TestPrometheusListenAddress(t *testing.T) {
+	testServer := newFakeEnrollServer(t, nil)
+	defer testServer.Close()
+
+	p, ua := loadTestPlugin(t, testServer, &Config{
+		PrometheusListenAddress: "127.0.0.1:0",
+	})
+	defer p.setPrometheusServer(nil)
+
+	prometheusServer := p.getPrometheusServer()
+	require.NotNil(t, prometheusServer)
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+	require.NoError(t, err)
+
+	response, err := http.Get("http://" + prometheusServer.listener.Addr().String() + prometheusMetricsPath)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `ejbca_upstreamauthority_mint_total{result="success"} 1`)
+	require.Contains(t, string(body), "ejbca_upstreamauthority_enroll_duration_seconds_count 1")
+}
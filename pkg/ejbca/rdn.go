@@ -0,0 +1,97 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// rdnSelectorPrefix prefixes an end_entity_name selector that reads an arbitrary RDN attribute from the CSR's
+	// subject, such as rdn:UID or rdn:2.5.4.5
+	rdnSelectorPrefix = "rdn:"
+
+	// serialNumberSelector is an end_entity_name selector for the serialNumber attribute of the CSR's subject, which
+	// device identities use to carry a hardware serial. It's equivalent to rdn:SERIALNUMBER.
+	serialNumberSelector = "serialnumber"
+)
+
+const (
+	rdnMultipleValuesFirst = "first"
+	rdnMultipleValuesJoin  = "join"
+	rdnMultipleValuesError = "error"
+
+	// rdnValueSeparator separates the values of an RDN attribute that rdn_multiple_values joins
+	rdnValueSeparator = ","
+)
+
+// rdnAttributeTypes maps the short names of common RDN attributes, in upper case, to their OIDs.
+var rdnAttributeTypes = map[string]asn1.ObjectIdentifier{
+	"CN":           {2, 5, 4, 3},
+	"SERIALNUMBER": {2, 5, 4, 5},
+	"C":            {2, 5, 4, 6},
+	"L":            {2, 5, 4, 7},
+	"ST":           {2, 5, 4, 8},
+	"STREET":       {2, 5, 4, 9},
+	"O":            {2, 5, 4, 10},
+	"OU":           {2, 5, 4, 11},
+	"POSTALCODE":   {2, 5, 4, 17},
+	"UID":          {0, 9, 2342, 19200300, 100, 1, 1},
+	"DC":           {0, 9, 2342, 19200300, 100, 1, 25},
+	"E":            {1, 2, 840, 113549, 1, 9, 1},
+}
+
+// parseRdnAttributeType returns the OID of an RDN attribute given either its short name (case-insensitive) or its
+// dotted OID.
+func parseRdnAttributeType(attribute string) (asn1.ObjectIdentifier, error) {
+	if oid, ok := rdnAttributeTypes[strings.ToUpper(attribute)]; ok {
+		return oid, nil
+	}
+
+	parts := strings.Split(attribute, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("unknown RDN attribute %q", attribute)
+	}
+	oid := make(asn1.ObjectIdentifier, 0, len(parts))
+	for _, part := range parts {
+		arc, err := strconv.Atoi(part)
+		if err != nil || arc < 0 {
+			return nil, fmt.Errorf("unknown RDN attribute %q", attribute)
+		}
+		oid = append(oid, arc)
+	}
+	return oid, nil
+}
+
+// getRdnValues returns the non-empty string values of the RDN attribute with the given type in name, in the order
+// they appear in the DN.
+func getRdnValues(name pkix.Name, attributeType asn1.ObjectIdentifier) []string {
+	var values []string
+	for _, atv := range name.Names {
+		if !atv.Type.Equal(attributeType) {
+			continue
+		}
+		if value, ok := atv.Value.(string); ok && value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,340 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// validateIssuedCA checks the CA certificate issued by EJBCA, and the chain returned with it, against the
+// configured expectations. Failures are returned as codes.Internal status errors, since they indicate that EJBCA
+// is configured differently than the plugin expects.
+func (p *Plugin) validateIssuedCA(config *Config, cert *x509.Certificate, caChain []*x509.Certificate) error {
+	if len(config.pinnedCAFingerprint) > 0 {
+		if !hasFingerprint(caChain[0], config.pinnedCAFingerprint) {
+			fingerprint := sha256.Sum256(caChain[0].Raw)
+			return status.Errorf(codes.Internal, "issuing CA %q has fingerprint %s, expected pinned_ca_fingerprint %s", caChain[0].Subject, hex.EncodeToString(fingerprint[:]), hex.EncodeToString(config.pinnedCAFingerprint))
+		}
+		if err := cert.CheckSignatureFrom(caChain[0]); err != nil {
+			return status.Errorf(codes.Internal, "issued CA certificate was not issued by the CA pinned by pinned_ca_fingerprint: %v", err)
+		}
+	}
+
+	if len(config.expectedIntermediateFingerprints) > 0 {
+		for _, intermediate := range caChain {
+			if isSelfSigned(intermediate) {
+				continue
+			}
+			if !slices.ContainsFunc(config.expectedIntermediateFingerprints, func(fingerprint []byte) bool {
+				return hasFingerprint(intermediate, fingerprint)
+			}) {
+				fingerprint := sha256.Sum256(intermediate.Raw)
+				return status.Errorf(codes.Internal, "intermediate CA %q has fingerprint %s, which is not in expected_intermediate_fingerprints", intermediate.Subject, hex.EncodeToString(fingerprint[:]))
+			}
+		}
+	}
+
+	if config.ExpectedSignatureAlgorithm != "" {
+		if !strings.EqualFold(cert.SignatureAlgorithm.String(), config.ExpectedSignatureAlgorithm) {
+			return status.Errorf(codes.Internal, "issued CA certificate is signed with %s, expected %s", cert.SignatureAlgorithm, config.ExpectedSignatureAlgorithm)
+		}
+	}
+
+	if config.RequirePathLen != nil {
+		if !cert.BasicConstraintsValid || (cert.MaxPathLen <= 0 && !cert.MaxPathLenZero) {
+			return status.Errorf(codes.Internal, "issued CA certificate has no pathLenConstraint, expected %d", *config.RequirePathLen)
+		}
+		if cert.MaxPathLen != *config.RequirePathLen {
+			return status.Errorf(codes.Internal, "issued CA certificate has pathLenConstraint %d, expected %d", cert.MaxPathLen, *config.RequirePathLen)
+		}
+	}
+
+	if len(config.AllowedKeyUsages) > 0 {
+		if disallowed := cert.KeyUsage &^ config.allowedKeyUsages; disallowed != 0 {
+			return status.Errorf(codes.Internal, "issued CA certificate has key usages that are not in allowed_key_usages: %s", strings.Join(keyUsageNames(disallowed), ", "))
+		}
+	}
+
+	return nil
+}
+
+// parseFingerprint decodes a hex-encoded SHA-256 fingerprint. Colons between bytes are allowed.
+func parseFingerprint(fingerprint string) ([]byte, error) {
+	decoded, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != sha256.Size {
+		return nil, fmt.Errorf("expected a %d byte SHA-256 fingerprint, got %d bytes", sha256.Size, len(decoded))
+	}
+	return decoded, nil
+}
+
+// hasFingerprint returns true if the SHA-256 fingerprint of cert is fingerprint.
+func hasFingerprint(cert *x509.Certificate, fingerprint []byte) bool {
+	sum := sha256.Sum256(cert.Raw)
+	return bytes.Equal(sum[:], fingerprint)
+}
+
+// keyUsages maps the RFC 5280 names of key usages accepted by allowed_key_usages to their x509.KeyUsage bits.
+var keyUsages = map[string]x509.KeyUsage{
+	"digitalSignature":  x509.KeyUsageDigitalSignature,
+	"contentCommitment": x509.KeyUsageContentCommitment,
+	"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+	"dataEncipherment":  x509.KeyUsageDataEncipherment,
+	"keyAgreement":      x509.KeyUsageKeyAgreement,
+	"keyCertSign":       x509.KeyUsageCertSign,
+	"cRLSign":           x509.KeyUsageCRLSign,
+	"encipherOnly":      x509.KeyUsageEncipherOnly,
+	"decipherOnly":      x509.KeyUsageDecipherOnly,
+}
+
+// keyUsageNames returns the sorted names of the key usages set in usage.
+func keyUsageNames(usage x509.KeyUsage) []string {
+	var names []string
+	for name, bit := range keyUsages {
+		if usage&bit != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// alternativeCertificateFields are the response fields that some EJBCA variants use instead of certificate for
+// the issued certificate, in order of preference. Each may hold the encoded certificate directly, or an object whose
+// certificate field holds it.
+var alternativeCertificateFields = []string{"certificate_container"}
+
+// getIssuedCertificate returns the encoded certificate from the first field of the enrollment response that
+// contains one, trying certificate before alternativeCertificateFields.
+func getIssuedCertificate(resp *ejbcaclient.CertificateRestResponse) string {
+	if certificate := resp.GetCertificate(); certificate != "" {
+		return certificate
+	}
+
+	for _, field := range alternativeCertificateFields {
+		switch value := resp.AdditionalProperties[field].(type) {
+		case string:
+			if value != "" {
+				return value
+			}
+		case map[string]interface{}:
+			if certificate, ok := value["certificate"].(string); ok && certificate != "" {
+				return certificate
+			}
+		}
+	}
+	return ""
+}
+
+// getRootCertificates returns the certificates in the root_certificates field of the enrollment response, which
+// some EJBCA versions return separately from certificate_chain. The field isn't modeled by the EJBCA client SDK.
+func getRootCertificates(resp *ejbcaclient.CertificateRestResponse) ([]*x509.Certificate, error) {
+	entries, _ := resp.AdditionalProperties["root_certificates"].([]interface{})
+
+	var roots []*x509.Certificate
+	for _, entry := range entries {
+		encoded, ok := entry.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected %T entry", entry)
+		}
+		der, err := decodeCertificateEntry(encoded)
+		if err != nil {
+			return nil, err
+		}
+		root, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, root)
+	}
+	return roots, nil
+}
+
+// mergeRootCertificates splits chain into its intermediates and the roots it contains, merging the roots with
+// rootCertificates. Roots are deduplicated by SHA-256 fingerprint, keeping the first occurrence.
+func mergeRootCertificates(chain []*x509.Certificate, rootCertificates []*x509.Certificate) ([]*x509.Certificate, []*x509.Certificate) {
+	var intermediates, roots []*x509.Certificate
+	seen := make(map[[sha256.Size]byte]bool)
+	addRoot := func(root *x509.Certificate) {
+		fingerprint := sha256.Sum256(root.Raw)
+		if !seen[fingerprint] {
+			seen[fingerprint] = true
+			roots = append(roots, root)
+		}
+	}
+
+	for _, cert := range chain {
+		if isSelfSigned(cert) {
+			addRoot(cert)
+		} else {
+			intermediates = append(intermediates, cert)
+		}
+	}
+	for _, root := range rootCertificates {
+		addRoot(root)
+	}
+	return intermediates, roots
+}
+
+// orderIssuerChain orders chain so that each certificate is followed by its issuer, starting with the issuer of
+// cert, by following the issuer/subject linkage between the certificates. This corrects chains that EJBCA returns
+// root-first. If the linkage can't account for every certificate in chain, chain is returned unchanged. The
+// returned bool reports whether the order was changed.
+func orderIssuerChain(cert *x509.Certificate, chain []*x509.Certificate) ([]*x509.Certificate, bool) {
+	remaining := slices.Clone(chain)
+	ordered := make([]*x509.Certificate, 0, len(chain))
+	for child := cert; len(remaining) > 0; {
+		i := slices.IndexFunc(remaining, func(candidate *x509.Certificate) bool {
+			return bytes.Equal(child.RawIssuer, candidate.RawSubject) && child.CheckSignatureFrom(candidate) == nil
+		})
+		if i < 0 {
+			return chain, false
+		}
+		child = remaining[i]
+		ordered = append(ordered, child)
+		remaining = slices.Delete(remaining, i, i+1)
+	}
+
+	for i := range chain {
+		if chain[i] != ordered[i] {
+			return ordered, true
+		}
+	}
+	return chain, false
+}
+
+const (
+	detectDuplicateSerialsWarn  = "warn"
+	detectDuplicateSerialsError = "error"
+
+	// maxRecentSerials is the number of serials remembered by detect_duplicate_serials
+	maxRecentSerials = 1024
+)
+
+// recordSerial remembers serial as the serial of a minted CA certificate, forgetting the oldest remembered serial
+// once maxRecentSerials are remembered. It returns true if serial was already remembered.
+func (p *Plugin) recordSerial(serial string) bool {
+	p.recentSerials.Lock()
+	defer p.recentSerials.Unlock()
+	if p.recentSerials.seen[serial] {
+		return true
+	}
+
+	if p.recentSerials.seen == nil {
+		p.recentSerials.seen = make(map[string]bool)
+	}
+	if len(p.recentSerials.order) >= maxRecentSerials {
+		delete(p.recentSerials.seen, p.recentSerials.order[0])
+		p.recentSerials.order = p.recentSerials.order[1:]
+	}
+	p.recentSerials.seen[serial] = true
+	p.recentSerials.order = append(p.recentSerials.order, serial)
+	return false
+}
+
+// crlInfo is the CRL information that newer EJBCA versions include in enrollment responses.
+type crlInfo struct {
+	DistributionPoints   []string
+	LatestPartitionIndex *int
+}
+
+// getCrlInfo returns the crl_distribution_points and latest_crl_partition_index fields of the enrollment response,
+// which aren't modeled by the EJBCA client SDK. Fields that are absent or malformed are left unset.
+func getCrlInfo(resp *ejbcaclient.CertificateRestResponse) crlInfo {
+	var info crlInfo
+
+	points, _ := resp.AdditionalProperties["crl_distribution_points"].([]interface{})
+	for _, point := range points {
+		if point, ok := point.(string); ok && point != "" {
+			info.DistributionPoints = append(info.DistributionPoints, point)
+		}
+	}
+
+	if index, ok := resp.AdditionalProperties["latest_crl_partition_index"].(float64); ok {
+		partitionIndex := int(index)
+		info.LatestPartitionIndex = &partitionIndex
+	}
+	return info
+}
+
+// supportedResponseFormats are the certificate response formats that the plugin can decode.
+var supportedResponseFormats = []string{"PEM", "DER"}
+
+// strayPemMarker matches a PEM BEGIN or END line, such as one left in a base64 DER entry without its counterpart.
+var strayPemMarker = regexp.MustCompile(`-----(BEGIN|END) [A-Z0-9 ]+-----`)
+
+// decodeCertificateEntry decodes a certificate returned by EJBCA. The entry is decoded as PEM if it contains a PEM
+// block, and as base64-encoded DER otherwise, regardless of the response_format of the response. Stray PEM markers
+// that don't form a complete block are stripped before base64 decoding.
+func decodeCertificateEntry(entry string) ([]byte, error) {
+	if block, _ := pem.Decode([]byte(entry)); block != nil {
+		return block.Bytes, nil
+	}
+	if strayPemMarker.MatchString(entry) {
+		der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(strayPemMarker.ReplaceAllString(entry, "")))
+		if err != nil || len(der) == 0 {
+			return nil, errors.New("malformed PEM block")
+		}
+		return der, nil
+	}
+
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return nil, errors.New("no certificate")
+	}
+	der, err := base64.StdEncoding.DecodeString(entry)
+	if err != nil {
+		return nil, fmt.Errorf("not PEM or base64 DER: %w", err)
+	}
+	return der, nil
+}
+
+// isSelfSigned returns true if cert is issued by itself and its signature verifies with its own public key.
+func isSelfSigned(cert *x509.Certificate) bool {
+	if !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		return false
+	}
+	return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+// parseSignatureAlgorithm returns the x509.SignatureAlgorithm whose name (as returned by its String method)
+// matches name, ignoring case.
+func parseSignatureAlgorithm(name string) (x509.SignatureAlgorithm, bool) {
+	for algorithm := x509.MD2WithRSA; algorithm <= x509.PureEd25519; algorithm++ {
+		if strings.EqualFold(algorithm.String(), name) {
+			return algorithm, true
+		}
+	}
+	return x509.UnknownSignatureAlgorithm, false
+}
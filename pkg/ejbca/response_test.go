@@ -0,0 +1,823 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spiffe/spire/test/plugintest"
+	"github.com/spiffe/spire/test/spiretest"
+	"github.com/spiffe/spire/test/util"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestExpectedSignatureAlgorithm(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		expectedSignatureAlgorithm string
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:                       "matching",
+			expectedSignatureAlgorithm: "ECDSA-SHA256",
+			expectedgRPCCode:           codes.OK,
+		},
+		{
+			name:                       "matching_ignores_case",
+			expectedSignatureAlgorithm: "ecdsa-sha256",
+			expectedgRPCCode:           codes.OK,
+		},
+		{
+			name:                       "mismatching",
+			expectedSignatureAlgorithm: "SHA256-RSA",
+			expectedgRPCCode:           codes.Internal,
+			expectedMessagePrefix:      "upstreamauthority(ejbca): issued CA certificate is signed with ECDSA-SHA256, expected SHA256-RSA",
+		},
+		{
+			name:             "unset",
+			expectedgRPCCode: codes.OK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := newFakeEnrollServer(t, nil)
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				ExpectedSignatureAlgorithm: tt.expectedSignatureAlgorithm,
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+		})
+	}
+}
+
+func TestAllowedKeyUsages(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		keyUsage         x509.KeyUsage
+		allowedKeyUsages []string
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:             "compliant",
+			keyUsage:         x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			allowedKeyUsages: []string{"keyCertSign", "cRLSign"},
+			expectedgRPCCode: codes.OK,
+		},
+		{
+			name:                  "extra_usages",
+			keyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			allowedKeyUsages:      []string{"keyCertSign", "cRLSign"},
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): issued CA certificate has key usages that are not in allowed_key_usages: digitalSignature, keyEncipherment",
+		},
+		{
+			name:             "unset",
+			keyUsage:         x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+			expectedgRPCCode: codes.OK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			ca, _, err := util.SelfSign(&x509.Certificate{
+				Subject:               pkix.Name{CommonName: "Fake-Root-CA"},
+				SerialNumber:          big.NewInt(1),
+				BasicConstraintsValid: true,
+				IsCA:                  true,
+				KeyUsage:              tt.keyUsage,
+				NotBefore:             now,
+				NotAfter:              now.Add(time.Hour),
+			})
+			require.NoError(t, err)
+
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				err := json.NewEncoder(w).Encode(certificateRestResponseFromExpectedCerts(t, []*x509.Certificate{ca}, nil, "PEM"))
+				require.NoError(t, err)
+			}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				AllowedKeyUsages: tt.allowedKeyUsages,
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+		})
+	}
+}
+
+func TestRequirePathLen(t *testing.T) {
+	zero := 0
+	one := 1
+
+	for _, tt := range []struct {
+		name string
+
+		maxPathLen     int
+		maxPathLenZero bool
+		requirePathLen *int
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:             "expected_path_len",
+			maxPathLen:       0,
+			maxPathLenZero:   true,
+			requirePathLen:   &zero,
+			expectedgRPCCode: codes.OK,
+		},
+		{
+			name:                  "different_path_len",
+			maxPathLen:            1,
+			requirePathLen:        &zero,
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): issued CA certificate has pathLenConstraint 1, expected 0",
+		},
+		{
+			name:                  "no_path_len",
+			maxPathLen:            -1,
+			requirePathLen:        &zero,
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): issued CA certificate has no pathLenConstraint, expected 0",
+		},
+		{
+			name:             "nonzero_path_len",
+			maxPathLen:       1,
+			requirePathLen:   &one,
+			expectedgRPCCode: codes.OK,
+		},
+		{
+			name:             "unset",
+			maxPathLen:       -1,
+			expectedgRPCCode: codes.OK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			ca, _, err := util.SelfSign(&x509.Certificate{
+				Subject:               pkix.Name{CommonName: "Fake-Root-CA"},
+				SerialNumber:          big.NewInt(1),
+				BasicConstraintsValid: true,
+				IsCA:                  true,
+				MaxPathLen:            tt.maxPathLen,
+				MaxPathLenZero:        tt.maxPathLenZero,
+				NotBefore:             now,
+				NotAfter:              now.Add(time.Hour),
+			})
+			require.NoError(t, err)
+
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				err := json.NewEncoder(w).Encode(certificateRestResponseFromExpectedCerts(t, []*x509.Certificate{ca}, nil, "PEM"))
+				require.NoError(t, err)
+			}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				RequirePathLen: tt.requirePathLen,
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+		})
+	}
+}
+
+func TestPinnedCaFingerprint(t *testing.T) {
+	rootCA, intermediateCA, svidIssuingCA, _ := issueTestCertificates(t)
+
+	// A second CA that shares the intermediate's subject DN but has a different key
+	now := time.Now()
+	sameDnCA, _, err := util.SelfSign(&x509.Certificate{
+		Subject:               intermediateCA.Subject,
+		SerialNumber:          big.NewInt(2),
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		NotBefore:             now,
+		NotAfter:              now.Add(time.Hour),
+	})
+	require.NoError(t, err)
+
+	fingerprint := func(cert *x509.Certificate) string {
+		sum := sha256.Sum256(cert.Raw)
+		return hex.EncodeToString(sum[:])
+	}
+
+	for _, tt := range []struct {
+		name string
+
+		pinnedCAFingerprint string
+		chain               []*x509.Certificate
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:                "pinned_ca",
+			pinnedCAFingerprint: fingerprint(intermediateCA),
+			chain:               []*x509.Certificate{svidIssuingCA, intermediateCA},
+			expectedgRPCCode:    codes.OK,
+		},
+		{
+			name:                "pinned_ca_with_colons",
+			pinnedCAFingerprint: strings.ToUpper(strings.Join(regexp.MustCompile("..").FindAllString(fingerprint(intermediateCA), -1), ":")),
+			chain:               []*x509.Certificate{svidIssuingCA, intermediateCA},
+			expectedgRPCCode:    codes.OK,
+		},
+		{
+			name:                  "other_ca_with_same_dn",
+			pinnedCAFingerprint:   fingerprint(intermediateCA),
+			chain:                 []*x509.Certificate{svidIssuingCA, sameDnCA},
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): issuing CA \"CN=Fake-Sub-CA\" has fingerprint " + fingerprint(sameDnCA) + ", expected pinned_ca_fingerprint " + fingerprint(intermediateCA),
+		},
+		{
+			name:                  "not_issued_by_pinned_ca",
+			pinnedCAFingerprint:   fingerprint(sameDnCA),
+			chain:                 []*x509.Certificate{svidIssuingCA, sameDnCA},
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): issued CA certificate was not issued by the CA pinned by pinned_ca_fingerprint",
+		},
+		{
+			name:             "unset",
+			chain:            []*x509.Certificate{svidIssuingCA, sameDnCA},
+			expectedgRPCCode: codes.OK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				err := json.NewEncoder(w).Encode(certificateRestResponseFromExpectedCerts(t, tt.chain, []*x509.Certificate{rootCA}, "PEM"))
+				require.NoError(t, err)
+			}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				PinnedCAFingerprint: tt.pinnedCAFingerprint,
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+		})
+	}
+}
+
+func TestExpectedIntermediateFingerprints(t *testing.T) {
+	rootCA, intermediateCA, svidIssuingCA, _ := issueTestCertificates(t)
+	_, otherIntermediateCA, _, _ := issueTestCertificates(t)
+
+	fingerprint := func(cert *x509.Certificate) string {
+		sum := sha256.Sum256(cert.Raw)
+		return hex.EncodeToString(sum[:])
+	}
+
+	for _, tt := range []struct {
+		name string
+
+		expectedIntermediateFingerprints []string
+		chain                            []*x509.Certificate
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:                             "matching",
+			expectedIntermediateFingerprints: []string{fingerprint(intermediateCA)},
+			chain:                            []*x509.Certificate{svidIssuingCA, intermediateCA},
+			expectedgRPCCode:                 codes.OK,
+		},
+		{
+			name:                             "superset",
+			expectedIntermediateFingerprints: []string{fingerprint(otherIntermediateCA), fingerprint(intermediateCA)},
+			chain:                            []*x509.Certificate{svidIssuingCA, intermediateCA},
+			expectedgRPCCode:                 codes.OK,
+		},
+		{
+			name:                             "unexpected_intermediate",
+			expectedIntermediateFingerprints: []string{fingerprint(intermediateCA)},
+			chain:                            []*x509.Certificate{svidIssuingCA, otherIntermediateCA},
+			expectedgRPCCode:                 codes.Internal,
+			expectedMessagePrefix:            "upstreamauthority(ejbca): intermediate CA \"CN=Fake-Sub-CA\" has fingerprint " + fingerprint(otherIntermediateCA) + ", which is not in expected_intermediate_fingerprints",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				err := json.NewEncoder(w).Encode(certificateRestResponseFromExpectedCerts(t, tt.chain, []*x509.Certificate{rootCA}, "PEM"))
+				require.NoError(t, err)
+			}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				ExpectedIntermediateFingerprints: tt.expectedIntermediateFingerprints,
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+		})
+	}
+}
+
+func TestMixedFormatChain(t *testing.T) {
+	rootCA, intermediateCA, svidIssuingCA, _ := issueTestCertificates(t)
+
+	encodePEM := func(cert *x509.Certificate) string {
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	}
+	encodeDER := func(cert *x509.Certificate) string {
+		return base64.StdEncoding.EncodeToString(cert.Raw)
+	}
+
+	for _, tt := range []struct {
+		name string
+
+		responseFormat string
+		certificate    string
+		chain          []string
+	}{
+		{
+			name:           "der_with_pem_chain",
+			responseFormat: "DER",
+			certificate:    encodeDER(svidIssuingCA),
+			chain:          []string{encodePEM(intermediateCA), encodePEM(rootCA)},
+		},
+		{
+			name:           "der_with_mixed_chain",
+			responseFormat: "DER",
+			certificate:    encodeDER(svidIssuingCA),
+			chain:          []string{encodePEM(intermediateCA), encodeDER(rootCA)},
+		},
+		{
+			name:           "pem_with_der_entries",
+			responseFormat: "PEM",
+			certificate:    encodeDER(svidIssuingCA),
+			chain:          []string{encodeDER(intermediateCA), encodePEM(rootCA)},
+		},
+		{
+			name:           "der_with_stray_pem_header",
+			responseFormat: "DER",
+			certificate:    encodeDER(svidIssuingCA),
+			chain:          []string{"-----BEGIN CERTIFICATE-----\n" + encodeDER(intermediateCA), encodeDER(rootCA)},
+		},
+		{
+			name:           "der_with_stray_pem_footer",
+			responseFormat: "DER",
+			certificate:    encodeDER(svidIssuingCA) + "\n-----END CERTIFICATE-----",
+			chain:          []string{encodeDER(intermediateCA), encodeDER(rootCA)},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				err := json.NewEncoder(w).Encode(map[string]any{
+					"response_format":   tt.responseFormat,
+					"certificate":       tt.certificate,
+					"certificate_chain": tt.chain,
+				})
+				require.NoError(t, err)
+			}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			x509CA, upstreamX509Roots, _, err := ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			require.NoError(t, err)
+			require.Equal(t, []*x509.Certificate{svidIssuingCA, intermediateCA}, x509CA)
+			require.Equal(t, []*x509.Certificate{rootCA}, upstreamX509Roots)
+		})
+	}
+}
+
+func TestDecodeCertificateEntryStrayPemMarkers(t *testing.T) {
+	_, intermediateCA, _, _ := issueTestCertificates(t)
+	der := base64.StdEncoding.EncodeToString(intermediateCA.Raw)
+
+	decoded, err := decodeCertificateEntry("-----BEGIN CERTIFICATE-----" + der)
+	require.NoError(t, err)
+	require.Equal(t, intermediateCA.Raw, decoded)
+
+	_, err = decodeCertificateEntry("-----BEGIN CERTIFICATE-----\nnot base64!")
+	require.EqualError(t, err, "malformed PEM block")
+
+	_, err = decodeCertificateEntry("-----BEGIN CERTIFICATE-----\n")
+	require.EqualError(t, err, "malformed PEM block")
+}
+
+func TestRootCertificatesField(t *testing.T) {
+	rootCA, intermediateCA, svidIssuingCA, _ := issueTestCertificates(t)
+	otherRootCA, _, _, _ := issueTestCertificates(t)
+
+	encodePEM := func(certs ...*x509.Certificate) []string {
+		var encoded []string
+		for _, cert := range certs {
+			encoded = append(encoded, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})))
+		}
+		return encoded
+	}
+
+	for _, tt := range []struct {
+		name string
+
+		chain            []*x509.Certificate
+		rootCertificates []*x509.Certificate
+
+		expectedRoots []*x509.Certificate
+	}{
+		{
+			name:             "overlapping",
+			chain:            []*x509.Certificate{intermediateCA, rootCA},
+			rootCertificates: []*x509.Certificate{rootCA},
+			expectedRoots:    []*x509.Certificate{rootCA},
+		},
+		{
+			name:             "separate",
+			chain:            []*x509.Certificate{intermediateCA},
+			rootCertificates: []*x509.Certificate{rootCA},
+			expectedRoots:    []*x509.Certificate{rootCA},
+		},
+		{
+			name:             "overlapping_with_additional_root",
+			chain:            []*x509.Certificate{intermediateCA, rootCA},
+			rootCertificates: []*x509.Certificate{otherRootCA, rootCA},
+			expectedRoots:    []*x509.Certificate{rootCA, otherRootCA},
+		},
+		{
+			name:          "absent",
+			chain:         []*x509.Certificate{intermediateCA, rootCA},
+			expectedRoots: []*x509.Certificate{rootCA},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				response := map[string]any{
+					"response_format":   "PEM",
+					"certificate":       encodePEM(svidIssuingCA)[0],
+					"certificate_chain": encodePEM(tt.chain...),
+				}
+				if tt.rootCertificates != nil {
+					response["root_certificates"] = encodePEM(tt.rootCertificates...)
+				}
+
+				w.Header().Add("Content-Type", "application/json")
+				err := json.NewEncoder(w).Encode(response)
+				require.NoError(t, err)
+			}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			x509CA, upstreamX509Roots, _, err := ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			require.NoError(t, err)
+			require.Equal(t, []*x509.Certificate{svidIssuingCA, intermediateCA}, x509CA)
+			require.Equal(t, tt.expectedRoots, upstreamX509Roots)
+		})
+	}
+}
+
+func TestIssuerChainOrder(t *testing.T) {
+	rootCA, intermediateCA, svidIssuingCA, _ := issueTestCertificates(t)
+
+	for _, tt := range []struct {
+		name string
+
+		chain []*x509.Certificate
+
+		expectedReordered bool
+	}{
+		{
+			name:              "root_first",
+			chain:             []*x509.Certificate{rootCA, intermediateCA},
+			expectedReordered: true,
+		},
+		{
+			name:              "leaf_first",
+			chain:             []*x509.Certificate{intermediateCA, rootCA},
+			expectedReordered: false,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ordered, reordered := orderIssuerChain(svidIssuingCA, tt.chain)
+			require.Equal(t, tt.expectedReordered, reordered)
+			require.Equal(t, []*x509.Certificate{intermediateCA, rootCA}, ordered)
+
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				err := json.NewEncoder(w).Encode(certificateRestResponseFromExpectedCerts(t, append([]*x509.Certificate{svidIssuingCA}, tt.chain...), nil, "PEM"))
+				require.NoError(t, err)
+			}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			x509CA, upstreamX509Roots, _, err := ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			require.NoError(t, err)
+			require.Equal(t, []*x509.Certificate{svidIssuingCA, intermediateCA}, x509CA)
+			require.Equal(t, []*x509.Certificate{rootCA}, upstreamX509Roots)
+		})
+	}
+
+	t.Run("unlinked_chain_unchanged", func(t *testing.T) {
+		otherRootCA, _, _, _ := issueTestCertificates(t)
+		chain := []*x509.Certificate{otherRootCA, intermediateCA}
+		ordered, reordered := orderIssuerChain(svidIssuingCA, chain)
+		require.False(t, reordered)
+		require.Equal(t, chain, ordered)
+	})
+}
+
+func TestDetectDuplicateSerials(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		detectDuplicateSerials string
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+		expectedWarnings      []string
+	}{
+		{
+			name:                   "warn",
+			detectDuplicateSerials: "warn",
+			expectedgRPCCode:       codes.OK,
+			expectedWarnings:       []string{"EJBCA returned a serial that was already returned by a previous mint"},
+		},
+		{
+			name:                   "error",
+			detectDuplicateSerials: "error",
+			expectedgRPCCode:       codes.Internal,
+			expectedMessagePrefix:  "upstreamauthority(ejbca): EJBCA returned serial ",
+		},
+		{
+			name:             "disabled",
+			expectedgRPCCode: codes.OK,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// The fake server returns the same certificate, and so the same serial, for every enrollment
+			testServer := newFakeEnrollServer(t, nil)
+			defer testServer.Close()
+
+			log, logHook := test.NewNullLogger()
+			_, ua := loadTestPluginWithOptions(t, testServer, &Config{
+				DetectDuplicateSerials: tt.detectDuplicateSerials,
+			}, []plugintest.Option{plugintest.Log(log)})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+
+			var warnings []string
+			for _, entry := range logHook.AllEntries() {
+				if entry.Level == logrus.WarnLevel {
+					warnings = append(warnings, entry.Message)
+				}
+			}
+			require.Equal(t, tt.expectedWarnings, warnings)
+		})
+	}
+
+	t.Run("bounded", func(t *testing.T) {
+		p := New()
+		for i := 0; i <= maxRecentSerials; i++ {
+			require.False(t, p.recordSerial(fmt.Sprintf("%x", i)))
+		}
+		require.True(t, p.recordSerial(fmt.Sprintf("%x", maxRecentSerials)))
+		require.False(t, p.recordSerial("0"), "the oldest serial should have been forgotten")
+	})
+}
+
+func TestGetCrlInfo(t *testing.T) {
+	partitionIndex := 3
+
+	for _, tt := range []struct {
+		name string
+
+		fields map[string]any
+
+		expectedCrlInfo crlInfo
+	}{
+		{
+			name: "crl_info",
+			fields: map[string]any{
+				"crl_distribution_points":    []string{"http://ejbca.example.org/crl/1.crl", "http://ejbca.example.org/crl/2.crl"},
+				"latest_crl_partition_index": 3,
+			},
+			expectedCrlInfo: crlInfo{
+				DistributionPoints:   []string{"http://ejbca.example.org/crl/1.crl", "http://ejbca.example.org/crl/2.crl"},
+				LatestPartitionIndex: &partitionIndex,
+			},
+		},
+		{
+			name:   "malformed",
+			fields: map[string]any{"crl_distribution_points": "http://ejbca.example.org/crl/1.crl", "latest_crl_partition_index": "3"},
+		},
+		{
+			name: "absent",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			response := map[string]any{"response_format": "PEM"}
+			for key, value := range tt.fields {
+				response[key] = value
+			}
+			responseBytes, err := json.Marshal(response)
+			require.NoError(t, err)
+
+			var certificateRestResponse ejbcaclient.CertificateRestResponse
+			require.NoError(t, json.Unmarshal(responseBytes, &certificateRestResponse))
+
+			require.Equal(t, tt.expectedCrlInfo, getCrlInfo(&certificateRestResponse))
+		})
+	}
+}
+
+func TestRootOnlyResponse(t *testing.T) {
+	rootCA, intermediateCA, _, _ := issueTestCertificates(t)
+
+	selfSignedLeaf, _, err := util.SelfSign(&x509.Certificate{
+		Subject:      pkix.Name{CommonName: "Fake-Self-Signed-Leaf"},
+		SerialNumber: big.NewInt(1),
+		NotBefore:    rootCA.NotBefore,
+		NotAfter:     rootCA.NotAfter,
+	})
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name string
+
+		cert *x509.Certificate
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+	}{
+		{
+			name:             "self_signed_root",
+			cert:             rootCA,
+			expectedgRPCCode: codes.OK,
+		},
+		{
+			name:                  "self_signed_non_ca",
+			cert:                  selfSignedLeaf,
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): EJBCA returned a single self-signed certificate that is not a CA",
+		},
+		{
+			name:                  "intermediate_without_chain",
+			cert:                  intermediateCA,
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): EJBCA did not return a CA chain",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Add("Content-Type", "application/json")
+				err := json.NewEncoder(w).Encode(certificateRestResponseFromExpectedCerts(t, []*x509.Certificate{tt.cert}, nil, "PEM"))
+				require.NoError(t, err)
+			}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			x509CA, upstreamX509Roots, _, err := ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+			if tt.expectedgRPCCode != codes.OK {
+				return
+			}
+
+			require.Equal(t, []*x509.Certificate{rootCA}, x509CA)
+			require.Equal(t, []*x509.Certificate{rootCA}, upstreamX509Roots)
+		})
+	}
+}
+
+func TestAlternativeCertificateFields(t *testing.T) {
+	rootCA, intermediateCA, svidIssuingCA, _ := issueTestCertificates(t)
+	certificate := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: svidIssuingCA.Raw}))
+
+	for _, tt := range []struct {
+		name string
+
+		fields map[string]any
+	}{
+		{
+			name:   "certificate",
+			fields: map[string]any{"certificate": certificate},
+		},
+		{
+			name:   "certificate_container",
+			fields: map[string]any{"certificate_container": certificate},
+		},
+		{
+			name:   "nested_certificate_container",
+			fields: map[string]any{"certificate_container": map[string]any{"certificate": certificate}},
+		},
+		{
+			name:   "certificate_preferred",
+			fields: map[string]any{"certificate": certificate, "certificate_container": "garbage"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				response := map[string]any{
+					"response_format": "PEM",
+					"certificate_chain": []string{
+						string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediateCA.Raw})),
+						string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootCA.Raw})),
+					},
+				}
+				for k, v := range tt.fields {
+					response[k] = v
+				}
+
+				w.Header().Add("Content-Type", "application/json")
+				err := json.NewEncoder(w).Encode(response)
+				require.NoError(t, err)
+			}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			x509CA, upstreamX509Roots, _, err := ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			require.NoError(t, err)
+			require.Equal(t, []*x509.Certificate{svidIssuingCA, intermediateCA}, x509CA)
+			require.Equal(t, []*x509.Certificate{rootCA}, upstreamX509Roots)
+		})
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
+	metricsv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/hostservice/common/metrics/v1"
+)
+
+const (
+	defaultRetryMaxAttempts    = 3
+	defaultRetryInitialBackoff = time.Second
+	defaultRetryMaxBackoff     = 30 * time.Second
+)
+
+// defaultRetryableStatusCodes are the HTTP status codes retried when retry.retryable_status_codes is unset
+var defaultRetryableStatusCodes = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+type RetryConfig struct {
+	MaxAttempts int `hcl:"max_attempts" json:"max_attempts"`
+	// Go duration strings, such as 500ms or 10s
+	InitialBackoff       string `hcl:"initial_backoff" json:"initial_backoff"`
+	MaxBackoff           string `hcl:"max_backoff" json:"max_backoff"`
+	RetryableStatusCodes []int  `hcl:"retryable_status_codes" json:"retryable_status_codes,omitempty"`
+	// EJBCA error codes, or substrings of EJBCA error messages, that are retried regardless of the HTTP status
+	RetryableErrorCodes []string `hcl:"retryable_error_codes" json:"retryable_error_codes,omitempty"`
+	// Retries successful responses with an empty body, which EJBCA occasionally returns under load
+	RetryEmptyResponses bool `hcl:"retry_empty_responses" json:"retry_empty_responses"`
+
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// errEmptyResponse is returned for a successful enrollment response with an empty body. An empty JSON object isn't
+// an empty body.
+var errEmptyResponse = errors.New("EJBCA returned a successful response with an empty body")
+
+// retryExhaustedError is returned when every attempt allowed by the retry configuration failed. It wraps the error
+// of the last attempt.
+type retryExhaustedError struct {
+	attempts int
+	elapsed  time.Duration
+	err      error
+}
+
+func (e *retryExhaustedError) Error() string {
+	return fmt.Sprintf("%v (attempts=%d, elapsed=%s)", e.err, e.attempts, e.elapsed)
+}
+
+func (e *retryExhaustedError) Unwrap() error {
+	return e.err
+}
+
+// isEmptyResponse returns true if httpResponse is a 2xx response whose body is empty or only whitespace. The body is
+// restored so that it can still be read.
+func isEmptyResponse(httpResponse *http.Response) bool {
+	if httpResponse == nil || httpResponse.Body == nil || httpResponse.StatusCode < 200 || httpResponse.StatusCode > 299 {
+		return false
+	}
+	body, err := io.ReadAll(httpResponse.Body)
+	httpResponse.Body.Close()
+	httpResponse.Body = io.NopCloser(bytes.NewReader(body))
+	return err == nil && len(bytes.TrimSpace(body)) == 0
+}
+
+// hasRetryableErrorCode returns true if the EJBCA error response in err has an error_code equal to one of
+// retryableErrorCodes, or an error_message containing one of them, ignoring case.
+func hasRetryableErrorCode(err error, retryableErrorCodes []string) bool {
+	if len(retryableErrorCodes) == 0 {
+		return false
+	}
+
+	body, ok := ejbcaErrorBody(err)
+	if !ok {
+		return false
+	}
+	var errorResponse ejbcaErrorResponse
+	if err := json.Unmarshal(body, &errorResponse); err != nil {
+		return false
+	}
+
+	errorCode := strconv.Itoa(errorResponse.ErrorCode)
+	message := strings.ToLower(errorResponse.ErrorMessage)
+	return slices.ContainsFunc(retryableErrorCodes, func(code string) bool {
+		return code == errorCode || strings.Contains(message, strings.ToLower(code))
+	})
+}
+
+// enroll sends the enrollment request with client, to the v2 enrollment endpoint if api_version is v2. If retry is
+// configured, requests that fail with a retryable HTTP status or EJBCA error code are retried with exponential backoff
+// until the attempts are exhausted or ctx is done. A retry that would start after the deadline of ctx isn't attempted.
+// A successful response with an empty body fails with errEmptyResponse, and is retried if
+// retry.retry_empty_responses is set.
+func (p *Plugin) enroll(ctx context.Context, config *Config, client ejbcaClient, enrollConfig ejbcaclient.EnrollCertificateRestRequest) (*ejbcaclient.CertificateRestResponse, *http.Response, error) {
+	logger := p.logger.Named("enroll")
+	retry := config.Retry
+
+	start := p.hooks.now()
+	var backoff time.Duration
+	if retry != nil {
+		backoff = retry.initialBackoff
+	}
+	for attempt := 1; ; attempt++ {
+		var enrollResponse *ejbcaclient.CertificateRestResponse
+		var httpResponse *http.Response
+		var err error
+		if config.APIVersion == apiVersionV2 {
+			enrollResponse, httpResponse, err = client.EnrollPkcs10CertificateV2(ctx, enrollConfig)
+		} else {
+			enrollResponse, httpResponse, err = client.EnrollPkcs10Certificate(ctx).
+				EnrollCertificateRestRequest(enrollConfig).
+				Execute()
+		}
+		emptyResponse := isEmptyResponse(httpResponse)
+		if emptyResponse {
+			enrollResponse, err = nil, errEmptyResponse
+		}
+		if err == nil || retry == nil || httpResponse == nil {
+			return enrollResponse, httpResponse, err
+		}
+		if !slices.Contains(retry.RetryableStatusCodes, httpResponse.StatusCode) && !hasRetryableErrorCode(err, retry.RetryableErrorCodes) && !(emptyResponse && retry.RetryEmptyResponses) {
+			return enrollResponse, httpResponse, err
+		}
+
+		if attempt >= retry.MaxAttempts {
+			elapsed := p.hooks.now().Sub(start)
+			logger.Error("Exhausted enrollment retries", "attempts", attempt, "elapsed", elapsed, "error", err)
+			_ = p.incrCounter(ctx, []string{"mint_retry_exhausted"}, &metricsv1.Label{Name: "attempts", Value: strconv.Itoa(attempt)})
+			return enrollResponse, httpResponse, &retryExhaustedError{attempts: attempt, elapsed: elapsed, err: err}
+		}
+
+		if deadline, ok := ctx.Deadline(); ok && deadline.Sub(p.hooks.now()) < backoff {
+			logger.Warn("EJBCA returned a retryable error, but the mint deadline would pass before the next attempt - not retrying", "attempt", attempt, "status", httpResponse.StatusCode, "backoff", backoff, "error", err)
+			return enrollResponse, httpResponse, err
+		}
+
+		logger.Warn("EJBCA returned a retryable error - retrying enrollment", "attempt", attempt, "status", httpResponse.StatusCode, "backoff", backoff, "error", err)
+		if httpResponse.Body != nil {
+			httpResponse.Body.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return enrollResponse, httpResponse, err
+		case <-p.hooks.after(backoff):
+		}
+		backoff = min(2*backoff, retry.maxBackoff)
+	}
+}
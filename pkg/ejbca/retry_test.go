@@ -0,0 +1,363 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	metricsv1 "github.com/spiffe/spire-plugin-sdk/proto/spire/hostservice/common/metrics/v1"
+	"github.com/spiffe/spire/pkg/common/hostservice/metricsservice"
+	"github.com/spiffe/spire/pkg/common/telemetry"
+	"github.com/spiffe/spire/test/fakes/fakemetrics"
+	"github.com/spiffe/spire/test/plugintest"
+	"github.com/spiffe/spire/test/spiretest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestRetryExhausted(t *testing.T) {
+	var hits atomic.Int32
+	testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"error_code":503,"error_message":"Service unavailable"}`))
+	}))
+	defer testServer.Close()
+
+	metrics := fakemetrics.New()
+	_, ua := loadTestPluginWithOptions(t, testServer, &Config{
+		Retry: &RetryConfig{
+			MaxAttempts:    3,
+			InitialBackoff: "1ms",
+			MaxBackoff:     "2ms",
+		},
+	}, []plugintest.Option{
+		plugintest.HostServices(metricsv1.MetricsServiceServer(metricsservice.V1(metrics))),
+	})
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+	spiretest.RequireGRPCStatusContains(t, err, codes.Internal, "(attempts=3, elapsed=")
+	require.Equal(t, int32(3), hits.Load())
+
+	require.Equal(t, []fakemetrics.MetricItem{
+		{
+			Type:   fakemetrics.IncrCounterWithLabelsType,
+			Key:    []string{"mint_retry_exhausted"},
+			Val:    1,
+			Labels: []telemetry.Label{{Name: "attempts", Value: "3"}},
+		},
+	}, metrics.AllMetrics())
+}
+
+func TestRetryNotConfigured(t *testing.T) {
+	var hits atomic.Int32
+	testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer testServer.Close()
+
+	_, ua := loadTestPlugin(t, testServer, &Config{})
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+	spiretest.RequireGRPCStatusHasPrefix(t, err, codes.Internal, "upstreamauthority(ejbca): EJBCA returned an error: failed to enroll CSR")
+	require.NotContains(t, err.Error(), "attempts=")
+	require.Equal(t, int32(1), hits.Load())
+}
+
+func TestRetryableErrorCodes(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		retryableErrorCodes []string
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+		expectedHits          int32
+	}{
+		{
+			name:                "error_message_substring",
+			retryableErrorCodes: []string{"custom_transient"},
+			expectedgRPCCode:    codes.OK,
+			expectedHits:        2,
+		},
+		{
+			name:                "error_code",
+			retryableErrorCodes: []string{"400"},
+			expectedgRPCCode:    codes.OK,
+			expectedHits:        2,
+		},
+		{
+			name:                  "not_retryable",
+			retryableErrorCodes:   []string{"CA_OFFLINE"},
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): EJBCA returned an error: failed to enroll CSR",
+			expectedHits:          1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			enrollHandler := newFakeEnrollHandler(t, nil)
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if hits.Add(1) > 1 {
+					enrollHandler.ServeHTTP(w, r)
+					return
+				}
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error_code":400,"error_message":"Crypto token is busy (CUSTOM_TRANSIENT)"}`))
+			}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				Retry: &RetryConfig{
+					InitialBackoff:      "1ms",
+					RetryableErrorCodes: tt.retryableErrorCodes,
+				},
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+			require.Equal(t, tt.expectedHits, hits.Load())
+		})
+	}
+}
+
+func TestRetryTransientStatus(t *testing.T) {
+	var hits atomic.Int32
+	enrollHandler := newFakeEnrollHandler(t, nil)
+	testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) > 2 {
+			enrollHandler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"error_code":503,"error_message":"Service unavailable"}`))
+	}))
+	defer testServer.Close()
+
+	_, ua := loadTestPlugin(t, testServer, &Config{
+		Retry: &RetryConfig{
+			MaxAttempts:    3,
+			InitialBackoff: "1ms",
+			MaxBackoff:     "2ms",
+		},
+	})
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	x509CA, _, _, err := ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+	require.NoError(t, err)
+	require.NotEmpty(t, x509CA)
+	require.Equal(t, int32(3), hits.Load())
+}
+
+func TestRetryRespectsDeadline(t *testing.T) {
+	var hits atomic.Int32
+	testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"error_code":503,"error_message":"Service unavailable"}`))
+	}))
+	defer testServer.Close()
+
+	_, ua := loadTestPlugin(t, testServer, &Config{
+		MaxEnrollmentDuration: "5s",
+		Retry: &RetryConfig{
+			MaxAttempts:    3,
+			InitialBackoff: "1m",
+		},
+	})
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+	spiretest.RequireGRPCStatusHasPrefix(t, err, codes.Internal, "upstreamauthority(ejbca): EJBCA returned an error: failed to enroll CSR")
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Equal(t, int32(1), hits.Load())
+}
+
+func TestRetryUsesHookClock(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		maxEnrollmentDuration string
+		failures              int32
+
+		expectedgRPCCode codes.Code
+		expectedHits     int32
+		expectedWaits    []time.Duration
+	}{
+		{
+			name:             "backoff_waits_on_hook_clock",
+			failures:         2,
+			expectedgRPCCode: codes.OK,
+			expectedHits:     3,
+			expectedWaits:    []time.Duration{time.Minute, 2 * time.Minute},
+		},
+		{
+			// After the first wait, 90s of the deadline remain on the hook clock, which is less than the next backoff
+			name:                  "deadline_checked_on_hook_clock",
+			maxEnrollmentDuration: "150s",
+			failures:              5,
+			expectedgRPCCode:      codes.Internal,
+			expectedHits:          2,
+			expectedWaits:         []time.Duration{time.Minute},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			enrollHandler := newFakeEnrollHandler(t, nil)
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if hits.Add(1) > tt.failures {
+					enrollHandler.ServeHTTP(w, r)
+					return
+				}
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				_, _ = w.Write([]byte(`{"error_code":503,"error_message":"Service unavailable"}`))
+			}))
+			defer testServer.Close()
+
+			// The fake clock starts at the real time so that it agrees with the real deadline of the mint context,
+			// and only moves when a backoff is waited out, which completes immediately
+			var mu sync.Mutex
+			now := time.Now()
+			var waits []time.Duration
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				MaxEnrollmentDuration: tt.maxEnrollmentDuration,
+				Retry: &RetryConfig{
+					MaxAttempts:    5,
+					InitialBackoff: "1m",
+					MaxBackoff:     "10m",
+				},
+			}, func(p *Plugin) {
+				p.hooks.now = func() time.Time {
+					mu.Lock()
+					defer mu.Unlock()
+					return now
+				}
+				p.hooks.after = func(d time.Duration) <-chan time.Time {
+					mu.Lock()
+					defer mu.Unlock()
+					waits = append(waits, d)
+					now = now.Add(d)
+					ch := make(chan time.Time, 1)
+					ch <- now
+					return ch
+				}
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, "")
+			require.Equal(t, tt.expectedHits, hits.Load())
+
+			mu.Lock()
+			defer mu.Unlock()
+			require.Equal(t, tt.expectedWaits, waits)
+		})
+	}
+}
+
+func TestRetryEmptyResponse(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		firstBody           string
+		retryEmptyResponses bool
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+		expectedHits          int32
+	}{
+		{
+			name:                "empty_body_retried",
+			firstBody:           "",
+			retryEmptyResponses: true,
+			expectedgRPCCode:    codes.OK,
+			expectedHits:        2,
+		},
+		{
+			name:                  "empty_body_not_retried",
+			firstBody:             "",
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): EJBCA returned an error: failed to enroll CSR - EJBCA returned a successful response with an empty body",
+			expectedHits:          1,
+		},
+		{
+			name:                  "empty_object_not_retried",
+			firstBody:             "{}",
+			retryEmptyResponses:   true,
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): ejbca returned unsupported certificate format",
+			expectedHits:          1,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			enrollHandler := newFakeEnrollHandler(t, nil)
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if hits.Add(1) > 1 {
+					enrollHandler.ServeHTTP(w, r)
+					return
+				}
+				w.Header().Add("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte(tt.firstBody))
+			}))
+			defer testServer.Close()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				Retry: &RetryConfig{
+					InitialBackoff:      "1ms",
+					RetryEmptyResponses: tt.retryEmptyResponses,
+				},
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+			require.Equal(t, tt.expectedHits, hits.Load())
+		})
+	}
+}
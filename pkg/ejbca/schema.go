@@ -0,0 +1,52 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// requestSchemaURL is the URL that the schema read from request_schema_file is registered under. Schemas with
+// relative $refs can't be resolved, since the schema isn't loaded from its own location.
+const requestSchemaURL = "request_schema.json"
+
+// compileRequestSchema compiles the JSON schema that enrollment requests are validated against.
+func compileRequestSchema(schema []byte) (*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource(requestSchemaURL, bytes.NewReader(schema)); err != nil {
+		return nil, err
+	}
+	return compiler.Compile(requestSchemaURL)
+}
+
+// validateRequestSchema validates the JSON that enrollConfig is marshaled to, as it's sent to EJBCA, against schema.
+func validateRequestSchema(schema *jsonschema.Schema, enrollConfig ejbcaclient.EnrollCertificateRestRequest) error {
+	body, err := json.Marshal(enrollConfig)
+	if err != nil {
+		return fmt.Errorf("failed to marshal enrollment request: %w", err)
+	}
+	request, err := jsonschema.UnmarshalJSON(bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to decode enrollment request: %w", err)
+	}
+	return schema.Validate(request)
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
+	"github.com/spiffe/spire/test/spiretest"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestRequestSchemaFile(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		schema string
+
+		expectedgRPCCode      codes.Code
+		expectedMessagePrefix string
+		expectedEnrolled      bool
+	}{
+		{
+			name: "valid",
+			schema: `{
+				"type": "object",
+				"required": ["certificate_request", "certificate_authority_name", "username", "password"]
+			}`,
+			expectedgRPCCode: codes.OK,
+			expectedEnrolled: true,
+		},
+		{
+			name: "missing_field",
+			schema: `{
+				"type": "object",
+				"required": ["certificate_request", "email"]
+			}`,
+			expectedgRPCCode:      codes.Internal,
+			expectedMessagePrefix: "upstreamauthority(ejbca): enrollment request violates request_schema_file: ",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			enrolled := false
+			testServer := newFakeEnrollServer(t, func(*ejbcaclient.EnrollCertificateRestRequest) {
+				enrolled = true
+			})
+			defer testServer.Close()
+
+			schemaPath := filepath.Join(t.TempDir(), "request_schema.json")
+			require.NoError(t, os.WriteFile(schemaPath, []byte(tt.schema), 0600))
+
+			_, ua := loadTestPlugin(t, testServer, &Config{
+				RequestSchemaFile: schemaPath,
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			spiretest.RequireGRPCStatusHasPrefix(t, err, tt.expectedgRPCCode, tt.expectedMessagePrefix)
+			if tt.expectedgRPCCode != codes.OK {
+				require.Contains(t, err.Error(), "missing properties: 'email'")
+			}
+			require.Equal(t, tt.expectedEnrolled, enrolled)
+		})
+	}
+}
+
+func TestCompileRequestSchema(t *testing.T) {
+	_, err := compileRequestSchema([]byte(`{"type": "object"}`))
+	require.NoError(t, err)
+
+	_, err = compileRequestSchema([]byte(`{"type": `))
+	require.Error(t, err)
+
+	_, err = compileRequestSchema([]byte(`{"type": "no-such-type"}`))
+	require.Error(t, err)
+}
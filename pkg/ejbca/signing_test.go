@@ -0,0 +1,81 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestSigning(t *testing.T) {
+	secret := "7aTbVmqGdXs3Ue8oPn2kLw"
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	var signature, timestamp, path string
+	var body []byte
+	enrollHandler := newFakeEnrollHandler(t, nil)
+	testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		signature = r.Header.Get("X-Signature")
+		timestamp = r.Header.Get("X-Timestamp")
+		path = r.URL.EscapedPath()
+		body, err = io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		enrollHandler.ServeHTTP(w, r)
+	}))
+	defer testServer.Close()
+
+	_, ua := loadTestPlugin(t, testServer, &Config{
+		RequestSigning: &RequestSigningConfig{
+			Secret: secret,
+		},
+	}, func(p *Plugin) {
+		p.hooks.now = func() time.Time { return now }
+	})
+
+	csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+	require.NoError(t, err)
+
+	_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+	require.NoError(t, err)
+
+	require.Equal(t, strconv.FormatInt(now.Unix(), 10), timestamp)
+	require.NotEmpty(t, signature)
+	require.NotEmpty(t, body)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(http.MethodPost + "\n" + path + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	actual, err := hex.DecodeString(signature)
+	require.NoError(t, err)
+	require.True(t, hmac.Equal(expected, actual), "X-Signature does not verify")
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// requestTiming accumulates a timing breakdown of the HTTP requests made with a context returned by withTrace. Each
+// phase is summed across requests, such as when an enrollment is retried.
+type requestTiming struct {
+	mu sync.Mutex
+
+	began, start                            time.Time
+	dnsStart, connectStart, tlsStart, wrote time.Time
+	dns, connect, tls, token, enroll        time.Duration
+}
+
+// newRequestTiming returns a requestTiming whose first request starts now.
+func newRequestTiming() *requestTiming {
+	now := time.Now()
+	return &requestTiming{began: now, start: now}
+}
+
+// withTrace returns a copy of ctx that records the timing of the requests made with it.
+//
+// The token phase is the time between the start of the mint, or the end of the previous request, and the transport
+// asking for a connection. Since the OAuth transport fetches tokens before it asks for a connection, this includes
+// token acquisition.
+func (t *requestTiming) withTrace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn: func(string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.token += time.Since(t.start)
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.dns += time.Since(t.dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connectStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.connect += time.Since(t.connectStart)
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.tls += time.Since(t.tlsStart)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.wrote = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			t.enroll += time.Since(t.wrote)
+			t.start = time.Now()
+		},
+	})
+}
+
+// fields returns the timing breakdown as key-value pairs for logging. The total is the time since newRequestTiming.
+func (t *requestTiming) fields() []any {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return []any{
+		"dns", t.dns.String(),
+		"connect", t.connect.String(),
+		"tls", t.tls.String(),
+		"token", t.token.String(),
+		"enroll", t.enroll.String(),
+		"total", time.Since(t.began).String(),
+	}
+}
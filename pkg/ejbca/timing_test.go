@@ -0,0 +1,86 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spiffe/spire/test/plugintest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceTiming(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		traceTiming bool
+	}{
+		{
+			name:        "enabled",
+			traceTiming: true,
+		},
+		{
+			name:        "disabled",
+			traceTiming: false,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer := newFakeEnrollServer(t, nil)
+			defer testServer.Close()
+
+			log, logHook := test.NewNullLogger()
+			log.SetLevel(logrus.DebugLevel)
+			_, ua := loadTestPluginWithOptions(t, testServer, &Config{
+				TraceTiming: tt.traceTiming,
+			}, []plugintest.Option{plugintest.Log(log)})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			require.NoError(t, err)
+
+			var timingEntry *logrus.Entry
+			for _, entry := range logHook.AllEntries() {
+				if entry.Message == "EJBCA request timing" {
+					timingEntry = entry
+				}
+			}
+			if !tt.traceTiming {
+				require.Nil(t, timingEntry)
+				return
+			}
+
+			require.NotNil(t, timingEntry)
+			require.Equal(t, logrus.DebugLevel, timingEntry.Level)
+			for _, field := range []string{"dns", "connect", "tls", "token", "enroll", "total"} {
+				require.Contains(t, timingEntry.Data, field)
+				_, err := time.ParseDuration(timingEntry.Data[field].(string))
+				require.NoError(t, err, "field %s should be a duration", field)
+			}
+
+			// The fake server is only reachable over TLS, so the handshake must have been timed
+			tlsDuration, err := time.ParseDuration(timingEntry.Data["tls"].(string))
+			require.NoError(t, err)
+			require.Positive(t, tlsDuration)
+		})
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans started by the plugin
+const tracerName = "github.com/Keyfactor/ejbca-spire-upstreamauthority-plugin/pkg/ejbca"
+
+const (
+	spanMintX509CA                    = "ejbca.MintX509CA"
+	spanParseCSR                      = "ejbca.ParseCSR"
+	spanResolveEndEntityName          = "ejbca.ResolveEndEntityName"
+	spanEnroll                        = "ejbca.Enroll"
+	spanAttributeCAName               = "ejbca.ca_name"
+	spanAttributeEndEntityProfileName = "ejbca.end_entity_profile_name"
+)
+
+type tracerProviderFunc func() trace.TracerProvider
+
+// startSpan starts a span named name with the tracer provider of the plugin, which is the global OpenTelemetry tracer
+// provider by default. If no tracer provider is registered, the span is a no-op.
+func (p *Plugin) startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return p.hooks.tracerProvider().Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// endSpan ends span, recording err and marking the span as errored if err isn't nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestMintX509CATracing(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+
+		enrollStatus int
+
+		expectedStatus       otelcodes.Code
+		expectedEnrollStatus otelcodes.Code
+	}{
+		{
+			name:                 "success",
+			enrollStatus:         http.StatusOK,
+			expectedStatus:       otelcodes.Unset,
+			expectedEnrollStatus: otelcodes.Unset,
+		},
+		{
+			name:                 "enroll_error",
+			enrollStatus:         http.StatusInternalServerError,
+			expectedStatus:       otelcodes.Error,
+			expectedEnrollStatus: otelcodes.Error,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			enrollHandler := newFakeEnrollHandler(t, nil)
+			testServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.enrollStatus != http.StatusOK {
+					w.WriteHeader(tt.enrollStatus)
+					return
+				}
+				enrollHandler.ServeHTTP(w, r)
+			}))
+			defer testServer.Close()
+
+			exporter := tracetest.NewInMemoryExporter()
+			tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+			defer func() {
+				require.NoError(t, tracerProvider.Shutdown(context.Background()))
+			}()
+
+			_, ua := loadTestPlugin(t, testServer, &Config{}, func(p *Plugin) {
+				p.hooks.tracerProvider = func() trace.TracerProvider { return tracerProvider }
+			})
+
+			csr, err := generateCSR("", nil, []string{"spiffe://example.org"}, nil)
+			require.NoError(t, err)
+
+			_, _, _, err = ua.MintX509CA(context.Background(), csr.Raw, 30*time.Second)
+			if tt.expectedStatus == otelcodes.Error {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+
+			spans := map[string]tracetest.SpanStub{}
+			for _, span := range exporter.GetSpans() {
+				spans[span.Name] = span
+			}
+			require.Len(t, spans, 4)
+
+			root, ok := spans[spanMintX509CA]
+			require.True(t, ok)
+			require.False(t, root.Parent.IsValid())
+			require.Equal(t, tt.expectedStatus, root.Status.Code)
+			require.Contains(t, root.Attributes, attribute.String(spanAttributeCAName, "Fake-Sub-CA"))
+			require.Contains(t, root.Attributes, attribute.String(spanAttributeEndEntityProfileName, "fakeSpireIntermediateCAEEP"))
+
+			for _, name := range []string{spanParseCSR, spanResolveEndEntityName, spanEnroll} {
+				child, ok := spans[name]
+				require.True(t, ok, name)
+				require.Equal(t, root.SpanContext.SpanID(), child.Parent.SpanID(), name)
+				require.Equal(t, root.SpanContext.TraceID(), child.SpanContext.TraceID(), name)
+			}
+			require.Equal(t, tt.expectedEnrollStatus, spans[spanEnroll].Status.Code)
+			require.Equal(t, otelcodes.Unset, spans[spanParseCSR].Status.Code)
+		})
+	}
+}
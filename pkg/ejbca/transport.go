@@ -0,0 +1,472 @@
+/*
+Copyright 2024 Keyfactor
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ejbca
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	ejbcaclient "github.com/Keyfactor/ejbca-go-client-sdk/api/ejbca"
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/net/http2"
+	"golang.org/x/oauth2"
+)
+
+const (
+	defaultTransportMaxIdleConns        = 100
+	defaultTransportMaxIdleConnsPerHost = 10
+	defaultTransportIdleConnTimeout     = 90 * time.Second
+	defaultTransportTLSHandshakeTimeout = 10 * time.Second
+)
+
+// TransportConfig tunes connection reuse to EJBCA. Unset fields take the defaults above, which keep more idle
+// connections per host than net/http so that bursts of mints reuse connections instead of each doing a TLS handshake.
+type TransportConfig struct {
+	MaxIdleConns        int `hcl:"max_idle_conns" json:"max_idle_conns"`
+	MaxIdleConnsPerHost int `hcl:"max_idle_conns_per_host" json:"max_idle_conns_per_host"`
+	// Go duration strings, such as 90s
+	IdleConnTimeout     string `hcl:"idle_conn_timeout" json:"idle_conn_timeout"`
+	TLSHandshakeTimeout string `hcl:"tls_handshake_timeout" json:"tls_handshake_timeout"`
+
+	idleConnTimeout     time.Duration
+	tlsHandshakeTimeout time.Duration
+}
+
+// apply sets the connection settings of transport.
+func (c *TransportConfig) apply(transport *http.Transport) {
+	transport.MaxIdleConns = c.MaxIdleConns
+	transport.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = c.idleConnTimeout
+	transport.TLSHandshakeTimeout = c.tlsHandshakeTimeout
+}
+
+// configureTransport applies configure to the *http.Transport used by the authenticator's HTTP client. The transport
+// is cloned before it's modified so that transports shared with the rest of the process (such as
+// http.DefaultTransport) are never changed.
+func configureTransport(authenticator ejbcaclient.Authenticator, configure func(*http.Transport)) error {
+	client, err := authenticator.GetHTTPClient()
+	if err != nil {
+		return err
+	}
+
+	clone := func(rt http.RoundTripper) (*http.Transport, error) {
+		if rt == nil {
+			rt = http.DefaultTransport
+		}
+		transport, ok := rt.(*http.Transport)
+		if !ok {
+			return nil, fmt.Errorf("unsupported HTTP transport %T", rt)
+		}
+		transport = transport.Clone()
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		configure(transport)
+		return transport, nil
+	}
+
+	switch t := client.Transport.(type) {
+	case *oauth2.Transport:
+		base, err := clone(t.Base)
+		if err != nil {
+			return err
+		}
+		t.Base = base
+	default:
+		transport, err := clone(t)
+		if err != nil {
+			return err
+		}
+		client.Transport = transport
+	}
+
+	return nil
+}
+
+// configureHTTP2 configures transport for HTTP/2 with connection health checks. After readIdleTimeout without frames
+// on a connection, a ping is sent, and the connection is closed if the ping isn't answered within pingTimeout (15s if
+// zero). Requests on a half-open connection then fail instead of hanging until their deadline.
+func configureHTTP2(transport *http.Transport, readIdleTimeout time.Duration, pingTimeout time.Duration) error {
+	http2Transport, err := http2.ConfigureTransports(transport)
+	if err != nil {
+		return fmt.Errorf("failed to configure HTTP/2: %w", err)
+	}
+	http2Transport.ReadIdleTimeout = readIdleTimeout
+	http2Transport.PingTimeout = pingTimeout
+	return nil
+}
+
+// parseProxyURL parses the URL of a proxy to EJBCA. http and https proxies are sent CONNECT requests, and socks5 and
+// socks5h proxies are used as SOCKS5 proxies, as supported by http.Transport.
+func parseProxyURL(rawURL string) (*url.URL, error) {
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		// The URL is left out of the error since it may contain proxy credentials
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return nil, urlErr.Err
+		}
+		return nil, err
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("scheme must be one of http, https, socks5, or socks5h, got %q", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, errors.New("proxy URL has no host")
+	}
+	return proxyURL, nil
+}
+
+// newServerCertificateVerifier returns a tls.Config VerifyConnection callback that logs the EJBCA server
+// certificate and rejects it if it lacks any EKU in require_server_eku. It runs after Go's own verification of the
+// certificate chain and hostname.
+func (p *Plugin) newServerCertificateVerifier(config *Config) func(tls.ConnectionState) error {
+	logger := p.logger.Named("verifyServerCertificate")
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("EJBCA server presented no certificate")
+		}
+		leaf := state.PeerCertificates[0]
+
+		ekus, err := getExtKeyUsages(leaf.Extensions)
+		if err != nil {
+			return fmt.Errorf("EJBCA server certificate is malformed: %w", err)
+		}
+		logger.Debug("Verifying EJBCA server certificate", "serverName", state.ServerName, "subject", leaf.Subject.String(), "ekus", ekus)
+
+		for _, required := range config.requiredServerEkus {
+			if !slices.Contains(ekus, required) {
+				logger.Error("EJBCA server certificate is missing a required EKU", "subject", leaf.Subject.String(), "requiredEku", required, "ekus", ekus)
+				return fmt.Errorf("EJBCA server certificate %q does not carry required EKU %s", leaf.Subject.String(), required)
+			}
+		}
+		return nil
+	}
+}
+
+// middlewareAuthenticator is an Authenticator whose HTTP client passes requests through the plugin's transport
+// middleware.
+type middlewareAuthenticator struct {
+	client *http.Client
+}
+
+// GetHTTPClient implements ejbcaclient.Authenticator
+func (a *middlewareAuthenticator) GetHTTPClient() (*http.Client, error) {
+	return a.client, nil
+}
+
+// wrapAuthenticator returns an Authenticator whose HTTP client uses the transport returned by wrap. The HTTP client of
+// the provided authenticator is copied, not modified.
+func wrapAuthenticator(authenticator ejbcaclient.Authenticator, wrap func(http.RoundTripper) http.RoundTripper) (ejbcaclient.Authenticator, error) {
+	client, err := authenticator.GetHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	wrapped := *client
+	wrapped.Transport = wrap(next)
+	return &middlewareAuthenticator{client: &wrapped}, nil
+}
+
+// newTransportMiddleware returns the chain of RoundTrippers that every request to EJBCA passes through.
+func (p *Plugin) newTransportMiddleware(config *Config) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		if config.RequestSigning != nil {
+			next = &requestSigningTransport{
+				next:   next,
+				secret: []byte(config.RequestSigning.Secret),
+				now:    p.hooks.now,
+			}
+		}
+		if config.CompressRequests {
+			next = &gzipRequestTransport{next: next, minBytes: compressRequestsMinBytes}
+		}
+		if config.RateLimitThreshold > 0 {
+			next = &rateLimitTransport{
+				next:      next,
+				threshold: config.RateLimitThreshold,
+				now:       p.hooks.now,
+				logger:    p.logger.Named("rateLimit"),
+			}
+		}
+		next = &bomStrippingTransport{next: next}
+		if len(config.responseEnvelopePath) > 0 {
+			next = &envelopeTransport{next: next, path: config.responseEnvelopePath}
+		}
+		return &loggingTransport{
+			next:   next,
+			logger: p.logger.Named("http"),
+		}
+	}
+}
+
+// loggingTransport logs the URL of every request to EJBCA at debug level, and at error level when the request fails
+// or EJBCA responds with an error status. Credentials and sensitive query parameters are redacted from the URL.
+type loggingTransport struct {
+	next   http.RoundTripper
+	logger hclog.Logger
+}
+
+func (t *loggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	requestURL := redactURL(req.URL)
+	t.logger.Debug("Sending request to EJBCA", "method", req.Method, "url", requestURL)
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		t.logger.Error("Request to EJBCA failed", "method", req.Method, "url", requestURL, "error", err)
+		return resp, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		t.logger.Error("EJBCA responded with an error status", "method", req.Method, "url", requestURL, "status", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// sensitiveQueryParameters are the query parameters whose values are redacted from logged URLs.
+var sensitiveQueryParameters = []string{"access_token", "client_secret", "code", "key", "password", "secret", "signature", "token"}
+
+// redactURL returns u as a string with any user info and the values of sensitiveQueryParameters redacted.
+func redactURL(u *url.URL) string {
+	redacted := *u
+	if query := redacted.Query(); len(query) > 0 {
+		for name := range query {
+			if slices.Contains(sensitiveQueryParameters, strings.ToLower(name)) {
+				query.Set(name, "xxxxx")
+			}
+		}
+		redacted.RawQuery = query.Encode()
+	}
+	return redacted.Redacted()
+}
+
+// bomStrippingTransport removes a UTF-8 byte order mark and leading whitespace from JSON response bodies. Some
+// proxies prepend a BOM to responses, which the EJBCA client is unable to decode.
+type bomStrippingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *bomStrippingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.Body == nil || !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		return resp, err
+	}
+
+	body := bufio.NewReader(resp.Body)
+	for {
+		r, _, err := body.ReadRune()
+		if err != nil {
+			break
+		}
+		if r != '\uFEFF' && !unicode.IsSpace(r) {
+			_ = body.UnreadRune()
+			break
+		}
+		resp.ContentLength = -1
+	}
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, resp.Body}
+	return resp, nil
+}
+
+// envelopeTransport replaces JSON response bodies with the value at path within them, for gateways that wrap EJBCA's
+// responses in an envelope such as {"data": {...}}. Error responses that aren't wrapped are passed through as is so
+// that errors generated by the gateway itself are still reported.
+type envelopeTransport struct {
+	next http.RoundTripper
+	path []string
+}
+
+func (t *envelopeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.Body == nil || !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		return resp, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	// Empty bodies are passed through so that they're reported as empty responses rather than missing envelopes
+	if len(bytes.TrimSpace(body)) == 0 {
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return resp, nil
+	}
+
+	unwrapped, err := unwrapEnvelope(body, t.path)
+	if err != nil {
+		if resp.StatusCode < http.StatusBadRequest {
+			return nil, fmt.Errorf("failed to unwrap response envelope: %w", err)
+		}
+		unwrapped = body
+	}
+
+	resp.Body = io.NopCloser(bytes.NewReader(unwrapped))
+	resp.ContentLength = int64(len(unwrapped))
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
+
+// unwrapEnvelope returns the JSON value at path within body, where each element of path names a field of an object.
+func unwrapEnvelope(body []byte, path []string) ([]byte, error) {
+	value := json.RawMessage(body)
+	for i, field := range path {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(value, &object); err != nil {
+			return nil, fmt.Errorf("%s is not an object: %w", strings.Join(append([]string{"response"}, path[:i]...), "."), err)
+		}
+		var ok bool
+		value, ok = object[field]
+		if !ok {
+			return nil, fmt.Errorf("response has no %s field", strings.Join(path[:i+1], "."))
+		}
+	}
+	return value, nil
+}
+
+// compressRequestsMinBytes is the size above which request bodies are compressed when compress_requests is enabled.
+// Smaller bodies don't benefit from compression.
+const compressRequestsMinBytes = 1024
+
+// gzipRequestTransport gzips request bodies larger than minBytes and sets Content-Encoding accordingly. Bodies that
+// already have a Content-Encoding are sent as is.
+type gzipRequestTransport struct {
+	next     http.RoundTripper
+	minBytes int
+}
+
+func (t *gzipRequestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.Header.Get("Content-Encoding") != "" {
+		return t.next.RoundTrip(req)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+
+	if len(body) <= t.minBytes {
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		return t.next.RoundTrip(req)
+	}
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write(body); err != nil {
+		return nil, fmt.Errorf("failed to compress request body: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress request body: %w", err)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Content-Encoding", "gzip")
+	req.ContentLength = int64(compressed.Len())
+	req.Body = io.NopCloser(bytes.NewReader(compressed.Bytes()))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(compressed.Bytes())), nil
+	}
+	return t.next.RoundTrip(req)
+}
+
+// rateLimitResetEpochThreshold separates the two conventions for X-RateLimit-Reset: values above it are Unix times,
+// and smaller values are seconds until the reset.
+const rateLimitResetEpochThreshold = 1_000_000_000
+
+// rateLimitTransport throttles requests proactively based on the X-RateLimit-Remaining and X-RateLimit-Reset headers
+// of EJBCA's responses. Once the remaining budget drops below threshold, requests are delayed until the reset, or
+// fail when their context is done first.
+type rateLimitTransport struct {
+	next      http.RoundTripper
+	threshold int
+	now       nowFunc
+	logger    hclog.Logger
+
+	mu       sync.Mutex
+	resumeAt time.Time
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	resumeAt := t.resumeAt
+	t.mu.Unlock()
+
+	if wait := resumeAt.Sub(t.now()); wait > 0 {
+		t.logger.Debug("Delaying request until the EJBCA rate limit resets", "wait", wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, fmt.Errorf("throttled until EJBCA rate limit resets at %s: %w", resumeAt.UTC().Format(time.RFC3339), req.Context().Err())
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil || remaining >= t.threshold {
+		return resp, nil
+	}
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil || reset < 0 {
+		return resp, nil
+	}
+
+	resumeAt = t.now().Add(time.Duration(reset) * time.Second)
+	if reset > rateLimitResetEpochThreshold {
+		resumeAt = time.Unix(reset, 0)
+	}
+	t.logger.Warn("EJBCA rate limit budget is low - delaying requests until it resets", "remaining", remaining, "threshold", t.threshold, "resetAt", resumeAt.UTC().Format(time.RFC3339))
+
+	t.mu.Lock()
+	if resumeAt.After(t.resumeAt) {
+		t.resumeAt = resumeAt
+	}
+	t.mu.Unlock()
+	return resp, nil
+}